@@ -0,0 +1,269 @@
+package libra
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrAdaptiveInvalid adaptive concurrency config is invalid
+var ErrAdaptiveInvalid = errors.New("the adaptive concurrency config is invalid")
+
+// errLimitReached message of the 503 response when load is shed by the adaptive limiter
+var errLimitReached = errors.New("adaptive concurrency limit reached, the origin is overloaded")
+
+// latencyAlpha weight of a new sample in the smoothed latency
+const latencyAlpha = 0.05
+
+// AdaptiveConfig adaptive concurrency limit of a site by AIMD, the limit of requests in flight
+// grows by 1 on a fast response while it is in use, and is multiplied by Backoff
+// on a slow response or an origin failure, requests over the limit fail with 503
+type AdaptiveConfig struct {
+	InitialLimit     int           // limit at first, default 20
+	MinLimit         int           // default 1
+	MaxLimit         int           // default 1000
+	LatencyThreshold time.Duration // a response slower than it is slow, 0 compares with the smoothed latency
+	Tolerance        float64       // without threshold, a response slower than smoothed latency * tolerance is slow, default 2
+	Backoff          float64       // in (0, 1), default 0.9
+}
+
+// adaptiveConfigJSON json struct of AdaptiveConfig, latency threshold is a string like 100ms
+type adaptiveConfigJSON struct {
+	InitialLimit     int     `json:"initial_limit,omitempty"`
+	MinLimit         int     `json:"min_limit,omitempty"`
+	MaxLimit         int     `json:"max_limit,omitempty"`
+	LatencyThreshold string  `json:"latency_threshold,omitempty"`
+	Tolerance        float64 `json:"tolerance,omitempty"`
+	Backoff          float64 `json:"backoff,omitempty"`
+}
+
+// MarshalJSON encode latency threshold as a string
+func (c AdaptiveConfig) MarshalJSON() ([]byte, error) {
+	v := adaptiveConfigJSON{
+		InitialLimit: c.InitialLimit,
+		MinLimit:     c.MinLimit,
+		MaxLimit:     c.MaxLimit,
+		Tolerance:    c.Tolerance,
+		Backoff:      c.Backoff,
+	}
+	if c.LatencyThreshold != 0 {
+		v.LatencyThreshold = c.LatencyThreshold.String()
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON decode latency threshold from a string
+func (c *AdaptiveConfig) UnmarshalJSON(data []byte) error {
+	v := adaptiveConfigJSON{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	config := AdaptiveConfig{
+		InitialLimit: v.InitialLimit,
+		MinLimit:     v.MinLimit,
+		MaxLimit:     v.MaxLimit,
+		Tolerance:    v.Tolerance,
+		Backoff:      v.Backoff,
+	}
+	if v.LatencyThreshold != "" {
+		var err error
+		if config.LatencyThreshold, err = time.ParseDuration(v.LatencyThreshold); err != nil {
+			return err
+		}
+	}
+	*c = config
+	return nil
+}
+
+// Validate check the config
+func (c AdaptiveConfig) Validate() error {
+	if c.InitialLimit < 0 || c.MinLimit < 0 || c.MaxLimit < 0 || c.LatencyThreshold < 0 {
+		return ErrAdaptiveInvalid
+	}
+	if c.Tolerance != 0 && !(c.Tolerance >= 1) || c.Backoff != 0 && !(c.Backoff > 0 && c.Backoff < 1) {
+		return ErrAdaptiveInvalid
+	}
+	c = c.withDefault()
+	if c.MinLimit > c.MaxLimit {
+		return ErrAdaptiveInvalid
+	}
+	return nil
+}
+
+// withDefault fill zero fields by default value, initial limit is kept in min~max
+func (c AdaptiveConfig) withDefault() AdaptiveConfig {
+	if c.MinLimit == 0 {
+		c.MinLimit = 1
+	}
+	if c.MaxLimit == 0 {
+		c.MaxLimit = 1000
+	}
+	if c.InitialLimit == 0 {
+		c.InitialLimit = 20
+	}
+	if c.InitialLimit < c.MinLimit {
+		c.InitialLimit = c.MinLimit
+	}
+	if c.InitialLimit > c.MaxLimit {
+		c.InitialLimit = c.MaxLimit
+	}
+	if c.Tolerance == 0 {
+		c.Tolerance = 2
+	}
+	if c.Backoff == 0 {
+		c.Backoff = 0.9
+	}
+	return c
+}
+
+// AdaptiveMetrics adaptive limiter state of a site
+type AdaptiveMetrics struct {
+	Limit    int     `json:"limit"`
+	InFlight int     `json:"in_flight"`
+	Latency  float64 `json:"latency_ms"` // smoothed latency
+	Shed     uint64  `json:"shed"`       // requests failed as the limit is reached
+}
+
+// adaptiveLimiter AIMD concurrency limiter of a site, methods of a nil limiter do nothing
+type adaptiveLimiter struct {
+	mu       sync.Mutex
+	config   AdaptiveConfig
+	limit    float64
+	inFlight int
+	latency  time.Duration // smoothed latency of successful responses
+	shed     uint64
+}
+
+// newAdaptiveLimiter get an adaptiveLimiter point
+func newAdaptiveLimiter(config AdaptiveConfig) *adaptiveLimiter {
+	config = config.withDefault()
+	return &adaptiveLimiter{config: config, limit: float64(config.InitialLimit)}
+}
+
+// acquire take a place under the limit, false if the limit is reached
+func (l *adaptiveLimiter) acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight >= int(l.limit) {
+		l.shed++
+		return false
+	}
+	l.inFlight++
+	return true
+}
+
+// release give up the place without a sample, the request never reached the origin
+func (l *adaptiveLimiter) release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+}
+
+// sample give up the place and adjust the limit by the latency of the response
+func (l *adaptiveLimiter) sample(rtt time.Duration, failed bool) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	inUse := l.inFlight*2 >= int(l.limit)
+	l.inFlight--
+
+	threshold := l.config.LatencyThreshold
+	if threshold == 0 {
+		threshold = time.Duration(float64(l.latency) * l.config.Tolerance)
+	}
+	slow := threshold > 0 && rtt > threshold
+	if !failed {
+		if l.latency == 0 {
+			l.latency = rtt
+		} else {
+			l.latency = time.Duration((1-latencyAlpha)*float64(l.latency) + latencyAlpha*float64(rtt))
+		}
+	}
+
+	switch {
+	case failed || slow:
+		l.limit *= l.config.Backoff
+		if l.limit < float64(l.config.MinLimit) {
+			l.limit = float64(l.config.MinLimit)
+		}
+	case inUse:
+		l.limit++
+		if l.limit > float64(l.config.MaxLimit) {
+			l.limit = float64(l.config.MaxLimit)
+		}
+	}
+}
+
+// metrics get limiter state
+func (l *adaptiveLimiter) metrics() *AdaptiveMetrics {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return &AdaptiveMetrics{
+		Limit:    int(l.limit),
+		InFlight: l.inFlight,
+		Latency:  float64(l.latency) / float64(time.Millisecond),
+		Shed:     l.shed,
+	}
+}
+
+// SetAdaptiveLimit set adaptive concurrency limit of a site, nil disables it,
+// the limit starts again from the initial limit every time it is set
+func (p *ProxySrv) SetAdaptiveLimit(domain string, config *AdaptiveConfig) error {
+	if config != nil {
+		if err := config.Validate(); err != nil {
+			return err
+		}
+	}
+
+	p.adaptiveLock.Lock()
+	defer p.adaptiveLock.Unlock()
+	if p.limiters == nil {
+		p.limiters = map[string]*adaptiveLimiter{}
+	}
+	if config == nil {
+		delete(p.limiters, domain)
+	} else {
+		p.limiters[domain] = newAdaptiveLimiter(*config)
+	}
+	return nil
+}
+
+// GetAdaptiveLimit get adaptive concurrency config of a site, nil if it is not enabled
+func (p *ProxySrv) GetAdaptiveLimit(domain string) *AdaptiveConfig {
+	limiter := p.getLimiter(domain)
+	if limiter == nil {
+		return nil
+	}
+	config := limiter.config
+	return &config
+}
+
+// getLimiter get adaptive limiter of a site, nil if it is not enabled
+func (p *ProxySrv) getLimiter(domain string) *adaptiveLimiter {
+	p.adaptiveLock.RLock()
+	defer p.adaptiveLock.RUnlock()
+	return p.limiters[domain]
+}
+
+// admitRequest take a place under the adaptive limit of the site,
+// the request fails with 503 if the limit is reached
+func (p *ProxySrv) admitRequest(req *http.Request, domain string) error {
+	limiter := p.getLimiter(domain)
+	state := getRequestState(req)
+	if limiter == nil || state == nil {
+		return nil
+	}
+	if !limiter.acquire() {
+		return failFast(state, errLimitReached)
+	}
+	state.limiter = limiter
+	return nil
+}
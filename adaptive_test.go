@@ -0,0 +1,137 @@
+package libra
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveConfig(t *testing.T) {
+	invalid := []AdaptiveConfig{{MinLimit: -1}, {Backoff: 1}, {Tolerance: 0.5}, {MinLimit: 10, MaxLimit: 5}, {MinLimit: 2000}}
+	for k, config := range invalid {
+		if config.Validate() != ErrAdaptiveInvalid {
+			t.Error("adaptive config have an error #1", k)
+		}
+	}
+	config := AdaptiveConfig{MinLimit: 30, MaxLimit: 40}.withDefault()
+	if config.Validate() != nil || config.InitialLimit != 30 || config.Backoff != 0.9 || config.Tolerance != 2 {
+		t.Error("adaptive config have an error #2")
+	}
+
+	err := json.Unmarshal([]byte(`{"max_limit":100,"latency_threshold":"150ms"}`), &config)
+	if err != nil || config.MaxLimit != 100 || config.LatencyThreshold != 150*time.Millisecond || config.MinLimit != 0 {
+		t.Error("adaptive config have an error #3")
+	}
+	data, _ := json.Marshal(config)
+	if string(data) != `{"max_limit":100,"latency_threshold":"150ms"}` {
+		t.Error("adaptive config have an error #4", string(data))
+	}
+}
+
+func TestAdaptiveLimiter(t *testing.T) {
+	l := newAdaptiveLimiter(AdaptiveConfig{InitialLimit: 4, MaxLimit: 5, LatencyThreshold: 100 * time.Millisecond, Backoff: 0.5})
+
+	for i := 0; i < 4; i++ {
+		if !l.acquire() {
+			t.Error("adaptive limiter have an error #1", i)
+		}
+	}
+	if l.acquire() || l.metrics().Shed != 1 {
+		t.Error("adaptive limiter have an error #2")
+	}
+
+	// fast responses grow the limit while it is in use
+	l.sample(10*time.Millisecond, false)
+	l.sample(10*time.Millisecond, false)
+	if m := l.metrics(); m.Limit != 5 || m.InFlight != 2 || m.Latency != 10 {
+		t.Error("adaptive limiter have an error #3", m)
+	}
+	l.sample(10*time.Millisecond, false)
+	l.sample(10*time.Millisecond, false)
+	if l.metrics().Limit != 5 {
+		t.Error("adaptive limiter have an error #4")
+	}
+
+	// slow responses and failures back off
+	l.acquire()
+	l.sample(time.Second, false)
+	l.acquire()
+	l.sample(time.Millisecond, true)
+	l.acquire()
+	l.sample(time.Millisecond, true)
+	if m := l.metrics(); m.Limit != 1 || m.InFlight != 0 {
+		t.Error("adaptive limiter have an error #5", m)
+	}
+
+	// without threshold a response slower than the smoothed latency * tolerance is slow
+	l = newAdaptiveLimiter(AdaptiveConfig{InitialLimit: 10})
+	l.acquire()
+	l.sample(10*time.Millisecond, false)
+	l.acquire()
+	l.sample(50*time.Millisecond, false)
+	if l.metrics().Limit != 9 {
+		t.Error("adaptive limiter have an error #6", l.metrics())
+	}
+
+	// a nil limiter does nothing
+	var none *adaptiveLimiter
+	none.release()
+	none.sample(time.Second, true)
+}
+
+func TestProxyAdaptiveLimit(t *testing.T) {
+	domain := "www.adaptive.com"
+	hold := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hold" {
+			<-hold
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer origin.Close()
+
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	proxy.RegistSite(domain, "roundrobin", "http").AddAddr(domain, origin.Listener.Addr().String(), 1)
+	if err := proxy.SetAdaptiveLimit(domain, &AdaptiveConfig{Backoff: 1.5}); err != ErrAdaptiveInvalid {
+		t.Error("proxy adaptive limit have an error #1")
+	}
+	proxy.SetAdaptiveLimit(domain, &AdaptiveConfig{InitialLimit: 1, MaxLimit: 1})
+	handler := proxy.Handler()
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "http://"+domain+path, nil))
+		return w
+	}
+
+	done := make(chan int)
+	go func() {
+		done <- get("/hold").Code
+	}()
+	limiter := proxy.getLimiter(domain)
+	for i := 0; i < 100 && limiter.metrics().InFlight != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if w := get("/"); w.Code != 503 || !strings.Contains(w.Body.String(), "adaptive concurrency limit") {
+		t.Error("proxy adaptive limit have an error #2", w.Code)
+	}
+	close(hold)
+	if code := <-done; code != 200 {
+		t.Error("proxy adaptive limit have an error #3", code)
+	}
+	if w := get("/"); w.Code != 200 {
+		t.Error("proxy adaptive limit have an error #4", w.Code)
+	}
+	if m := limiter.metrics(); m.InFlight != 0 || m.Shed != 1 {
+		t.Error("proxy adaptive limit have an error #5", m)
+	}
+
+	proxy.SetAdaptiveLimit(domain, nil)
+	if proxy.GetAdaptiveLimit(domain) != nil {
+		t.Error("proxy adaptive limit have an error #6")
+	}
+	proxy.FlushProxy(domain)
+}
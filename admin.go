@@ -0,0 +1,968 @@
+package libra
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/zhuCheer/libra/balancer"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Admin api errors.
+var (
+	ErrAdminBadRequest     = errors.New("bad request params")
+	ErrAdminMethod         = errors.New("method not allowed")
+	ErrAdminNotImplemented = errors.New("not implemented")
+)
+
+// AdminResponse admin api common response struct
+type AdminResponse struct {
+	Code int         `json:"code"`
+	Msg  string      `json:"msg"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// SiteView site info render by admin api
+type SiteView struct {
+	Domain   string         `json:"domain"`
+	Scheme   string         `json:"scheme"`
+	LoadType string         `json:"load_type"`
+	Items    []EndpointView `json:"items"`
+
+	SlowStart         *balancer.SlowStart `json:"slow_start,omitempty"`
+	FailoverThreshold float64             `json:"failover_threshold,omitempty"`
+	Breaker           *BreakerConfig      `json:"breaker,omitempty"`
+	RateLimits        []RateLimitRule     `json:"rate_limits,omitempty"`
+	Queue             *QueueConfig        `json:"queue,omitempty"`
+	Adaptive          *AdaptiveConfig     `json:"adaptive,omitempty"`
+	Forwarded         ForwardedConfig     `json:"forwarded"`
+	HeaderRules       []HeaderRule        `json:"header_rules,omitempty"`
+	Cache             *CacheConfig        `json:"cache,omitempty"`
+	CoalesceRules     []CoalesceRule      `json:"coalesce_rules,omitempty"`
+	Compress          *CompressConfig     `json:"compress,omitempty"`
+	RewriteRules      []RewriteRule       `json:"rewrite_rules,omitempty"`
+	HostPolicy        HostPolicy          `json:"host_policy"`
+	HTTPS             *HTTPSConfig        `json:"https,omitempty"`
+	IPRules           []IPRule            `json:"ip_rules,omitempty"`
+}
+
+// EndpointView endpoint info render by admin api
+type EndpointView struct {
+	balancer.EndpointItem
+	Healthy  bool   `json:"healthy"`
+	InFlight int64  `json:"in_flight"`
+	Breaker  string `json:"breaker,omitempty"` // circuit breaker state if enabled
+}
+
+// SiteRequest admin api params to register a site
+type SiteRequest struct {
+	Domain   string `json:"domain"`
+	LoadType string `json:"load_type"`
+	Scheme   string `json:"scheme"`
+}
+
+// SlowStartRequest admin api params to set slow start of a site
+type SlowStartRequest struct {
+	Domain     string  `json:"domain"`
+	Window     string  `json:"window"` // duration like 30s, empty or 0s disables slow start
+	Aggression float64 `json:"aggression,omitempty"`
+	MinWeight  uint32  `json:"min_weight,omitempty"`
+}
+
+// FailoverRequest admin api params to set failover threshold of a site
+type FailoverRequest struct {
+	Domain    string  `json:"domain"`
+	Threshold float64 `json:"threshold"`
+}
+
+// BreakerRequest admin api params to set circuit breaker of a site, a nil breaker disables it
+type BreakerRequest struct {
+	Domain  string         `json:"domain"`
+	Breaker *BreakerConfig `json:"breaker"`
+}
+
+// RateLimitRequest admin api params to set rate limit rules of a site, empty rules disable it
+type RateLimitRequest struct {
+	Domain string          `json:"domain"`
+	Rules  []RateLimitRule `json:"rules"`
+}
+
+// QueueRequest admin api params to set request queue of a site, a nil queue disables it
+type QueueRequest struct {
+	Domain string       `json:"domain"`
+	Queue  *QueueConfig `json:"queue"`
+}
+
+// AdaptiveRequest admin api params to set adaptive concurrency limit of a site, a nil config disables it
+type AdaptiveRequest struct {
+	Domain   string          `json:"domain"`
+	Adaptive *AdaptiveConfig `json:"adaptive"`
+}
+
+// ForwardedRequest admin api params to set forwarding headers of a site, a nil config resets it
+type ForwardedRequest struct {
+	Domain    string           `json:"domain"`
+	Forwarded *ForwardedConfig `json:"forwarded"`
+}
+
+// HeaderRulesRequest admin api params to set header rules of a site, empty rules remove them
+type HeaderRulesRequest struct {
+	Domain string       `json:"domain"`
+	Rules  []HeaderRule `json:"rules"`
+}
+
+// CoalesceRulesRequest admin api params to set coalesce rules of a site, empty rules remove them
+type CoalesceRulesRequest struct {
+	Domain string         `json:"domain"`
+	Rules  []CoalesceRule `json:"rules"`
+}
+
+// CompressRequest admin api params to set response compression of a site, null compress disables it
+type CompressRequest struct {
+	Domain   string          `json:"domain"`
+	Compress *CompressConfig `json:"compress"`
+}
+
+// RewriteRulesRequest admin api params to set rewrite rules of a site, empty rules remove them
+type RewriteRulesRequest struct {
+	Domain string        `json:"domain"`
+	Rules  []RewriteRule `json:"rules"`
+}
+
+// HostPolicyRequest admin api params to set the origin host policy of a site, a nil policy resets it
+type HostPolicyRequest struct {
+	Domain string      `json:"domain"`
+	Policy *HostPolicy `json:"policy"`
+}
+
+// HTTPSRequest admin api params to set the https policy of a site, null https disables it
+type HTTPSRequest struct {
+	Domain string       `json:"domain"`
+	HTTPS  *HTTPSConfig `json:"https"`
+}
+
+// IPRulesRequest admin api params to set ip filter rules of a site, empty rules remove them
+type IPRulesRequest struct {
+	Domain string   `json:"domain"`
+	Rules  []IPRule `json:"rules"`
+}
+
+// IPFilterRequest admin api params to add or delete a CIDR of an ip filter rule of a site
+type IPFilterRequest struct {
+	Domain string   `json:"domain"`
+	Path   string   `json:"path,omitempty"`
+	Action IPAction `json:"action"`
+	CIDR   string   `json:"cidr"`
+}
+
+// CacheRequest admin api params to set response cache of a site, null cache disables it
+type CacheRequest struct {
+	Domain string       `json:"domain"`
+	Cache  *CacheConfig `json:"cache"`
+}
+
+// PurgeRequest admin api params to delete cached responses of a site by url or url prefix
+type PurgeRequest struct {
+	Domain string `json:"domain"`
+	URL    string `json:"url,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// PurgeResult admin api result of a purge
+type PurgeResult struct {
+	Purged int `json:"purged"`
+}
+
+// EndpointsRequest admin api params to replace all endpoints of a site
+type EndpointsRequest struct {
+	Domain string                  `json:"domain"`
+	Items  []balancer.EndpointItem `json:"items"`
+}
+
+// EndpointRequest admin api params to edit an endpoint
+type EndpointRequest struct {
+	Domain string `json:"domain"`
+	Addr   string `json:"addr"`
+	Weight uint32 `json:"weight"`
+	Ramp   string `json:"ramp,omitempty"` // duration like 30s, change weight gradually
+}
+
+// DrainRequest admin api params to drain an endpoint
+type DrainRequest struct {
+	Domain  string `json:"domain"`
+	Addr    string `json:"addr"`
+	Remove  bool   `json:"remove,omitempty"`  // delete the endpoint once drained
+	Timeout string `json:"timeout,omitempty"` // duration like 5m, delete it anyway after timeout
+}
+
+// PriorityRequest admin api params to change the priority level of an endpoint
+type PriorityRequest struct {
+	Domain   string `json:"domain"`
+	Addr     string `json:"addr"`
+	Priority int    `json:"priority"`
+}
+
+// MaxConnsRequest admin api params to change max requests in flight to an endpoint
+type MaxConnsRequest struct {
+	Domain   string `json:"domain"`
+	Addr     string `json:"addr"`
+	MaxConns uint32 `json:"max_conns"`
+}
+
+// HealthRequest admin api params to mark an endpoint healthy or not
+type HealthRequest struct {
+	Domain  string `json:"domain"`
+	Addr    string `json:"addr"`
+	Healthy bool   `json:"healthy"`
+}
+
+// StateRequest admin api params to change the state of an endpoint
+type StateRequest struct {
+	Domain string `json:"domain"`
+	Addr   string `json:"addr"`
+	State  string `json:"state"` // active, draining or disabled
+}
+
+// RunAdmin start admin api server, it returns the listen error
+func (p *ProxySrv) RunAdmin(addr string) error {
+	Logger.Info("start admin server bind " + addr)
+
+	adminServer := &http.Server{
+		Addr:    addr,
+		Handler: p.AdminHandler(),
+	}
+	p.srvLock.Lock()
+	p.adminServer = adminServer
+	p.srvLock.Unlock()
+
+	return adminServer.ListenAndServe()
+}
+
+// AdminHandler get admin api http handler
+func (p *ProxySrv) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/sites", p.adminSites)
+	mux.HandleFunc("/api/site/add", p.adminSiteAdd)
+	mux.HandleFunc("/api/site/del", p.adminSiteDel)
+	mux.HandleFunc("/api/site/slowstart", p.adminSiteSlowStart)
+	mux.HandleFunc("/api/site/failover", p.adminSiteFailover)
+	mux.HandleFunc("/api/site/breaker", p.adminSiteBreaker)
+	mux.HandleFunc("/api/site/ratelimit", p.adminSiteRateLimit)
+	mux.HandleFunc("/api/site/queue", p.adminSiteQueue)
+	mux.HandleFunc("/api/site/adaptive", p.adminSiteAdaptive)
+	mux.HandleFunc("/api/site/forwarded", p.adminSiteForwarded)
+	mux.HandleFunc("/api/site/headers", p.adminSiteHeaders)
+	mux.HandleFunc("/api/site/cache", p.adminSiteCache)
+	mux.HandleFunc("/api/cache/purge", p.adminCachePurge)
+	mux.HandleFunc("/api/site/coalesce", p.adminSiteCoalesce)
+	mux.HandleFunc("/api/site/compress", p.adminSiteCompress)
+	mux.HandleFunc("/api/site/rewrites", p.adminSiteRewrites)
+	mux.HandleFunc("/api/site/host", p.adminSiteHost)
+	mux.HandleFunc("/api/site/https", p.adminSiteHTTPS)
+	mux.HandleFunc("/api/site/ipfilter", p.adminSiteIPFilter)
+	mux.HandleFunc("/api/ipfilter/add", p.adminIPFilterAdd)
+	mux.HandleFunc("/api/ipfilter/del", p.adminIPFilterDel)
+	mux.HandleFunc("/api/endpoint/add", p.adminEndpointAdd)
+	mux.HandleFunc("/api/endpoint/del", p.adminEndpointDel)
+	mux.HandleFunc("/api/endpoint/set", p.adminEndpointSet)
+	mux.HandleFunc("/api/endpoint/weight", p.adminEndpointWeight)
+	mux.HandleFunc("/api/endpoint/drain", p.adminEndpointDrain)
+	mux.HandleFunc("/api/endpoint/state", p.adminEndpointState)
+	mux.HandleFunc("/api/endpoint/priority", p.adminEndpointPriority)
+	mux.HandleFunc("/api/endpoint/health", p.adminEndpointHealth)
+	mux.HandleFunc("/api/endpoint/maxconns", p.adminEndpointMaxConns)
+	mux.HandleFunc("/api/metrics", p.adminMetrics)
+	mux.HandleFunc("/api/registry", p.adminRegistry)
+	mux.HandleFunc("/api/watch", p.adminWatch)
+
+	return p.identityMiddleware(mux)
+}
+
+// adminSites list all sites
+func (p *ProxySrv) adminSites(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, ErrAdminMethod)
+		return
+	}
+
+	sites := []SiteView{}
+	for _, node := range balancer.GetAllSites() {
+		breaker := p.GetBreaker(node.Domain)
+		items := []EndpointView{}
+		endpoints, _ := balancer.GetEndpoints(node.Domain)
+		for _, item := range endpoints {
+			view := EndpointView{
+				EndpointItem: item,
+				Healthy:      balancer.IsHealthy(node.Domain, item.Endpoint),
+				InFlight:     p.InFlight(node.Domain, item.Endpoint),
+			}
+			if breaker != nil {
+				view.Breaker = p.BreakerState(node.Domain, item.Endpoint).String()
+			}
+			items = append(items, view)
+		}
+		view := SiteView{
+			Domain:   node.Domain,
+			Scheme:   node.Scheme,
+			LoadType: node.LoadType,
+			Items:    items,
+		}
+		if slowStart, err := balancer.GetSlowStart(node.Domain); err == nil && slowStart.Enabled() {
+			view.SlowStart = &slowStart
+		}
+		view.FailoverThreshold, _ = balancer.GetFailoverThreshold(node.Domain)
+		view.Breaker = breaker
+		view.RateLimits = p.GetRateLimit(node.Domain)
+		view.Queue = p.GetQueue(node.Domain)
+		view.Adaptive = p.GetAdaptiveLimit(node.Domain)
+		view.Forwarded = p.GetForwarded(node.Domain)
+		view.HeaderRules = p.GetHeaderRules(node.Domain)
+		view.Cache = p.GetCache(node.Domain)
+		view.CoalesceRules = p.GetCoalesceRules(node.Domain)
+		view.Compress = p.GetCompress(node.Domain)
+		view.RewriteRules = p.GetRewriteRules(node.Domain)
+		view.HostPolicy = p.GetHostPolicy(node.Domain)
+		view.HTTPS = p.GetHTTPS(node.Domain)
+		view.IPRules = p.GetIPRules(node.Domain)
+		sites = append(sites, view)
+	}
+	writeAdminData(w, sites)
+}
+
+// adminSiteAdd register a site
+func (p *ProxySrv) adminSiteAdd(w http.ResponseWriter, r *http.Request) {
+	params := SiteRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+	if params.Domain == "" {
+		writeAdminError(w, http.StatusBadRequest, ErrAdminBadRequest)
+		return
+	}
+	if params.Scheme == "" {
+		params.Scheme = "http"
+	}
+
+	p.RegistSite(params.Domain, params.LoadType, params.Scheme)
+	writeAdminData(w, nil)
+}
+
+// adminSiteDel remove a site
+func (p *ProxySrv) adminSiteDel(w http.ResponseWriter, r *http.Request) {
+	params := SiteRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+	if _, err := balancer.GetSiteInfo(params.Domain); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+
+	p.FlushProxy(params.Domain)
+	writeAdminData(w, nil)
+}
+
+// adminSiteSlowStart set slow start of a site
+func (p *ProxySrv) adminSiteSlowStart(w http.ResponseWriter, r *http.Request) {
+	params := SlowStartRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+	slowStart := balancer.SlowStart{Aggression: params.Aggression, MinWeight: params.MinWeight}
+	if params.Window != "" {
+		var err error
+		if slowStart.Window, err = time.ParseDuration(params.Window); err != nil {
+			writeAdminError(w, http.StatusBadRequest, ErrAdminBadRequest)
+			return
+		}
+	}
+
+	switch err := p.SetSlowStart(params.Domain, slowStart); err {
+	case nil:
+		writeAdminData(w, nil)
+	case balancer.ErrServiceNotFound:
+		writeAdminError(w, http.StatusNotFound, err)
+	default:
+		writeAdminError(w, http.StatusBadRequest, err)
+	}
+}
+
+// adminSiteFailover set failover threshold of a site
+func (p *ProxySrv) adminSiteFailover(w http.ResponseWriter, r *http.Request) {
+	params := FailoverRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+
+	switch err := p.SetFailoverThreshold(params.Domain, params.Threshold); err {
+	case nil:
+		writeAdminData(w, nil)
+	case balancer.ErrServiceNotFound:
+		writeAdminError(w, http.StatusNotFound, err)
+	default:
+		writeAdminError(w, http.StatusBadRequest, err)
+	}
+}
+
+// adminSiteBreaker set circuit breaker of a site
+func (p *ProxySrv) adminSiteBreaker(w http.ResponseWriter, r *http.Request) {
+	params := BreakerRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+	if _, err := balancer.GetSiteInfo(params.Domain); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err := p.SetBreaker(params.Domain, params.Breaker); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeAdminData(w, nil)
+}
+
+// adminSiteRateLimit set rate limit rules of a site
+func (p *ProxySrv) adminSiteRateLimit(w http.ResponseWriter, r *http.Request) {
+	params := RateLimitRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+	if _, err := balancer.GetSiteInfo(params.Domain); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err := p.SetRateLimit(params.Domain, params.Rules); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeAdminData(w, nil)
+}
+
+// adminSiteQueue set request queue of a site
+func (p *ProxySrv) adminSiteQueue(w http.ResponseWriter, r *http.Request) {
+	params := QueueRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+	if _, err := balancer.GetSiteInfo(params.Domain); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err := p.SetQueue(params.Domain, params.Queue); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeAdminData(w, nil)
+}
+
+// adminSiteAdaptive set adaptive concurrency limit of a site
+func (p *ProxySrv) adminSiteAdaptive(w http.ResponseWriter, r *http.Request) {
+	params := AdaptiveRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+	if _, err := balancer.GetSiteInfo(params.Domain); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err := p.SetAdaptiveLimit(params.Domain, params.Adaptive); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeAdminData(w, nil)
+}
+
+// adminSiteForwarded set forwarding headers of a site
+func (p *ProxySrv) adminSiteForwarded(w http.ResponseWriter, r *http.Request) {
+	params := ForwardedRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+	if _, err := balancer.GetSiteInfo(params.Domain); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err := p.SetForwarded(params.Domain, params.Forwarded); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeAdminData(w, nil)
+}
+
+// adminSiteHeaders set header rules of a site
+func (p *ProxySrv) adminSiteHeaders(w http.ResponseWriter, r *http.Request) {
+	params := HeaderRulesRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+	if _, err := balancer.GetSiteInfo(params.Domain); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err := p.SetHeaderRules(params.Domain, params.Rules); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeAdminData(w, nil)
+}
+
+// adminSiteCache set response cache of a site
+func (p *ProxySrv) adminSiteCache(w http.ResponseWriter, r *http.Request) {
+	params := CacheRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+	if _, err := balancer.GetSiteInfo(params.Domain); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err := p.SetCache(params.Domain, params.Cache); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeAdminData(w, nil)
+}
+
+// adminSiteCoalesce set coalesce rules of a site
+func (p *ProxySrv) adminSiteCoalesce(w http.ResponseWriter, r *http.Request) {
+	params := CoalesceRulesRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+	if _, err := balancer.GetSiteInfo(params.Domain); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err := p.SetCoalesceRules(params.Domain, params.Rules); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeAdminData(w, nil)
+}
+
+// adminSiteCompress set response compression of a site
+func (p *ProxySrv) adminSiteCompress(w http.ResponseWriter, r *http.Request) {
+	params := CompressRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+	if _, err := balancer.GetSiteInfo(params.Domain); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err := p.SetCompress(params.Domain, params.Compress); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeAdminData(w, nil)
+}
+
+// adminSiteRewrites set rewrite rules of a site
+func (p *ProxySrv) adminSiteRewrites(w http.ResponseWriter, r *http.Request) {
+	params := RewriteRulesRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+	if _, err := balancer.GetSiteInfo(params.Domain); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err := p.SetRewriteRules(params.Domain, params.Rules); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeAdminData(w, nil)
+}
+
+// adminSiteHost set the origin host policy of a site
+func (p *ProxySrv) adminSiteHost(w http.ResponseWriter, r *http.Request) {
+	params := HostPolicyRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+	if _, err := balancer.GetSiteInfo(params.Domain); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err := p.SetHostPolicy(params.Domain, params.Policy); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeAdminData(w, nil)
+}
+
+// adminSiteHTTPS set the https policy of a site
+func (p *ProxySrv) adminSiteHTTPS(w http.ResponseWriter, r *http.Request) {
+	params := HTTPSRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+	if _, err := balancer.GetSiteInfo(params.Domain); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err := p.SetHTTPS(params.Domain, params.HTTPS); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeAdminData(w, nil)
+}
+
+// adminSiteIPFilter set ip filter rules of a site
+func (p *ProxySrv) adminSiteIPFilter(w http.ResponseWriter, r *http.Request) {
+	params := IPRulesRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+	if _, err := balancer.GetSiteInfo(params.Domain); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err := p.SetIPRules(params.Domain, params.Rules); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeAdminData(w, nil)
+}
+
+// adminIPFilterAdd add a CIDR to an ip filter rule of a site
+func (p *ProxySrv) adminIPFilterAdd(w http.ResponseWriter, r *http.Request) {
+	params := IPFilterRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+	if _, err := balancer.GetSiteInfo(params.Domain); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err := p.AddIPFilter(params.Domain, params.Path, params.Action, params.CIDR); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeAdminData(w, nil)
+}
+
+// adminIPFilterDel delete a CIDR from an ip filter rule of a site
+func (p *ProxySrv) adminIPFilterDel(w http.ResponseWriter, r *http.Request) {
+	params := IPFilterRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+	if _, err := balancer.GetSiteInfo(params.Domain); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+
+	p.DelIPFilter(params.Domain, params.Path, params.Action, params.CIDR)
+	writeAdminData(w, nil)
+}
+
+// adminCachePurge delete cached responses of a site by url or url prefix
+func (p *ProxySrv) adminCachePurge(w http.ResponseWriter, r *http.Request) {
+	params := PurgeRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+	if params.Domain == "" || (params.URL == "") == (params.Prefix == "") {
+		writeAdminError(w, http.StatusBadRequest, ErrAdminBadRequest)
+		return
+	}
+
+	url, prefix := params.URL, false
+	if params.Prefix != "" {
+		url, prefix = params.Prefix, true
+	}
+	purged, err := p.PurgeCache(params.Domain, url, prefix)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeAdminData(w, PurgeResult{Purged: purged})
+}
+
+// adminEndpointAdd add an endpoint to a site
+func (p *ProxySrv) adminEndpointAdd(w http.ResponseWriter, r *http.Request) {
+	params := EndpointRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+	if params.Addr == "" {
+		writeAdminError(w, http.StatusBadRequest, ErrAdminBadRequest)
+		return
+	}
+	info, err := balancer.GetSiteInfo(params.Domain)
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err = info.Balancer.AddAddr(params.Addr, params.Weight); err != nil {
+		writeAdminError(w, http.StatusConflict, err)
+		return
+	}
+	writeAdminData(w, nil)
+}
+
+// adminEndpointDel delete an endpoint from a site
+func (p *ProxySrv) adminEndpointDel(w http.ResponseWriter, r *http.Request) {
+	params := EndpointRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+	info, err := balancer.GetSiteInfo(params.Domain)
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err = info.Balancer.DelAddr(params.Addr); err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeAdminData(w, nil)
+}
+
+// adminEndpointSet replace all endpoints of a site at once, it responds the diff
+func (p *ProxySrv) adminEndpointSet(w http.ResponseWriter, r *http.Request) {
+	params := EndpointsRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+	if _, err := balancer.GetSiteInfo(params.Domain); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+
+	diff, err := p.SetAddrs(params.Domain, params.Items)
+	if err != nil {
+		writeAdminError(w, http.StatusConflict, err)
+		return
+	}
+	writeAdminData(w, diff)
+}
+
+// adminEndpointWeight change the weight of an endpoint, gradually if ramp is given
+func (p *ProxySrv) adminEndpointWeight(w http.ResponseWriter, r *http.Request) {
+	params := EndpointRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+	var ramp time.Duration
+	if params.Ramp != "" {
+		var err error
+		if ramp, err = time.ParseDuration(params.Ramp); err != nil {
+			writeAdminError(w, http.StatusBadRequest, ErrAdminBadRequest)
+			return
+		}
+	}
+
+	if err := p.RampWeight(params.Domain, params.Addr, params.Weight, ramp); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+	writeAdminData(w, nil)
+}
+
+// adminEndpointDrain drain an endpoint, it is deleted once drained if remove is true
+func (p *ProxySrv) adminEndpointDrain(w http.ResponseWriter, r *http.Request) {
+	params := DrainRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+	var timeout time.Duration
+	if params.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(params.Timeout); err != nil {
+			writeAdminError(w, http.StatusBadRequest, ErrAdminBadRequest)
+			return
+		}
+	}
+
+	if err := p.DrainAddr(params.Domain, params.Addr, params.Remove, timeout); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+	writeAdminData(w, map[string]int64{"in_flight": p.InFlight(params.Domain, params.Addr)})
+}
+
+// adminEndpointState change the state of an endpoint
+func (p *ProxySrv) adminEndpointState(w http.ResponseWriter, r *http.Request) {
+	params := StateRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+	state, err := balancer.ParseState(params.State)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err = p.SetAddrState(params.Domain, params.Addr, state); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+	writeAdminData(w, nil)
+}
+
+// adminEndpointPriority change the priority level of an endpoint
+func (p *ProxySrv) adminEndpointPriority(w http.ResponseWriter, r *http.Request) {
+	params := PriorityRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+
+	if err := p.SetPriority(params.Domain, params.Addr, params.Priority); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+	writeAdminData(w, nil)
+}
+
+// adminEndpointHealth mark an endpoint healthy or not
+func (p *ProxySrv) adminEndpointHealth(w http.ResponseWriter, r *http.Request) {
+	params := HealthRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+
+	if err := p.SetHealthy(params.Domain, params.Addr, params.Healthy); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+	writeAdminData(w, nil)
+}
+
+// adminEndpointMaxConns change max requests in flight to an endpoint
+func (p *ProxySrv) adminEndpointMaxConns(w http.ResponseWriter, r *http.Request) {
+	params := MaxConnsRequest{}
+	if !readAdminParams(w, r, &params) {
+		return
+	}
+
+	if err := p.SetMaxConns(params.Domain, params.Addr, params.MaxConns); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+	writeAdminData(w, nil)
+}
+
+// adminMetrics get concurrency metrics of all sites
+func (p *ProxySrv) adminMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, ErrAdminMethod)
+		return
+	}
+	writeAdminData(w, p.Metrics())
+}
+
+// adminRegistry GET export registry document, POST import registry document
+func (p *ProxySrv) adminRegistry(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		data, err := p.ExportRegistry()
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(data)
+	case http.MethodPost:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, ErrAdminBadRequest)
+			return
+		}
+		if err = p.ImportRegistry(data); err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeAdminData(w, nil)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, ErrAdminMethod)
+	}
+}
+
+// adminWatch stream registry change events as json lines until the client leaves,
+// the domain query param filter events of a site, EventsDropped is always sent so the client can resync
+func (p *ProxySrv) adminWatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, ErrAdminMethod)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAdminError(w, http.StatusInternalServerError, ErrAdminNotImplemented)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	events, cancel := balancer.Watch(64)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case e := <-events:
+			if domain != "" && e.Domain != domain && e.Type != balancer.EventsDropped {
+				continue
+			}
+			if err := encoder.Encode(e); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-p.closing:
+			return
+		}
+	}
+}
+
+// readAdminParams decode json body of a POST request,
+// if it returns false the error response has been written
+func readAdminParams(w http.ResponseWriter, r *http.Request, params interface{}) bool {
+	if r.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, ErrAdminMethod)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		writeAdminError(w, http.StatusBadRequest, ErrAdminBadRequest)
+		return false
+	}
+	return true
+}
+
+// writeAdminData write a success response
+func writeAdminData(w http.ResponseWriter, data interface{}) {
+	writeAdminResponse(w, http.StatusOK, AdminResponse{Code: 0, Msg: "success", Data: data})
+}
+
+// writeAdminError write an error response, code is the http status code
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminResponse(w, status, AdminResponse{Code: status, Msg: err.Error()})
+}
+
+// writeAdminResponse write json response
+func writeAdminResponse(w http.ResponseWriter, status int, resp AdminResponse) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
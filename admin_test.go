@@ -0,0 +1,366 @@
+package libra
+
+import (
+	"encoding/json"
+	"github.com/zhuCheer/libra/balancer"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminRequest(handler http.Handler, method, path, body string) (int, AdminResponse) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	resp := AdminResponse{}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	return rec.Code, resp
+}
+
+func TestAdminSites(t *testing.T) {
+	domain := "www.admin-sites.com"
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	handler := proxy.AdminHandler()
+
+	code, _ := adminRequest(handler, "POST", "/api/site/add", `{"domain":"`+domain+`","load_type":"wroundrobin"}`)
+	if code != 200 {
+		t.Error("admin site add have an error #1")
+	}
+	info, err := proxy.GetSiteInfo(domain)
+	if err != nil || info.Scheme != "http" || info.LoadType != "wroundrobin" {
+		t.Error("admin site add have an error #2")
+	}
+
+	code, resp := adminRequest(handler, "GET", "/api/sites", "")
+	if code != 200 || resp.Code != 0 || !strings.Contains(toJSON(resp.Data), domain) {
+		t.Error("admin sites have an error #3")
+	}
+
+	code, _ = adminRequest(handler, "POST", "/api/sites", "")
+	if code != 405 {
+		t.Error("admin sites have an error #4")
+	}
+
+	code, _ = adminRequest(handler, "POST", "/api/site/add", `{"domain":""}`)
+	if code != 400 {
+		t.Error("admin site add have an error #5")
+	}
+
+	code, _ = adminRequest(handler, "POST", "/api/site/slowstart", `{"domain":"`+domain+`","window":"30s","aggression":2}`)
+	code, resp = adminRequest(handler, "GET", "/api/sites", "")
+	if code != 200 || !strings.Contains(toJSON(resp.Data), `"slow_start":{"aggression":2,"window":"30s"}`) {
+		t.Error("admin site slow start have an error #5.1", toJSON(resp.Data))
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/slowstart", `{"domain":"`+domain+`","window":"-1s"}`)
+	if code != 400 {
+		t.Error("admin site slow start have an error #5.2")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/slowstart", `{"domain":"www.admin-notfound.com","window":"1s"}`)
+	if code != 404 {
+		t.Error("admin site slow start have an error #5.3")
+	}
+
+	code, _ = adminRequest(handler, "POST", "/api/site/breaker", `{"domain":"`+domain+`","breaker":{"consecutive_failures":5}}`)
+	if code != 200 || proxy.GetBreaker(domain) == nil || proxy.GetBreaker(domain).ConsecutiveFailures != 5 {
+		t.Error("admin site breaker have an error #5.4")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/breaker", `{"domain":"`+domain+`","breaker":{}}`)
+	if code != 400 {
+		t.Error("admin site breaker have an error #5.5")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/breaker", `{"domain":"`+domain+`"}`)
+	if code != 200 || proxy.GetBreaker(domain) != nil {
+		t.Error("admin site breaker have an error #5.6")
+	}
+
+	code, _ = adminRequest(handler, "POST", "/api/site/ratelimit", `{"domain":"`+domain+`","rules":[{"key":"ip","rate":5}]}`)
+	if rules := proxy.GetRateLimit(domain); code != 200 || len(rules) != 1 || rules[0].Key != "ip" {
+		t.Error("admin site rate limit have an error #5.7")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/ratelimit", `{"domain":"`+domain+`","rules":[{"rate":0}]}`)
+	if code != 400 {
+		t.Error("admin site rate limit have an error #5.8")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/ratelimit", `{"domain":"`+domain+`"}`)
+	if code != 200 || proxy.GetRateLimit(domain) != nil {
+		t.Error("admin site rate limit have an error #5.9")
+	}
+
+	code, _ = adminRequest(handler, "POST", "/api/site/queue", `{"domain":"`+domain+`","queue":{"size":5,"timeout":"2s"}}`)
+	if queue := proxy.GetQueue(domain); code != 200 || queue == nil || queue.Size != 5 || queue.Timeout != 2*time.Second {
+		t.Error("admin site queue have an error #5.10")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/queue", `{"domain":"`+domain+`","queue":{"size":0}}`)
+	if code != 400 {
+		t.Error("admin site queue have an error #5.11")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/adaptive", `{"domain":"`+domain+`","adaptive":{"max_limit":50,"latency_threshold":"200ms"}}`)
+	if adaptive := proxy.GetAdaptiveLimit(domain); code != 200 || adaptive == nil || adaptive.LatencyThreshold != 200*time.Millisecond {
+		t.Error("admin site adaptive have an error #5.11.1")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/adaptive", `{"domain":"`+domain+`","adaptive":{"backoff":2}}`)
+	if code != 400 {
+		t.Error("admin site adaptive have an error #5.11.2")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/forwarded", `{"domain":"`+domain+`","forwarded":{"mode":"overwrite","forwarded":true}}`)
+	if forwarded := proxy.GetForwarded(domain); code != 200 || forwarded.Mode != ForwardedOverwrite || !forwarded.Forwarded {
+		t.Error("admin site forwarded have an error #5.11.3")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/forwarded", `{"domain":"`+domain+`","forwarded":{"mode":"keep"}}`)
+	if code != 400 {
+		t.Error("admin site forwarded have an error #5.11.4")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/headers", `{"domain":"`+domain+`","rules":[{"target":"response","action":"set","name":"X-Site","value":"{#host#}"}]}`)
+	if rules := proxy.GetHeaderRules(domain); code != 200 || len(rules) != 1 || rules[0].Value != "{#host#}" {
+		t.Error("admin site headers have an error #5.11.5")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/headers", `{"domain":"`+domain+`","rules":[{"target":"origin","action":"set","name":"X-Site"}]}`)
+	if code != 400 {
+		t.Error("admin site headers have an error #5.11.6")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/cache", `{"domain":"`+domain+`","cache":{"default_ttl":"1m","stale_if_error":"1h","max_stale":"2h"}}`)
+	if cache := proxy.GetCache(domain); code != 200 || cache == nil || cache.DefaultTTL != time.Minute ||
+		cache.StaleIfError != time.Hour || cache.MaxStale != 2*time.Hour {
+		t.Error("admin site cache have an error #5.11.7")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/cache", `{"domain":"`+domain+`","cache":{"max_object_size":-1}}`)
+	if code != 400 {
+		t.Error("admin site cache have an error #5.11.8")
+	}
+	proxy.getCacheStore().Set(&CacheEntry{Key: domain + "/static/a.js"})
+	proxy.getCacheStore().Set(&CacheEntry{Key: domain + "/static/b.js"})
+	code, resp = adminRequest(handler, "POST", "/api/cache/purge", `{"domain":"`+domain+`","url":"/static/a.js"}`)
+	if data, _ := json.Marshal(resp.Data); code != 200 || string(data) != `{"purged":1}` {
+		t.Error("admin cache purge have an error #5.11.9", string(data))
+	}
+	code, resp = adminRequest(handler, "POST", "/api/cache/purge", `{"domain":"`+domain+`","prefix":"/static/"}`)
+	if data, _ := json.Marshal(resp.Data); code != 200 || string(data) != `{"purged":1}` {
+		t.Error("admin cache purge have an error #5.11.10", string(data))
+	}
+	code, _ = adminRequest(handler, "POST", "/api/cache/purge", `{"domain":"`+domain+`"}`)
+	if code != 400 {
+		t.Error("admin cache purge have an error #5.11.11")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/coalesce", `{"domain":"`+domain+`","rules":[{"path":"/api/","headers":["Accept"]}]}`)
+	if rules := proxy.GetCoalesceRules(domain); code != 200 || len(rules) != 1 || rules[0].Headers[0] != "Accept" {
+		t.Error("admin site coalesce have an error #5.11.12")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/coalesce", `{"domain":"`+domain+`","rules":[{"max_waiters":-1}]}`)
+	if code != 400 {
+		t.Error("admin site coalesce have an error #5.11.13")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/compress", `{"domain":"`+domain+`","compress":{"types":["text/*"],"min_size":1024}}`)
+	if compress := proxy.GetCompress(domain); code != 200 || compress == nil || compress.MinSize != 1024 {
+		t.Error("admin site compress have an error #5.11.14")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/compress", `{"domain":"`+domain+`","compress":{"level":10}}`)
+	if code != 400 {
+		t.Error("admin site compress have an error #5.11.15")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/rewrites", `{"domain":"`+domain+`","rules":[{"match":"^/v1/(.*)$","action":"rewrite","replace":"/api/$1"}]}`)
+	if rules := proxy.GetRewriteRules(domain); code != 200 || len(rules) != 1 || rules[0].Replace != "/api/$1" {
+		t.Error("admin site rewrites have an error #5.11.16")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/rewrites", `{"domain":"`+domain+`","rules":[{"match":"(","action":"rewrite","replace":"/"}]}`)
+	if code != 400 {
+		t.Error("admin site rewrites have an error #5.11.17")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/host", `{"domain":"`+domain+`","policy":{"mode":"custom","host":"bucket.storage.com"}}`)
+	if policy := proxy.GetHostPolicy(domain); code != 200 || policy.Host != "bucket.storage.com" {
+		t.Error("admin site host have an error #5.11.18")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/host", `{"domain":"`+domain+`","policy":{"mode":"custom"}}`)
+	if code != 400 {
+		t.Error("admin site host have an error #5.11.19")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/https", `{"domain":"`+domain+`","https":{"redirect":true,"hsts":{"max_age":"8760h"}}}`)
+	if config := proxy.GetHTTPS(domain); code != 200 || config == nil || !config.Redirect || config.HSTS.MaxAge != 8760*time.Hour {
+		t.Error("admin site https have an error #5.11.20")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/https", `{"domain":"`+domain+`","https":{"redirect_status":303}}`)
+	if code != 400 {
+		t.Error("admin site https have an error #5.11.21")
+	}
+	proxy.SetHTTPS(domain, nil)
+	code, _ = adminRequest(handler, "POST", "/api/site/ipfilter", `{"domain":"`+domain+`","rules":[{"action":"allow","cidrs":["10.0.0.0/8"]}]}`)
+	if rules := proxy.GetIPRules(domain); code != 200 || len(rules) != 1 || rules[0].CIDRs[0] != "10.0.0.0/8" {
+		t.Error("admin site ipfilter have an error #5.11.22")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/ipfilter/add", `{"domain":"`+domain+`","action":"allow","cidr":"2001:db8::/32"}`)
+	if rules := proxy.GetIPRules(domain); code != 200 || len(rules) != 1 || len(rules[0].CIDRs) != 2 {
+		t.Error("admin ipfilter add have an error #5.11.23")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/ipfilter/add", `{"domain":"`+domain+`","action":"allow","cidr":"10.0.0.0/33"}`)
+	if code != 400 {
+		t.Error("admin ipfilter add have an error #5.11.24")
+	}
+	adminRequest(handler, "POST", "/api/ipfilter/del", `{"domain":"`+domain+`","action":"allow","cidr":"10.0.0.0/8"}`)
+	code, _ = adminRequest(handler, "POST", "/api/ipfilter/del", `{"domain":"`+domain+`","action":"allow","cidr":"2001:db8::/32"}`)
+	if code != 200 || proxy.GetIPRules(domain) != nil {
+		t.Error("admin ipfilter del have an error #5.11.25")
+	}
+	code, resp = adminRequest(handler, "GET", "/api/metrics", "")
+	data, _ := json.Marshal(resp.Data)
+	if code != 200 || !strings.Contains(string(data), `"queue":{"size":5,"timeout":"2s"}`) || !strings.Contains(string(data), `"adaptive":{"in_flight":0,"latency_ms":0,"limit":20,"shed":0}`) {
+		t.Error("admin metrics have an error #5.12", string(data))
+	}
+
+	code, _ = adminRequest(handler, "POST", "/api/site/del", `{"domain":"`+domain+`"}`)
+	if _, err = proxy.GetSiteInfo(domain); code != 200 || err == nil {
+		t.Error("admin site del have an error #6")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/del", `{"domain":"`+domain+`"}`)
+	if code != 404 {
+		t.Error("admin site del have an error #7")
+	}
+}
+
+func TestAdminEndpoint(t *testing.T) {
+	domain := "www.admin-endpoint.com"
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	proxy.RegistSite(domain, "roundrobin", "http")
+	handler := proxy.AdminHandler()
+
+	code, _ := adminRequest(handler, "POST", "/api/endpoint/add", `{"domain":"`+domain+`","addr":"192.168.1.100:80","weight":2}`)
+	info, _ := proxy.GetSiteInfo(domain)
+	if code != 200 || len(info.Items) != 1 || info.Items[0].Weight != 2 {
+		t.Error("admin endpoint add have an error #1")
+	}
+
+	code, resp := adminRequest(handler, "POST", "/api/endpoint/add", `{"domain":"`+domain+`","addr":"192.168.1.100:80"}`)
+	if code != 409 || resp.Msg != "the endpoint has existed" {
+		t.Error("admin endpoint add have an error #2")
+	}
+
+	code, _ = adminRequest(handler, "POST", "/api/endpoint/add", `{"domain":"www.admin-notfound.com","addr":"192.168.1.100:80"}`)
+	if code != 404 {
+		t.Error("admin endpoint add have an error #3")
+	}
+
+	code, _ = adminRequest(handler, "POST", "/api/endpoint/add", `{"domain":`)
+	if code != 400 {
+		t.Error("admin endpoint add have an error #4")
+	}
+
+	code, _ = adminRequest(handler, "POST", "/api/endpoint/del", `{"domain":"`+domain+`","addr":"192.168.1.100:80"}`)
+	if code != 200 || len(info.Items) != 0 {
+		t.Error("admin endpoint del have an error #5")
+	}
+
+	code, resp = adminRequest(handler, "POST", "/api/endpoint/set", `{"domain":"`+domain+`","items":[{"endpoint":"192.168.1.101:80","weight":1}]}`)
+	info, _ = proxy.GetSiteInfo(domain)
+	if code != 200 || len(info.Items) != 1 || !strings.Contains(toJSON(resp.Data), `"added":[{"endpoint":"192.168.1.101:80"`) {
+		t.Error("admin endpoint set have an error #5.1")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/endpoint/set", `{"domain":"www.admin-notfound.com","items":[]}`)
+	if code != 404 {
+		t.Error("admin endpoint set have an error #5.2")
+	}
+
+	code, _ = adminRequest(handler, "POST", "/api/endpoint/weight", `{"domain":"`+domain+`","addr":"192.168.1.101:80","weight":8,"ramp":"1m"}`)
+	info, _ = proxy.GetSiteInfo(domain)
+	if code != 200 || info.Items[0].Weight != 8 {
+		t.Error("admin endpoint weight have an error #5.3")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/endpoint/weight", `{"domain":"`+domain+`","addr":"192.168.1.101:80","weight":8,"ramp":"1x"}`)
+	if code != 400 {
+		t.Error("admin endpoint weight have an error #5.4")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/endpoint/weight", `{"domain":"`+domain+`","addr":"192.168.1.109:80","weight":8}`)
+	if code != 404 {
+		t.Error("admin endpoint weight have an error #5.5")
+	}
+
+	code, _ = adminRequest(handler, "POST", "/api/endpoint/drain", `{"domain":"`+domain+`","addr":"192.168.1.100:80"}`)
+	if code != 404 {
+		t.Error("admin endpoint drain have an error #6")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/endpoint/drain", `{"domain":"`+domain+`","addr":"192.168.1.101:80","remove":true,"timeout":"1x"}`)
+	if code != 400 {
+		t.Error("admin endpoint drain have an error #7")
+	}
+	code, resp = adminRequest(handler, "POST", "/api/endpoint/drain", `{"domain":"`+domain+`","addr":"192.168.1.101:80"}`)
+	if code != 200 || endpoints(domain)[0].State != balancer.StateDraining || toJSON(resp.Data) != `{"in_flight":0}` {
+		t.Error("admin endpoint drain have an error #8")
+	}
+	code, resp = adminRequest(handler, "GET", "/api/sites", "")
+	if code != 200 || !strings.Contains(toJSON(resp.Data), `"endpoint":"192.168.1.101:80","healthy":true,"in_flight":0,"state":"draining"`) {
+		t.Error("admin sites have an error #9", toJSON(resp.Data))
+	}
+
+	code, _ = adminRequest(handler, "POST", "/api/endpoint/state", `{"domain":"`+domain+`","addr":"192.168.1.101:80","state":"sleeping"}`)
+	if code != 400 {
+		t.Error("admin endpoint state have an error #10")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/endpoint/state", `{"domain":"`+domain+`","addr":"192.168.1.101:80","state":"active"}`)
+	if code != 200 || !endpoints(domain)[0].IsActive() {
+		t.Error("admin endpoint state have an error #11")
+	}
+
+	code, _ = adminRequest(handler, "POST", "/api/endpoint/priority", `{"domain":"`+domain+`","addr":"192.168.1.101:80","priority":1}`)
+	if code != 200 || endpoints(domain)[0].Priority != 1 {
+		t.Error("admin endpoint priority have an error #12")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/endpoint/maxconns", `{"domain":"`+domain+`","addr":"192.168.1.101:80","max_conns":30}`)
+	if code != 200 || endpoints(domain)[0].MaxConns != 30 {
+		t.Error("admin endpoint max conns have an error #12.1")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/endpoint/health", `{"domain":"`+domain+`","addr":"192.168.1.101:80","healthy":false}`)
+	if code != 200 || balancer.IsHealthy(domain, "192.168.1.101:80") {
+		t.Error("admin endpoint health have an error #13")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/endpoint/health", `{"domain":"`+domain+`","addr":"192.168.1.109:80"}`)
+	if code != 404 {
+		t.Error("admin endpoint health have an error #14")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/failover", `{"domain":"`+domain+`","threshold":0.5}`)
+	code, resp = adminRequest(handler, "GET", "/api/sites", "")
+	if code != 200 || !strings.Contains(toJSON(resp.Data), `"failover_threshold":0.5`) || !strings.Contains(toJSON(resp.Data), `"healthy":false`) {
+		t.Error("admin site failover have an error #15")
+	}
+	code, _ = adminRequest(handler, "POST", "/api/site/failover", `{"domain":"`+domain+`","threshold":2}`)
+	if code != 400 {
+		t.Error("admin site failover have an error #16")
+	}
+}
+
+func endpoints(domain string) []balancer.EndpointItem {
+	items, _ := balancer.GetEndpoints(domain)
+	return items
+}
+
+func toJSON(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func TestAdminWatch(t *testing.T) {
+	domain := "www.admin-watch.com"
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	admin := httptest.NewServer(proxy.AdminHandler())
+	defer admin.Close()
+
+	res, err := http.Get(admin.URL + "/api/watch?domain=" + domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	proxy.RegistSite("www.admin-other.com", "random", "http")
+	proxy.RegistSite(domain, "random", "http")
+	proxy.AddAddr(domain, "192.168.1.100:80", 1)
+
+	decoder := json.NewDecoder(res.Body)
+	e1 := map[string]interface{}{}
+	e2 := map[string]interface{}{}
+	decoder.Decode(&e1)
+	decoder.Decode(&e2)
+	if e1["type"] != "SiteAdded" || e1["domain"] != domain || e2["type"] != "EndpointAdded" {
+		t.Error("admin watch have an error #1", e1, e2)
+	}
+	proxy.FlushProxy(domain)
+	proxy.FlushProxy("www.admin-other.com")
+}
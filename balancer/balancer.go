@@ -4,22 +4,26 @@ import (
 	"errors"
 
 	"log"
+	"sort"
 	"sync"
 )
 
 // Balancer is an interface used to lookup the target host
 // Interfaces can be implemented using different algorithms, loop/round robin or others
 type Balancer interface {
-	AddAddr(addr string, weight uint32) error //add target addr
-	DelAddr(addr string) error                // del target addr
-	GetOne() (*ProxyTarget, error)            // Return the endpoint by different algorithms
+	AddAddr(addr string, weight uint32) error             //add target addr
+	DelAddr(addr string) error                            // del target addr
+	SetAddrs(items []EndpointItem) (*EndpointDiff, error) // replace all target addrs at once
+	GetOne() (*ProxyTarget, error)                        // Return the endpoint by different algorithms
 }
 
 // Common errors.
 var (
-	ErrServiceNotFound = errors.New("the proxy srv not found")
-	ErrServiceExisted  = errors.New("the proxy srv has existed")
-	ErrEndpointExisted = errors.New("the endpoint has existed")
+	ErrServiceNotFound  = errors.New("the proxy srv not found")
+	ErrServiceExisted   = errors.New("the proxy srv has existed")
+	ErrEndpointExisted  = errors.New("the endpoint has existed")
+	ErrEndpointNotFound = errors.New("the endpoint not found")
+	ErrStateInvalid     = errors.New("the endpoint state is invalid")
 )
 
 // Global lock for the default registry,
@@ -35,12 +39,41 @@ type OriginItem struct {
 	Weight   uint32 `json:"weight"`
 }
 
+// EndpointOptions endpoint settings besides addr and weight, the zero value is an active primary without limit,
+// they are not in OriginItem so its positional literals like OriginItem{"ip:port", 10} keep compiling
+type EndpointOptions struct {
+	State    EndpointState `json:"state,omitempty"`     // empty is active
+	Priority int           `json:"priority,omitempty"`  // 0 is primary, greater levels are backups
+	MaxConns uint32        `json:"max_conns,omitempty"` // max requests in flight, 0 is unlimited
+}
+
+// EndpointItem an endpoint with its options, it is encoded in json as one flat object
+type EndpointItem struct {
+	OriginItem
+	EndpointOptions
+}
+
 // RegistNode register a proxy node struct
 type RegistNode struct {
 	Domain   string       `json:"domain"`
 	Items    []OriginItem `json:"items"`
 	Balancer Balancer     `json:"balancer,omitempty"`
 	Scheme   string       `json:"scheme"`
+	LoadType string       `json:"load_type"`
+
+	options           map[string]EndpointOptions // endpoint state, priority and max conns, see SetState
+	ramps             map[string]*weightRamp     // endpoint weight ramping, see RampWeight
+	slowStart         SlowStart                  // see SetSlowStart
+	unhealthy         map[string]bool            // see SetHealthy
+	failoverThreshold float64                    // see SetFailoverThreshold
+}
+
+// EndpointDiff endpoints changed by SetAddrs,
+// Changed items are the new value of endpoints whose weight, state, priority or max conns changed
+type EndpointDiff struct {
+	Added   []EndpointItem `json:"added"`
+	Removed []EndpointItem `json:"removed"`
+	Changed []EndpointItem `json:"changed"`
 }
 
 // ProxyTarget proxy target node struct
@@ -51,14 +84,15 @@ type ProxyTarget struct {
 
 // newTarget New Target server is register a node
 func newTarget(node RegistNode) error {
-	lock.Lock()
-	defer lock.Unlock()
+	tx := beginTx()
+	defer tx.commit()
 	if _, ok := registryMap[node.Domain]; !ok {
 		if registryMap == nil {
 			registryMap = map[string]*RegistNode{}
 		}
 
 		registryMap[node.Domain] = &node
+		tx.emitSiteAdded(&node)
 		return nil
 	}
 	return ErrServiceExisted
@@ -66,8 +100,8 @@ func newTarget(node RegistNode) error {
 
 // RegistTargetNoAddr register a target server node target ip list is empty
 func RegistTargetNoAddr(domain, loadType, scheme string) *RegistNode {
-	lock.Lock()
-	defer lock.Unlock()
+	tx := beginTx()
+	defer tx.commit()
 	if _, ok := registryMap[domain]; !ok {
 		if registryMap == nil {
 			registryMap = map[string]*RegistNode{}
@@ -78,7 +112,9 @@ func RegistTargetNoAddr(domain, loadType, scheme string) *RegistNode {
 			Items:    []OriginItem{},
 			Balancer: getBalancerByLoadType(domain, loadType),
 			Scheme:   scheme,
+			LoadType: getLoadTypeName(loadType),
 		}
+		tx.emitSiteAdded(registryMap[domain])
 		return registryMap[domain]
 	} else {
 		return registryMap[domain]
@@ -99,6 +135,23 @@ func getBalancerByLoadType(domain, loadType string) Balancer {
 	return b
 }
 
+// getLoadTypeName get the load type really used, unknown type fall back to random
+func getLoadTypeName(loadType string) string {
+	if ValidLoadType(loadType) {
+		return loadType
+	}
+	return "random"
+}
+
+// ValidLoadType check the load type is supported
+func ValidLoadType(loadType string) bool {
+	switch loadType {
+	case "random", "roundrobin", "wroundrobin":
+		return true
+	}
+	return false
+}
+
 // GetSiteInfo get target for out package
 func GetSiteInfo(domain string) (*RegistNode, error) {
 	info, err := getTarget(domain)
@@ -110,6 +163,30 @@ func GetSiteInfo(domain string) (*RegistNode, error) {
 	return info, nil
 }
 
+// GetAllSites get a copy of all registered sites order by domain,
+// they are not changed by later changes of the registry
+func GetAllSites() []*RegistNode {
+	lock.RLock()
+	sites := make([]*RegistNode, 0, len(registryMap))
+	for _, node := range registryMap {
+		items := make([]OriginItem, len(node.Items))
+		copy(items, node.Items)
+		sites = append(sites, &RegistNode{
+			Domain:   node.Domain,
+			Items:    items,
+			Balancer: node.Balancer,
+			Scheme:   node.Scheme,
+			LoadType: node.LoadType,
+		})
+	}
+	lock.RUnlock()
+
+	sort.Slice(sites, func(i, j int) bool {
+		return sites[i].Domain < sites[j].Domain
+	})
+	return sites
+}
+
 // getTarget get a Target server
 func getTarget(domain string) (*RegistNode, error) {
 	lock.RLock()
@@ -125,15 +202,18 @@ func getTarget(domain string) (*RegistNode, error) {
 
 // FlushProxy flush an proxy server
 func FlushProxy(domain string) {
-	lock.Lock()
-	defer lock.Unlock()
-	delete(registryMap, domain)
+	tx := beginTx()
+	defer tx.commit()
+	if node, ok := registryMap[domain]; ok {
+		delete(registryMap, domain)
+		tx.emitSiteRemoved(node)
+	}
 }
 
 // addEndpoint add an endpoint
 func addEndpoint(domain string, endpoints ...OriginItem) error {
-	lock.Lock()
-	defer lock.Unlock()
+	tx := beginTx()
+	defer tx.commit()
 
 	if registryMap == nil {
 		registryMap = map[string]*RegistNode{}
@@ -142,17 +222,25 @@ func addEndpoint(domain string, endpoints ...OriginItem) error {
 	service, ok := registryMap[domain]
 	if ok == false {
 		registryMap[domain] = &RegistNode{
-			domain,
-			endpoints,
-			getBalancerByLoadType(domain, "random"),
-			"http",
+			Domain:   domain,
+			Items:    endpoints,
+			Balancer: getBalancerByLoadType(domain, "random"),
+			Scheme:   "http",
+			LoadType: "random",
+		}
+		tx.emitSiteAdded(registryMap[domain])
+		for _, item := range endpoints {
+			tx.emitEndpoint(EndpointAdded, domain, nil, &EndpointItem{OriginItem: item})
 		}
 	} else {
+		now := timeNow()
 		for _, item := range endpoints {
 			if stringInOriginItem(item.Endpoint, service.Items) {
 				return ErrEndpointExisted
 			}
 			service.Items = append(service.Items, item)
+			service.startSlowly(item, now)
+			tx.emitEndpoint(EndpointAdded, domain, nil, &EndpointItem{OriginItem: item})
 		}
 	}
 
@@ -161,8 +249,8 @@ func addEndpoint(domain string, endpoints ...OriginItem) error {
 
 // delEndpoint remove an endpoint
 func delEndpoint(domain string, addr string) error {
-	lock.Lock()
-	defer lock.Unlock()
+	tx := beginTx()
+	defer tx.commit()
 
 	service, ok := registryMap[domain]
 	if ok == false {
@@ -170,33 +258,145 @@ func delEndpoint(domain string, addr string) error {
 	}
 	for k, item := range service.Items {
 		if item.Endpoint == addr {
-			endpoints := append(service.Items[:k], service.Items[k+1:]...)
+			// build a new slice, balancers may be reading the old one
+			endpoints := make([]OriginItem, 0, len(service.Items)-1)
+			endpoints = append(endpoints, service.Items[:k]...)
+			endpoints = append(endpoints, service.Items[k+1:]...)
+			before := service.endpointItem(item)
 			service.Items = endpoints
+			service.forget(addr)
+			tx.emitEndpoint(EndpointRemoved, domain, &before, nil)
 			break
 		}
 	}
 	return nil
 }
 
+// setEndpoints replace all endpoints of a site at once,
+// readers see either the old list or the new one, never a half updated one
+func setEndpoints(domain string, endpoints []EndpointItem) (*EndpointDiff, error) {
+	items, options, err := splitEndpointItems(endpoints)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := beginTx()
+	defer tx.commit()
+
+	service, ok := registryMap[domain]
+	if ok == false {
+		return nil, ErrServiceNotFound
+	}
+	before := service.endpointItems()
+	diff := diffItems(before, endpoints)
+	tx.emitItemsDiff(domain, before, diff)
+	for _, item := range diff.Removed {
+		service.forget(item.Endpoint)
+	}
+	service.Items = items
+	service.options = options
+	now := timeNow()
+	for _, item := range diff.Changed {
+		old, _ := findEndpointItem(item.Endpoint, before)
+		if !old.IsActive() && item.IsActive() {
+			service.startSlowly(item.OriginItem, now)
+		} else if old.Weight != item.Weight {
+			// a new weight given wins over the ramp in progress
+			delete(service.ramps, item.Endpoint)
+		}
+	}
+	for _, item := range diff.Added {
+		service.startSlowly(item.OriginItem, now)
+	}
+
+	return diff, nil
+}
+
+// getItems get endpoints of a site which can be picked, with their effective weight,
+// only available endpoints of the priority level in use are included,
+// draining, disabled, unhealthy and at capacity ones are not, the returned slice must not be modified
+func getItems(domain string) ([]OriginItem, error) {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	node, ok := registryMap[domain]
+	if ok == false {
+		return nil, ErrServiceNotFound
+	}
+	return node.availableItems(node.effectiveItems(timeNow())), nil
+}
+
 // ChangeLoadType set site load type
 func ChangeLoadType(domain string, loadType string) error {
-	lock.Lock()
-	defer lock.Unlock()
+	tx := beginTx()
+	defer tx.commit()
 
 	service, ok := registryMap[domain]
 	if ok == false {
 		registryMap[domain] = &RegistNode{
-			domain,
-			[]OriginItem{},
-			getBalancerByLoadType(domain, loadType),
-			"http",
+			Domain:   domain,
+			Items:    []OriginItem{},
+			Balancer: getBalancerByLoadType(domain, loadType),
+			Scheme:   "http",
+			LoadType: getLoadTypeName(loadType),
 		}
+		tx.emitSiteAdded(registryMap[domain])
 	} else {
+		oldLoadType := service.LoadType
 		service.Balancer = getBalancerByLoadType(domain, loadType)
+		service.LoadType = getLoadTypeName(loadType)
+		if oldLoadType != service.LoadType {
+			tx.emitLoadType(domain, oldLoadType, service.LoadType)
+		}
 	}
 	return nil
 }
 
+// splitEndpointItems check endpoints and split them to items and options of the non zero ones
+func splitEndpointItems(endpoints []EndpointItem) ([]OriginItem, map[string]EndpointOptions, error) {
+	items := make([]OriginItem, 0, len(endpoints))
+	options := map[string]EndpointOptions{}
+	for _, item := range endpoints {
+		if stringInOriginItem(item.Endpoint, items) {
+			return nil, nil, ErrEndpointExisted
+		}
+		if !item.State.valid() {
+			return nil, nil, ErrStateInvalid
+		}
+		items = append(items, item.OriginItem)
+		if item.EndpointOptions != (EndpointOptions{}) {
+			options[item.Endpoint] = item.EndpointOptions
+		}
+	}
+	return items, options, nil
+}
+
+// endpointItem get an endpoint with its options, it should be called with the registry lock
+func (node *RegistNode) endpointItem(item OriginItem) EndpointItem {
+	return EndpointItem{OriginItem: item, EndpointOptions: node.options[item.Endpoint]}
+}
+
+// endpointItems get all endpoints with their options, it should be called with the registry lock
+func (node *RegistNode) endpointItems() []EndpointItem {
+	items := make([]EndpointItem, 0, len(node.Items))
+	for _, item := range node.Items {
+		items = append(items, node.endpointItem(item))
+	}
+	return items
+}
+
+// setOptions change options of an endpoint, it should be called with the registry write lock
+func (node *RegistNode) setOptions(addr string, options EndpointOptions) {
+	if options == (EndpointOptions{}) {
+		delete(node.options, addr)
+		return
+	}
+	if node.options == nil {
+		node.options = map[string]EndpointOptions{}
+	}
+	node.options[addr] = options
+}
+
 // stringInOriginItem check endpoint is existed
 func stringInOriginItem(needle string, haystack []OriginItem) bool {
 	result := false
@@ -24,6 +24,11 @@ func (b *testBalancer) DelAddr(addr string) error {
 	return nil
 }
 
+func (b *testBalancer) SetAddrs(items []EndpointItem) (*EndpointDiff, error) {
+
+	return &EndpointDiff{}, nil
+}
+
 func (b *testBalancer) ChangeLoadType(loadType string) error {
 
 	return nil
@@ -266,6 +271,23 @@ func TestChangeLoadType(t *testing.T) {
 	}
 }
 
+func TestGetAllSites(t *testing.T) {
+	registryMap = nil
+	RegistTargetNoAddr("www.google.com", "random", "http")
+	RegistTargetNoAddr("www.facebook.com", "random", "http")
+	addEndpoint("www.google.com", OriginItem{"192.168.1.101:80", 10})
+
+	sites := GetAllSites()
+	if len(sites) != 2 || sites[0].Domain != "www.facebook.com" || len(sites[1].Items) != 1 {
+		t.Error("GetAllSites func have an error #1")
+	}
+	addEndpoint("www.google.com", OriginItem{"192.168.1.102:80", 10})
+	ChangeLoadType("www.google.com", "roundrobin")
+	if len(sites[1].Items) != 1 || sites[1].LoadType != "random" || sites[1] == registryMap["www.google.com"] {
+		t.Error("GetAllSites func have an error #2")
+	}
+}
+
 func TestGetSiteInfo(t *testing.T) {
 	registryMap = nil
 
@@ -280,3 +302,68 @@ func TestGetSiteInfo(t *testing.T) {
 		t.Error("siteInfo have an error #2")
 	}
 }
+
+func TestSetEndpoints(t *testing.T) {
+	registryMap = nil
+	_, err := setEndpoints("www.google.com", []EndpointItem{})
+	if err != ErrServiceNotFound {
+		t.Error("setEndpoints func have an error #1")
+	}
+
+	RegistTargetNoAddr("www.google.com", "random", "http")
+	addEndpoint("www.google.com", []OriginItem{{"192.168.1.101:80", 10}, {"192.168.1.102:80", 10}}...)
+	oldItems, _ := getItems("www.google.com")
+
+	diff, err := setEndpoints("www.google.com", []EndpointItem{{OriginItem: OriginItem{"192.168.1.102:80", 20}}, {OriginItem: OriginItem{"192.168.1.103:80", 10}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Added) != 1 || diff.Added[0].Endpoint != "192.168.1.103:80" ||
+		len(diff.Removed) != 1 || diff.Removed[0].Endpoint != "192.168.1.101:80" ||
+		len(diff.Changed) != 1 || diff.Changed[0].Weight != 20 {
+		t.Error("setEndpoints func have an error #2")
+	}
+	items, _ := getItems("www.google.com")
+	if len(items) != 2 || items[0].Endpoint != "192.168.1.102:80" {
+		t.Error("setEndpoints func have an error #3")
+	}
+	if oldItems[0].Endpoint != "192.168.1.101:80" || oldItems[1].Weight != 10 {
+		t.Error("setEndpoints func have an error #4")
+	}
+
+	_, err = setEndpoints("www.google.com", []EndpointItem{{OriginItem: OriginItem{"192.168.1.102:80", 20}}, {OriginItem: OriginItem{"192.168.1.102:80", 10}}})
+	if err != ErrEndpointExisted || len(registryMap["www.google.com"].Items) != 2 {
+		t.Error("setEndpoints func have an error #5")
+	}
+}
+
+func TestSetEndpointsConcurrency(t *testing.T) {
+	registryMap = nil
+	RegistTargetNoAddr("www.google.com", "roundrobin", "http")
+	addEndpoint("www.google.com", OriginItem{"192.168.1.100:80", 10})
+	setA := []EndpointItem{{OriginItem: OriginItem{"192.168.1.101:80", 10}}, {OriginItem: OriginItem{"192.168.1.102:80", 10}}}
+	setB := []EndpointItem{{OriginItem: OriginItem{"192.168.1.103:80", 10}}}
+	balancer := registryMap["www.google.com"].Balancer
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		for i := 0; i < 200; i++ {
+			if i%2 == 0 {
+				balancer.SetAddrs(setA)
+			} else {
+				balancer.SetAddrs(setB)
+			}
+		}
+		wg.Done()
+	}()
+	go func() {
+		for i := 0; i < 200; i++ {
+			if _, err := balancer.GetOne(); err != nil {
+				t.Error("SetAddrs concurrency have an error #1", err)
+			}
+		}
+		wg.Done()
+	}()
+	wg.Wait()
+}
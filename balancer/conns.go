@@ -0,0 +1,83 @@
+package balancer
+
+// SetMaxConns change the max requests in flight to an endpoint, 0 means unlimited,
+// endpoints at capacity are skipped by balancers until a request is done
+func SetMaxConns(domain, addr string, maxConns uint32) error {
+	tx := beginTx()
+	defer tx.commit()
+
+	service, ok := registryMap[domain]
+	if ok == false {
+		return ErrServiceNotFound
+	}
+	item, ok := findOriginItem(addr, service.Items)
+	if ok == false {
+		return ErrEndpointNotFound
+	}
+	before := service.endpointItem(item)
+	if before.MaxConns == maxConns {
+		return nil
+	}
+
+	after := before
+	after.MaxConns = maxConns
+	service.setOptions(addr, after.EndpointOptions)
+	tx.emitEndpoint(MaxConnsChanged, domain, &before, &after)
+	return nil
+}
+
+// TryAcquire count a request in flight to an endpoint like Acquire,
+// it fails if the endpoint is at capacity so concurrent picks never exceed max conns
+func TryAcquire(domain, addr string) (release func(), ok bool) {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	var maxConns uint32
+	if service, found := registryMap[domain]; found {
+		maxConns = service.options[addr].MaxConns
+	}
+
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	if maxConns > 0 && inFlight[statsKey(domain, addr)] >= int64(maxConns) {
+		return nil, false
+	}
+	return acquire(domain, addr), true
+}
+
+// AtCapacity check any active endpoint of a site has max conns requests in flight
+func AtCapacity(domain string) bool {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	service, ok := registryMap[domain]
+	if ok == false {
+		return false
+	}
+	for _, item := range service.Items {
+		if service.options[item.Endpoint].IsActive() && service.atCapacity(item) {
+			return true
+		}
+	}
+	return false
+}
+
+// SlotFreed get a channel closed once a request in flight to any endpoint of the site is done,
+// get it before picking so a slot freed meanwhile is not missed
+func SlotFreed(domain string) <-chan struct{} {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+
+	freed, ok := slotFreed[domain]
+	if !ok {
+		freed = make(chan struct{})
+		slotFreed[domain] = freed
+	}
+	return freed
+}
+
+// atCapacity check the endpoint has max conns requests in flight, it should be called with the registry lock
+func (node *RegistNode) atCapacity(item OriginItem) bool {
+	maxConns := node.options[item.Endpoint].MaxConns
+	return maxConns > 0 && InFlight(node.Domain, item.Endpoint) >= int64(maxConns)
+}
@@ -0,0 +1,66 @@
+package balancer
+
+import (
+	"testing"
+)
+
+func TestMaxConns(t *testing.T) {
+	registryMap = nil
+	domain := "www.google.com"
+	newTarget(RegistNode{
+		Domain: domain,
+		Items: []OriginItem{
+			{Endpoint: "192.168.1.100", Weight: 1},
+			{Endpoint: "192.168.1.101", Weight: 1},
+		},
+	})
+	SetMaxConns(domain, "192.168.1.100", 1)
+	balancer := NewRoundRobinLoad(domain)
+
+	release, ok := TryAcquire(domain, "192.168.1.100")
+	if !ok || !AtCapacity(domain) {
+		t.Error("max conns have an error #1")
+	}
+	if _, ok = TryAcquire(domain, "192.168.1.100"); ok {
+		t.Error("max conns have an error #2")
+	}
+	for i := 0; i < 4; i++ {
+		if target, _ := balancer.GetOne(); target == nil || target.Addr != "192.168.1.101" {
+			t.Error("max conns have an error #3")
+		}
+	}
+
+	// a slot freed wakes waiters and the endpoint is picked again
+	freed := SlotFreed(domain)
+	release()
+	release()
+	select {
+	case <-freed:
+	default:
+		t.Error("max conns have an error #4")
+	}
+	if AtCapacity(domain) || InFlight(domain, "192.168.1.100") != 0 {
+		t.Error("max conns have an error #5")
+	}
+
+	if err := SetMaxConns(domain, "192.168.1.101", 2); err != nil {
+		t.Error("max conns have an error #6")
+	}
+	if SetMaxConns(domain, "192.168.1.102", 2) != ErrEndpointNotFound || SetMaxConns("www.notfound.com", "192.168.1.101", 2) != ErrServiceNotFound {
+		t.Error("max conns have an error #7")
+	}
+	items, _ := GetEndpoints(domain)
+	if items[1].MaxConns != 2 {
+		t.Error("max conns have an error #8")
+	}
+	release1, _ := TryAcquire(domain, "192.168.1.101")
+	release2, ok := TryAcquire(domain, "192.168.1.101")
+	if !ok {
+		t.Error("max conns have an error #9")
+	}
+	if _, ok = TryAcquire(domain, "192.168.1.101"); ok {
+		t.Error("max conns have an error #10")
+	}
+	release1()
+	release2()
+}
@@ -0,0 +1,204 @@
+package balancer
+
+import (
+	"sync"
+	"time"
+)
+
+// EndpointState endpoint state, draining and disabled endpoints get no new requests
+type EndpointState string
+
+// Endpoint states, an empty state is active.
+const (
+	StateActive   EndpointState = "active"
+	StateDraining EndpointState = "draining"
+	StateDisabled EndpointState = "disabled"
+)
+
+// drainInterval how often a draining endpoint is checked for auto removal
+var drainInterval = 100 * time.Millisecond
+
+// in-flight request counters by domain and endpoint
+var (
+	statsLock sync.Mutex
+	inFlight  = map[string]int64{}
+	slotFreed = map[string]chan struct{}{} // by domain, closed when a request is released
+)
+
+// normalize get the state with empty as active
+func (s EndpointState) normalize() EndpointState {
+	if s == "" {
+		return StateActive
+	}
+	return s
+}
+
+// valid check the state is known
+func (s EndpointState) valid() bool {
+	switch s.normalize() {
+	case StateActive, StateDraining, StateDisabled:
+		return true
+	}
+	return false
+}
+
+// ParseState get an endpoint state by name
+func ParseState(name string) (EndpointState, error) {
+	state := EndpointState(name)
+	if !state.valid() {
+		return "", ErrStateInvalid
+	}
+	return state.normalize(), nil
+}
+
+// IsActive check the endpoint can be picked by balancers
+func (o EndpointOptions) IsActive() bool {
+	return o.State.normalize() == StateActive
+}
+
+// statsKey in-flight counter key
+func statsKey(domain, addr string) string {
+	return domain + "|" + addr
+}
+
+// Acquire count a request in flight to an endpoint,
+// call the returned func once the request and its response body are done
+func Acquire(domain, addr string) (release func()) {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	return acquire(domain, addr)
+}
+
+// acquire count a request in flight, it should be called with statsLock
+func acquire(domain, addr string) (release func()) {
+	key := statsKey(domain, addr)
+	inFlight[key]++
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			statsLock.Lock()
+			inFlight[key]--
+			if inFlight[key] <= 0 {
+				delete(inFlight, key)
+			}
+			if freed, ok := slotFreed[domain]; ok {
+				close(freed)
+				delete(slotFreed, domain)
+			}
+			statsLock.Unlock()
+		})
+	}
+}
+
+// InFlight get the count of requests in flight to an endpoint
+func InFlight(domain, addr string) int64 {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	return inFlight[statsKey(domain, addr)]
+}
+
+// SetState change the state of an endpoint,
+// draining and disabled endpoints get no new requests but in-flight ones are not broken,
+// an endpoint activated again starts slowly if slow start is on
+func SetState(domain, addr string, state EndpointState) error {
+	if !state.valid() {
+		return ErrStateInvalid
+	}
+
+	tx := beginTx()
+	defer tx.commit()
+
+	service, ok := registryMap[domain]
+	if ok == false {
+		return ErrServiceNotFound
+	}
+	item, ok := findOriginItem(addr, service.Items)
+	if ok == false {
+		return ErrEndpointNotFound
+	}
+	before := service.endpointItem(item)
+	if before.State.normalize() == state.normalize() {
+		return nil
+	}
+
+	after := before
+	after.State = state.normalize()
+	service.setOptions(addr, after.EndpointOptions)
+	if !before.IsActive() {
+		service.startSlowly(item, timeNow())
+	}
+	tx.emitEndpoint(StateChanged, domain, &before, &after)
+	return nil
+}
+
+// DrainAddr set an endpoint draining, if remove is true the endpoint is deleted
+// once it has no request in flight or timeout passed, timeout <= 0 means wait forever,
+// it is not deleted if its state is changed again before that
+func DrainAddr(domain, addr string, remove bool, timeout time.Duration) error {
+	if err := SetState(domain, addr, StateDraining); err != nil {
+		return err
+	}
+	if !remove {
+		return nil
+	}
+
+	go func() {
+		var deadline <-chan time.Time
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		ticker := time.NewTicker(drainInterval)
+		defer ticker.Stop()
+
+		for isDraining(domain, addr) && InFlight(domain, addr) > 0 {
+			select {
+			case <-ticker.C:
+			case <-deadline:
+				removeDrained(domain, addr)
+				return
+			}
+		}
+		removeDrained(domain, addr)
+	}()
+	return nil
+}
+
+// isDraining check an endpoint is still draining
+func isDraining(domain, addr string) bool {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	node, ok := registryMap[domain]
+	if ok == false {
+		return false
+	}
+	_, ok = findOriginItem(addr, node.Items)
+	return ok && node.options[addr].State.normalize() == StateDraining
+}
+
+// removeDrained delete an endpoint if it is still draining
+func removeDrained(domain, addr string) {
+	tx := beginTx()
+	defer tx.commit()
+
+	service, ok := registryMap[domain]
+	if ok == false {
+		return
+	}
+	for k, item := range service.Items {
+		if item.Endpoint != addr || service.options[addr].State.normalize() != StateDraining {
+			continue
+		}
+		before := service.endpointItem(item)
+		endpoints := make([]OriginItem, 0, len(service.Items)-1)
+		endpoints = append(endpoints, service.Items[:k]...)
+		endpoints = append(endpoints, service.Items[k+1:]...)
+		service.Items = endpoints
+		service.forget(addr)
+		tx.emitEndpoint(EndpointRemoved, domain, &before, nil)
+		return
+	}
+}
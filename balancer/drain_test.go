@@ -0,0 +1,171 @@
+package balancer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSetState(t *testing.T) {
+	registryMap = nil
+	if err := SetState("www.google.com", "192.168.1.100", StateDraining); err != ErrServiceNotFound {
+		t.Error("SetState func have an error #1")
+	}
+
+	domain := "www.google.com"
+	newTarget(RegistNode{
+		Domain: domain,
+		Items: []OriginItem{
+			{Endpoint: "192.168.1.100", Weight: 2},
+			{Endpoint: "192.168.1.101", Weight: 1},
+		},
+	})
+	if err := SetState(domain, "192.168.1.105", StateDraining); err != ErrEndpointNotFound {
+		t.Error("SetState func have an error #2")
+	}
+	if err := SetState(domain, "192.168.1.100", EndpointState("sleeping")); err != ErrStateInvalid {
+		t.Error("SetState func have an error #3")
+	}
+
+	events, cancel := Watch(10)
+	defer cancel()
+	if err := SetState(domain, "192.168.1.100", StateDraining); err != nil {
+		t.Fatal(err)
+	}
+	if items, _ := GetEndpoints(domain); items[0].State != StateDraining || !items[1].IsActive() {
+		t.Error("SetState func have an error #4")
+	}
+	e := receiveEvents(t, events, 1)[0]
+	if e.Type != StateChanged || !e.Before.IsActive() || e.After.State != StateDraining {
+		t.Error("SetState func have an error #5")
+	}
+
+	for _, balancer := range []Balancer{NewRandomLoad(domain), NewRoundRobinLoad(domain), NewWRoundRobinLoad(domain)} {
+		for i := 0; i < 10; i++ {
+			target, err := balancer.GetOne()
+			if err != nil || target.Addr != "192.168.1.101" {
+				t.Error("SetState func have an error #6")
+			}
+		}
+	}
+
+	SetState(domain, "192.168.1.101", StateDisabled)
+	if _, err := NewRoundRobinLoad(domain).GetOne(); err == nil {
+		t.Error("SetState func have an error #7")
+	}
+
+	if state, err := ParseState(""); err != nil || state != StateActive {
+		t.Error("ParseState func have an error #8")
+	}
+	if _, err := ParseState("sleeping"); err != ErrStateInvalid {
+		t.Error("ParseState func have an error #9")
+	}
+}
+
+func TestDrainWRoundRobin(t *testing.T) {
+	registryMap = nil
+	domain := "www.google.com"
+	var balancer = NewWRoundRobinLoad(domain)
+	newTarget(RegistNode{
+		Domain: domain,
+		Items: []OriginItem{
+			{Endpoint: "192.168.1.100", Weight: 10},
+			{Endpoint: "192.168.1.101", Weight: 10},
+		},
+	})
+
+	// start a round, then drain an endpoint in the middle of it
+	balancer.GetOne()
+	SetState(domain, "192.168.1.100", StateDraining)
+	for i := 0; i < 20; i++ {
+		target, err := balancer.GetOne()
+		if err != nil || target.Addr != "192.168.1.101" {
+			t.Error("drain WRoundRobin have an error #1")
+		}
+	}
+}
+
+func TestInFlight(t *testing.T) {
+	release1 := Acquire("www.google.com", "192.168.1.100")
+	release2 := Acquire("www.google.com", "192.168.1.100")
+	if InFlight("www.google.com", "192.168.1.100") != 2 || InFlight("www.google.com", "192.168.1.101") != 0 {
+		t.Error("InFlight func have an error #1")
+	}
+
+	release1()
+	release1()
+	if InFlight("www.google.com", "192.168.1.100") != 1 {
+		t.Error("InFlight func have an error #2")
+	}
+	release2()
+	if InFlight("www.google.com", "192.168.1.100") != 0 {
+		t.Error("InFlight func have an error #3")
+	}
+}
+
+func TestDrainAddr(t *testing.T) {
+	drainInterval = time.Millisecond
+	defer func() {
+		drainInterval = 100 * time.Millisecond
+	}()
+
+	registryMap = nil
+	domain := "www.google.com"
+	newTarget(RegistNode{
+		Domain: domain,
+		Items: []OriginItem{
+			{Endpoint: "192.168.1.100", Weight: 1},
+			{Endpoint: "192.168.1.101", Weight: 1},
+			{Endpoint: "192.168.1.102", Weight: 1},
+		},
+	})
+	if err := DrainAddr(domain, "192.168.1.105", true, 0); err != ErrEndpointNotFound {
+		t.Error("DrainAddr func have an error #1")
+	}
+
+	// removed once the request in flight is done
+	release := Acquire(domain, "192.168.1.100")
+	DrainAddr(domain, "192.168.1.100", true, 0)
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := findOriginItem("192.168.1.100", siteItems(domain)); !ok {
+		t.Error("DrainAddr func have an error #2")
+	}
+	release()
+	waitRemoved(domain, "192.168.1.100")
+	if _, ok := findOriginItem("192.168.1.100", siteItems(domain)); ok {
+		t.Error("DrainAddr func have an error #3")
+	}
+
+	// removed after timeout even if a request is still in flight
+	release = Acquire(domain, "192.168.1.101")
+	defer release()
+	DrainAddr(domain, "192.168.1.101", true, 10*time.Millisecond)
+	waitRemoved(domain, "192.168.1.101")
+	if _, ok := findOriginItem("192.168.1.101", siteItems(domain)); ok {
+		t.Error("DrainAddr func have an error #4")
+	}
+
+	// not removed if it is active again
+	release = Acquire(domain, "192.168.1.102")
+	DrainAddr(domain, "192.168.1.102", true, 0)
+	SetState(domain, "192.168.1.102", StateActive)
+	release()
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := findOriginItem("192.168.1.102", siteItems(domain)); !ok {
+		t.Error("DrainAddr func have an error #5")
+	}
+}
+
+func siteItems(domain string) []OriginItem {
+	lock.RLock()
+	defer lock.RUnlock()
+	return registryMap[domain].Items
+}
+
+func waitRemoved(domain, addr string) {
+	for i := 0; i < 100; i++ {
+		if _, ok := findOriginItem(addr, siteItems(domain)); !ok {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,41 @@
+package balancer
+
+import (
+	"sync"
+)
+
+// AvailabilityFilter check an endpoint can be picked, it returns false to skip the endpoint,
+// it is called with the registry read lock so it must not call funcs changing the registry
+type AvailabilityFilter func(domain string, item OriginItem) bool
+
+var (
+	filterLock sync.RWMutex
+	filters    []AvailabilityFilter
+)
+
+// AddAvailabilityFilter register a filter used by all balancers,
+// endpoints skipped by a filter are treated like unhealthy ones
+func AddAvailabilityFilter(filter AvailabilityFilter) {
+	filterLock.Lock()
+	defer filterLock.Unlock()
+	filters = append(filters, filter)
+}
+
+// getFilters get registered filters
+func getFilters() []AvailabilityFilter {
+	filterLock.RLock()
+	defer filterLock.RUnlock()
+	return filters
+}
+
+// GetEndpoints get a copy of all endpoints of a site with their options whatever their state is
+func GetEndpoints(domain string) ([]EndpointItem, error) {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	node, ok := registryMap[domain]
+	if ok == false {
+		return nil, ErrServiceNotFound
+	}
+	return node.endpointItems(), nil
+}
@@ -0,0 +1,180 @@
+package balancer
+
+import (
+	"errors"
+	"sort"
+)
+
+// ErrThresholdInvalid failover threshold is not in 0~1
+var ErrThresholdInvalid = errors.New("the failover threshold should be in 0~1")
+
+// SetPriority change the priority level of an endpoint, 0 is primary,
+// endpoints of a greater level are backups and get requests only when lower levels fail
+func SetPriority(domain, addr string, priority int) error {
+	tx := beginTx()
+	defer tx.commit()
+
+	service, ok := registryMap[domain]
+	if ok == false {
+		return ErrServiceNotFound
+	}
+	item, ok := findOriginItem(addr, service.Items)
+	if ok == false {
+		return ErrEndpointNotFound
+	}
+	before := service.endpointItem(item)
+	if before.Priority == priority {
+		return nil
+	}
+
+	after := before
+	after.Priority = priority
+	service.setOptions(addr, after.EndpointOptions)
+	tx.emitEndpoint(PriorityChanged, domain, &before, &after)
+	return nil
+}
+
+// SetHealthy mark an endpoint healthy or not, unhealthy endpoints get no new requests,
+// the health is runtime state, it is not saved in snapshots
+func SetHealthy(domain, addr string, healthy bool) error {
+	tx := beginTx()
+	defer tx.commit()
+
+	service, ok := registryMap[domain]
+	if ok == false {
+		return ErrServiceNotFound
+	}
+	item, ok := findOriginItem(addr, service.Items)
+	if ok == false {
+		return ErrEndpointNotFound
+	}
+	if service.unhealthy[addr] == !healthy {
+		return nil
+	}
+
+	if healthy {
+		delete(service.unhealthy, addr)
+	} else {
+		if service.unhealthy == nil {
+			service.unhealthy = map[string]bool{}
+		}
+		service.unhealthy[addr] = true
+	}
+	endpoint := service.endpointItem(item)
+	tx.emitHealth(domain, &endpoint, healthy)
+	return nil
+}
+
+// IsHealthy check an endpoint is not marked unhealthy
+func IsHealthy(domain, addr string) bool {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	service, ok := registryMap[domain]
+	return !ok || !service.unhealthy[addr]
+}
+
+// SetFailoverThreshold set when a site fails over to the next priority level,
+// a level is used while the ratio of its available endpoints is not less than threshold,
+// 0 means a level is used while any of its endpoints is available
+func SetFailoverThreshold(domain string, threshold float64) error {
+	if !(threshold >= 0 && threshold <= 1) {
+		return ErrThresholdInvalid
+	}
+
+	tx := beginTx()
+	defer tx.commit()
+
+	service, ok := registryMap[domain]
+	if ok == false {
+		return ErrServiceNotFound
+	}
+	if service.failoverThreshold == threshold {
+		return nil
+	}
+	service.failoverThreshold = threshold
+	tx.emitSiteChanged(service)
+	return nil
+}
+
+// GetFailoverThreshold get failover threshold of a site
+func GetFailoverThreshold(domain string) (float64, error) {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	service, ok := registryMap[domain]
+	if ok == false {
+		return 0, ErrServiceNotFound
+	}
+	return service.failoverThreshold, nil
+}
+
+// available check an endpoint can be picked, it should be called with the registry lock
+func (node *RegistNode) available(item OriginItem, filters []AvailabilityFilter) bool {
+	if !node.options[item.Endpoint].IsActive() || node.unhealthy[item.Endpoint] || node.atCapacity(item) {
+		return false
+	}
+	for _, filter := range filters {
+		if !filter(node.Domain, item) {
+			return false
+		}
+	}
+	return true
+}
+
+// availableItems get endpoints of the priority level in use,
+// it returns items directly when all of them are available primaries
+func (node *RegistNode) availableItems(items []OriginItem) []OriginItem {
+	filters := getFilters()
+	simple := true
+	for _, item := range items {
+		if node.options[item.Endpoint].Priority != 0 || !node.available(item, filters) {
+			simple = false
+			break
+		}
+	}
+	if simple {
+		return items
+	}
+
+	levels := []int{}
+	total := map[int]int{}
+	available := map[int][]OriginItem{}
+	for _, item := range items {
+		priority := node.options[item.Endpoint].Priority
+		if _, ok := total[priority]; !ok {
+			levels = append(levels, priority)
+		}
+		total[priority]++
+		if node.available(item, filters) {
+			available[priority] = append(available[priority], item)
+		}
+	}
+	sort.Ints(levels)
+
+	// the first level healthy enough, or the first level having anything available
+	var fallback []OriginItem
+	for _, level := range levels {
+		count := len(available[level])
+		if count == 0 {
+			continue
+		}
+		if float64(count) >= node.failoverThreshold*float64(total[level]) {
+			return available[level]
+		}
+		if fallback == nil {
+			fallback = available[level]
+		}
+	}
+	if fallback == nil {
+		return []OriginItem{}
+	}
+	return fallback
+}
+
+// forget remove runtime state of a deleted endpoint, it should be called with the registry write lock
+func (node *RegistNode) forget(addr string) {
+	delete(node.options, addr)
+	delete(node.ramps, addr)
+	delete(node.unhealthy, addr)
+}
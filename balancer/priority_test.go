@@ -0,0 +1,156 @@
+package balancer
+
+import (
+	"testing"
+)
+
+func TestPriorityFailover(t *testing.T) {
+	registryMap = nil
+	domain := "www.google.com"
+	newTarget(RegistNode{
+		Domain: domain,
+		Items: []OriginItem{
+			{Endpoint: "192.168.1.100", Weight: 1},
+			{Endpoint: "192.168.1.101", Weight: 1},
+			{Endpoint: "192.168.1.200", Weight: 1},
+			{Endpoint: "192.168.1.250", Weight: 1},
+		},
+	})
+	SetPriority(domain, "192.168.1.200", 1)
+	SetPriority(domain, "192.168.1.250", 2)
+	balancers := []Balancer{NewRandomLoad(domain), NewRoundRobinLoad(domain), NewWRoundRobinLoad(domain)}
+	picked := func() map[string]int {
+		addrs := map[string]int{}
+		for _, balancer := range balancers {
+			for i := 0; i < 10; i++ {
+				target, err := balancer.GetOne()
+				if err != nil {
+					addrs[err.Error()]++
+					continue
+				}
+				addrs[target.Addr]++
+			}
+		}
+		return addrs
+	}
+
+	addrs := picked()
+	if len(addrs) != 2 || addrs["192.168.1.100"] == 0 || addrs["192.168.1.101"] == 0 {
+		t.Error("priority failover have an error #1", addrs)
+	}
+
+	// backup only when all primaries are unhealthy or drained
+	SetHealthy(domain, "192.168.1.100", false)
+	addrs = picked()
+	if len(addrs) != 1 || addrs["192.168.1.101"] != 30 {
+		t.Error("priority failover have an error #2", addrs)
+	}
+	SetState(domain, "192.168.1.101", StateDraining)
+	addrs = picked()
+	if len(addrs) != 1 || addrs["192.168.1.200"] != 30 {
+		t.Error("priority failover have an error #3", addrs)
+	}
+	SetHealthy(domain, "192.168.1.200", false)
+	addrs = picked()
+	if len(addrs) != 1 || addrs["192.168.1.250"] != 30 {
+		t.Error("priority failover have an error #4", addrs)
+	}
+	SetHealthy(domain, "192.168.1.250", false)
+	if _, err := balancers[1].GetOne(); err == nil {
+		t.Error("priority failover have an error #5")
+	}
+
+	// fail over when the available ratio of primaries is less than threshold
+	SetHealthy(domain, "192.168.1.200", true)
+	SetState(domain, "192.168.1.101", StateActive)
+	addrs = picked()
+	if len(addrs) != 1 || addrs["192.168.1.101"] != 30 {
+		t.Error("priority failover have an error #6", addrs)
+	}
+	if err := SetFailoverThreshold(domain, 0.6); err != nil {
+		t.Fatal(err)
+	}
+	addrs = picked()
+	if len(addrs) != 1 || addrs["192.168.1.200"] != 30 {
+		t.Error("priority failover have an error #7", addrs)
+	}
+
+	// use the first level having anything available if no level is healthy enough
+	SetHealthy(domain, "192.168.1.200", false)
+	addrs = picked()
+	if len(addrs) != 1 || addrs["192.168.1.101"] != 30 {
+		t.Error("priority failover have an error #8", addrs)
+	}
+
+	SetHealthy(domain, "192.168.1.100", true)
+	addrs = picked()
+	if len(addrs) != 2 || addrs["192.168.1.100"] == 0 || addrs["192.168.1.101"] == 0 {
+		t.Error("priority failover have an error #9", addrs)
+	}
+}
+
+func TestSetPriority(t *testing.T) {
+	registryMap = nil
+	if err := SetPriority("www.google.com", "192.168.1.100", 1); err != ErrServiceNotFound {
+		t.Error("SetPriority func have an error #1")
+	}
+	if err := SetHealthy("www.google.com", "192.168.1.100", false); err != ErrServiceNotFound {
+		t.Error("SetHealthy func have an error #2")
+	}
+
+	domain := "www.google.com"
+	var balancer = NewRoundRobinLoad(domain)
+	newTarget(RegistNode{
+		Domain: domain,
+		Items: []OriginItem{
+			{Endpoint: "192.168.1.100", Weight: 1},
+			{Endpoint: "192.168.1.101", Weight: 1},
+		},
+	})
+	if err := SetPriority(domain, "192.168.1.105", 1); err != ErrEndpointNotFound {
+		t.Error("SetPriority func have an error #3")
+	}
+	if err := SetHealthy(domain, "192.168.1.105", false); err != ErrEndpointNotFound {
+		t.Error("SetHealthy func have an error #4")
+	}
+
+	events, cancel := Watch(10)
+	defer cancel()
+	SetPriority(domain, "192.168.1.101", 1)
+	SetHealthy(domain, "192.168.1.100", false)
+	SetHealthy(domain, "192.168.1.100", false)
+	list := receiveEvents(t, events, 2)
+	if list[0].Type != PriorityChanged || list[0].After.Priority != 1 {
+		t.Error("SetPriority func have an error #5")
+	}
+	if list[1].Type != HealthChanged || list[1].Healthy == nil || *list[1].Healthy {
+		t.Error("SetHealthy func have an error #6")
+	}
+	if IsHealthy(domain, "192.168.1.100") || !IsHealthy(domain, "192.168.1.101") {
+		t.Error("IsHealthy func have an error #7")
+	}
+	if target, _ := balancer.GetOne(); target.Addr != "192.168.1.101" {
+		t.Error("SetPriority func have an error #8")
+	}
+
+	// health is kept by Restore and forgot when the endpoint is deleted
+	if err := Restore(Snapshot()); err != nil {
+		t.Fatal(err)
+	}
+	if IsHealthy(domain, "192.168.1.100") {
+		t.Error("SetHealthy func have an error #9")
+	}
+	balancer.DelAddr("192.168.1.100")
+	balancer.AddAddr("192.168.1.100", 1)
+	if !IsHealthy(domain, "192.168.1.100") {
+		t.Error("SetHealthy func have an error #10")
+	}
+
+	if err := SetFailoverThreshold(domain, 1.5); err != ErrThresholdInvalid {
+		t.Error("SetFailoverThreshold func have an error #11")
+	}
+	SetFailoverThreshold(domain, 0.5)
+	if threshold, _ := GetFailoverThreshold(domain); threshold != 0.5 {
+		t.Error("GetFailoverThreshold func have an error #12")
+	}
+}
@@ -19,16 +19,16 @@ func NewRandomLoad(domain string) Balancer {
 
 // GetOne get an target by random
 func (r *RandomLoad) GetOne() (*ProxyTarget, error) {
-	targetSrv, err := getTarget(r.domain)
+	items, err := getItems(r.domain)
 	if err != nil {
 		return nil, err
 	}
-	if len(targetSrv.Items) == 0 {
+	if len(items) == 0 {
 		return nil, errors.New("not found endpoints")
 	}
-	randCode := rand.Intn(len(targetSrv.Items))
+	randCode := rand.Intn(len(items))
 
-	return &ProxyTarget{targetSrv.Domain, targetSrv.Items[randCode].Endpoint}, nil
+	return &ProxyTarget{r.domain, items[randCode].Endpoint}, nil
 }
 
 // AddAddr add an endpoint
@@ -44,3 +44,8 @@ func (r *RandomLoad) AddAddr(addr string, weight uint32) error {
 func (r *RandomLoad) DelAddr(addr string) error {
 	return delEndpoint(r.domain, addr)
 }
+
+// SetAddrs replace all endpoints at once
+func (r *RandomLoad) SetAddrs(items []EndpointItem) (*EndpointDiff, error) {
+	return setEndpoints(r.domain, items)
+}
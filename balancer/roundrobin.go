@@ -2,6 +2,7 @@ package balancer
 
 import (
 	"errors"
+	"sync"
 )
 
 // RoundRobinLoad this is a round robin balancer
@@ -9,25 +10,31 @@ import (
 type RoundRobinLoad struct {
 	domain      string
 	activeIndex int
+	mu          sync.Mutex
 }
 
 // NewRoundRobinLoad get a RoundRobin point
 func NewRoundRobinLoad(domain string) Balancer {
-	return &RoundRobinLoad{domain, 0}
+	return &RoundRobinLoad{domain: domain}
 }
 
 // GetOne get an target by round robin
 func (r *RoundRobinLoad) GetOne() (*ProxyTarget, error) {
-	targetSrv, err := getTarget(r.domain)
+	items, err := getItems(r.domain)
 	if err != nil {
 		return nil, err
 	}
-	if len(targetSrv.Items) == 0 {
+	if len(items) == 0 {
 		return nil, errors.New("not found endpoints")
 	}
 
-	target := &ProxyTarget{targetSrv.Domain, targetSrv.Items[r.activeIndex].Endpoint}
-	r.activeIndex = (r.activeIndex + 1) % len(targetSrv.Items)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.activeIndex >= len(items) {
+		r.activeIndex = 0
+	}
+	target := &ProxyTarget{r.domain, items[r.activeIndex].Endpoint}
+	r.activeIndex = (r.activeIndex + 1) % len(items)
 
 	return target, nil
 }
@@ -45,3 +52,8 @@ func (r *RoundRobinLoad) AddAddr(addr string, weight uint32) error {
 func (r *RoundRobinLoad) DelAddr(addr string) error {
 	return delEndpoint(r.domain, addr)
 }
+
+// SetAddrs replace all endpoints at once
+func (r *RoundRobinLoad) SetAddrs(items []EndpointItem) (*EndpointDiff, error) {
+	return setEndpoints(r.domain, items)
+}
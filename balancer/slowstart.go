@@ -0,0 +1,136 @@
+package balancer
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"time"
+)
+
+// ErrSlowStartInvalid slow start config is invalid
+var ErrSlowStartInvalid = errors.New("the slow start config is invalid")
+
+// SlowStart slow start config of a site, the effective weight of a new endpoint
+// grows from MinWeight to its weight during Window, a zero Window disables it
+type SlowStart struct {
+	Window     time.Duration
+	Aggression float64 // curve of the growth, 1 or 0 is linear, >1 grows faster at the beginning
+	MinWeight  uint32  // weight at the beginning, 0 means 1
+}
+
+// slowStartJSON json struct of SlowStart, window is a duration like 30s
+type slowStartJSON struct {
+	Window     string  `json:"window"`
+	Aggression float64 `json:"aggression,omitempty"`
+	MinWeight  uint32  `json:"min_weight,omitempty"`
+}
+
+// MarshalJSON encode window as a duration string
+func (s SlowStart) MarshalJSON() ([]byte, error) {
+	return json.Marshal(slowStartJSON{
+		Window:     s.Window.String(),
+		Aggression: s.Aggression,
+		MinWeight:  s.MinWeight,
+	})
+}
+
+// UnmarshalJSON decode window from a duration string
+func (s *SlowStart) UnmarshalJSON(data []byte) error {
+	v := slowStartJSON{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	var window time.Duration
+	if v.Window != "" {
+		var err error
+		if window, err = time.ParseDuration(v.Window); err != nil {
+			return err
+		}
+	}
+	*s = SlowStart{Window: window, Aggression: v.Aggression, MinWeight: v.MinWeight}
+	return nil
+}
+
+// Enabled check slow start is on
+func (s SlowStart) Enabled() bool {
+	return s.Window > 0
+}
+
+// valid check the config can be used
+func (s SlowStart) valid() bool {
+	return s.Window >= 0 && s.Aggression >= 0 && !math.IsNaN(s.Aggression) && !math.IsInf(s.Aggression, 0)
+}
+
+// curve get the weight curve, weight ratio is elapsed ratio ^ (1 / aggression)
+func (s SlowStart) curve() func(float64) float64 {
+	if s.Aggression == 0 || s.Aggression == 1 {
+		return linearCurve
+	}
+	exponent := 1 / s.Aggression
+	return func(x float64) float64 {
+		if x <= 0 {
+			return 0
+		}
+		return math.Pow(x, exponent)
+	}
+}
+
+// SetSlowStart set slow start config of a site, it applies to endpoints added
+// or activated after it, endpoints already slow starting keep their ramp
+func SetSlowStart(domain string, slowStart SlowStart) error {
+	if !slowStart.valid() {
+		return ErrSlowStartInvalid
+	}
+
+	tx := beginTx()
+	defer tx.commit()
+
+	service, ok := registryMap[domain]
+	if ok == false {
+		return ErrServiceNotFound
+	}
+	if service.slowStart == slowStart {
+		return nil
+	}
+	service.slowStart = slowStart
+	tx.emitSiteChanged(service)
+	return nil
+}
+
+// GetSlowStart get slow start config of a site
+func GetSlowStart(domain string) (SlowStart, error) {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	service, ok := registryMap[domain]
+	if ok == false {
+		return SlowStart{}, ErrServiceNotFound
+	}
+	return service.slowStart, nil
+}
+
+// startSlowly ramp the weight of a new endpoint if slow start is on,
+// it should be called with the registry write lock
+func (node *RegistNode) startSlowly(item OriginItem, now time.Time) {
+	if !node.slowStart.Enabled() || !node.options[item.Endpoint].IsActive() {
+		return
+	}
+	from := node.slowStart.MinWeight
+	if from == 0 {
+		from = 1
+	}
+	if from >= item.Weight {
+		return
+	}
+
+	if node.ramps == nil {
+		node.ramps = map[string]*weightRamp{}
+	}
+	node.ramps[item.Endpoint] = &weightRamp{
+		from:     from,
+		to:       item.Weight,
+		start:    now,
+		duration: node.slowStart.Window,
+		curve:    node.slowStart.curve(),
+	}
+}
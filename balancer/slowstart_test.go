@@ -0,0 +1,155 @@
+package balancer
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestSetSlowStart(t *testing.T) {
+	registryMap = nil
+	if err := SetSlowStart("www.google.com", SlowStart{Window: time.Minute}); err != ErrServiceNotFound {
+		t.Error("SetSlowStart func have an error #1")
+	}
+
+	domain := "www.google.com"
+	newTarget(RegistNode{
+		Domain: domain,
+		Items:  []OriginItem{},
+	})
+	if err := SetSlowStart(domain, SlowStart{Window: -time.Minute}); err != ErrSlowStartInvalid {
+		t.Error("SetSlowStart func have an error #2")
+	}
+
+	events, cancel := Watch(10)
+	defer cancel()
+	if err := SetSlowStart(domain, SlowStart{Window: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	SetSlowStart(domain, SlowStart{Window: time.Minute})
+	e := receiveEvents(t, events, 1)[0]
+	if e.Type != SiteChanged || e.Site.SlowStart == nil || e.Site.SlowStart.Window != time.Minute {
+		t.Error("SetSlowStart func have an error #3")
+	}
+	if slowStart, err := GetSlowStart(domain); err != nil || slowStart.Window != time.Minute {
+		t.Error("GetSlowStart func have an error #4")
+	}
+}
+
+func TestSlowStartWeight(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() {
+		timeNow = time.Now
+	}()
+
+	registryMap = nil
+	domain := "www.google.com"
+	var balancer = NewWRoundRobinLoad(domain)
+	newTarget(RegistNode{
+		Domain: domain,
+		Items: []OriginItem{
+			{Endpoint: "192.168.1.100", Weight: 10},
+		},
+	})
+	SetSlowStart(domain, SlowStart{Window: 10 * time.Second})
+
+	balancer.AddAddr("192.168.1.101", 11)
+	items, _ := getItems(domain)
+	if items[0].Weight != 10 || items[1].Weight != 1 || registryMap[domain].Items[1].Weight != 11 {
+		t.Error("slow start have an error #1")
+	}
+
+	v1 := 0
+	for i := 0; i < 11; i++ {
+		target, _ := balancer.GetOne()
+		if target.Addr == "192.168.1.101" {
+			v1++
+		}
+	}
+	if v1 != 1 {
+		t.Error("slow start have an error #2", v1)
+	}
+
+	now = now.Add(5 * time.Second)
+	items, _ = getItems(domain)
+	if items[1].Weight != 6 {
+		t.Error("slow start have an error #3", items[1].Weight)
+	}
+	now = now.Add(5 * time.Second)
+	items, _ = getItems(domain)
+	if items[1].Weight != 11 {
+		t.Error("slow start have an error #4", items[1].Weight)
+	}
+
+	// SetAddrs added endpoints and endpoints activated again start slowly too
+	SetState(domain, "192.168.1.100", StateDisabled)
+	balancer.SetAddrs([]EndpointItem{
+		{OriginItem: OriginItem{Endpoint: "192.168.1.100", Weight: 10}},
+		{OriginItem: OriginItem{Endpoint: "192.168.1.102", Weight: 10}},
+	})
+	items, _ = getItems(domain)
+	if items[0].Weight != 1 || items[1].Weight != 1 {
+		t.Error("slow start have an error #5")
+	}
+
+	// a new weight given wins over slow start
+	balancer.SetAddrs([]EndpointItem{
+		{OriginItem: OriginItem{Endpoint: "192.168.1.100", Weight: 10}},
+		{OriginItem: OriginItem{Endpoint: "192.168.1.102", Weight: 20}},
+	})
+	items, _ = getItems(domain)
+	if items[0].Weight != 1 || items[1].Weight != 20 {
+		t.Error("slow start have an error #6")
+	}
+
+	SetSlowStart(domain, SlowStart{})
+	balancer.AddAddr("192.168.1.103", 10)
+	items, _ = getItems(domain)
+	if items[2].Weight != 10 {
+		t.Error("slow start have an error #7")
+	}
+}
+
+func TestSlowStartCurve(t *testing.T) {
+	linear := SlowStart{Window: time.Second}.curve()
+	if linear(0.25) != 0.25 {
+		t.Error("slow start curve have an error #1")
+	}
+	aggressive := SlowStart{Window: time.Second, Aggression: 2}.curve()
+	if aggressive(0.25) != 0.5 || aggressive(0) != 0 || aggressive(1) != 1 {
+		t.Error("slow start curve have an error #2")
+	}
+	if (SlowStart{Aggression: -1}).valid() {
+		t.Error("slow start curve have an error #3")
+	}
+}
+
+func TestSlowStartJSON(t *testing.T) {
+	data, _ := json.Marshal(SlowStart{Window: 30 * time.Second, Aggression: 1.5})
+	if string(data) != `{"window":"30s","aggression":1.5}` {
+		t.Error("slow start json have an error #1", string(data))
+	}
+
+	slowStart := SlowStart{}
+	if err := json.Unmarshal([]byte(`{"window":"1m","min_weight":2}`), &slowStart); err != nil ||
+		slowStart.Window != time.Minute || slowStart.MinWeight != 2 {
+		t.Error("slow start json have an error #2")
+	}
+	if err := json.Unmarshal([]byte(`{"window":"1x"}`), &slowStart); err == nil {
+		t.Error("slow start json have an error #3")
+	}
+
+	registryMap = nil
+	domain := "www.google.com"
+	newTarget(RegistNode{Domain: domain, Items: []OriginItem{}})
+	SetSlowStart(domain, SlowStart{Window: time.Minute})
+	sites := Snapshot()
+	Restore(nil)
+	if err := Restore(sites); err != nil {
+		t.Fatal(err)
+	}
+	if slowStart, _ = GetSlowStart(domain); slowStart.Window != time.Minute {
+		t.Error("slow start json have an error #4")
+	}
+}
@@ -0,0 +1,241 @@
+package balancer
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ErrSiteInvalid snapshot site can not be restored
+var ErrSiteInvalid = errors.New("the snapshot site is invalid")
+
+// SiteSnapshot a copy of a registered site
+type SiteSnapshot struct {
+	Domain   string         `json:"domain"`
+	Scheme   string         `json:"scheme"`
+	LoadType string         `json:"load_type"`
+	Items    []EndpointItem `json:"items"`
+
+	SlowStart         *SlowStart `json:"slow_start,omitempty"`
+	FailoverThreshold float64    `json:"failover_threshold,omitempty"`
+}
+
+// changeHooks funcs called when registry changed
+var (
+	hookLock    sync.RWMutex
+	changeHooks []func(domain string)
+)
+
+// OnChange register a func called after a site or its endpoints changed,
+// unlike Subscribe it is called synchronously by the func making the change,
+// once for every changed domain, without holding the registry lock
+func OnChange(fn func(domain string)) {
+	hookLock.Lock()
+	defer hookLock.Unlock()
+	changeHooks = append(changeHooks, fn)
+}
+
+// notifyChange call change hooks for domains of the events
+func notifyChange(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	hookLock.RLock()
+	hooks := changeHooks
+	hookLock.RUnlock()
+
+	notified := map[string]bool{}
+	for _, e := range events {
+		if notified[e.Domain] {
+			continue
+		}
+		notified[e.Domain] = true
+		for _, fn := range hooks {
+			fn(e.Domain)
+		}
+	}
+}
+
+// siteSnapshot copy a site, it should be called with the registry lock
+func siteSnapshot(node *RegistNode) *SiteSnapshot {
+	site := &SiteSnapshot{
+		Domain:   node.Domain,
+		Scheme:   node.Scheme,
+		LoadType: node.LoadType,
+		Items:    node.endpointItems(),
+
+		FailoverThreshold: node.failoverThreshold,
+	}
+	if node.slowStart.Enabled() {
+		slowStart := node.slowStart
+		site.SlowStart = &slowStart
+	}
+	return site
+}
+
+// Snapshot copy all registered sites order by domain
+func Snapshot() []SiteSnapshot {
+	lock.RLock()
+	sites := make([]SiteSnapshot, 0, len(registryMap))
+	for _, node := range registryMap {
+		sites = append(sites, *siteSnapshot(node))
+	}
+	lock.RUnlock()
+
+	sort.Slice(sites, func(i, j int) bool {
+		return sites[i].Domain < sites[j].Domain
+	})
+	return sites
+}
+
+// Restore replace all registered sites by snapshot,
+// nothing is changed if a site is invalid
+func Restore(sites []SiteSnapshot) error {
+	nodes := map[string]*RegistNode{}
+	for _, site := range sites {
+		if site.Domain == "" || nodes[site.Domain] != nil {
+			return ErrSiteInvalid
+		}
+		items, options, err := splitEndpointItems(site.Items)
+		if err != nil {
+			return err
+		}
+		scheme := site.Scheme
+		if scheme == "" {
+			scheme = "http"
+		}
+		slowStart := SlowStart{}
+		if site.SlowStart != nil {
+			if !site.SlowStart.valid() {
+				return ErrSlowStartInvalid
+			}
+			slowStart = *site.SlowStart
+		}
+		if !(site.FailoverThreshold >= 0 && site.FailoverThreshold <= 1) {
+			return ErrThresholdInvalid
+		}
+
+		nodes[site.Domain] = &RegistNode{
+			Domain:   site.Domain,
+			Items:    items,
+			Balancer: getBalancerByLoadType(site.Domain, site.LoadType),
+			Scheme:   scheme,
+			LoadType: getLoadTypeName(site.LoadType),
+
+			options:           options,
+			slowStart:         slowStart,
+			failoverThreshold: site.FailoverThreshold,
+		}
+	}
+
+	tx := beginTx()
+	defer tx.commit()
+
+	domains := []string{}
+	for domain := range registryMap {
+		domains = append(domains, domain)
+	}
+	for domain := range nodes {
+		if registryMap[domain] == nil {
+			domains = append(domains, domain)
+		}
+	}
+	sort.Strings(domains)
+	for _, domain := range domains {
+		tx.emitDiff(registryMap[domain], nodes[domain])
+		// health is runtime state, keep it for endpoints still existed
+		if before, after := registryMap[domain], nodes[domain]; before != nil && after != nil {
+			for addr := range before.unhealthy {
+				if stringInOriginItem(addr, after.Items) {
+					if after.unhealthy == nil {
+						after.unhealthy = map[string]bool{}
+					}
+					after.unhealthy[addr] = true
+				}
+			}
+		}
+	}
+	registryMap = nodes
+
+	return nil
+}
+
+// emitDiff add events changing site before to site after, nil means the site is not existed
+func (tx *registryTx) emitDiff(before, after *RegistNode) {
+	switch {
+	case before == nil:
+		tx.emitSiteAdded(after)
+		return
+	case after == nil:
+		tx.emitSiteRemoved(before)
+		return
+	}
+
+	if before.LoadType != after.LoadType {
+		tx.emitLoadType(after.Domain, before.LoadType, after.LoadType)
+	}
+	if before.slowStart != after.slowStart || before.failoverThreshold != after.failoverThreshold {
+		tx.emitSiteChanged(after)
+	}
+	beforeItems := before.endpointItems()
+	tx.emitItemsDiff(after.Domain, beforeItems, diffItems(beforeItems, after.endpointItems()))
+}
+
+// diffItems get endpoints changed from items before to items after,
+// Changed contains endpoints whose weight, state, priority or max conns changed
+func diffItems(before, after []EndpointItem) *EndpointDiff {
+	diff := &EndpointDiff{
+		Added:   []EndpointItem{},
+		Removed: []EndpointItem{},
+		Changed: []EndpointItem{},
+	}
+	for _, item := range before {
+		if _, ok := findEndpointItem(item.Endpoint, after); !ok {
+			diff.Removed = append(diff.Removed, item)
+		}
+	}
+	for _, item := range after {
+		old, ok := findEndpointItem(item.Endpoint, before)
+		if !ok {
+			diff.Added = append(diff.Added, item)
+		} else if old != item {
+			diff.Changed = append(diff.Changed, item)
+		}
+	}
+	return diff
+}
+
+// emitItemsDiff add endpoint events of a diff, before is the items diff computed from
+func (tx *registryTx) emitItemsDiff(domain string, before []EndpointItem, diff *EndpointDiff) {
+	for k := range diff.Removed {
+		tx.emitEndpoint(EndpointRemoved, domain, &diff.Removed[k], nil)
+	}
+	for k, item := range diff.Changed {
+		old, _ := findEndpointItem(item.Endpoint, before)
+		tx.emitItemChanged(domain, &old, &diff.Changed[k])
+	}
+	for k := range diff.Added {
+		tx.emitEndpoint(EndpointAdded, domain, nil, &diff.Added[k])
+	}
+}
+
+// findOriginItem find an endpoint by addr
+func findOriginItem(addr string, items []OriginItem) (OriginItem, bool) {
+	for _, item := range items {
+		if item.Endpoint == addr {
+			return item, true
+		}
+	}
+	return OriginItem{}, false
+}
+
+// findEndpointItem find an endpoint with options by addr
+func findEndpointItem(addr string, items []EndpointItem) (EndpointItem, bool) {
+	for _, item := range items {
+		if item.Endpoint == addr {
+			return item, true
+		}
+	}
+	return EndpointItem{}, false
+}
@@ -0,0 +1,117 @@
+package balancer
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	registryMap = nil
+	RegistTargetNoAddr("www.google.com", "wroundrobin", "https")
+	RegistTargetNoAddr("www.facebook.com", "xxx", "http")
+	addEndpoint("www.google.com", []OriginItem{{Endpoint: "192.168.1.101:80", Weight: 10}, {Endpoint: "192.168.1.102:80", Weight: 20}}...)
+
+	sites := Snapshot()
+	if len(sites) != 2 || sites[0].Domain != "www.facebook.com" || sites[1].Domain != "www.google.com" {
+		t.Fatal("Snapshot func have an error #1")
+	}
+	if sites[0].LoadType != "random" || sites[1].LoadType != "wroundrobin" || sites[1].Scheme != "https" {
+		t.Error("Snapshot func have an error #2")
+	}
+
+	sites[1].Items[0].Weight = 100
+	if registryMap["www.google.com"].Items[0].Weight != 10 {
+		t.Error("Snapshot func have an error #3")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	registryMap = nil
+	RegistTargetNoAddr("www.facebook.com", "random", "http")
+
+	err := Restore([]SiteSnapshot{
+		{Domain: "www.google.com", LoadType: "wroundrobin", Items: []EndpointItem{{OriginItem: OriginItem{Endpoint: "192.168.1.101:80", Weight: 10}}}},
+		{Domain: "www.google.cn", LoadType: "roundrobin", Scheme: "https"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(registryMap) != 2 || registryMap["www.facebook.com"] != nil {
+		t.Error("Restore func have an error #1")
+	}
+	if _, ok := registryMap["www.google.com"].Balancer.(*WRoundRobinLoad); !ok {
+		t.Error("Restore func have an error #2")
+	}
+	if registryMap["www.google.com"].Scheme != "http" || registryMap["www.google.cn"].Scheme != "https" {
+		t.Error("Restore func have an error #3")
+	}
+	target, err := registryMap["www.google.com"].Balancer.GetOne()
+	if err != nil || target.Addr != "192.168.1.101:80" {
+		t.Error("Restore func have an error #4")
+	}
+
+	err = Restore([]SiteSnapshot{{Domain: "www.google.com"}, {Domain: "www.google.com"}})
+	if err != ErrSiteInvalid || len(registryMap) != 2 {
+		t.Error("Restore func have an error #5")
+	}
+	err = Restore([]SiteSnapshot{{Domain: "www.google.com", Items: []EndpointItem{{OriginItem: OriginItem{Endpoint: "192.168.1.101:80", Weight: 10}}, {OriginItem: OriginItem{Endpoint: "192.168.1.101:80", Weight: 10}}}}})
+	if err != ErrEndpointExisted {
+		t.Error("Restore func have an error #6")
+	}
+}
+
+func TestSnapshotOptions(t *testing.T) {
+	registryMap = nil
+	RegistTargetNoAddr("www.google.com", "random", "http")
+	addEndpoint("www.google.com", OriginItem{"192.168.1.101:80", 10}, OriginItem{"192.168.1.102:80", 10})
+	SetState("www.google.com", "192.168.1.101:80", StateDraining)
+	SetPriority("www.google.com", "192.168.1.102:80", 1)
+	SetMaxConns("www.google.com", "192.168.1.102:80", 5)
+
+	data, _ := json.Marshal(Snapshot())
+	sites := []SiteSnapshot{}
+	json.Unmarshal(data, &sites)
+	expect := `{"endpoint":"192.168.1.102:80","weight":10,"priority":1,"max_conns":5}`
+	if item, _ := json.Marshal(sites[0].Items[1]); string(item) != expect {
+		t.Error("Snapshot options have an error #1", string(item))
+	}
+
+	registryMap = nil
+	if err := Restore(sites); err != nil {
+		t.Fatal(err)
+	}
+	items, _ := GetEndpoints("www.google.com")
+	if items[0].State != StateDraining || items[1].Priority != 1 || items[1].MaxConns != 5 {
+		t.Error("Snapshot options have an error #2")
+	}
+	delEndpoint("www.google.com", "192.168.1.102:80")
+	addEndpoint("www.google.com", OriginItem{"192.168.1.102:80", 10})
+	if items, _ = GetEndpoints("www.google.com"); items[1].EndpointOptions != (EndpointOptions{}) {
+		t.Error("Snapshot options have an error #3")
+	}
+}
+
+func TestOnChange(t *testing.T) {
+	registryMap = nil
+	changes := []string{}
+	OnChange(func(domain string) {
+		changes = append(changes, domain)
+	})
+	defer func() {
+		changeHooks = nil
+	}()
+
+	RegistTargetNoAddr("www.google.com", "random", "http")
+	RegistTargetNoAddr("www.google.com", "random", "http")
+	addEndpoint("www.google.com", OriginItem{Endpoint: "192.168.1.101:80", Weight: 10})
+	addEndpoint("www.google.com", OriginItem{Endpoint: "192.168.1.101:80", Weight: 10})
+	delEndpoint("www.google.com", "192.168.1.105:80")
+	delEndpoint("www.google.com", "192.168.1.101:80")
+	ChangeLoadType("www.google.com", "roundrobin")
+	FlushProxy("www.google.com")
+	FlushProxy("www.google.com")
+
+	if len(changes) != 5 {
+		t.Error("OnChange func have an error #1", changes)
+	}
+}
@@ -0,0 +1,310 @@
+package balancer
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType registry change event type
+type EventType int
+
+// Registry change event types.
+const (
+	SiteAdded EventType = iota + 1
+	SiteRemoved
+	EndpointAdded
+	EndpointRemoved
+	WeightChanged
+	LoadTypeChanged
+	StateChanged
+	SiteChanged
+	PriorityChanged
+	HealthChanged
+	MaxConnsChanged
+	EventsDropped
+)
+
+var eventTypeNames = map[EventType]string{
+	SiteAdded:       "SiteAdded",
+	SiteRemoved:     "SiteRemoved",
+	EndpointAdded:   "EndpointAdded",
+	EndpointRemoved: "EndpointRemoved",
+	WeightChanged:   "WeightChanged",
+	LoadTypeChanged: "LoadTypeChanged",
+	StateChanged:    "StateChanged",
+	SiteChanged:     "SiteChanged",
+	PriorityChanged: "PriorityChanged",
+	HealthChanged:   "HealthChanged",
+	MaxConnsChanged: "MaxConnsChanged",
+	EventsDropped:   "EventsDropped",
+}
+
+// String get event type name
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+// MarshalText event type is encoded by name in json
+func (t EventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// Event a registry change event,
+// Before and After are the endpoint around the change, nil when it is not existed,
+// Site is the site added, removed or changed, OldLoadType and NewLoadType are for LoadTypeChanged,
+// Healthy is for HealthChanged, Dropped is the number of events lost for EventsDropped
+type Event struct {
+	Seq         uint64        `json:"seq"`
+	Type        EventType     `json:"type"`
+	Domain      string        `json:"domain"`
+	Endpoint    string        `json:"endpoint,omitempty"`
+	Before      *EndpointItem `json:"before,omitempty"`
+	After       *EndpointItem `json:"after,omitempty"`
+	Site        *SiteSnapshot `json:"site,omitempty"`
+	OldLoadType string        `json:"old_load_type,omitempty"`
+	NewLoadType string        `json:"new_load_type,omitempty"`
+	Healthy     *bool         `json:"healthy,omitempty"`
+	Dropped     int           `json:"dropped,omitempty"`
+	Time        time.Time     `json:"time"`
+}
+
+// subscriber deliver events to a callback in its own goroutine,
+// so a slow subscriber never blocks the registry or other subscribers
+type subscriber struct {
+	fn      func(Event)
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []Event
+	dropped int
+	closed  bool
+}
+
+// maxSubscriberQueue the max events queued for a subscriber
+var maxSubscriberQueue = 4096
+
+var (
+	subLock     sync.RWMutex
+	subscribers = map[*subscriber]bool{}
+	eventSeq    uint64
+)
+
+// Subscribe call fn for every registry change event,
+// events are delivered in order they happened, fn is never called with the registry lock held,
+// when a slow subscriber has maxSubscriberQueue events queued the newer events are dropped,
+// fn then gets an EventsDropped event with the number of lost events and should resync by Snapshot,
+// call the returned func to stop the subscription, it does not wait for a running fn,
+// so it is safe to call inside fn, and fn is not called again after it returns
+func Subscribe(fn func(Event)) (cancel func()) {
+	sub := &subscriber{fn: fn}
+	sub.cond = sync.NewCond(&sub.mu)
+
+	subLock.Lock()
+	subscribers[sub] = true
+	subLock.Unlock()
+
+	go sub.run()
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			subLock.Lock()
+			delete(subscribers, sub)
+			subLock.Unlock()
+
+			sub.mu.Lock()
+			sub.closed = true
+			sub.queue = nil
+			sub.cond.Signal()
+			sub.mu.Unlock()
+		})
+	}
+}
+
+// Watch get registry change events by a channel, buffer is the channel size,
+// the channel is closed after cancel is called
+func Watch(buffer int) (events <-chan Event, cancel func()) {
+	ch := make(chan Event, buffer)
+	stop := make(chan struct{})
+	sendLock := sync.Mutex{}
+	cancelSub := Subscribe(func(e Event) {
+		sendLock.Lock()
+		defer sendLock.Unlock()
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		select {
+		case ch <- e:
+		case <-stop:
+		}
+	})
+
+	once := sync.Once{}
+	return ch, func() {
+		once.Do(func() {
+			close(stop)
+			cancelSub()
+			sendLock.Lock()
+			close(ch)
+			sendLock.Unlock()
+		})
+	}
+}
+
+// run deliver queued events until closed
+func (s *subscriber) run() {
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && s.dropped == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+		events := s.queue
+		s.queue = nil
+		if s.dropped > 0 {
+			events = append(events, s.droppedEvent())
+		}
+		s.mu.Unlock()
+
+		for _, e := range events {
+			if s.isClosed() {
+				return
+			}
+			s.fn(e)
+		}
+	}
+}
+
+// isClosed check the subscription is canceled
+func (s *subscriber) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// droppedEvent make an EventsDropped event and reset the dropped count, must hold mu
+func (s *subscriber) droppedEvent() Event {
+	e := Event{Type: EventsDropped, Dropped: s.dropped, Time: time.Now()}
+	s.dropped = 0
+	return e
+}
+
+// push append events to queue, events over maxSubscriberQueue are dropped and counted
+func (s *subscriber) push(events []Event) {
+	s.mu.Lock()
+	for _, e := range events {
+		if len(s.queue) >= maxSubscriberQueue {
+			s.dropped++
+			continue
+		}
+		if s.dropped > 0 {
+			s.queue = append(s.queue, s.droppedEvent())
+		}
+		s.queue = append(s.queue, e)
+	}
+	s.cond.Signal()
+	s.mu.Unlock()
+}
+
+// registryTx hold the registry write lock and collect change events
+type registryTx struct {
+	events []Event
+}
+
+// beginTx lock the registry
+func beginTx() *registryTx {
+	lock.Lock()
+	return &registryTx{}
+}
+
+// commit queue events to subscribers before unlock so their order is the order of changes,
+// then call change hooks without the lock
+func (tx *registryTx) commit() {
+	if len(tx.events) > 0 {
+		now := time.Now()
+		for k := range tx.events {
+			eventSeq++
+			tx.events[k].Seq = eventSeq
+			tx.events[k].Time = now
+		}
+
+		subLock.RLock()
+		for sub := range subscribers {
+			sub.push(tx.events)
+		}
+		subLock.RUnlock()
+	}
+	lock.Unlock()
+
+	notifyChange(tx.events)
+}
+
+// emitSiteAdded add a SiteAdded event
+func (tx *registryTx) emitSiteAdded(node *RegistNode) {
+	tx.events = append(tx.events, Event{Type: SiteAdded, Domain: node.Domain, Site: siteSnapshot(node)})
+}
+
+// emitSiteRemoved add a SiteRemoved event
+func (tx *registryTx) emitSiteRemoved(node *RegistNode) {
+	tx.events = append(tx.events, Event{Type: SiteRemoved, Domain: node.Domain, Site: siteSnapshot(node)})
+}
+
+// emitSiteChanged add a SiteChanged event, site settings like slow start changed
+func (tx *registryTx) emitSiteChanged(node *RegistNode) {
+	tx.events = append(tx.events, Event{Type: SiteChanged, Domain: node.Domain, Site: siteSnapshot(node)})
+}
+
+// emitLoadType add a LoadTypeChanged event
+func (tx *registryTx) emitLoadType(domain, oldLoadType, newLoadType string) {
+	tx.events = append(tx.events, Event{
+		Type:        LoadTypeChanged,
+		Domain:      domain,
+		OldLoadType: oldLoadType,
+		NewLoadType: newLoadType,
+	})
+}
+
+// emitItemChanged add WeightChanged, StateChanged or PriorityChanged events of an endpoint
+func (tx *registryTx) emitItemChanged(domain string, before, after *EndpointItem) {
+	if before.Weight != after.Weight {
+		tx.emitEndpoint(WeightChanged, domain, before, after)
+	}
+	if before.State.normalize() != after.State.normalize() {
+		tx.emitEndpoint(StateChanged, domain, before, after)
+	}
+	if before.Priority != after.Priority {
+		tx.emitEndpoint(PriorityChanged, domain, before, after)
+	}
+	if before.MaxConns != after.MaxConns {
+		tx.emitEndpoint(MaxConnsChanged, domain, before, after)
+	}
+}
+
+// emitHealth add a HealthChanged event
+func (tx *registryTx) emitHealth(domain string, item *EndpointItem, healthy bool) {
+	tx.emitEndpoint(HealthChanged, domain, item, item)
+	tx.events[len(tx.events)-1].Healthy = &healthy
+}
+
+// emitEndpoint add an endpoint event, before and after are copied
+func (tx *registryTx) emitEndpoint(eventType EventType, domain string, before, after *EndpointItem) {
+	e := Event{Type: eventType, Domain: domain}
+	if before != nil {
+		item := *before
+		e.Before = &item
+		e.Endpoint = item.Endpoint
+	}
+	if after != nil {
+		item := *after
+		e.After = &item
+		e.Endpoint = item.Endpoint
+	}
+	tx.events = append(tx.events, e)
+}
@@ -0,0 +1,203 @@
+package balancer
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func receiveEvents(t *testing.T, events <-chan Event, n int) []Event {
+	result := []Event{}
+	for i := 0; i < n; i++ {
+		select {
+		case e := <-events:
+			result = append(result, e)
+		case <-time.After(time.Second):
+			t.Fatalf("receive events timeout, got %d want %d", len(result), n)
+		}
+	}
+	return result
+}
+
+func TestWatch(t *testing.T) {
+	registryMap = nil
+	events, cancel := Watch(10)
+
+	RegistTargetNoAddr("www.google.com", "random", "http")
+	addEndpoint("www.google.com", OriginItem{Endpoint: "192.168.1.101:80", Weight: 10})
+	ChangeLoadType("www.google.com", "wroundrobin")
+	ChangeLoadType("www.google.com", "wroundrobin")
+	delEndpoint("www.google.com", "192.168.1.101:80")
+	FlushProxy("www.google.com")
+
+	result := receiveEvents(t, events, 5)
+	types := []EventType{SiteAdded, EndpointAdded, LoadTypeChanged, EndpointRemoved, SiteRemoved}
+	for k, e := range result {
+		if e.Type != types[k] || e.Domain != "www.google.com" {
+			t.Errorf("Watch have an error #1 %d %v", k, e.Type)
+		}
+		if k > 0 && e.Seq != result[k-1].Seq+1 {
+			t.Error("Watch have an error #2")
+		}
+	}
+	if result[1].After == nil || result[1].After.Weight != 10 || result[1].Before != nil {
+		t.Error("Watch have an error #3")
+	}
+	if result[2].OldLoadType != "random" || result[2].NewLoadType != "wroundrobin" {
+		t.Error("Watch have an error #4")
+	}
+	if result[3].Before == nil || result[3].Endpoint != "192.168.1.101:80" {
+		t.Error("Watch have an error #5")
+	}
+
+	cancel()
+	cancel()
+	if _, ok := <-events; ok {
+		t.Error("Watch have an error #6")
+	}
+}
+
+func TestWatchRestore(t *testing.T) {
+	registryMap = nil
+	RegistTargetNoAddr("www.google.com", "random", "http")
+	RegistTargetNoAddr("www.facebook.com", "random", "http")
+	addEndpoint("www.google.com", []OriginItem{{Endpoint: "192.168.1.101:80", Weight: 10}, {Endpoint: "192.168.1.102:80", Weight: 10}}...)
+
+	events, cancel := Watch(10)
+	defer cancel()
+	Restore([]SiteSnapshot{
+		{Domain: "www.google.com", LoadType: "roundrobin", Items: []EndpointItem{{OriginItem: OriginItem{Endpoint: "192.168.1.102:80", Weight: 20}}, {OriginItem: OriginItem{Endpoint: "192.168.1.103:80", Weight: 10}}}},
+		{Domain: "www.google.cn"},
+	})
+
+	result := receiveEvents(t, events, 6)
+	expect := []string{
+		"SiteRemoved www.facebook.com",
+		"SiteAdded www.google.cn",
+		"LoadTypeChanged www.google.com",
+		"EndpointRemoved www.google.com 192.168.1.101:80",
+		"WeightChanged www.google.com 192.168.1.102:80",
+		"EndpointAdded www.google.com 192.168.1.103:80",
+	}
+	for k, e := range result {
+		got := strings.TrimSpace(e.Type.String() + " " + e.Domain + " " + e.Endpoint)
+		if got != expect[k] {
+			t.Errorf("Restore events have an error #%d %s", k, got)
+		}
+	}
+	if result[4].Before.Weight != 10 || result[4].After.Weight != 20 {
+		t.Error("Restore events have an error #7")
+	}
+}
+
+func TestSubscribeOrder(t *testing.T) {
+	registryMap = nil
+	RegistTargetNoAddr("www.google.com", "random", "http")
+
+	mu := sync.Mutex{}
+	seqs := []uint64{}
+	wg := sync.WaitGroup{}
+	wg.Add(50)
+	cancel := Subscribe(func(e Event) {
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		seqs = append(seqs, e.Seq)
+		mu.Unlock()
+		wg.Done()
+	})
+	defer cancel()
+
+	for i := 0; i < 50; i++ {
+		go addEndpoint("www.google.com", OriginItem{Endpoint: "192.168.1.1:" + string(rune('a'+i)), Weight: 10})
+	}
+	wg.Wait()
+
+	for k := 1; k < len(seqs); k++ {
+		if seqs[k] != seqs[k-1]+1 {
+			t.Fatal("Subscribe order have an error #1")
+		}
+	}
+}
+
+func TestSubscribeCancelInside(t *testing.T) {
+	registryMap = nil
+	RegistTargetNoAddr("www.google.com", "random", "http")
+
+	calls := make(chan Event, 10)
+	cancelSub := make(chan func(), 1)
+	cancelSub <- Subscribe(func(e Event) {
+		cancel := <-cancelSub
+		cancel()
+		cancelSub <- cancel
+		calls <- e
+	})
+
+	addEndpoint("www.google.com", OriginItem{Endpoint: "192.168.1.101:80", Weight: 10})
+	addEndpoint("www.google.com", OriginItem{Endpoint: "192.168.1.102:80", Weight: 10})
+	select {
+	case <-calls:
+	case <-time.After(time.Second):
+		t.Fatal("Subscribe cancel inside have an error #1")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if len(calls) != 0 {
+		t.Error("Subscribe cancel inside have an error #2")
+	}
+
+	events, cancelWatch := Watch(0)
+	addEndpoint("www.google.com", OriginItem{Endpoint: "192.168.1.103:80", Weight: 10})
+	done := make(chan struct{})
+	go func() {
+		cancelWatch()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Subscribe cancel inside have an error #3")
+	}
+	for range events {
+	}
+}
+
+func TestSubscribeOverflow(t *testing.T) {
+	registryMap = nil
+	RegistTargetNoAddr("www.google.com", "random", "http")
+	defer func(n int) { maxSubscriberQueue = n }(maxSubscriberQueue)
+	maxSubscriberQueue = 5
+
+	block := make(chan struct{})
+	events := make(chan Event, 20)
+	cancel := Subscribe(func(e Event) {
+		<-block
+		events <- e
+	})
+	defer cancel()
+
+	addEndpoint("www.google.com", OriginItem{Endpoint: "192.168.1.100:80", Weight: 10})
+	time.Sleep(20 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		addEndpoint("www.google.com", OriginItem{Endpoint: "192.168.1.1:" + string(rune('a'+i)), Weight: 10})
+	}
+	close(block)
+
+	result := receiveEvents(t, events, 7)
+	if result[0].Endpoint != "192.168.1.100:80" || result[5].Endpoint != "192.168.1.1:e" {
+		t.Error("Subscribe overflow have an error #1")
+	}
+	if result[6].Type != EventsDropped || result[6].Dropped != 5 {
+		t.Error("Subscribe overflow have an error #2", result[6].Type, result[6].Dropped)
+	}
+}
+
+func TestEventTypeString(t *testing.T) {
+	if WeightChanged.String() != "WeightChanged" || EventType(100).String() != "Unknown" {
+		t.Error("EventType String have an error #1")
+	}
+	data, _ := json.Marshal(Event{Type: SiteAdded})
+	if !strings.Contains(string(data), `"type":"SiteAdded"`) {
+		t.Error("EventType MarshalText have an error #2")
+	}
+}
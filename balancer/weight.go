@@ -0,0 +1,141 @@
+package balancer
+
+import (
+	"time"
+)
+
+// timeNow get current time, it is replaced in testing
+var timeNow = time.Now
+
+// weightRamp move the effective weight of an endpoint from one value to another
+// during a period, curve maps the elapsed ratio 0~1 to the weight ratio 0~1
+type weightRamp struct {
+	from     uint32
+	to       uint32
+	start    time.Time
+	duration time.Duration
+	curve    func(float64) float64
+}
+
+// linearCurve weight grows at a constant speed
+func linearCurve(x float64) float64 {
+	return x
+}
+
+// weight get effective weight at time now
+func (w *weightRamp) weight(now time.Time) uint32 {
+	if w.done(now) {
+		return w.to
+	}
+	ratio := 0.0
+	if elapsed := now.Sub(w.start); elapsed > 0 {
+		ratio = w.curve(float64(elapsed) / float64(w.duration))
+	}
+	if ratio < 0 {
+		ratio = 0
+	}
+	if ratio > 1 {
+		ratio = 1
+	}
+	return uint32(float64(w.from) + (float64(w.to)-float64(w.from))*ratio + 0.5)
+}
+
+// done check the ramp is finished
+func (w *weightRamp) done(now time.Time) bool {
+	return w.duration <= 0 || now.Sub(w.start) >= w.duration
+}
+
+// effectiveItems get items with the weight at time now,
+// it returns node.Items directly when no endpoint is ramping
+func (node *RegistNode) effectiveItems(now time.Time) []OriginItem {
+	if len(node.ramps) == 0 {
+		return node.Items
+	}
+
+	items := make([]OriginItem, len(node.Items))
+	copy(items, node.Items)
+	for k, item := range items {
+		if ramp, ok := node.ramps[item.Endpoint]; ok {
+			items[k].Weight = ramp.weight(now)
+		}
+	}
+	return items
+}
+
+// effectiveWeight get the weight of an endpoint at time now
+func (node *RegistNode) effectiveWeight(item OriginItem, now time.Time) uint32 {
+	if ramp, ok := node.ramps[item.Endpoint]; ok {
+		return ramp.weight(now)
+	}
+	return item.Weight
+}
+
+// cleanRamps remove finished ramps, it should be called with the registry write lock
+func (node *RegistNode) cleanRamps(now time.Time) {
+	for addr, ramp := range node.ramps {
+		if ramp.done(now) {
+			delete(node.ramps, addr)
+		}
+	}
+}
+
+// SetWeight change the weight of an endpoint in place,
+// weight aware balancers use the new weight from their next round
+func SetWeight(domain, addr string, weight uint32) error {
+	return setWeight(domain, addr, weight, nil)
+}
+
+// RampWeight change the weight of an endpoint gradually,
+// the effective weight moves linearly from the current one to weight during duration
+func RampWeight(domain, addr string, weight uint32, duration time.Duration) error {
+	if duration <= 0 {
+		return SetWeight(domain, addr, weight)
+	}
+	return setWeight(domain, addr, weight, &weightRamp{
+		to:       weight,
+		duration: duration,
+		curve:    linearCurve,
+	})
+}
+
+// setWeight change the weight of an endpoint, the ramp starts from its effective weight
+func setWeight(domain, addr string, weight uint32, ramp *weightRamp) error {
+	tx := beginTx()
+	defer tx.commit()
+
+	service, ok := registryMap[domain]
+	if ok == false {
+		return ErrServiceNotFound
+	}
+	now := timeNow()
+	service.cleanRamps(now)
+
+	for k, item := range service.Items {
+		if item.Endpoint != addr {
+			continue
+		}
+
+		if ramp != nil {
+			ramp.from = service.effectiveWeight(item, now)
+			ramp.start = now
+			if service.ramps == nil {
+				service.ramps = map[string]*weightRamp{}
+			}
+			service.ramps[addr] = ramp
+		} else {
+			delete(service.ramps, addr)
+		}
+		if item.Weight == weight {
+			return nil
+		}
+
+		items := make([]OriginItem, len(service.Items))
+		copy(items, service.Items)
+		items[k].Weight = weight
+		service.Items = items
+		before, after := service.endpointItem(item), service.endpointItem(items[k])
+		tx.emitEndpoint(WeightChanged, domain, &before, &after)
+		return nil
+	}
+	return ErrEndpointNotFound
+}
@@ -0,0 +1,123 @@
+package balancer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSetWeight(t *testing.T) {
+	registryMap = nil
+	if err := SetWeight("www.google.com", "192.168.1.100", 10); err != ErrServiceNotFound {
+		t.Error("SetWeight func have an error #1")
+	}
+
+	domain := "www.google.com"
+	var balancer = NewWRoundRobinLoad(domain)
+	newTarget(RegistNode{
+		Domain: domain,
+		Items: []OriginItem{
+			{Endpoint: "192.168.1.100", Weight: 10},
+			{Endpoint: "192.168.1.101", Weight: 10},
+		},
+	})
+	if err := SetWeight(domain, "192.168.1.105", 10); err != ErrEndpointNotFound {
+		t.Error("SetWeight func have an error #2")
+	}
+
+	events, cancel := Watch(10)
+	defer cancel()
+	oldItems := registryMap[domain].Items
+	if err := SetWeight(domain, "192.168.1.101", 30); err != nil {
+		t.Fatal(err)
+	}
+	if registryMap[domain].Items[1].Weight != 30 || oldItems[1].Weight != 10 {
+		t.Error("SetWeight func have an error #3")
+	}
+	e := receiveEvents(t, events, 1)[0]
+	if e.Type != WeightChanged || e.Before.Weight != 10 || e.After.Weight != 30 {
+		t.Error("SetWeight func have an error #4")
+	}
+
+	v1 := 0
+	for i := 0; i < 40; i++ {
+		target, _ := balancer.GetOne()
+		if target.Addr == "192.168.1.100" {
+			v1++
+		}
+	}
+	if v1 != 10 {
+		t.Error("SetWeight func have an error #5", v1)
+	}
+}
+
+func TestRampWeight(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() {
+		timeNow = time.Now
+	}()
+
+	domain := "www.google.com"
+	registryMap = nil
+	newTarget(RegistNode{
+		Domain: domain,
+		Items: []OriginItem{
+			{Endpoint: "192.168.1.100", Weight: 10},
+			{Endpoint: "192.168.1.101", Weight: 10},
+		},
+	})
+	if err := RampWeight(domain, "192.168.1.105", 10, time.Minute); err != ErrEndpointNotFound {
+		t.Error("RampWeight func have an error #1")
+	}
+
+	RampWeight(domain, "192.168.1.101", 110, 10*time.Second)
+	if registryMap[domain].Items[1].Weight != 110 {
+		t.Error("RampWeight func have an error #2")
+	}
+
+	items, _ := getItems(domain)
+	if items[1].Weight != 10 || items[0].Weight != 10 {
+		t.Error("RampWeight func have an error #3")
+	}
+	now = now.Add(5 * time.Second)
+	items, _ = getItems(domain)
+	if items[1].Weight != 60 {
+		t.Error("RampWeight func have an error #4", items[1].Weight)
+	}
+
+	// change direction in the middle, start from the effective weight
+	RampWeight(domain, "192.168.1.101", 0, 10*time.Second)
+	now = now.Add(5 * time.Second)
+	items, _ = getItems(domain)
+	if items[1].Weight != 30 {
+		t.Error("RampWeight func have an error #5", items[1].Weight)
+	}
+	now = now.Add(5 * time.Second)
+	items, _ = getItems(domain)
+	if items[1].Weight != 0 {
+		t.Error("RampWeight func have an error #6", items[1].Weight)
+	}
+
+	SetWeight(domain, "192.168.1.101", 20)
+	if len(registryMap[domain].ramps) != 0 {
+		t.Error("RampWeight func have an error #7")
+	}
+
+	RampWeight(domain, "192.168.1.101", 40, 10*time.Second)
+	delEndpoint(domain, "192.168.1.101")
+	if len(registryMap[domain].ramps) != 0 {
+		t.Error("RampWeight func have an error #8")
+	}
+}
+
+func TestWeightRampCurve(t *testing.T) {
+	start := time.Now()
+	ramp := &weightRamp{from: 100, to: 0, start: start, duration: 10 * time.Second, curve: linearCurve}
+	if ramp.weight(start.Add(-time.Second)) != 100 || ramp.weight(start.Add(2*time.Second)) != 80 ||
+		ramp.weight(start.Add(time.Minute)) != 0 {
+		t.Error("weightRamp have an error #1")
+	}
+	if ramp.done(start.Add(time.Second)) || !ramp.done(start.Add(10*time.Second)) {
+		t.Error("weightRamp have an error #2")
+	}
+}
@@ -2,6 +2,7 @@ package balancer
 
 import (
 	"errors"
+	"sync"
 )
 
 // WRoundRobinLoad this is a round robin by weight balancer
@@ -11,25 +12,26 @@ type WRoundRobinLoad struct {
 	activeIndex  int
 	activeWeight uint32
 	activeItems  []OriginItem
+	mu           sync.Mutex
 }
 
 // NewWRoundRobinLoad get a WRoundRobin point
 func NewWRoundRobinLoad(domain string) Balancer {
-	return &WRoundRobinLoad{domain, 0, 0, []OriginItem{}}
+	return &WRoundRobinLoad{domain: domain, activeItems: []OriginItem{}}
 }
 
 // GetOne get an target by round robin with weight
 func (r *WRoundRobinLoad) GetOne() (*ProxyTarget, error) {
-	targetSrv, err := getTarget(r.domain)
+	items, err := getItems(r.domain)
 	if err != nil {
 		return nil, err
 	}
-	if len(targetSrv.Items) == 0 {
+	if len(items) == 0 {
 		return nil, errors.New("not found endpoints")
 	}
 
 	initAllZero := 1
-	for _, item := range targetSrv.Items {
+	for _, item := range items {
 		if item.Weight > 0 {
 			initAllZero = 0
 		}
@@ -38,6 +40,9 @@ func (r *WRoundRobinLoad) GetOne() (*ProxyTarget, error) {
 		return nil, errors.New("not found available endpoints")
 	}
 
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	isAllZero := 1
 	for _, item := range r.activeItems {
 		if item.Weight > 0 {
@@ -45,23 +50,40 @@ func (r *WRoundRobinLoad) GetOne() (*ProxyTarget, error) {
 		}
 	}
 	if isAllZero == 1 {
-		r.reloadActiveItems()
+		r.loadActiveItems(items)
+	}
+
+	target := r.pickActiveItem(items)
+	if target == nil {
+		// the rest of this round are endpoints no longer active, start a new round
+		r.loadActiveItems(items)
+		target = r.pickActiveItem(items)
 	}
 
+	return target, nil
+}
+
+// pickActiveItem take one weight from the active round, endpoints not in items
+// like draining ones lose their remaining weight, it should be called with r.mu
+func (r *WRoundRobinLoad) pickActiveItem(items []OriginItem) *ProxyTarget {
 	var target *ProxyTarget
 
 	for i := 0; i < len(r.activeItems); i++ {
-		if r.activeItems[r.activeIndex].Weight > 0 {
-			r.activeItems[r.activeIndex].Weight--
-			target = &ProxyTarget{targetSrv.Domain, r.activeItems[r.activeIndex].Endpoint}
+		item := &r.activeItems[r.activeIndex]
+		if item.Weight > 0 && !stringInOriginItem(item.Endpoint, items) {
+			item.Weight = 0
+		}
+		if item.Weight > 0 {
+			item.Weight--
+			target = &ProxyTarget{r.domain, item.Endpoint}
 			break
 		} else {
-			r.activeIndex = (r.activeIndex + 1) % len(targetSrv.Items)
+			r.activeIndex = (r.activeIndex + 1) % len(r.activeItems)
 		}
 	}
-	r.activeIndex = (r.activeIndex + 1) % len(targetSrv.Items)
+	r.activeIndex = (r.activeIndex + 1) % len(r.activeItems)
 
-	return target, nil
+	return target
 }
 
 // AddAddr add an endpoint
@@ -97,16 +119,40 @@ func (r *WRoundRobinLoad) DelAddr(addr string) error {
 	return err
 }
 
+// SetAddrs replace all endpoints at once, active weight is reloaded once
+func (r *WRoundRobinLoad) SetAddrs(items []EndpointItem) (*EndpointDiff, error) {
+	diff, err := setEndpoints(r.domain, items)
+	if err != nil {
+		return nil, err
+	}
+
+	return diff, r.reloadActiveItems()
+}
+
 // reloadActiveItems reload active weight
 // when edit items,should run this func
 func (r *WRoundRobinLoad) reloadActiveItems() error {
-	target, err := getTarget(r.domain)
+	items, err := getItems(r.domain)
 	if err != nil {
 		return err
 	}
 
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.loadActiveItems(items)
+}
+
+// loadActiveItems compute active weight from items, no items clear the active round,
+// it should be called with r.mu
+func (r *WRoundRobinLoad) loadActiveItems(items []OriginItem) error {
+	if len(items) == 0 {
+		r.activeItems = []OriginItem{}
+		r.activeIndex = 0
+		return nil
+	}
+
 	originItems := make([]OriginItem, 0)
-	for _, item := range target.Items {
+	for _, item := range items {
 		originItems = append(originItems, item)
 	}
 	gcdWeight, err := getGCDWeight(originItems)
@@ -114,7 +160,7 @@ func (r *WRoundRobinLoad) reloadActiveItems() error {
 		return err
 	}
 
-	for k, item := range target.Items {
+	for k, item := range items {
 		if originItems[k].Weight == 0 {
 			originItems[k].Weight = 0
 		} else {
@@ -102,6 +102,56 @@ func TestDelAddrWRoundRobin(t *testing.T) {
 	}
 }
 
+func TestSetAddrsWRoundRobin(t *testing.T) {
+	domain := "www.google.com"
+	var balancer = NewWRoundRobinLoad(domain)
+	registryMap = nil
+	newTarget(RegistNode{
+		Domain: domain,
+		Items: []OriginItem{
+			{"192.168.1.100", 80},
+			{"192.168.1.101", 80},
+		},
+	})
+	balancer.GetOne()
+
+	diff, err := balancer.SetAddrs([]EndpointItem{
+		{OriginItem: OriginItem{"192.168.1.101", 20}},
+		{OriginItem: OriginItem{"192.168.1.102", 40}},
+	})
+	if err != nil || len(diff.Added) != 1 || len(diff.Removed) != 1 || len(diff.Changed) != 1 {
+		t.Error("SetAddrs func have an error #1")
+	}
+
+	v1 := 0
+	v2 := 0
+	for i := 0; i < 30; i++ {
+		target, _ := balancer.GetOne()
+		if target.Addr == "192.168.1.101" {
+			v1++
+		}
+		if target.Addr == "192.168.1.102" {
+			v2++
+		}
+	}
+	if v1 != 10 || v2 != 20 {
+		t.Error("SetAddrs func have an error #2", v1, v2)
+	}
+
+	// an empty list is applied and clears the active round
+	diff, err = balancer.SetAddrs(nil)
+	if err != nil || len(diff.Removed) != 2 || len(balancer.(*WRoundRobinLoad).activeItems) != 0 {
+		t.Error("SetAddrs func have an error #3", err)
+	}
+	if _, err = balancer.GetOne(); err == nil {
+		t.Error("SetAddrs func have an error #4")
+	}
+	balancer.SetAddrs([]EndpointItem{{OriginItem: OriginItem{"192.168.1.103", 5}}})
+	if target, err := balancer.GetOne(); err != nil || target.Addr != "192.168.1.103" {
+		t.Error("SetAddrs func have an error #5", err)
+	}
+}
+
 func TestGetMaxWeightIndex(t *testing.T) {
 	items := []OriginItem{}
 	_, err := getMaxWeight(items)
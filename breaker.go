@@ -0,0 +1,417 @@
+package libra
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/zhuCheer/libra/balancer"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrBreakerInvalid circuit breaker config is invalid
+var ErrBreakerInvalid = errors.New("the circuit breaker config is invalid")
+
+// errCircuitOpen message of the fail fast response when all endpoints of a site are open
+var errCircuitOpen = errors.New("circuit breaker is open, all origin endpoints are unavailable")
+
+// BreakerState circuit breaker state of an endpoint
+type BreakerState int
+
+// Circuit breaker states.
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+// String get breaker state name
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerConfig circuit breaker config of a site, every endpoint of the site has its own breaker,
+// a breaker opens on FailureRatio or ConsecutiveFailures, zero value of them disables the check,
+// after OpenTimeout it becomes half-open and lets HalfOpenProbes requests test the endpoint
+type BreakerConfig struct {
+	Window              time.Duration // failures are counted in a window, default 10s
+	MinRequests         int           // requests needed in a window before FailureRatio is checked, default 10
+	FailureRatio        float64       // open when failures / requests of a window reach it
+	ConsecutiveFailures int           // open after failures in a row
+	OpenTimeout         time.Duration // how long it keeps open before half-open, default 30s
+	HalfOpenProbes      int           // probes allowed in half-open, close after all of them succeed, default 1
+}
+
+// breakerConfigJSON json struct of BreakerConfig, durations are strings like 10s
+type breakerConfigJSON struct {
+	Window              string  `json:"window,omitempty"`
+	MinRequests         int     `json:"min_requests,omitempty"`
+	FailureRatio        float64 `json:"failure_ratio,omitempty"`
+	ConsecutiveFailures int     `json:"consecutive_failures,omitempty"`
+	OpenTimeout         string  `json:"open_timeout,omitempty"`
+	HalfOpenProbes      int     `json:"half_open_probes,omitempty"`
+}
+
+// MarshalJSON encode durations as strings
+func (c BreakerConfig) MarshalJSON() ([]byte, error) {
+	v := breakerConfigJSON{
+		MinRequests:         c.MinRequests,
+		FailureRatio:        c.FailureRatio,
+		ConsecutiveFailures: c.ConsecutiveFailures,
+		HalfOpenProbes:      c.HalfOpenProbes,
+	}
+	if c.Window != 0 {
+		v.Window = c.Window.String()
+	}
+	if c.OpenTimeout != 0 {
+		v.OpenTimeout = c.OpenTimeout.String()
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON decode durations from strings
+func (c *BreakerConfig) UnmarshalJSON(data []byte) error {
+	v := breakerConfigJSON{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	config := BreakerConfig{
+		MinRequests:         v.MinRequests,
+		FailureRatio:        v.FailureRatio,
+		ConsecutiveFailures: v.ConsecutiveFailures,
+		HalfOpenProbes:      v.HalfOpenProbes,
+	}
+	var err error
+	if v.Window != "" {
+		if config.Window, err = time.ParseDuration(v.Window); err != nil {
+			return err
+		}
+	}
+	if v.OpenTimeout != "" {
+		if config.OpenTimeout, err = time.ParseDuration(v.OpenTimeout); err != nil {
+			return err
+		}
+	}
+	*c = config
+	return nil
+}
+
+// Validate check the config
+func (c BreakerConfig) Validate() error {
+	if c.Window < 0 || c.MinRequests < 0 || c.ConsecutiveFailures < 0 || c.OpenTimeout < 0 || c.HalfOpenProbes < 0 ||
+		!(c.FailureRatio >= 0 && c.FailureRatio <= 1) {
+		return ErrBreakerInvalid
+	}
+	if c.FailureRatio == 0 && c.ConsecutiveFailures == 0 {
+		return ErrBreakerInvalid
+	}
+	return nil
+}
+
+// withDefault fill zero fields by default value
+func (c BreakerConfig) withDefault() BreakerConfig {
+	if c.Window == 0 {
+		c.Window = 10 * time.Second
+	}
+	if c.MinRequests == 0 {
+		c.MinRequests = 10
+	}
+	if c.OpenTimeout == 0 {
+		c.OpenTimeout = 30 * time.Second
+	}
+	if c.HalfOpenProbes == 0 {
+		c.HalfOpenProbes = 1
+	}
+	return c
+}
+
+// circuitBreaker breaker of an endpoint
+type circuitBreaker struct {
+	mu          sync.Mutex
+	config      BreakerConfig
+	state       BreakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	consecutive int
+	openedAt    time.Time
+	probes      int // probes in flight
+	passed      int // probes succeeded
+	probeAt     time.Time
+}
+
+// newCircuitBreaker get a closed breaker
+func newCircuitBreaker(config BreakerConfig) *circuitBreaker {
+	return &circuitBreaker{config: config.withDefault()}
+}
+
+// available check a request may be allowed without taking a probe
+func (b *circuitBreaker) available(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expireProbes(now)
+
+	switch b.state {
+	case BreakerOpen:
+		return now.Sub(b.openedAt) >= b.config.OpenTimeout
+	case BreakerHalfOpen:
+		return b.probes+b.passed < b.config.HalfOpenProbes
+	}
+	return true
+}
+
+// allow check a request can be sent, probe is true if it is a half-open probe
+func (b *circuitBreaker) allow(now time.Time) (ok bool, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expireProbes(now)
+
+	if b.state == BreakerOpen {
+		if now.Sub(b.openedAt) < b.config.OpenTimeout {
+			return false, false
+		}
+		b.state = BreakerHalfOpen
+		b.probes = 0
+		b.passed = 0
+	}
+	if b.state == BreakerHalfOpen {
+		if b.probes+b.passed >= b.config.HalfOpenProbes {
+			return false, false
+		}
+		b.probes++
+		b.probeAt = now
+		return true, true
+	}
+	return true, false
+}
+
+// record count the result of a request allowed before
+func (b *circuitBreaker) record(probe bool, success bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		if b.state != BreakerHalfOpen {
+			return
+		}
+		b.probes--
+		if !success {
+			b.open(now)
+			return
+		}
+		b.passed++
+		if b.passed >= b.config.HalfOpenProbes {
+			b.close(now)
+		}
+		return
+	}
+	if b.state != BreakerClosed {
+		// a request sent before the breaker opened
+		return
+	}
+
+	if now.Sub(b.windowStart) >= b.config.Window {
+		b.windowStart = now
+		b.requests = 0
+		b.failures = 0
+	}
+	b.requests++
+	if success {
+		b.consecutive = 0
+		return
+	}
+	b.failures++
+	b.consecutive++
+
+	if b.config.ConsecutiveFailures > 0 && b.consecutive >= b.config.ConsecutiveFailures {
+		b.open(now)
+		return
+	}
+	if b.config.FailureRatio > 0 && b.requests >= b.config.MinRequests &&
+		float64(b.failures) >= math.Max(b.config.FailureRatio*float64(b.requests), 1) {
+		b.open(now)
+	}
+}
+
+// expireProbes probes never recorded like canceled requests are treated as failed,
+// so the breaker is never stuck in half-open, it should be called with b.mu
+func (b *circuitBreaker) expireProbes(now time.Time) {
+	if b.state == BreakerHalfOpen && b.probes > 0 && now.Sub(b.probeAt) >= b.config.OpenTimeout {
+		b.open(now)
+	}
+}
+
+// open it should be called with b.mu
+func (b *circuitBreaker) open(now time.Time) {
+	b.state = BreakerOpen
+	b.openedAt = now
+	b.probes = 0
+	b.passed = 0
+}
+
+// close it should be called with b.mu
+func (b *circuitBreaker) close(now time.Time) {
+	b.state = BreakerClosed
+	b.windowStart = now
+	b.requests = 0
+	b.failures = 0
+	b.consecutive = 0
+	b.probes = 0
+	b.passed = 0
+}
+
+// getState get current state, an open breaker past its timeout is reported half-open
+func (b *circuitBreaker) getState(now time.Time) BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && now.Sub(b.openedAt) >= b.config.OpenTimeout {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// breakerKey breaker map key
+func breakerKey(domain, addr string) string {
+	return domain + "|" + addr
+}
+
+// SetBreaker enable circuit breakers for every endpoint of a site, open endpoints get no requests,
+// a nil config disables them, when all endpoints are open requests fail fast with a 503 page
+func (p *ProxySrv) SetBreaker(domain string, config *BreakerConfig) error {
+	if config != nil {
+		if err := config.Validate(); err != nil {
+			return err
+		}
+	}
+
+	p.breakerLock.Lock()
+	defer p.breakerLock.Unlock()
+	if p.breakerConfigs == nil {
+		p.breakerConfigs = map[string]BreakerConfig{}
+		p.breakers = map[string]*circuitBreaker{}
+	}
+	for key := range p.breakers {
+		if strings.HasPrefix(key, domain+"|") {
+			delete(p.breakers, key)
+		}
+	}
+	if config == nil {
+		delete(p.breakerConfigs, domain)
+	} else {
+		p.breakerConfigs[domain] = *config
+	}
+
+	if !p.breakerHooked {
+		p.breakerHooked = true
+		balancer.AddAvailabilityFilter(p.breakerAvailable)
+		balancer.OnChange(p.pruneBreakers)
+	}
+	return nil
+}
+
+// GetBreaker get circuit breaker config of a site, nil if it is not enabled
+func (p *ProxySrv) GetBreaker(domain string) *BreakerConfig {
+	p.breakerLock.RLock()
+	defer p.breakerLock.RUnlock()
+	config, ok := p.breakerConfigs[domain]
+	if !ok {
+		return nil
+	}
+	return &config
+}
+
+// BreakerState get circuit breaker state of an addr, it is closed if breaker is not enabled
+func (p *ProxySrv) BreakerState(domain, addr string) BreakerState {
+	p.breakerLock.RLock()
+	b := p.breakers[breakerKey(domain, addr)]
+	p.breakerLock.RUnlock()
+	if b == nil {
+		return BreakerClosed
+	}
+	return b.getState(time.Now())
+}
+
+// getBreaker get the breaker of an endpoint, nil if breaker is not enabled for the site
+func (p *ProxySrv) getBreaker(domain, addr string) *circuitBreaker {
+	key := breakerKey(domain, addr)
+	p.breakerLock.RLock()
+	b := p.breakers[key]
+	config, enabled := p.breakerConfigs[domain]
+	p.breakerLock.RUnlock()
+	if b != nil || !enabled {
+		return b
+	}
+
+	p.breakerLock.Lock()
+	defer p.breakerLock.Unlock()
+	if b = p.breakers[key]; b == nil {
+		b = newCircuitBreaker(config)
+		p.breakers[key] = b
+	}
+	return b
+}
+
+// breakerAvailable balancer availability filter skipping open endpoints
+func (p *ProxySrv) breakerAvailable(domain string, item balancer.OriginItem) bool {
+	p.breakerLock.RLock()
+	b := p.breakers[breakerKey(domain, item.Endpoint)]
+	p.breakerLock.RUnlock()
+	return b == nil || b.available(time.Now())
+}
+
+// siteCircuitOpen check all active endpoints of a site are open
+func (p *ProxySrv) siteCircuitOpen(domain string) bool {
+	if p.GetBreaker(domain) == nil {
+		return false
+	}
+	items, err := balancer.GetEndpoints(domain)
+	if err != nil {
+		return false
+	}
+
+	open := 0
+	now := time.Now()
+	for _, item := range items {
+		if !item.IsActive() {
+			continue
+		}
+		b := p.getBreaker(domain, item.Endpoint)
+		if b == nil || b.available(now) {
+			return false
+		}
+		open++
+	}
+	return open > 0
+}
+
+// pruneBreakers remove breakers of endpoints deleted from a site
+func (p *ProxySrv) pruneBreakers(domain string) {
+	items, _ := balancer.GetEndpoints(domain)
+
+	p.breakerLock.Lock()
+	defer p.breakerLock.Unlock()
+	for key := range p.breakers {
+		if !strings.HasPrefix(key, domain+"|") {
+			continue
+		}
+		found := false
+		for _, item := range items {
+			if key == breakerKey(domain, item.Endpoint) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			delete(p.breakers, key)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package libra
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker(BreakerConfig{ConsecutiveFailures: 3, OpenTimeout: time.Second, HalfOpenProbes: 2})
+
+	b.record(false, false, now)
+	b.record(false, false, now)
+	b.record(false, true, now)
+	b.record(false, false, now)
+	b.record(false, false, now)
+	if b.getState(now) != BreakerClosed {
+		t.Error("circuit breaker have an error #1")
+	}
+	b.record(false, false, now)
+	if b.getState(now) != BreakerOpen || b.available(now) {
+		t.Error("circuit breaker have an error #2")
+	}
+	if ok, _ := b.allow(now.Add(500 * time.Millisecond)); ok {
+		t.Error("circuit breaker have an error #3")
+	}
+
+	// half-open lets a limited number of probes pass
+	now = now.Add(time.Second)
+	if b.getState(now) != BreakerHalfOpen || !b.available(now) {
+		t.Error("circuit breaker have an error #4")
+	}
+	ok1, probe1 := b.allow(now)
+	ok2, probe2 := b.allow(now)
+	ok3, _ := b.allow(now)
+	if !ok1 || !ok2 || ok3 || !probe1 || !probe2 || b.available(now) {
+		t.Error("circuit breaker have an error #5")
+	}
+	b.record(true, true, now)
+	b.record(true, false, now)
+	if b.getState(now) != BreakerOpen {
+		t.Error("circuit breaker have an error #6")
+	}
+
+	now = now.Add(time.Second)
+	b.allow(now)
+	b.allow(now)
+	b.record(true, true, now)
+	b.record(true, true, now)
+	if b.getState(now) != BreakerClosed {
+		t.Error("circuit breaker have an error #7")
+	}
+
+	// a probe never recorded expires as a failure
+	b.open(now)
+	now = now.Add(time.Second)
+	b.allow(now)
+	b.allow(now)
+	now = now.Add(time.Second)
+	if b.available(now) || b.getState(now) != BreakerOpen {
+		t.Error("circuit breaker have an error #8")
+	}
+}
+
+func TestCircuitBreakerRatio(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker(BreakerConfig{FailureRatio: 0.5, MinRequests: 4, Window: time.Second})
+
+	b.record(false, false, now)
+	b.record(false, false, now)
+	b.record(false, false, now)
+	if b.getState(now) != BreakerClosed {
+		t.Error("circuit breaker ratio have an error #1")
+	}
+
+	// counts are reset in a new window
+	now = now.Add(time.Second)
+	b.record(false, false, now)
+	b.record(false, true, now)
+	b.record(false, true, now)
+	if b.getState(now) != BreakerClosed {
+		t.Error("circuit breaker ratio have an error #2")
+	}
+	b.record(false, false, now)
+	if b.getState(now) != BreakerOpen {
+		t.Error("circuit breaker ratio have an error #3")
+	}
+}
+
+func TestBreakerConfig(t *testing.T) {
+	if (BreakerConfig{}).Validate() != ErrBreakerInvalid || (BreakerConfig{FailureRatio: 2}).Validate() != ErrBreakerInvalid {
+		t.Error("breaker config have an error #1")
+	}
+	if (BreakerConfig{ConsecutiveFailures: 5}).Validate() != nil {
+		t.Error("breaker config have an error #2")
+	}
+
+	config := BreakerConfig{}
+	err := json.Unmarshal([]byte(`{"failure_ratio":0.5,"window":"1m","open_timeout":"5s"}`), &config)
+	if err != nil || config.FailureRatio != 0.5 || config.Window != time.Minute || config.OpenTimeout != 5*time.Second {
+		t.Error("breaker config have an error #3")
+	}
+	data, _ := json.Marshal(config)
+	if string(data) != `{"window":"1m0s","failure_ratio":0.5,"open_timeout":"5s"}` {
+		t.Error("breaker config have an error #4", string(data))
+	}
+	if err = json.Unmarshal([]byte(`{"window":"1x"}`), &config); err == nil {
+		t.Error("breaker config have an error #5")
+	}
+}
+
+func TestProxyBreaker(t *testing.T) {
+	domain := "www.breaker.com"
+	badOrigin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer badOrigin.Close()
+	goodOrigin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "good")
+	}))
+	defer goodOrigin.Close()
+	badAddr := badOrigin.Listener.Addr().String()
+	goodAddr := goodOrigin.Listener.Addr().String()
+
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	proxy.RegistSite(domain, "roundrobin", "http").
+		AddAddr(domain, badAddr, 1).
+		AddAddr(domain, goodAddr, 1)
+	if err := proxy.SetBreaker(domain, &BreakerConfig{}); err != ErrBreakerInvalid {
+		t.Error("proxy breaker have an error #1")
+	}
+	proxy.SetBreaker(domain, &BreakerConfig{ConsecutiveFailures: 2, OpenTimeout: time.Minute})
+	proxy.SetErrorPage(503, "<h1>{#title#}</h1>{#msg#}")
+	server := httptest.NewServer(proxy.Handler())
+	defer server.Close()
+
+	get := func() (int, string) {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		req.Host = domain
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err.Error()
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	for i := 0; i < 4; i++ {
+		get()
+	}
+	if proxy.BreakerState(domain, badAddr) != BreakerOpen || proxy.BreakerState(domain, goodAddr) != BreakerClosed {
+		t.Error("proxy breaker have an error #2")
+	}
+	for i := 0; i < 4; i++ {
+		if code, body := get(); code != 200 || body != "good" {
+			t.Error("proxy breaker have an error #3", code)
+		}
+	}
+
+	// all endpoints are open, fail fast with the 503 page
+	proxy.DelAddr(domain, goodAddr)
+	proxy.AddAddr(domain, goodAddr, 1)
+	goodOrigin.Close()
+	for i := 0; i < 4; i++ {
+		get()
+	}
+	code, body := get()
+	if code != 503 || !strings.HasPrefix(body, "<h1>503 Service Unavailable</h1>circuit breaker is open") {
+		t.Error("proxy breaker have an error #4", code, body)
+	}
+
+	proxy.SetBreaker(domain, nil)
+	if proxy.GetBreaker(domain) != nil || proxy.BreakerState(domain, badAddr) != BreakerClosed {
+		t.Error("proxy breaker have an error #5")
+	}
+	proxy.FlushProxy(domain)
+}
@@ -0,0 +1,716 @@
+package libra
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrCacheInvalid response cache config is invalid
+var ErrCacheInvalid = errors.New("the response cache config is invalid")
+
+// DefaultCacheBytes max bytes of the memory cache store used if no store is set
+var DefaultCacheBytes int64 = 64 << 20
+
+// cacheStatusHeader response header telling how the cache served a request
+const cacheStatusHeader = "X-Cache"
+
+// Cache status of responses.
+const (
+	CacheHit         = "HIT"         // served from the cache
+	CacheMiss        = "MISS"        // served by the origin
+	CacheStale       = "STALE"       // served from the cache after it expired
+	CacheRevalidated = "REVALIDATED" // served from the cache after the origin confirmed it unchanged
+	CacheBypass      = "BYPASS"      // the request can not use the cache
+)
+
+// cacheableStatus status codes of responses which can be cached
+var cacheableStatus = map[int]bool{200: true, 203: true, 204: true, 300: true, 301: true, 308: true, 404: true, 410: true}
+
+// cacheSkipHeaders response headers not kept in the cache, they are different by request
+var cacheSkipHeaders = []string{
+	"Age", cacheStatusHeader, "X-Libra-Version", "X-Libra-Code", errorHeader,
+	"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// CacheConfig response cache of a site, GET responses are cached by Cache-Control,
+// Expires and Vary of the origin and revalidated by ETag and Last-Modified,
+// expired responses are kept as the last good ones until evicted by the store
+type CacheConfig struct {
+	DefaultTTL    time.Duration // freshness of responses without max-age or Expires, 0 does not cache them
+	MaxObjectSize int64         // larger responses are not cached, default 1MB
+
+	// an expired response is served while it is refreshed in background,
+	// for responses without the stale-while-revalidate directive
+	StaleWhileRevalidate time.Duration
+	// an expired response is served when the origin fails or all endpoints are down,
+	// for responses without the stale-if-error directive, responses are kept for it even without freshness
+	StaleIfError time.Duration
+	// max time a response is served after it expired, 0 is unlimited
+	MaxStale time.Duration
+}
+
+// cacheConfigJSON json struct of CacheConfig, durations are strings like 1m
+type cacheConfigJSON struct {
+	DefaultTTL           string `json:"default_ttl,omitempty"`
+	MaxObjectSize        int64  `json:"max_object_size,omitempty"`
+	StaleWhileRevalidate string `json:"stale_while_revalidate,omitempty"`
+	StaleIfError         string `json:"stale_if_error,omitempty"`
+	MaxStale             string `json:"max_stale,omitempty"`
+}
+
+// MarshalJSON encode durations as strings
+func (c CacheConfig) MarshalJSON() ([]byte, error) {
+	v := cacheConfigJSON{MaxObjectSize: c.MaxObjectSize}
+	for _, d := range []struct {
+		value time.Duration
+		field *string
+	}{
+		{c.DefaultTTL, &v.DefaultTTL},
+		{c.StaleWhileRevalidate, &v.StaleWhileRevalidate},
+		{c.StaleIfError, &v.StaleIfError},
+		{c.MaxStale, &v.MaxStale},
+	} {
+		if d.value != 0 {
+			*d.field = d.value.String()
+		}
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON decode durations from strings
+func (c *CacheConfig) UnmarshalJSON(data []byte) error {
+	v := cacheConfigJSON{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	config := CacheConfig{MaxObjectSize: v.MaxObjectSize}
+	for _, d := range []struct {
+		field string
+		value *time.Duration
+	}{
+		{v.DefaultTTL, &config.DefaultTTL},
+		{v.StaleWhileRevalidate, &config.StaleWhileRevalidate},
+		{v.StaleIfError, &config.StaleIfError},
+		{v.MaxStale, &config.MaxStale},
+	} {
+		if d.field == "" {
+			continue
+		}
+		var err error
+		if *d.value, err = time.ParseDuration(d.field); err != nil {
+			return err
+		}
+	}
+	*c = config
+	return nil
+}
+
+// Validate check the config
+func (c CacheConfig) Validate() error {
+	if c.DefaultTTL < 0 || c.MaxObjectSize < 0 || c.StaleWhileRevalidate < 0 || c.StaleIfError < 0 || c.MaxStale < 0 {
+		return ErrCacheInvalid
+	}
+	return nil
+}
+
+// staleWindow get how long a response can be served after it expired by the directive
+// stale-while-revalidate or stale-if-error of the response or the default of the site
+func (c CacheConfig) staleWindow(header http.Header, directive string) time.Duration {
+	cc := parseCacheControl(header)
+	if cc.has("must-revalidate") || cc.has("proxy-revalidate") {
+		return 0
+	}
+	if directive == "stale-while-revalidate" && cc.has("no-cache") {
+		return 0
+	}
+	window, ok := cc.seconds(directive)
+	if !ok {
+		window = c.StaleIfError
+		if directive == "stale-while-revalidate" {
+			window = c.StaleWhileRevalidate
+		}
+	}
+	if c.MaxStale > 0 && window > c.MaxStale {
+		window = c.MaxStale
+	}
+	return window
+}
+
+// withDefault fill zero fields by default value
+func (c CacheConfig) withDefault() CacheConfig {
+	if c.MaxObjectSize == 0 {
+		c.MaxObjectSize = 1 << 20
+	}
+	return c
+}
+
+// SetCache set response cache of a site, nil disables it, cached entries are kept until purged
+func (p *ProxySrv) SetCache(domain string, config *CacheConfig) error {
+	if config != nil {
+		if err := config.Validate(); err != nil {
+			return err
+		}
+	}
+
+	p.cacheLock.Lock()
+	defer p.cacheLock.Unlock()
+	if p.cacheConfigs == nil {
+		p.cacheConfigs = map[string]CacheConfig{}
+	}
+	if config == nil {
+		delete(p.cacheConfigs, domain)
+	} else {
+		p.cacheConfigs[domain] = *config
+	}
+	return nil
+}
+
+// GetCache get response cache config of a site, nil if it is not enabled
+func (p *ProxySrv) GetCache(domain string) *CacheConfig {
+	p.cacheLock.RLock()
+	defer p.cacheLock.RUnlock()
+	config, ok := p.cacheConfigs[domain]
+	if !ok {
+		return nil
+	}
+	return &config
+}
+
+// SetCacheStore set the store of cached responses of all sites,
+// a memory store of DefaultCacheBytes is used if it is not set
+func (p *ProxySrv) SetCacheStore(store CacheStore) {
+	p.cacheLock.Lock()
+	defer p.cacheLock.Unlock()
+	p.cacheStore = store
+}
+
+// getCacheStore get the cache store
+func (p *ProxySrv) getCacheStore() CacheStore {
+	p.cacheLock.Lock()
+	defer p.cacheLock.Unlock()
+	if p.cacheStore == nil {
+		p.cacheStore = NewMemoryCacheStore(DefaultCacheBytes)
+	}
+	return p.cacheStore
+}
+
+// PurgeCache delete cached responses of a site by the url like /static/a.js?v=1,
+// or all urls starting with it if prefix is true, it returns the count deleted
+func (p *ProxySrv) PurgeCache(domain, url string, prefix bool) (int, error) {
+	key := domain + url
+	return p.getCacheStore().Purge(func(k string) bool {
+		if prefix {
+			return strings.HasPrefix(k, key)
+		}
+		return k == key || strings.HasPrefix(k, key+"\n")
+	})
+}
+
+// cacheMiddleware serve requests of sites with response cache enabled
+func (p *ProxySrv) cacheMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := p.GetCache(r.Host)
+		if config == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		p.serveCache(config.withDefault(), w, r, handler)
+	})
+}
+
+// serveCache serve a request from the cache or the origin
+func (p *ProxySrv) serveCache(config CacheConfig, w http.ResponseWriter, r *http.Request, handler http.Handler) {
+	key := r.Host + r.URL.RequestURI()
+	store := p.getCacheStore()
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		// unsafe methods change the resource so the cached url is out of date
+		if r.Method != http.MethodOptions && r.Method != http.MethodTrace {
+			p.PurgeCache(r.Host, r.URL.RequestURI(), false)
+		}
+		handler.ServeHTTP(w, r)
+		return
+	}
+	reqCC := parseCacheControl(r.Header)
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Upgrade") != "" || reqCC.has("no-store") {
+		w.Header().Set(cacheStatusHeader, CacheBypass)
+		handler.ServeHTTP(w, r)
+		return
+	}
+
+	now := time.Now()
+	entry := p.lookupCache(store, key, r)
+	noCache := reqCC.has("no-cache") || r.Header.Get("Pragma") == "no-cache"
+	if entry != nil && !noCache {
+		age := now.Sub(entry.Date)
+		fresh := now.Before(entry.Expires)
+		if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+			fresh = false
+		}
+		if minFresh, ok := reqCC.seconds("min-fresh"); ok && now.Add(minFresh).After(entry.Expires) {
+			fresh = false
+		}
+		if fresh {
+			p.writeCacheEntry(w, r, entry, CacheHit, now)
+			return
+		}
+		stale := now.Sub(entry.Expires)
+		if maxStale, ok := reqCC.seconds("max-stale"); reqCC.has("max-stale") && (!ok || stale <= maxStale) &&
+			(config.MaxStale == 0 || stale <= config.MaxStale) {
+			p.writeCacheEntry(w, r, entry, CacheStale, now)
+			return
+		}
+		if stale < config.staleWindow(entry.Header, "stale-while-revalidate") {
+			p.writeCacheEntry(w, r, entry, CacheStale, now)
+			p.refreshCache(config, r, handler, key, entry)
+			return
+		}
+	}
+	p.fetchCache(config, w, r, handler, key, entry)
+}
+
+// refreshCache get the response of a stale entry from the origin in background,
+// requests of an entry being refreshed do not start another one
+func (p *ProxySrv) refreshCache(config CacheConfig, r *http.Request, handler http.Handler, key string, entry *CacheEntry) {
+	p.cacheLock.Lock()
+	if p.cacheRefreshing == nil {
+		p.cacheRefreshing = map[string]bool{}
+	}
+	if p.cacheRefreshing[entry.Key] {
+		p.cacheLock.Unlock()
+		return
+	}
+	p.cacheRefreshing[entry.Key] = true
+	p.cacheLock.Unlock()
+
+	// the request is detached from the client which may be gone before the origin responds
+	ctx := context.Background()
+	if state := getRequestState(r); state != nil {
+		ctx = context.WithValue(ctx, requestStateKey{}, &requestState{
+			domain:       state.domain,
+			path:         state.path,
+			requestID:    state.requestID,
+			clientIP:     state.clientIP,
+			peerTrusted:  state.peerTrusted,
+			forwardedFor: state.forwardedFor,
+			rewrite:      state.rewrite,
+		})
+	}
+	req := r.WithContext(ctx)
+	req.Header = http.Header{}
+	for k, v := range r.Header {
+		req.Header[k] = v
+	}
+	req.Method = http.MethodGet
+
+	go func() {
+		defer func() {
+			p.cacheLock.Lock()
+			delete(p.cacheRefreshing, entry.Key)
+			p.cacheLock.Unlock()
+		}()
+		p.fetchCache(config, &discardWriter{header: http.Header{}}, req, handler, key, entry)
+	}()
+}
+
+// fetchCache get the response from the origin and cache it,
+// a stale entry with validators is revalidated by a conditional request,
+// it is served instead of the error if the origin fails within stale-if-error
+func (p *ProxySrv) fetchCache(config CacheConfig, w http.ResponseWriter, r *http.Request, handler http.Handler, key string, entry *CacheEntry) {
+	cw := &cacheWriter{ResponseWriter: w, maxSize: config.MaxObjectSize}
+	validators := false
+	if entry != nil {
+		validators = entry.Header.Get("ETag") != "" || entry.Header.Get("Last-Modified") != ""
+		cw.fallback = time.Since(entry.Expires) < config.staleWindow(entry.Header, "stale-if-error")
+		if !validators && !cw.fallback {
+			entry = nil
+		}
+	}
+	base := http.Header{}
+	for k, v := range w.Header() {
+		base[k] = append([]string{}, v...)
+	}
+
+	upstream := r
+	if validators {
+		// the conditions of the client are answered by libra from the entry
+		upstream = new(http.Request)
+		*upstream = *r
+		upstream.Header = http.Header{}
+		for k, v := range r.Header {
+			upstream.Header[k] = v
+		}
+		for _, name := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"} {
+			upstream.Header.Del(name)
+		}
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			upstream.Header.Set("If-None-Match", etag)
+		}
+		if modified := entry.Header.Get("Last-Modified"); modified != "" {
+			upstream.Header.Set("If-Modified-Since", modified)
+		}
+		cw.revalidate = true
+	}
+	handler.ServeHTTP(cw, upstream)
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	now := time.Now()
+	if cw.failed {
+		// headers of the error response are dropped
+		header := w.Header()
+		for k := range header {
+			delete(header, k)
+		}
+		for k, v := range base {
+			header[k] = v
+		}
+		p.writeCacheEntry(w, r, entry, CacheStale, now)
+		return
+	}
+	if cw.notModified {
+		refreshed := refreshCacheEntry(entry, cw.header, now, config)
+		p.storeCache(p.getCacheStore(), refreshed, r)
+		p.writeCacheEntry(w, r, refreshed, CacheRevalidated, now)
+		return
+	}
+	if r.Method != http.MethodGet || cw.tooLarge {
+		return
+	}
+	cw.header.Del(p.GetRequestID().Header)
+	if entry = newCacheEntry(key, cw.status, cw.header, cw.body.Bytes(), now, config); entry != nil {
+		p.storeCache(p.getCacheStore(), entry, r)
+	}
+}
+
+// lookupCache get the entry of a request, the variant is selected by Vary
+func (p *ProxySrv) lookupCache(store CacheStore, key string, r *http.Request) *CacheEntry {
+	entry, err := store.Get(key)
+	if err != nil {
+		Logger.Error("cache store have an error %v%s", err, requestIDField(r))
+		return nil
+	}
+	if entry == nil || len(entry.Vary) == 0 {
+		return entry
+	}
+	if entry, err = store.Get(varyCacheKey(key, entry.Vary, r.Header)); err != nil {
+		Logger.Error("cache store have an error %v%s", err, requestIDField(r))
+		return nil
+	}
+	return entry
+}
+
+// storeCache save an entry, a response with Vary is saved as a variant of the url
+func (p *ProxySrv) storeCache(store CacheStore, entry *CacheEntry, r *http.Request) {
+	vary := varyHeaders(entry.Header)
+	var err error
+	if len(vary) > 0 {
+		if err = store.Set(&CacheEntry{Key: entry.Key, Vary: vary, Date: entry.Date, Expires: entry.Expires}); err == nil {
+			variant := *entry
+			variant.Key = varyCacheKey(entry.Key, vary, r.Header)
+			err = store.Set(&variant)
+		}
+	} else {
+		err = store.Set(entry)
+	}
+	if err != nil {
+		Logger.Error("cache store have an error %v%s", err, requestIDField(r))
+	}
+}
+
+// writeCacheEntry write a cached response, conditions of the request are answered by 304
+func (p *ProxySrv) writeCacheEntry(w http.ResponseWriter, r *http.Request, entry *CacheEntry, status string, now time.Time) {
+	header := w.Header()
+	for key, values := range entry.Header {
+		header[key] = append([]string{}, values...)
+	}
+	age := int64(now.Sub(entry.Date) / time.Second)
+	if age < 0 {
+		age = 0
+	}
+	header.Set("Age", strconv.FormatInt(age, 10))
+	header.Set(cacheStatusHeader, status)
+	p.setIdentityHeader(header)
+	p.setRequestIDHeader(header, r)
+
+	if entry.Status == http.StatusOK && notModified(r, entry.Header) {
+		header.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	header.Set("Content-Length", strconv.Itoa(len(entry.Body)))
+	w.WriteHeader(entry.Status)
+	if r.Method != http.MethodHead {
+		w.Write(entry.Body)
+	}
+}
+
+// newCacheEntry get the entry of a response, nil if the response can not be cached,
+// a response expired at once is kept only if it can be revalidated or served stale
+func newCacheEntry(key string, status int, header http.Header, body []byte, now time.Time, config CacheConfig) *CacheEntry {
+	cc := parseCacheControl(header)
+	if !cacheableStatus[status] || cc.has("no-store") || cc.has("private") || header.Get("Set-Cookie") != "" {
+		return nil
+	}
+	for _, name := range varyHeaders(header) {
+		if name == "*" {
+			return nil
+		}
+	}
+	// error pages of libra are rendered with the request id and time of the request
+	if _, ok := header[http.CanonicalHeaderKey(errorHeader)]; ok {
+		return nil
+	}
+
+	entry := &CacheEntry{Key: key, Status: status, Header: cacheHeader(header), Body: append([]byte{}, body...)}
+	entry.Date, entry.Expires = cacheFreshness(header, now, config.DefaultTTL)
+	if !entry.Expires.After(now) && header.Get("ETag") == "" && header.Get("Last-Modified") == "" &&
+		config.staleWindow(header, "stale-while-revalidate") == 0 && config.staleWindow(header, "stale-if-error") == 0 {
+		return nil
+	}
+	return entry
+}
+
+// refreshCacheEntry get a copy of the entry updated by the headers of a 304 response
+func refreshCacheEntry(entry *CacheEntry, header http.Header, now time.Time, config CacheConfig) *CacheEntry {
+	refreshed := *entry
+	refreshed.Header = http.Header{}
+	for key, values := range entry.Header {
+		refreshed.Header[key] = values
+	}
+	for _, key := range []string{"Cache-Control", "Expires", "Date", "ETag", "Last-Modified", "Vary"} {
+		if values, ok := header[key]; ok {
+			refreshed.Header[key] = values
+		}
+	}
+	refreshed.Date, refreshed.Expires = cacheFreshness(refreshed.Header, now, config.DefaultTTL)
+	return &refreshed
+}
+
+// cacheFreshness get when the response was generated and when it expires,
+// by s-maxage, max-age, Expires or the default ttl in order
+func cacheFreshness(header http.Header, now time.Time, defaultTTL time.Duration) (date, expires time.Time) {
+	date = now
+	if age, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil && age > 0 {
+		date = now.Add(-time.Duration(age) * time.Second)
+	}
+
+	cc := parseCacheControl(header)
+	if cc.has("no-cache") {
+		return date, date
+	}
+	if ttl, ok := cc.seconds("s-maxage"); ok {
+		return date, date.Add(ttl)
+	}
+	if ttl, ok := cc.seconds("max-age"); ok {
+		return date, date.Add(ttl)
+	}
+	if value := header.Get("Expires"); value != "" {
+		expires, err := http.ParseTime(value)
+		if err != nil {
+			return date, date
+		}
+		// Expires is relative to the clock of the origin
+		if origin, err := http.ParseTime(header.Get("Date")); err == nil {
+			return date, date.Add(expires.Sub(origin))
+		}
+		return date, expires
+	}
+	return date, date.Add(defaultTTL)
+}
+
+// cacheHeader copy headers of a response kept in the cache
+func cacheHeader(header http.Header) http.Header {
+	kept := http.Header{}
+	for key, values := range header {
+		kept[key] = append([]string{}, values...)
+	}
+	for _, key := range cacheSkipHeaders {
+		kept.Del(key)
+	}
+	return kept
+}
+
+// varyHeaders get canonical header names of Vary sorted
+func varyHeaders(header http.Header) []string {
+	names := []string{}
+	for _, value := range header["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// varyCacheKey get the key of the variant of a request
+func varyCacheKey(key string, vary []string, header http.Header) string {
+	var b bytes.Buffer
+	b.WriteString(key)
+	for _, name := range vary {
+		b.WriteString("\n" + name + ":" + strings.Join(header[name], ","))
+	}
+	return b.String()
+}
+
+// notModified check the conditions of a request are met by a cached response
+func notModified(r *http.Request, header http.Header) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, value := range strings.Split(match, ",") {
+			value = strings.TrimPrefix(strings.TrimSpace(value), "W/")
+			if value == "*" || value == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		modified, err := http.ParseTime(header.Get("Last-Modified"))
+		return err == nil && !modified.After(since)
+	}
+	return false
+}
+
+// cacheControl directives of a Cache-Control header
+type cacheControl map[string]string
+
+// parseCacheControl parse the Cache-Control headers, names are lower case
+func parseCacheControl(header http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, value := range header["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, arg := directive, ""
+			if i := strings.Index(directive, "="); i >= 0 {
+				name, arg = directive[:i], strings.Trim(strings.TrimSpace(directive[i+1:]), `"`)
+			}
+			cc[strings.ToLower(strings.TrimSpace(name))] = arg
+		}
+	}
+	return cc
+}
+
+// has check a directive is present
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds get the delta seconds of a directive
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	value, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// cacheWriter http.ResponseWriter copying the response of the origin for the cache,
+// a 304 answering the revalidation and a server error replaced by the fallback are kept from the client
+type cacheWriter struct {
+	http.ResponseWriter
+	maxSize     int64
+	revalidate  bool
+	fallback    bool // a stale entry can be served on server errors
+	failed      bool // a server error is replaced by the stale entry
+	status      int
+	header      http.Header // headers when the status is written
+	body        bytes.Buffer
+	tooLarge    bool
+	notModified bool
+}
+
+// WriteHeader keep the status and headers
+func (w *cacheWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	w.header = http.Header{}
+	for key, values := range w.ResponseWriter.Header() {
+		w.header[key] = append([]string{}, values...)
+	}
+	if w.revalidate && status == http.StatusNotModified {
+		w.notModified = true
+		return
+	}
+	if w.fallback && status >= http.StatusInternalServerError {
+		w.failed = true
+		return
+	}
+	w.ResponseWriter.Header().Set(cacheStatusHeader, CacheMiss)
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write copy the body until it is larger than max size
+func (w *cacheWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.notModified || w.failed {
+		return len(b), nil
+	}
+	if !w.tooLarge {
+		if int64(w.body.Len()+len(b)) > w.maxSize {
+			w.tooLarge = true
+			w.body.Reset()
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush flush the response if supported
+func (w *cacheWriter) Flush() {
+	if w.status == 0 || w.notModified || w.failed {
+		return
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap get the wrapped http.ResponseWriter
+func (w *cacheWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// discardWriter http.ResponseWriter dropping the response of a background request
+type discardWriter struct {
+	header http.Header
+}
+
+// Header get the headers
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+// Write drop the body
+func (w *discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// WriteHeader drop the status
+func (w *discardWriter) WriteHeader(status int) {}
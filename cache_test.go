@@ -0,0 +1,333 @@
+package libra
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheFreshness(t *testing.T) {
+	now := time.Now()
+	header := http.Header{}
+	header.Set("Cache-Control", "public, max-age=60, s-maxage=120")
+	if date, expires := cacheFreshness(header, now, 0); !date.Equal(now) || expires.Sub(now) != 120*time.Second {
+		t.Error("cache freshness have an error #1")
+	}
+	header.Set("Cache-Control", "max-age=60")
+	header.Set("Age", "10")
+	if _, expires := cacheFreshness(header, now, 0); expires.Sub(now) != 50*time.Second {
+		t.Error("cache freshness have an error #2")
+	}
+	header = http.Header{}
+	header.Set("Date", now.UTC().Format(http.TimeFormat))
+	header.Set("Expires", now.Add(time.Hour).UTC().Format(http.TimeFormat))
+	if _, expires := cacheFreshness(header, now, 0); expires.Sub(now) < 59*time.Minute {
+		t.Error("cache freshness have an error #3")
+	}
+	header.Set("Expires", "0")
+	if _, expires := cacheFreshness(header, now, time.Hour); expires.After(now) {
+		t.Error("cache freshness have an error #4")
+	}
+	if _, expires := cacheFreshness(http.Header{}, now, time.Minute); expires.Sub(now) != time.Minute {
+		t.Error("cache freshness have an error #5")
+	}
+	header = http.Header{}
+	header.Set("Cache-Control", "no-cache, max-age=60")
+	if _, expires := cacheFreshness(header, now, 0); expires.After(now) {
+		t.Error("cache freshness have an error #6")
+	}
+}
+
+func TestNewCacheEntry(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		status int
+		header map[string]string
+		cached bool
+	}{
+		{200, map[string]string{"Cache-Control": "max-age=60"}, true},
+		{200, map[string]string{"Cache-Control": "no-store, max-age=60"}, false},
+		{200, map[string]string{"Cache-Control": "private, max-age=60"}, false},
+		{200, map[string]string{"Cache-Control": "max-age=60", "Set-Cookie": "a=1"}, false},
+		{200, map[string]string{"Cache-Control": "max-age=60", "Vary": "*"}, false},
+		{500, map[string]string{"Cache-Control": "max-age=60"}, false},
+		{200, map[string]string{}, false},
+		{200, map[string]string{"ETag": `"v1"`}, true},
+		{404, map[string]string{"Expires": now.Add(time.Hour).UTC().Format(http.TimeFormat)}, true},
+		{404, map[string]string{"Expires": now.Add(time.Hour).UTC().Format(http.TimeFormat), errorHeader: ""}, false},
+	}
+	for k, c := range cases {
+		header := http.Header{}
+		for key, value := range c.header {
+			header.Set(key, value)
+		}
+		header.Set("X-Libra-Version", version)
+		entry := newCacheEntry("www.a.com/", c.status, header, nil, now, CacheConfig{})
+		if (entry != nil) != c.cached {
+			t.Error("new cache entry have an error #1", k)
+		}
+		if entry != nil && entry.Header.Get("X-Libra-Version") != "" {
+			t.Error("new cache entry have an error #2", k)
+		}
+	}
+}
+
+func TestCacheStaleWindow(t *testing.T) {
+	config := CacheConfig{StaleWhileRevalidate: time.Minute, StaleIfError: time.Hour, MaxStale: 30 * time.Minute}
+	header := http.Header{}
+	if config.staleWindow(header, "stale-while-revalidate") != time.Minute || config.staleWindow(header, "stale-if-error") != 30*time.Minute {
+		t.Error("cache stale window have an error #1")
+	}
+	header.Set("Cache-Control", "max-age=60, stale-while-revalidate=10")
+	if config.staleWindow(header, "stale-while-revalidate") != 10*time.Second {
+		t.Error("cache stale window have an error #2")
+	}
+	header.Set("Cache-Control", "no-cache")
+	if config.staleWindow(header, "stale-while-revalidate") != 0 || config.staleWindow(header, "stale-if-error") == 0 {
+		t.Error("cache stale window have an error #3")
+	}
+	header.Set("Cache-Control", "max-age=60, must-revalidate")
+	if config.staleWindow(header, "stale-if-error") != 0 {
+		t.Error("cache stale window have an error #4")
+	}
+	if err := (CacheConfig{MaxStale: -time.Second}).Validate(); err != ErrCacheInvalid {
+		t.Error("cache stale window have an error #5")
+	}
+}
+
+func TestCacheStale(t *testing.T) {
+	domain := "www.cachestale.com"
+	var hits, failing int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("error"))
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=60")
+		if r.URL.Path == "/sie" {
+			w.Header().Set("Cache-Control", "max-age=0")
+		}
+		if strings.HasPrefix(r.URL.Path, "/legacy/") || strings.HasPrefix(r.URL.Path, "/new/") {
+			w.Write([]byte(r.URL.Path))
+			return
+		}
+		w.Write([]byte("body " + strconv.Itoa(int(n))))
+	}))
+	defer origin.Close()
+
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	proxy.RegistSite(domain, "roundrobin", "http").AddAddr(domain, origin.Listener.Addr().String(), 1)
+	proxy.SetCacheStore(NewMemoryCacheStore(1 << 20))
+	proxy.SetCache(domain, &CacheConfig{StaleIfError: time.Hour, MaxStale: time.Minute})
+	handler := proxy.Handler()
+	get := func(path string) (*httptest.ResponseRecorder, string) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "http://"+domain+path, nil))
+		body, _ := ioutil.ReadAll(w.Body)
+		return w, string(body)
+	}
+
+	// stale-while-revalidate serves the stale response and refreshes it in background once
+	get("/swr")
+	w, body := get("/swr")
+	if w.Header().Get("X-Cache") != CacheStale || body != "body 1" {
+		t.Error("cache stale have an error #1", w.Header().Get("X-Cache"), body)
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&hits) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, body = get("/swr"); body != "body 2" && body != "body 3" {
+		t.Error("cache stale have an error #2", body)
+	}
+
+	// the background refresh of a rewritten request fetches the rewritten path
+	proxy.SetRewriteRules(domain, []RewriteRule{{Match: "^/legacy/(.*)$", Action: RewritePath, Replace: "/new/$1"}})
+	get("/legacy/a")
+	before := atomic.LoadInt32(&hits)
+	if w, body = get("/legacy/a"); w.Header().Get("X-Cache") != CacheStale || body != "/new/a" {
+		t.Error("cache stale have an error #2.1", w.Header().Get("X-Cache"), body)
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&hits) == before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, body = get("/legacy/a"); body != "/new/a" {
+		t.Error("cache stale have an error #2.2", body)
+	}
+	proxy.SetRewriteRules(domain, nil)
+
+	// stale-if-error serves the stale response when the origin fails
+	get("/sie")
+	atomic.StoreInt32(&failing, 1)
+	if w, body = get("/sie"); w.Code != 200 || w.Header().Get("X-Cache") != CacheStale || !strings.HasPrefix(body, "body") {
+		t.Error("cache stale have an error #3", w.Code, body)
+	}
+
+	// the response is not served after max stale
+	proxy.getCacheStore().Set(&CacheEntry{Key: domain + "/old", Status: 200, Body: []byte("old"), Date: time.Now().Add(-time.Hour), Expires: time.Now().Add(-2 * time.Minute)})
+	if w, _ = get("/old"); w.Code != 500 || w.Header().Get("X-Cache") == CacheStale {
+		t.Error("cache stale have an error #4", w.Code)
+	}
+
+	// stale-if-error serves the stale response when all endpoints are down
+	atomic.StoreInt32(&failing, 0)
+	get("/sie")
+	origin.Close()
+	if w, body = get("/sie"); w.Code != 200 || w.Header().Get("X-Cache") != CacheStale {
+		t.Error("cache stale have an error #5", w.Code, body)
+	}
+}
+
+func TestCacheMiddleware(t *testing.T) {
+	domain := "www.cache.com"
+	var hits int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/etag":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+			w.Write([]byte(r.Header.Get("Accept-Language")))
+			return
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/gone":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("body " + strconv.Itoa(int(n))))
+	}))
+	defer origin.Close()
+
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	proxy.RegistSite(domain, "roundrobin", "http").AddAddr(domain, origin.Listener.Addr().String(), 1)
+	proxy.SetCacheStore(NewMemoryCacheStore(1 << 20))
+	if err := proxy.SetCache(domain, &CacheConfig{DefaultTTL: -time.Second}); err != ErrCacheInvalid {
+		t.Error("cache middleware have an error #1")
+	}
+	proxy.SetCache(domain, &CacheConfig{})
+	handler := proxy.Handler()
+	get := func(method, path string, header map[string]string) (*httptest.ResponseRecorder, string) {
+		req := httptest.NewRequest(method, "http://"+domain+path, nil)
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		body, _ := ioutil.ReadAll(w.Body)
+		return w, string(body)
+	}
+
+	w, body := get("GET", "/fresh", nil)
+	if w.Header().Get("X-Cache") != CacheMiss || body != "body 1" {
+		t.Error("cache middleware have an error #2", body)
+	}
+	w, body = get("GET", "/fresh", map[string]string{"X-Request-Id": "cached-1"})
+	if w.Header().Get("X-Cache") != CacheHit || body != "body 1" || w.Header().Get("Age") != "0" ||
+		w.Header().Get("X-Request-Id") != "cached-1" || w.Header().Get("X-LIBRA-VERSION") != version || hits != 1 {
+		t.Error("cache middleware have an error #3", w.Header())
+	}
+	if w, _ = get("HEAD", "/fresh", nil); w.Header().Get("X-Cache") != CacheHit || w.Header().Get("Content-Length") != "6" {
+		t.Error("cache middleware have an error #4")
+	}
+	if w, _ = get("GET", "/fresh", map[string]string{"Cache-Control": "no-cache"}); w.Header().Get("X-Cache") != CacheMiss || hits != 2 {
+		t.Error("cache middleware have an error #5")
+	}
+	if w, _ = get("GET", "/fresh", map[string]string{"Authorization": "Basic eA=="}); w.Header().Get("X-Cache") != CacheBypass || hits != 3 {
+		t.Error("cache middleware have an error #6")
+	}
+
+	// no-cache responses are revalidated by ETag
+	get("GET", "/etag", nil)
+	w, body = get("GET", "/etag", nil)
+	if w.Code != 200 || w.Header().Get("X-Cache") != CacheRevalidated || body != "body 4" || hits != 5 {
+		t.Error("cache middleware have an error #7", w.Code, body, hits)
+	}
+	if w, _ = get("GET", "/etag", map[string]string{"If-None-Match": `"v1"`}); w.Code != http.StatusNotModified {
+		t.Error("cache middleware have an error #8", w.Code)
+	}
+
+	// variants by Vary
+	if _, body = get("GET", "/vary", map[string]string{"Accept-Language": "en"}); body != "en" {
+		t.Error("cache middleware have an error #9")
+	}
+	get("GET", "/vary", map[string]string{"Accept-Language": "zh"})
+	w, body = get("GET", "/vary", map[string]string{"Accept-Language": "en"})
+	if w.Header().Get("X-Cache") != CacheHit || body != "en" || hits != 8 {
+		t.Error("cache middleware have an error #10", body, hits)
+	}
+
+	get("GET", "/private", nil)
+	if w, _ = get("GET", "/private", nil); w.Header().Get("X-Cache") != CacheMiss {
+		t.Error("cache middleware have an error #11")
+	}
+
+	// purge by url and prefix, an unsafe method purges its url
+	if n, _ := proxy.PurgeCache(domain, "/vary", false); n != 3 {
+		t.Error("cache middleware have an error #12", n)
+	}
+	get("POST", "/fresh", nil)
+	if w, _ = get("GET", "/fresh", nil); w.Header().Get("X-Cache") != CacheMiss {
+		t.Error("cache middleware have an error #13")
+	}
+	if n, _ := proxy.PurgeCache(domain, "/", true); n != 2 {
+		t.Error("cache middleware have an error #14", n)
+	}
+
+	// max-stale of the request accepts an expired response
+	proxy.SetCacheStore(NewMemoryCacheStore(1 << 20))
+	proxy.getCacheStore().Set(&CacheEntry{Key: domain + "/old", Status: 200, Body: []byte("old"), Date: time.Now().Add(-time.Minute), Expires: time.Now().Add(-time.Second)})
+	if w, body = get("GET", "/old", map[string]string{"Cache-Control": "max-stale=10"}); w.Header().Get("X-Cache") != CacheStale || body != "old" {
+		t.Error("cache middleware have an error #15")
+	}
+	if w, _ = get("GET", "/old", nil); w.Header().Get("X-Cache") != CacheMiss {
+		t.Error("cache middleware have an error #16")
+	}
+
+	// error pages of libra replacing the origin ones are not cached
+	proxy.SetErrorPage(http.StatusNotFound, "{#request_id#}")
+	proxy.SetCache(domain, &CacheConfig{DefaultTTL: time.Minute})
+	get("GET", "/gone", map[string]string{"X-Request-Id": "gone-1"})
+	if w, body = get("GET", "/gone", map[string]string{"X-Request-Id": "gone-2"}); w.Code != 404 || w.Header().Get("X-Cache") != CacheMiss || body != "gone-2" {
+		t.Error("cache middleware have an error #17", w.Code, w.Header().Get("X-Cache"), body)
+	}
+
+	// response header rules are applied for each client, not kept in the entry
+	proxy.SetHeaderRules(domain, []HeaderRule{
+		{Target: HeaderResponse, Action: HeaderSet, Name: "X-Client", Value: "{#client_ip#}"},
+		{Target: HeaderResponse, Action: HeaderSet, Name: "X-Endpoint", Value: "{#endpoint#}"},
+	})
+	getFrom := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://"+domain+"/fresh", nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	if w = getFrom("198.51.100.1:1000"); w.Header().Get("X-Client") != "198.51.100.1" || w.Header().Get("X-Endpoint") == "" {
+		t.Error("cache middleware have an error #18", w.Header())
+	}
+	w = getFrom("198.51.100.2:1000")
+	if w.Header().Get("X-Cache") != CacheHit || w.Header().Get("X-Client") != "198.51.100.2" || w.Header().Get("X-Endpoint") != "" {
+		t.Error("cache middleware have an error #19", w.Header())
+	}
+	proxy.SetHeaderRules(domain, nil)
+}
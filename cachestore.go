@@ -0,0 +1,290 @@
+package libra
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheEntry a cached response, entries are not modified once stored
+type CacheEntry struct {
+	Key     string      `json:"key"`
+	Status  int         `json:"status,omitempty"`
+	Header  http.Header `json:"header,omitempty"`
+	Body    []byte      `json:"body,omitempty"`
+	Vary    []string    `json:"vary,omitempty"` // request headers selecting the variant, set on the entry of the url only
+	Date    time.Time   `json:"date"`           // when the response was generated by the origin
+	Expires time.Time   `json:"expires"`        // fresh until
+}
+
+// size get the bytes taken by the entry
+func (e *CacheEntry) size() int64 {
+	size := int64(len(e.Key) + len(e.Body) + 64)
+	for key, values := range e.Header {
+		for _, value := range values {
+			size += int64(len(key) + len(value))
+		}
+	}
+	for _, name := range e.Vary {
+		size += int64(len(name))
+	}
+	return size
+}
+
+// CacheStore keep cached responses by key, it must be safe for concurrent use
+type CacheStore interface {
+	// Get get an entry, nil if not existed
+	Get(key string) (*CacheEntry, error)
+	// Set add or replace the entry of entry.Key
+	Set(entry *CacheEntry) error
+	// Purge delete entries whose key matches, it returns the count deleted
+	Purge(match func(key string) bool) (int, error)
+}
+
+// cacheItem an entry in the lru list
+type cacheItem struct {
+	key   string
+	size  int64
+	entry *CacheEntry // nil for the disk store
+}
+
+// cacheLRU keys by recent use bounded by bytes, it should be called with the lock of the store
+type cacheLRU struct {
+	maxBytes int64
+	size     int64
+	items    map[string]*list.Element
+	list     *list.List // front is the most recent
+}
+
+// newCacheLRU get a cacheLRU point
+func newCacheLRU(maxBytes int64) *cacheLRU {
+	return &cacheLRU{maxBytes: maxBytes, items: map[string]*list.Element{}, list: list.New()}
+}
+
+// get get an item and mark it recently used
+func (c *cacheLRU) get(key string) *cacheItem {
+	elem, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	c.list.MoveToFront(elem)
+	return elem.Value.(*cacheItem)
+}
+
+// add add or replace an item, it returns the items evicted,
+// an item larger than max bytes is evicted at once
+func (c *cacheLRU) add(item *cacheItem) []*cacheItem {
+	c.remove(item.key)
+	if item.size > c.maxBytes {
+		return []*cacheItem{item}
+	}
+	c.items[item.key] = c.list.PushFront(item)
+	c.size += item.size
+
+	evicted := []*cacheItem{}
+	for c.size > c.maxBytes && c.list.Len() > 0 {
+		oldest := c.list.Back().Value.(*cacheItem)
+		c.remove(oldest.key)
+		evicted = append(evicted, oldest)
+	}
+	return evicted
+}
+
+// remove delete an item, false if not existed
+func (c *cacheLRU) remove(key string) bool {
+	elem, ok := c.items[key]
+	if !ok {
+		return false
+	}
+	c.list.Remove(elem)
+	delete(c.items, key)
+	c.size -= elem.Value.(*cacheItem).size
+	return true
+}
+
+// match get keys matched
+func (c *cacheLRU) match(match func(key string) bool) []string {
+	keys := []string{}
+	for key := range c.items {
+		if match(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// MemoryCacheStore in memory CacheStore, the least recently used entries
+// are evicted when the entries take more than max bytes
+type MemoryCacheStore struct {
+	mu  sync.Mutex
+	lru *cacheLRU
+}
+
+// NewMemoryCacheStore get a MemoryCacheStore point
+func NewMemoryCacheStore(maxBytes int64) *MemoryCacheStore {
+	return &MemoryCacheStore{lru: newCacheLRU(maxBytes)}
+}
+
+// Get get an entry
+func (s *MemoryCacheStore) Get(key string) (*CacheEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if item := s.lru.get(key); item != nil {
+		return item.entry, nil
+	}
+	return nil, nil
+}
+
+// Set add an entry, an entry larger than max bytes is not kept
+func (s *MemoryCacheStore) Set(entry *CacheEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lru.add(&cacheItem{key: entry.Key, size: entry.size(), entry: entry})
+	return nil
+}
+
+// Purge delete matched entries
+func (s *MemoryCacheStore) Purge(match func(key string) bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := s.lru.match(match)
+	for _, key := range keys {
+		s.lru.remove(key)
+	}
+	return len(keys), nil
+}
+
+// Size get bytes taken by the entries
+func (s *MemoryCacheStore) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.size
+}
+
+// DiskCacheStore CacheStore saving an entry per file in a dir, the least recently used
+// entries are deleted when the files take more than max bytes, entries are kept over restarts
+type DiskCacheStore struct {
+	dir string
+	mu  sync.Mutex
+	lru *cacheLRU
+}
+
+// NewDiskCacheStore get a DiskCacheStore point, entries found in dir are loaded
+func NewDiskCacheStore(dir string, maxBytes int64) (*DiskCacheStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &DiskCacheStore{dir: dir, lru: newCacheLRU(maxBytes)}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	// the oldest files are added first so they are evicted first
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".cache") {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		entry, err := readCacheFile(path)
+		if err != nil || s.path(entry.Key) != path {
+			os.Remove(path)
+			continue
+		}
+		for _, evicted := range s.lru.add(&cacheItem{key: entry.Key, size: file.Size()}) {
+			os.Remove(s.path(evicted.key))
+		}
+	}
+	return s, nil
+}
+
+// path get the file path of a key
+func (s *DiskCacheStore) path(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".cache")
+}
+
+// Get read an entry from its file
+func (s *DiskCacheStore) Get(key string) (*CacheEntry, error) {
+	s.mu.Lock()
+	item := s.lru.get(key)
+	s.mu.Unlock()
+	if item == nil {
+		return nil, nil
+	}
+
+	entry, err := readCacheFile(s.path(key))
+	if os.IsNotExist(err) {
+		s.mu.Lock()
+		s.lru.remove(key)
+		s.mu.Unlock()
+		return nil, nil
+	}
+	if err != nil || entry.Key != key {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Set write an entry to its file
+func (s *DiskCacheStore) Set(entry *CacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := s.path(entry.Key)
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	for _, evicted := range s.lru.add(&cacheItem{key: entry.Key, size: int64(len(data))}) {
+		os.Remove(s.path(evicted.key))
+	}
+	return nil
+}
+
+// Purge delete files of matched entries
+func (s *DiskCacheStore) Purge(match func(key string) bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := s.lru.match(match)
+	for _, key := range keys {
+		s.lru.remove(key)
+		if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
+
+// readCacheFile decode an entry file
+func readCacheFile(path string) (*CacheEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entry := &CacheEntry{}
+	if err = json.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
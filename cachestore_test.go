@@ -0,0 +1,91 @@
+package libra
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMemoryCacheStore(t *testing.T) {
+	store := NewMemoryCacheStore(600)
+	body := []byte(strings.Repeat("a", 200))
+	store.Set(&CacheEntry{Key: "www.a.com/1", Body: body})
+	store.Set(&CacheEntry{Key: "www.a.com/2", Body: body})
+	if entry, _ := store.Get("www.a.com/1"); entry == nil || store.Size() == 0 {
+		t.Error("MemoryCacheStore have an error #1")
+	}
+
+	// the least recently used /2 is evicted
+	store.Set(&CacheEntry{Key: "www.a.com/3", Body: body})
+	if entry, _ := store.Get("www.a.com/2"); entry != nil {
+		t.Error("MemoryCacheStore have an error #2")
+	}
+	if entry, _ := store.Get("www.a.com/1"); entry == nil {
+		t.Error("MemoryCacheStore have an error #3")
+	}
+	if store.Size() > 600 {
+		t.Error("MemoryCacheStore have an error #4", store.Size())
+	}
+
+	// an entry larger than the store is not kept
+	store.Set(&CacheEntry{Key: "www.a.com/big", Body: make([]byte, 1000)})
+	if entry, _ := store.Get("www.a.com/big"); entry != nil {
+		t.Error("MemoryCacheStore have an error #5")
+	}
+
+	n, _ := store.Purge(func(key string) bool { return strings.HasPrefix(key, "www.a.com/") })
+	if n != 2 || store.Size() != 0 {
+		t.Error("MemoryCacheStore have an error #6", n)
+	}
+}
+
+func TestDiskCacheStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libra-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewDiskCacheStore(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := &CacheEntry{Key: "www.a.com/1", Status: 200, Header: map[string][]string{"Etag": {`"v1"`}}, Body: []byte("hello")}
+	if err = store.Set(entry); err != nil {
+		t.Fatal(err)
+	}
+	store.Set(&CacheEntry{Key: "www.a.com/2", Body: []byte("world")})
+	if got, err := store.Get("www.a.com/1"); err != nil || got == nil || string(got.Body) != "hello" || got.Header.Get("ETag") != `"v1"` {
+		t.Error("DiskCacheStore have an error #1")
+	}
+
+	// entries are loaded by a new store on the same dir
+	store, err = NewDiskCacheStore(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.Get("www.a.com/2"); got == nil || string(got.Body) != "world" {
+		t.Error("DiskCacheStore have an error #2")
+	}
+	if n, _ := store.Purge(func(key string) bool { return key == "www.a.com/1" }); n != 1 {
+		t.Error("DiskCacheStore have an error #3")
+	}
+	if got, _ := store.Get("www.a.com/1"); got != nil {
+		t.Error("DiskCacheStore have an error #4")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Error("DiskCacheStore have an error #5", len(files))
+	}
+
+	// files over max bytes are evicted
+	store, _ = NewDiskCacheStore(dir, 300)
+	store.Set(&CacheEntry{Key: "www.a.com/3", Body: []byte(strings.Repeat("a", 100))})
+	store.Set(&CacheEntry{Key: "www.a.com/4", Body: []byte(strings.Repeat("a", 100))})
+	if got, _ := store.Get("www.a.com/2"); got != nil {
+		t.Error("DiskCacheStore have an error #6")
+	}
+	if got, _ := store.Get("www.a.com/4"); got == nil {
+		t.Error("DiskCacheStore have an error #7")
+	}
+}
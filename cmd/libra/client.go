@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/zhuCheer/libra"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// adminClient talk to the libra admin api
+type adminClient struct {
+	addr   string
+	client *http.Client
+}
+
+// newAdminClient new an admin api client, addr is host:port or an url
+func newAdminClient(addr string) *adminClient {
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		addr = "http://" + addr
+	}
+	return &adminClient{
+		addr:   addr,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// listSites get all sites
+func (c *adminClient) listSites() ([]libra.SiteView, error) {
+	sites := []libra.SiteView{}
+	err := c.do(http.MethodGet, "/api/sites", nil, &sites)
+	return sites, err
+}
+
+// addEndpoint add an endpoint to a site
+func (c *adminClient) addEndpoint(domain, addr string, weight uint32) error {
+	return c.do(http.MethodPost, "/api/endpoint/add", libra.EndpointRequest{Domain: domain, Addr: addr, Weight: weight}, nil)
+}
+
+// delEndpoint delete an endpoint from a site
+func (c *adminClient) delEndpoint(domain, addr string) error {
+	return c.do(http.MethodPost, "/api/endpoint/del", libra.EndpointRequest{Domain: domain, Addr: addr}, nil)
+}
+
+// setWeight change the weight of an endpoint, ramp is a duration like 30s or empty
+func (c *adminClient) setWeight(domain, addr string, weight uint32, ramp string) error {
+	return c.do(http.MethodPost, "/api/endpoint/weight", libra.EndpointRequest{Domain: domain, Addr: addr, Weight: weight, Ramp: ramp}, nil)
+}
+
+// drainEndpoint drain an endpoint of a site, it is deleted once drained if remove is true
+func (c *adminClient) drainEndpoint(domain, addr string, remove bool, timeout string) error {
+	return c.do(http.MethodPost, "/api/endpoint/drain", libra.DrainRequest{Domain: domain, Addr: addr, Remove: remove, Timeout: timeout}, nil)
+}
+
+// setState change the state of an endpoint
+func (c *adminClient) setState(domain, addr, state string) error {
+	return c.do(http.MethodPost, "/api/endpoint/state", libra.StateRequest{Domain: domain, Addr: addr, State: state}, nil)
+}
+
+// setPriority change the priority level of an endpoint
+func (c *adminClient) setPriority(domain, addr string, priority int) error {
+	return c.do(http.MethodPost, "/api/endpoint/priority", libra.PriorityRequest{Domain: domain, Addr: addr, Priority: priority}, nil)
+}
+
+// setMaxConns change max requests in flight to an endpoint
+func (c *adminClient) setMaxConns(domain, addr string, maxConns uint32) error {
+	return c.do(http.MethodPost, "/api/endpoint/maxconns", libra.MaxConnsRequest{Domain: domain, Addr: addr, MaxConns: maxConns}, nil)
+}
+
+// purgeCache delete cached responses of a site by url or url prefix
+func (c *adminClient) purgeCache(domain, url, prefix string) (int, error) {
+	result := libra.PurgeResult{}
+	err := c.do(http.MethodPost, "/api/cache/purge", libra.PurgeRequest{Domain: domain, URL: url, Prefix: prefix}, &result)
+	return result.Purged, err
+}
+
+// addIPFilter add a CIDR to an ip filter rule of a site
+func (c *adminClient) addIPFilter(domain, path, action, cidr string) error {
+	return c.do(http.MethodPost, "/api/ipfilter/add", libra.IPFilterRequest{Domain: domain, Path: path, Action: libra.IPAction(action), CIDR: cidr}, nil)
+}
+
+// delIPFilter delete a CIDR from an ip filter rule of a site
+func (c *adminClient) delIPFilter(domain, path, action, cidr string) error {
+	return c.do(http.MethodPost, "/api/ipfilter/del", libra.IPFilterRequest{Domain: domain, Path: path, Action: libra.IPAction(action), CIDR: cidr}, nil)
+}
+
+// do send a request to admin api and decode data into out
+func (c *adminClient) do(method, path string, params interface{}, out interface{}) error {
+	var body bytes.Buffer
+	if params != nil {
+		if err := json.NewEncoder(&body).Encode(params); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, c.addr+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	resp := libra.AdminResponse{Data: out}
+	if err = json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return fmt.Errorf("admin api responds %s", res.Status)
+	}
+	if res.StatusCode != http.StatusOK {
+		return errors.New(resp.Msg)
+	}
+	return nil
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/zhuCheer/libra"
+	"github.com/zhuCheer/libra/balancer"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Config libra command config, it can be loaded from a json file
+type Config struct {
+	Listen   string            `json:"listen"`
+	Admin    string            `json:"admin"`
+	LogLevel string            `json:"log_level"`
+	Persist  string            `json:"persist"`
+	Headers  map[string]string `json:"headers"`
+	Sites    []SiteConfig      `json:"sites"`
+
+	ErrorPages     map[int]string         `json:"error_pages,omitempty"`     // html template file by status code
+	TrustedProxies []string               `json:"trusted_proxies,omitempty"` // CIDR or ip of proxies in front of libra
+	Identity       *libra.Identity        `json:"identity,omitempty"`        // like {"mode":"custom","server":"web"}
+	RequestID      *libra.RequestIDConfig `json:"request_id,omitempty"`      // like {"header":"X-Trace-Id","format":"ulid"}
+	Tracing        *libra.TracingConfig   `json:"tracing,omitempty"`         // like {"sample_rate":0.1}, spans are exported to otlp
+	OTLP           *libra.OTLPExporter    `json:"otlp,omitempty"`            // like {"endpoint":"http://127.0.0.1:4318/v1/traces"}
+	CacheStore     *CacheStoreConfig      `json:"cache_store,omitempty"`     // store of the response cache of sites
+	TLS            *TLSConfig             `json:"tls,omitempty"`             // https listener terminating TLS
+}
+
+// TLSConfig https listener of the proxy, it serves the same sites as the http one
+type TLSConfig struct {
+	Listen   string `json:"listen"` // like 0.0.0.0:5443
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// CacheStoreConfig store of cached responses, entries are saved in Dir if it is set, or in memory
+type CacheStoreConfig struct {
+	MaxBytes int64  `json:"max_bytes"`
+	Dir      string `json:"dir,omitempty"`
+}
+
+// SiteConfig a site and its origin endpoints
+type SiteConfig struct {
+	Domain    string                  `json:"domain"`
+	LoadType  string                  `json:"load_type"`
+	Scheme    string                  `json:"scheme"`
+	Endpoints []balancer.EndpointItem `json:"endpoints"`
+	SlowStart *balancer.SlowStart     `json:"slow_start,omitempty"` // like {"window":"30s"}
+	Failover  float64                 `json:"failover_threshold,omitempty"`
+	Breaker   *libra.BreakerConfig    `json:"breaker,omitempty"`
+	RateLimit []libra.RateLimitRule   `json:"rate_limits,omitempty"`
+	Queue     *libra.QueueConfig      `json:"queue,omitempty"` // like {"size":100,"timeout":"5s"}
+	Adaptive  *libra.AdaptiveConfig   `json:"adaptive,omitempty"`
+	Forwarded *libra.ForwardedConfig  `json:"forwarded,omitempty"`
+	Headers   []libra.HeaderRule      `json:"header_rules,omitempty"`
+	Cache     *libra.CacheConfig      `json:"cache,omitempty"` // like {"default_ttl":"1m","stale_if_error":"1h"}
+	Coalesce  []libra.CoalesceRule    `json:"coalesce_rules,omitempty"`
+	Compress  *libra.CompressConfig   `json:"compress,omitempty"` // like {"types":["text/html"],"min_size":1024}
+	Rewrites  []libra.RewriteRule     `json:"rewrite_rules,omitempty"`
+	Host      *libra.HostPolicy       `json:"host_policy,omitempty"` // like {"mode":"custom","host":"bucket.storage.com"}
+	HTTPS     *libra.HTTPSConfig      `json:"https,omitempty"`       // like {"redirect":true,"hsts":{"max_age":"8760h"}}
+	IPRules   []libra.IPRule          `json:"ip_rules,omitempty"`    // like [{"path":"/admin/","action":"allow","cidrs":["10.0.0.0/8"]}]
+}
+
+// defaultConfig the config used when no file given
+func defaultConfig() *Config {
+	return &Config{
+		Listen:   "0.0.0.0:5000",
+		Admin:    "127.0.0.1:5080",
+		LogLevel: "info",
+		Headers:  map[string]string{},
+	}
+}
+
+// loadConfig read a json config file, fields missing in the file keep default value
+func loadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parse config %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate check the config, it returns all problems found
+func (c *Config) Validate() error {
+	problems := []string{}
+
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		problems = append(problems, fmt.Sprintf("listen %q is not a valid address", c.Listen))
+	}
+	if c.Admin != "" {
+		if _, _, err := net.SplitHostPort(c.Admin); err != nil {
+			problems = append(problems, fmt.Sprintf("admin %q is not a valid address", c.Admin))
+		}
+	}
+
+	domains := map[string]bool{}
+	for k, site := range c.Sites {
+		if site.Domain == "" {
+			problems = append(problems, fmt.Sprintf("sites[%d] domain is empty", k))
+		} else if domains[site.Domain] {
+			problems = append(problems, fmt.Sprintf("sites[%d] domain %s is duplicated", k, site.Domain))
+		}
+		domains[site.Domain] = true
+
+		if site.LoadType != "" && !balancer.ValidLoadType(site.LoadType) {
+			problems = append(problems, fmt.Sprintf("sites[%d] load_type %q is not supported", k, site.LoadType))
+		}
+		if site.Scheme != "" && site.Scheme != "http" && site.Scheme != "https" {
+			problems = append(problems, fmt.Sprintf("sites[%d] scheme %q is not supported", k, site.Scheme))
+		}
+
+		if site.SlowStart != nil && (site.SlowStart.Window < 0 || site.SlowStart.Aggression < 0) {
+			problems = append(problems, fmt.Sprintf("sites[%d] slow_start is invalid", k))
+		}
+		if site.Failover < 0 || site.Failover > 1 {
+			problems = append(problems, fmt.Sprintf("sites[%d] failover_threshold should be in 0~1", k))
+		}
+		if site.Breaker != nil {
+			if err := site.Breaker.Validate(); err != nil {
+				problems = append(problems, fmt.Sprintf("sites[%d] breaker: %v", k, err))
+			}
+		}
+		for i, rule := range site.RateLimit {
+			if err := rule.Validate(); err != nil {
+				problems = append(problems, fmt.Sprintf("sites[%d].rate_limits[%d]: %v", k, i, err))
+			}
+		}
+		if site.Queue != nil {
+			if err := site.Queue.Validate(); err != nil {
+				problems = append(problems, fmt.Sprintf("sites[%d] queue: %v", k, err))
+			}
+		}
+		if site.Adaptive != nil {
+			if err := site.Adaptive.Validate(); err != nil {
+				problems = append(problems, fmt.Sprintf("sites[%d] adaptive: %v", k, err))
+			}
+		}
+		if site.Forwarded != nil {
+			if err := site.Forwarded.Validate(); err != nil {
+				problems = append(problems, fmt.Sprintf("sites[%d] forwarded: %v", k, err))
+			}
+		}
+		for i, rule := range site.Headers {
+			if err := rule.Validate(); err != nil {
+				problems = append(problems, fmt.Sprintf("sites[%d].header_rules[%d]: %v", k, i, err))
+			}
+		}
+		if site.Cache != nil {
+			if err := site.Cache.Validate(); err != nil {
+				problems = append(problems, fmt.Sprintf("sites[%d] cache: %v", k, err))
+			}
+		}
+		for i, rule := range site.Coalesce {
+			if err := rule.Validate(); err != nil {
+				problems = append(problems, fmt.Sprintf("sites[%d].coalesce_rules[%d]: %v", k, i, err))
+			}
+		}
+		if site.Compress != nil {
+			if err := site.Compress.Validate(); err != nil {
+				problems = append(problems, fmt.Sprintf("sites[%d] compress: %v", k, err))
+			}
+		}
+		for i, rule := range site.Rewrites {
+			if err := rule.Validate(); err != nil {
+				problems = append(problems, fmt.Sprintf("sites[%d].rewrite_rules[%d]: %v", k, i, err))
+			}
+		}
+		if site.Host != nil {
+			if err := site.Host.Validate(); err != nil {
+				problems = append(problems, fmt.Sprintf("sites[%d] host_policy: %v", k, err))
+			}
+		}
+		if site.HTTPS != nil {
+			if err := site.HTTPS.Validate(); err != nil {
+				problems = append(problems, fmt.Sprintf("sites[%d] https: %v", k, err))
+			}
+		}
+		for i, rule := range site.IPRules {
+			if err := rule.Validate(); err != nil {
+				problems = append(problems, fmt.Sprintf("sites[%d].ip_rules[%d]: %v", k, i, err))
+			}
+		}
+
+		endpoints := map[string]bool{}
+		for i, item := range site.Endpoints {
+			if item.Endpoint == "" {
+				problems = append(problems, fmt.Sprintf("sites[%d].endpoints[%d] endpoint is empty", k, i))
+			} else if endpoints[item.Endpoint] {
+				problems = append(problems, fmt.Sprintf("sites[%d].endpoints[%d] endpoint %s is duplicated", k, i, item.Endpoint))
+			}
+			endpoints[item.Endpoint] = true
+			if _, err := balancer.ParseState(string(item.State)); err != nil {
+				problems = append(problems, fmt.Sprintf("sites[%d].endpoints[%d] state %q is not supported", k, i, item.State))
+			}
+		}
+	}
+
+	statuses := []int{}
+	for status := range c.ErrorPages {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	for _, status := range statuses {
+		if status < 400 || status > 599 {
+			problems = append(problems, fmt.Sprintf("error_pages status %d is not an error", status))
+		}
+	}
+	if err := libra.NewHttpProxySrv(c.Listen, nil).SetTrustedProxies(c.TrustedProxies); err != nil {
+		problems = append(problems, fmt.Sprintf("trusted_proxies: %v", err))
+	}
+	if c.Identity != nil {
+		if err := c.Identity.Validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("identity: %v", err))
+		}
+	}
+	if c.RequestID != nil {
+		if err := c.RequestID.Validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("request_id: %v", err))
+		}
+	}
+	if c.Tracing != nil {
+		if err := c.Tracing.Validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("tracing: %v", err))
+		}
+		if c.OTLP == nil {
+			problems = append(problems, "tracing: otlp is required")
+		}
+	}
+	if c.OTLP != nil {
+		if err := c.OTLP.Validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("otlp: %v", err))
+		}
+	}
+	if c.CacheStore != nil && c.CacheStore.MaxBytes <= 0 {
+		problems = append(problems, "cache_store max_bytes should be greater than 0")
+	}
+	if c.TLS != nil {
+		if _, _, err := net.SplitHostPort(c.TLS.Listen); err != nil {
+			problems = append(problems, fmt.Sprintf("tls listen %q is not a valid address", c.TLS.Listen))
+		}
+		if c.TLS.CertFile == "" || c.TLS.KeyFile == "" {
+			problems = append(problems, "tls cert_file and key_file are required")
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Apply register all sites and endpoints to the proxy server
+func (c *Config) Apply(srv *libra.ProxySrv) error {
+	for status, path := range c.ErrorPages {
+		page, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("error page %d: %v", status, err)
+		}
+		srv.SetErrorPage(status, string(page))
+	}
+	if err := srv.SetTrustedProxies(c.TrustedProxies); err != nil {
+		return fmt.Errorf("trusted proxies: %v", err)
+	}
+	if c.Identity != nil {
+		if err := srv.SetIdentity(*c.Identity); err != nil {
+			return fmt.Errorf("identity: %v", err)
+		}
+	}
+	if c.RequestID != nil {
+		if err := srv.SetRequestID(c.RequestID); err != nil {
+			return fmt.Errorf("request id: %v", err)
+		}
+	}
+	if c.CacheStore != nil {
+		if c.CacheStore.Dir == "" {
+			srv.SetCacheStore(libra.NewMemoryCacheStore(c.CacheStore.MaxBytes))
+		} else {
+			store, err := libra.NewDiskCacheStore(c.CacheStore.Dir, c.CacheStore.MaxBytes)
+			if err != nil {
+				return fmt.Errorf("cache store: %v", err)
+			}
+			srv.SetCacheStore(store)
+		}
+	}
+	if c.Tracing != nil && c.OTLP != nil {
+		if err := srv.SetTracing(c.Tracing, c.OTLP); err != nil {
+			return fmt.Errorf("tracing: %v", err)
+		}
+	}
+
+	for _, site := range c.Sites {
+		loadType := site.LoadType
+		if loadType == "" {
+			loadType = "random"
+		}
+		scheme := site.Scheme
+		if scheme == "" {
+			scheme = "http"
+		}
+		srv.RegistSite(site.Domain, loadType, scheme)
+
+		info, err := srv.GetSiteInfo(site.Domain)
+		if err != nil {
+			return err
+		}
+		for _, item := range site.Endpoints {
+			if err = info.Balancer.AddAddr(item.Endpoint, item.Weight); err != nil {
+				return fmt.Errorf("site %s add %s: %v", site.Domain, item.Endpoint, err)
+			}
+			if item.Priority != 0 {
+				if err = srv.SetPriority(site.Domain, item.Endpoint, item.Priority); err != nil {
+					return fmt.Errorf("site %s priority of %s: %v", site.Domain, item.Endpoint, err)
+				}
+			}
+			if item.MaxConns != 0 {
+				if err = srv.SetMaxConns(site.Domain, item.Endpoint, item.MaxConns); err != nil {
+					return fmt.Errorf("site %s max conns of %s: %v", site.Domain, item.Endpoint, err)
+				}
+			}
+			if !item.IsActive() {
+				if err = srv.SetAddrState(site.Domain, item.Endpoint, item.State); err != nil {
+					return fmt.Errorf("site %s state of %s: %v", site.Domain, item.Endpoint, err)
+				}
+			}
+		}
+		if err = srv.SetFailoverThreshold(site.Domain, site.Failover); err != nil {
+			return fmt.Errorf("site %s failover: %v", site.Domain, err)
+		}
+		if site.Breaker != nil {
+			if err = srv.SetBreaker(site.Domain, site.Breaker); err != nil {
+				return fmt.Errorf("site %s breaker: %v", site.Domain, err)
+			}
+		}
+		if len(site.RateLimit) > 0 {
+			if err = srv.SetRateLimit(site.Domain, site.RateLimit); err != nil {
+				return fmt.Errorf("site %s rate limit: %v", site.Domain, err)
+			}
+		}
+		if site.Queue != nil {
+			if err = srv.SetQueue(site.Domain, site.Queue); err != nil {
+				return fmt.Errorf("site %s queue: %v", site.Domain, err)
+			}
+		}
+		if site.Adaptive != nil {
+			if err = srv.SetAdaptiveLimit(site.Domain, site.Adaptive); err != nil {
+				return fmt.Errorf("site %s adaptive: %v", site.Domain, err)
+			}
+		}
+		if site.Forwarded != nil {
+			if err = srv.SetForwarded(site.Domain, site.Forwarded); err != nil {
+				return fmt.Errorf("site %s forwarded: %v", site.Domain, err)
+			}
+		}
+		if len(site.Headers) > 0 {
+			if err = srv.SetHeaderRules(site.Domain, site.Headers); err != nil {
+				return fmt.Errorf("site %s header rules: %v", site.Domain, err)
+			}
+		}
+		if site.Cache != nil {
+			if err = srv.SetCache(site.Domain, site.Cache); err != nil {
+				return fmt.Errorf("site %s cache: %v", site.Domain, err)
+			}
+		}
+		if len(site.Coalesce) > 0 {
+			if err = srv.SetCoalesceRules(site.Domain, site.Coalesce); err != nil {
+				return fmt.Errorf("site %s coalesce rules: %v", site.Domain, err)
+			}
+		}
+		if site.Compress != nil {
+			if err = srv.SetCompress(site.Domain, site.Compress); err != nil {
+				return fmt.Errorf("site %s compress: %v", site.Domain, err)
+			}
+		}
+		if len(site.Rewrites) > 0 {
+			if err = srv.SetRewriteRules(site.Domain, site.Rewrites); err != nil {
+				return fmt.Errorf("site %s rewrite rules: %v", site.Domain, err)
+			}
+		}
+		if site.Host != nil {
+			if err = srv.SetHostPolicy(site.Domain, site.Host); err != nil {
+				return fmt.Errorf("site %s host policy: %v", site.Domain, err)
+			}
+		}
+		if site.HTTPS != nil {
+			if err = srv.SetHTTPS(site.Domain, site.HTTPS); err != nil {
+				return fmt.Errorf("site %s https: %v", site.Domain, err)
+			}
+		}
+		if len(site.IPRules) > 0 {
+			if err = srv.SetIPRules(site.Domain, site.IPRules); err != nil {
+				return fmt.Errorf("site %s ip rules: %v", site.Domain, err)
+			}
+		}
+		// set after the endpoints so the endpoints at boot take their full weight at once
+		if site.SlowStart != nil {
+			if err = srv.SetSlowStart(site.Domain, *site.SlowStart); err != nil {
+				return fmt.Errorf("site %s slow start: %v", site.Domain, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseSiteFlag parse a -site flag value, the format is
+// domain=addr[@weight],addr[@weight]
+func parseSiteFlag(value, loadType, scheme string) (SiteConfig, error) {
+	site := SiteConfig{LoadType: loadType, Scheme: scheme}
+
+	parts := strings.SplitN(value, "=", 2)
+	site.Domain = strings.TrimSpace(parts[0])
+	if site.Domain == "" {
+		return site, fmt.Errorf("site %q domain is empty", value)
+	}
+	if len(parts) == 1 || parts[1] == "" {
+		return site, nil
+	}
+
+	for _, addr := range strings.Split(parts[1], ",") {
+		item := balancer.EndpointItem{OriginItem: balancer.OriginItem{Endpoint: strings.TrimSpace(addr), Weight: 1}}
+		if i := strings.LastIndex(item.Endpoint, "@"); i >= 0 {
+			weight, err := strconv.ParseUint(item.Endpoint[i+1:], 10, 32)
+			if err != nil {
+				return site, fmt.Errorf("site %q weight of %s is invalid", value, addr)
+			}
+			item.Endpoint = item.Endpoint[:i]
+			item.Weight = uint32(weight)
+		}
+		site.Endpoints = append(site.Endpoints, item)
+	}
+	return site, nil
+}
+
+// siteFlags collect repeated -site flags
+type siteFlags []string
+
+func (s *siteFlags) String() string {
+	return strings.Join(*s, " ")
+}
+
+func (s *siteFlags) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
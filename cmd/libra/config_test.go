@@ -0,0 +1,237 @@
+package main
+
+import (
+	"github.com/zhuCheer/libra"
+	"github.com/zhuCheer/libra/balancer"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := loadConfig("")
+	if err != nil || cfg.Listen != "0.0.0.0:5000" || cfg.Admin != "127.0.0.1:5080" {
+		t.Error("loadConfig default have an error #1")
+	}
+
+	dir, _ := ioutil.TempDir("", "libra")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "libra.json")
+	ioutil.WriteFile(path, []byte(`{
+		"listen": "127.0.0.1:6000",
+		"sites": [{"domain": "www.google.com", "load_type": "wroundrobin",
+			"endpoints": [{"endpoint": "192.168.1.100:80", "weight": 2}]}]
+	}`), 0644)
+
+	cfg, err = loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != "127.0.0.1:6000" || cfg.Admin != "127.0.0.1:5080" {
+		t.Error("loadConfig have an error #2")
+	}
+	if len(cfg.Sites) != 1 || cfg.Sites[0].Endpoints[0].Weight != 2 {
+		t.Error("loadConfig have an error #3")
+	}
+
+	ioutil.WriteFile(path, []byte(`{"listen":`), 0644)
+	if _, err = loadConfig(path); err == nil {
+		t.Error("loadConfig have an error #4")
+	}
+	if _, err = loadConfig(filepath.Join(dir, "notfound.json")); err == nil {
+		t.Error("loadConfig have an error #5")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Sites = []SiteConfig{{Domain: "www.google.com", LoadType: "random"}}
+	if err := cfg.Validate(); err != nil {
+		t.Error("Config Validate have an error #1", err)
+	}
+
+	cfg.Listen = "127.0.0.1"
+	cfg.Sites = append(cfg.Sites,
+		SiteConfig{Domain: "www.google.com", LoadType: "hash", Scheme: "ftp"},
+		SiteConfig{},
+		SiteConfig{Domain: "www.google.org", Endpoints: []balancer.EndpointItem{{OriginItem: balancer.OriginItem{Endpoint: "192.168.1.100:80"}, EndpointOptions: balancer.EndpointOptions{State: "sleeping"}}}},
+		SiteConfig{Domain: "www.google.net", SlowStart: &balancer.SlowStart{Window: -time.Second}},
+		SiteConfig{Domain: "www.google.io", Breaker: &libra.BreakerConfig{}},
+		SiteConfig{Domain: "www.google.cn", RateLimit: []libra.RateLimitRule{{Rate: 10, Key: "cookie"}}},
+		SiteConfig{Domain: "www.google.us", Queue: &libra.QueueConfig{}},
+		SiteConfig{Domain: "www.google.de", Adaptive: &libra.AdaptiveConfig{MinLimit: 10, MaxLimit: 5}},
+		SiteConfig{Domain: "www.google.fr", Forwarded: &libra.ForwardedConfig{Mode: "keep"}},
+		SiteConfig{Domain: "www.google.it", Headers: []libra.HeaderRule{{Target: "response", Action: "rename", Name: "X-A"}}},
+		SiteConfig{Domain: "www.google.es", Cache: &libra.CacheConfig{DefaultTTL: -time.Second}},
+		SiteConfig{Domain: "www.google.nl", Coalesce: []libra.CoalesceRule{{MaxSize: -1}}},
+		SiteConfig{Domain: "www.google.be", Compress: &libra.CompressConfig{Level: 10}},
+		SiteConfig{Domain: "www.google.ch", Rewrites: []libra.RewriteRule{{Match: "^/a", Action: "redirect", Replace: "/b", Status: 200}}},
+		SiteConfig{Domain: "www.google.at", Host: &libra.HostPolicy{Mode: libra.HostEndpoint, Host: "a.com"}},
+		SiteConfig{Domain: "www.google.pl", HTTPS: &libra.HTTPSConfig{Port: -1}},
+		SiteConfig{Domain: "www.google.se", IPRules: []libra.IPRule{{Action: libra.IPAllow, CIDRs: []string{"10.0.0.0/33"}}}},
+	)
+	cfg.ErrorPages = map[int]string{200: "ok.html"}
+	cfg.TrustedProxies = []string{"10.0.0.0/33"}
+	cfg.Identity = &libra.Identity{Mode: libra.IdentityCustom}
+	cfg.RequestID = &libra.RequestIDConfig{Format: "snowflake"}
+	cfg.Tracing = &libra.TracingConfig{SampleRate: -1}
+	cfg.OTLP = libra.NewOTLPExporter("ftp://127.0.0.1:4318")
+	cfg.CacheStore = &CacheStoreConfig{}
+	cfg.TLS = &TLSConfig{Listen: "5443"}
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Config Validate have an error #2")
+	}
+	expect := `listen "127.0.0.1" is not a valid address; ` +
+		`sites[1] domain www.google.com is duplicated; ` +
+		`sites[1] load_type "hash" is not supported; ` +
+		`sites[1] scheme "ftp" is not supported; ` +
+		`sites[2] domain is empty; ` +
+		`sites[3].endpoints[0] state "sleeping" is not supported; ` +
+		`sites[4] slow_start is invalid; ` +
+		`sites[5] breaker: the circuit breaker config is invalid; ` +
+		`sites[6].rate_limits[0]: the rate limit rule is invalid; ` +
+		`sites[7] queue: the request queue config is invalid; ` +
+		`sites[8] adaptive: the adaptive concurrency config is invalid; ` +
+		`sites[9] forwarded: the forwarded header config is invalid; ` +
+		`sites[10].header_rules[0]: the header rule is invalid; ` +
+		`sites[11] cache: the response cache config is invalid; ` +
+		`sites[12].coalesce_rules[0]: the coalesce rule is invalid; ` +
+		`sites[13] compress: the response compression config is invalid; ` +
+		`sites[14].rewrite_rules[0]: the rewrite rule is invalid; ` +
+		`sites[15] host_policy: the origin host policy is invalid; ` +
+		`sites[16] https: the https policy is invalid; ` +
+		`sites[17].ip_rules[0]: the ip filter rule is invalid; ` +
+		`error_pages status 200 is not an error; ` +
+		`trusted_proxies: invalid CIDR address: 10.0.0.0/33; ` +
+		`identity: the server identity is invalid; ` +
+		`request_id: the request id config is invalid; ` +
+		`tracing: the tracing config is invalid; ` +
+		`otlp: the otlp endpoint "ftp://127.0.0.1:4318" is not a http url; ` +
+		`cache_store max_bytes should be greater than 0; ` +
+		`tls listen "5443" is not a valid address; ` +
+		`tls cert_file and key_file are required`
+	if err.Error() != expect {
+		t.Error("Config Validate have an error #3", err)
+	}
+}
+
+func TestConfigApply(t *testing.T) {
+	domain := "www.cmd-apply.com"
+	cfg := defaultConfig()
+	cfg.Sites = []SiteConfig{{Domain: domain, LoadType: "roundrobin"}}
+	site, _ := parseSiteFlag(domain+"=192.168.1.100:80,192.168.1.101:80@3", "roundrobin", "")
+	cfg.Sites[0].Endpoints = site.Endpoints
+	cfg.Sites[0].Endpoints[1].State = balancer.StateDisabled
+	cfg.Sites[0].SlowStart = &balancer.SlowStart{Window: time.Minute}
+	cfg.Sites[0].RateLimit = []libra.RateLimitRule{{Key: "ip", Rate: 5}}
+	cfg.Sites[0].Queue = &libra.QueueConfig{Size: 10}
+	cfg.Sites[0].Adaptive = &libra.AdaptiveConfig{MaxLimit: 50}
+	cfg.Sites[0].Forwarded = &libra.ForwardedConfig{Mode: libra.ForwardedStrip}
+	cfg.Sites[0].Headers = []libra.HeaderRule{{Target: libra.HeaderRequest, Action: libra.HeaderRemove, Name: "Cookie"}}
+	cfg.TrustedProxies = []string{"10.0.0.0/8"}
+	cfg.Identity = &libra.Identity{Mode: libra.IdentityHidden}
+	cfg.RequestID = &libra.RequestIDConfig{Header: "x-trace-id", Format: libra.RequestIDULID}
+	cfg.Tracing = &libra.TracingConfig{SampleRate: 0.5}
+	cfg.OTLP = libra.NewOTLPExporter("http://127.0.0.1:4318/v1/traces")
+	cfg.CacheStore = &CacheStoreConfig{MaxBytes: 1 << 20}
+	cfg.Sites[0].Cache = &libra.CacheConfig{DefaultTTL: time.Minute}
+	cfg.Sites[0].Coalesce = []libra.CoalesceRule{{Path: "/api/", Headers: []string{"Accept"}}}
+	cfg.Sites[0].Compress = &libra.CompressConfig{MinSize: 512}
+	cfg.Sites[0].Rewrites = []libra.RewriteRule{{Match: "^/v1/(.*)$", Action: libra.RewritePath, Replace: "/api/$1"}}
+	cfg.Sites[0].Host = &libra.HostPolicy{Mode: libra.HostEndpoint}
+	cfg.Sites[0].HTTPS = &libra.HTTPSConfig{Redirect: true}
+	cfg.Sites[0].IPRules = []libra.IPRule{{Path: "/admin/", Action: libra.IPAllow, CIDRs: []string{"10.0.0.0/8", "fd00::/8"}}}
+	cfg.Sites[0].Endpoints[0].MaxConns = 8
+
+	srv := libra.NewHttpProxySrv(cfg.Listen, nil)
+	if err := cfg.Apply(srv); err != nil {
+		t.Fatal(err)
+	}
+	info, err := srv.GetSiteInfo(domain)
+	items, _ := balancer.GetEndpoints(domain)
+	if err != nil || info.Scheme != "http" || len(items) != 2 || items[1].State != balancer.StateDisabled {
+		t.Error("Config Apply have an error #1")
+	}
+	if slowStart, _ := balancer.GetSlowStart(domain); slowStart.Window != time.Minute || info.Items[0].Weight != 1 {
+		t.Error("Config Apply have an error #1.1")
+	}
+	if rules := srv.GetRateLimit(domain); len(rules) != 1 || rules[0].Rate != 5 {
+		t.Error("Config Apply have an error #1.2")
+	}
+	if queue := srv.GetQueue(domain); queue == nil || queue.Size != 10 || items[0].MaxConns != 8 {
+		t.Error("Config Apply have an error #1.3")
+	}
+	if adaptive := srv.GetAdaptiveLimit(domain); adaptive == nil || adaptive.MaxLimit != 50 {
+		t.Error("Config Apply have an error #1.4")
+	}
+	if srv.GetForwarded(domain).Mode != libra.ForwardedStrip {
+		t.Error("Config Apply have an error #1.5")
+	}
+	if rules := srv.GetHeaderRules(domain); len(rules) != 1 || rules[0].Name != "Cookie" {
+		t.Error("Config Apply have an error #1.6")
+	}
+	if srv.GetIdentity().Mode != libra.IdentityHidden {
+		t.Error("Config Apply have an error #1.7")
+	}
+	if config := srv.GetRequestID(); config.Header != "X-Trace-Id" || config.Format != libra.RequestIDULID {
+		t.Error("Config Apply have an error #1.8")
+	}
+	if tracing := srv.GetTracing(); tracing == nil || tracing.SampleRate != 0.5 {
+		t.Error("Config Apply have an error #1.9")
+	}
+	if cache := srv.GetCache(domain); cache == nil || cache.DefaultTTL != time.Minute {
+		t.Error("Config Apply have an error #1.10")
+	}
+	if rules := srv.GetCoalesceRules(domain); len(rules) != 1 || rules[0].Path != "/api/" {
+		t.Error("Config Apply have an error #1.11")
+	}
+	if compress := srv.GetCompress(domain); compress == nil || compress.MinSize != 512 {
+		t.Error("Config Apply have an error #1.12")
+	}
+	if rules := srv.GetRewriteRules(domain); len(rules) != 1 || rules[0].Replace != "/api/$1" {
+		t.Error("Config Apply have an error #1.13")
+	}
+	if srv.GetHostPolicy(domain).Mode != libra.HostEndpoint {
+		t.Error("Config Apply have an error #1.14")
+	}
+	if config := srv.GetHTTPS(domain); config == nil || !config.Redirect {
+		t.Error("Config Apply have an error #1.15")
+	}
+	if rules := srv.GetIPRules(domain); len(rules) != 1 || len(rules[0].CIDRs) != 2 {
+		t.Error("Config Apply have an error #1.16")
+	}
+	srv.SetTracing(nil, nil)
+
+	if err := cfg.Apply(srv); err == nil {
+		t.Error("Config Apply have an error #2")
+	}
+}
+
+func TestParseSiteFlag(t *testing.T) {
+	site, err := parseSiteFlag("www.google.com=192.168.1.100:80@2, 192.168.1.101:80", "wroundrobin", "https")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if site.Domain != "www.google.com" || site.LoadType != "wroundrobin" || site.Scheme != "https" {
+		t.Error("parseSiteFlag have an error #1")
+	}
+	if len(site.Endpoints) != 2 || site.Endpoints[0].Weight != 2 ||
+		site.Endpoints[1].Endpoint != "192.168.1.101:80" || site.Endpoints[1].Weight != 1 {
+		t.Error("parseSiteFlag have an error #2")
+	}
+
+	site, err = parseSiteFlag("www.google.com", "random", "http")
+	if err != nil || len(site.Endpoints) != 0 {
+		t.Error("parseSiteFlag have an error #3")
+	}
+
+	if _, err = parseSiteFlag("=192.168.1.100:80", "random", "http"); err == nil {
+		t.Error("parseSiteFlag have an error #4")
+	}
+	if _, err = parseSiteFlag("www.google.com=192.168.1.100:80@x", "random", "http"); err == nil {
+		t.Error("parseSiteFlag have an error #5")
+	}
+}
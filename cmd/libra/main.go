@@ -0,0 +1,434 @@
+// Command libra runs the libra reverse proxy and talks to its admin api.
+//
+//	libra serve -config libra.json
+//	libra serve -listen 0.0.0.0:5000 -site www.a.com=127.0.0.1:5001@2,127.0.0.1:5002
+//	libra validate -config libra.json
+//	libra sites list
+//	libra endpoint add -domain www.a.com -addr 127.0.0.1:5003 -weight 1
+//	libra endpoint del -domain www.a.com -addr 127.0.0.1:5003
+//	libra endpoint weight -domain www.a.com -addr 127.0.0.1:5003 -weight 5 -ramp 30s
+//	libra endpoint drain -domain www.a.com -addr 127.0.0.1:5003 -remove -timeout 5m
+//	libra endpoint state -domain www.a.com -addr 127.0.0.1:5003 -state active
+//	libra endpoint priority -domain www.a.com -addr 127.0.0.1:5003 -priority 1
+//	libra endpoint maxconns -domain www.a.com -addr 127.0.0.1:5003 -max-conns 50
+//	libra cache purge -domain www.a.com -prefix /static/
+//	libra ipfilter add -domain www.a.com -action allow -cidr 10.0.0.0/8 -path /admin/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/zhuCheer/libra"
+	"github.com/zhuCheer/libra/balancer"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// Exit codes.
+const (
+	exitOK      = 0
+	exitError   = 1
+	exitUsage   = 2
+	exitInvalid = 3
+)
+
+// shutdownTimeout max time waiting for in-flight requests when stopping
+var shutdownTimeout = 10 * time.Second
+
+const usage = `Usage: libra <command> [options]
+
+Commands:
+  serve              start the reverse proxy
+  validate           check a config file
+  sites list         list sites through the admin api
+  endpoint add       add an endpoint through the admin api
+  endpoint del       delete an endpoint through the admin api
+  endpoint weight    change the weight of an endpoint through the admin api
+  endpoint drain     drain an endpoint through the admin api
+  endpoint state     set an endpoint active, draining or disabled through the admin api
+  endpoint priority  set the priority level of an endpoint through the admin api, 0 is primary
+  endpoint maxconns  set max requests in flight to an endpoint through the admin api, 0 is unlimited
+  cache purge        delete cached responses of a site by url or url prefix through the admin api
+  ipfilter add       add a CIDR to the allow or deny list of a site through the admin api
+  ipfilter del       delete a CIDR from the allow or deny list of a site through the admin api
+
+Run "libra <command> -h" for the options of a command.
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run dispatch the sub command and returns the exit code
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+
+	switch args[0] {
+	case "serve":
+		return runServe(args[1:], stderr)
+	case "validate":
+		return runValidate(args[1:], stdout, stderr)
+	case "sites":
+		if len(args) < 2 || args[1] != "list" {
+			fmt.Fprint(stderr, usage)
+			return exitUsage
+		}
+		return runSitesList(args[2:], stdout, stderr)
+	case "endpoint":
+		if len(args) < 2 {
+			fmt.Fprint(stderr, usage)
+			return exitUsage
+		}
+		return runEndpoint(args[1], args[2:], stdout, stderr)
+	case "cache":
+		if len(args) < 2 || args[1] != "purge" {
+			fmt.Fprint(stderr, usage)
+			return exitUsage
+		}
+		return runCachePurge(args[2:], stdout, stderr)
+	case "ipfilter":
+		if len(args) < 2 || args[1] != "add" && args[1] != "del" {
+			fmt.Fprint(stderr, usage)
+			return exitUsage
+		}
+		return runIPFilter(args[1], args[2:], stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return exitOK
+	}
+
+	fmt.Fprintf(stderr, "libra: unknown command %q\n\n%s", args[0], usage)
+	return exitUsage
+}
+
+// serveFlags parse the serve and validate options into a config
+func serveFlags(name string, args []string, stderr io.Writer) (*Config, error) {
+	fs := flag.NewFlagSet("libra "+name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	configPath := fs.String("config", "", "json config file path")
+	listen := fs.String("listen", "", "proxy listen address, override the config")
+	admin := fs.String("admin", "", "admin api listen address, override the config")
+	logLevel := fs.String("log-level", "", "log level debug|info|warn|error|critical")
+	persist := fs.String("persist", "", "registry file, runtime changes are saved into it and restored on start")
+	loadType := fs.String("load", "roundrobin", "load type of -site sites random|roundrobin|wroundrobin")
+	scheme := fs.String("scheme", "http", "origin scheme of -site sites http|https")
+	sites := siteFlags{}
+	fs.Var(&sites, "site", "add a site, domain=addr[@weight],addr[@weight], can be repeated")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return nil, err
+	}
+	if *listen != "" {
+		cfg.Listen = *listen
+	}
+	if *admin != "" {
+		cfg.Admin = *admin
+	}
+	if *logLevel != "" {
+		cfg.LogLevel = *logLevel
+	}
+	if *persist != "" {
+		cfg.Persist = *persist
+	}
+	for _, value := range sites {
+		site, err := parseSiteFlag(value, *loadType, *scheme)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Sites = append(cfg.Sites, site)
+	}
+	return cfg, nil
+}
+
+// runValidate check config and print the result
+func runValidate(args []string, stdout, stderr io.Writer) int {
+	cfg, err := serveFlags("validate", args, stderr)
+	if err == flag.ErrHelp {
+		return exitOK
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "libra:", err)
+		return exitUsage
+	}
+	if err = cfg.Validate(); err != nil {
+		fmt.Fprintln(stderr, "libra: invalid config:", err)
+		return exitInvalid
+	}
+
+	fmt.Fprintf(stdout, "config ok, %d sites\n", len(cfg.Sites))
+	return exitOK
+}
+
+// runServe start proxy and admin servers until a stop signal
+func runServe(args []string, stderr io.Writer) int {
+	cfg, err := serveFlags("serve", args, stderr)
+	if err == flag.ErrHelp {
+		return exitOK
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "libra:", err)
+		return exitUsage
+	}
+	if err = cfg.Validate(); err != nil {
+		fmt.Fprintln(stderr, "libra: invalid config:", err)
+		return exitInvalid
+	}
+
+	srv := libra.NewHttpProxySrv(cfg.Listen, cfg.Headers)
+	srv.SetLoggerLevel(cfg.LogLevel)
+	if err = cfg.Apply(srv); err != nil {
+		fmt.Fprintln(stderr, "libra:", err)
+		return exitInvalid
+	}
+	if cfg.Persist != "" {
+		// persisted sites win over the config ones, they hold the runtime changes, sites new in the config are kept
+		persister := libra.NewFilePersister(cfg.Persist)
+		if err = mergePersisted(persister); err != nil {
+			fmt.Fprintln(stderr, "libra: persist:", err)
+			return exitInvalid
+		}
+		if err = srv.SetPersister(persister); err != nil {
+			fmt.Fprintln(stderr, "libra: persist:", err)
+			return exitInvalid
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	errs := make(chan error, 3)
+	go func() {
+		errs <- srv.Run()
+	}()
+	if cfg.TLS != nil {
+		go func() {
+			errs <- srv.RunTLS(cfg.TLS.Listen, cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		}()
+	}
+	if cfg.Admin != "" {
+		go func() {
+			errs <- srv.RunAdmin(cfg.Admin)
+		}()
+	}
+
+	select {
+	case sig := <-signals:
+		libra.Logger.Info("receive signal " + sig.String() + ", shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err = srv.Shutdown(ctx); err != nil {
+			fmt.Fprintln(stderr, "libra: shutdown:", err)
+			return exitError
+		}
+		return exitOK
+	case err = <-errs:
+		if err == http.ErrServerClosed {
+			return exitOK
+		}
+		fmt.Fprintln(stderr, "libra:", err)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		srv.Shutdown(ctx)
+		return exitError
+	}
+}
+
+// runSitesList print all sites of a running libra
+func runSitesList(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("libra sites list", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	admin := fs.String("admin", "127.0.0.1:5080", "admin api address")
+	if err := fs.Parse(args); err != nil {
+		return parseErrorCode(err)
+	}
+
+	sites, err := newAdminClient(*admin).listSites()
+	if err != nil {
+		fmt.Fprintln(stderr, "libra:", err)
+		return exitError
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DOMAIN\tSCHEME\tLOAD TYPE\tENDPOINT\tWEIGHT\tSTATE\tIN FLIGHT\tPRIORITY\tHEALTHY")
+	for _, site := range sites {
+		if len(site.Items) == 0 {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t-\t-\t-\t-\t-\t-\n", site.Domain, site.Scheme, site.LoadType)
+		}
+		for _, item := range site.Items {
+			state := item.State
+			if state == "" {
+				state = balancer.StateActive
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%d\t%d\t%t\n", site.Domain, site.Scheme, site.LoadType,
+				item.Endpoint, item.Weight, state, item.InFlight, item.Priority, item.Healthy)
+		}
+	}
+	tw.Flush()
+	return exitOK
+}
+
+// runEndpoint add, delete, reweight, drain or change state, priority or max conns of an endpoint of a running libra
+func runEndpoint(action string, args []string, stdout, stderr io.Writer) int {
+	switch action {
+	case "add", "del", "weight", "drain", "state", "priority", "maxconns":
+	default:
+		fmt.Fprintf(stderr, "libra: unknown endpoint action %q\n\n%s", action, usage)
+		return exitUsage
+	}
+
+	fs := flag.NewFlagSet("libra endpoint "+action, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	admin := fs.String("admin", "127.0.0.1:5080", "admin api address")
+	domain := fs.String("domain", "", "site domain")
+	addr := fs.String("addr", "", "endpoint address ip:port")
+	weight := fs.Uint("weight", 1, "endpoint weight, only for add and weight")
+	ramp := fs.String("ramp", "", "change weight gradually during a duration like 30s, only for weight")
+	remove := fs.Bool("remove", false, "delete the endpoint once drained, only for drain")
+	timeout := fs.String("timeout", "", "delete the endpoint anyway after a duration like 5m, only for drain with -remove")
+	state := fs.String("state", "", "endpoint state active|draining|disabled, only for state")
+	priority := fs.Int("priority", 0, "endpoint priority level, 0 is primary, only for priority")
+	maxConns := fs.Uint("max-conns", 0, "max requests in flight, 0 is unlimited, only for maxconns")
+	if err := fs.Parse(args); err != nil {
+		return parseErrorCode(err)
+	}
+	if *domain == "" || *addr == "" {
+		fmt.Fprintln(stderr, "libra: -domain and -addr are required")
+		return exitUsage
+	}
+
+	client := newAdminClient(*admin)
+	var err error
+	switch action {
+	case "add":
+		err = client.addEndpoint(*domain, *addr, uint32(*weight))
+	case "del":
+		err = client.delEndpoint(*domain, *addr)
+	case "weight":
+		err = client.setWeight(*domain, *addr, uint32(*weight), *ramp)
+	case "drain":
+		err = client.drainEndpoint(*domain, *addr, *remove, *timeout)
+	case "state":
+		err = client.setState(*domain, *addr, *state)
+	case "priority":
+		err = client.setPriority(*domain, *addr, *priority)
+	case "maxconns":
+		err = client.setMaxConns(*domain, *addr, uint32(*maxConns))
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "libra:", err)
+		return exitError
+	}
+
+	fmt.Fprintf(stdout, "endpoint %s %s %s ok\n", *addr, *domain, action)
+	return exitOK
+}
+
+// runCachePurge delete cached responses of a site of a running libra
+func runCachePurge(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("libra cache purge", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	admin := fs.String("admin", "127.0.0.1:5080", "admin api address")
+	domain := fs.String("domain", "", "site domain")
+	url := fs.String("url", "", "url of the responses like /a.js?v=1")
+	prefix := fs.String("prefix", "", "url prefix of the responses like /static/")
+	if err := fs.Parse(args); err != nil {
+		return parseErrorCode(err)
+	}
+	if *domain == "" || (*url == "") == (*prefix == "") {
+		fmt.Fprintln(stderr, "libra: -domain and one of -url and -prefix are required")
+		return exitUsage
+	}
+
+	purged, err := newAdminClient(*admin).purgeCache(*domain, *url, *prefix)
+	if err != nil {
+		fmt.Fprintln(stderr, "libra:", err)
+		return exitError
+	}
+	fmt.Fprintf(stdout, "%d cached responses of %s purged\n", purged, *domain)
+	return exitOK
+}
+
+// runIPFilter add or delete a CIDR of an ip filter rule of a site of a running libra
+func runIPFilter(action string, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("libra ipfilter "+action, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	admin := fs.String("admin", "127.0.0.1:5080", "admin api address")
+	domain := fs.String("domain", "", "site domain")
+	path := fs.String("path", "", "path prefix of the rule, empty matches all")
+	ruleAction := fs.String("action", "allow", "allow or deny")
+	cidr := fs.String("cidr", "", "CIDR like 10.0.0.0/8 or an ip")
+	if err := fs.Parse(args); err != nil {
+		return parseErrorCode(err)
+	}
+	if *domain == "" || *cidr == "" {
+		fmt.Fprintln(stderr, "libra: -domain and -cidr are required")
+		return exitUsage
+	}
+
+	client := newAdminClient(*admin)
+	var err error
+	if action == "add" {
+		err = client.addIPFilter(*domain, *path, *ruleAction, *cidr)
+	} else {
+		err = client.delIPFilter(*domain, *path, *ruleAction, *cidr)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "libra:", err)
+		return exitError
+	}
+	fmt.Fprintf(stdout, "ipfilter %s %s %s %s ok\n", *ruleAction, *cidr, *domain, action)
+	return exitOK
+}
+
+// mergePersisted add the registered sites missing from the persisted registry to it,
+// so sites new in the config are not dropped by the import, the persisted ones win
+func mergePersisted(persister libra.Persister) error {
+	data, err := persister.Load()
+	if err != nil || len(data) == 0 {
+		return err
+	}
+	snapshot := libra.RegistrySnapshot{}
+	if err = json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+
+	persisted := map[string]bool{}
+	for _, site := range snapshot.Sites {
+		persisted[site.Domain] = true
+	}
+	for _, site := range balancer.Snapshot() {
+		if persisted[site.Domain] {
+			libra.Logger.Info("site %s of the config is overridden by the persist file", site.Domain)
+			continue
+		}
+		libra.Logger.Info("site %s of the config is added to the persist file", site.Domain)
+		snapshot.Sites = append(snapshot.Sites, site)
+	}
+	if data, err = json.MarshalIndent(snapshot, "", "  "); err != nil {
+		return err
+	}
+	return persister.Save(data)
+}
+
+// parseErrorCode exit code of a flag parse error
+func parseErrorCode(err error) int {
+	if err == flag.ErrHelp {
+		return exitOK
+	}
+	return exitUsage
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"github.com/zhuCheer/libra"
+	"github.com/zhuCheer/libra/balancer"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunUsage(t *testing.T) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+
+	if code := run([]string{}, stdout, stderr); code != exitUsage {
+		t.Error("run have an error #1")
+	}
+	if code := run([]string{"unknown"}, stdout, stderr); code != exitUsage {
+		t.Error("run have an error #2")
+	}
+	if code := run([]string{"endpoint", "move"}, stdout, stderr); code != exitUsage {
+		t.Error("run have an error #3")
+	}
+	if code := run([]string{"endpoint", "add", "-domain", "www.google.com"}, stdout, stderr); code != exitUsage {
+		t.Error("run have an error #4")
+	}
+	if code := run([]string{"help"}, stdout, stderr); code != exitOK || !strings.Contains(stdout.String(), "Usage") {
+		t.Error("run have an error #5")
+	}
+}
+
+func TestRunValidate(t *testing.T) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+
+	code := run([]string{"validate", "-site", "www.google.com=192.168.1.100:80"}, stdout, stderr)
+	if code != exitOK || stdout.String() != "config ok, 1 sites\n" {
+		t.Error("run validate have an error #1")
+	}
+
+	code = run([]string{"validate", "-site", "www.google.com", "-load", "hash"}, stdout, stderr)
+	if code != exitInvalid {
+		t.Error("run validate have an error #2")
+	}
+
+	code = run([]string{"validate", "-config", "/not/found/libra.json"}, stdout, stderr)
+	if code != exitUsage {
+		t.Error("run validate have an error #3")
+	}
+}
+
+func TestRunAdminCommands(t *testing.T) {
+	domain := "www.cmd-admin.com"
+	srv := libra.NewHttpProxySrv("127.0.0.1:5000", nil)
+	srv.RegistSite(domain, "roundrobin", "http")
+	admin := httptest.NewServer(srv.AdminHandler())
+	defer admin.Close()
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	code := run([]string{"endpoint", "add", "-admin", admin.URL, "-domain", domain, "-addr", "192.168.1.100:80", "-weight", "3"}, stdout, stderr)
+	if code != exitOK {
+		t.Error("run endpoint add have an error #1", stderr.String())
+	}
+	code = run([]string{"endpoint", "add", "-admin", admin.URL, "-domain", domain, "-addr", "192.168.1.100:80"}, stdout, stderr)
+	if code != exitError || !strings.Contains(stderr.String(), "the endpoint has existed") {
+		t.Error("run endpoint add have an error #2")
+	}
+
+	code = run([]string{"endpoint", "weight", "-admin", admin.URL, "-domain", domain, "-addr", "192.168.1.100:80", "-weight", "5", "-ramp", "10s"}, stdout, stderr)
+	if code != exitOK {
+		t.Error("run endpoint weight have an error #2.1", stderr.String())
+	}
+
+	stdout.Reset()
+	code = run([]string{"sites", "list", "-admin", admin.URL}, stdout, stderr)
+	if code != exitOK || !strings.Contains(stdout.String(), "192.168.1.100:80  5") {
+		t.Error("run sites list have an error #3", stdout.String())
+	}
+
+	code = run([]string{"endpoint", "drain", "-admin", admin.URL, "-domain", domain, "-addr", "192.168.1.100:80", "-timeout", "1m"}, stdout, stderr)
+	stdout.Reset()
+	run([]string{"sites", "list", "-admin", admin.URL}, stdout, stderr)
+	if code != exitOK || !strings.Contains(stdout.String(), "draining  0") {
+		t.Error("run endpoint drain have an error #3.1", stdout.String())
+	}
+	code = run([]string{"endpoint", "priority", "-admin", admin.URL, "-domain", domain, "-addr", "192.168.1.100:80", "-priority", "2"}, stdout, stderr)
+	stdout.Reset()
+	run([]string{"sites", "list", "-admin", admin.URL}, stdout, stderr)
+	if code != exitOK || !strings.Contains(stdout.String(), "2         true") {
+		t.Error("run endpoint priority have an error #3.1.1", stdout.String())
+	}
+	code = run([]string{"endpoint", "maxconns", "-admin", admin.URL, "-domain", domain, "-addr", "192.168.1.100:80", "-max-conns", "20"}, stdout, stderr)
+	if items, _ := balancer.GetEndpoints(domain); code != exitOK || items[0].MaxConns != 20 {
+		t.Error("run endpoint maxconns have an error #3.1.2")
+	}
+	code = run([]string{"cache", "purge", "-admin", admin.URL, "-domain", domain, "-prefix", "/static/"}, stdout, stderr)
+	if code != exitOK || !strings.Contains(stdout.String(), "0 cached responses of "+domain+" purged") {
+		t.Error("run cache purge have an error #3.1.3", stderr.String())
+	}
+	code = run([]string{"cache", "purge", "-admin", admin.URL, "-domain", domain}, stdout, stderr)
+	if code != exitUsage {
+		t.Error("run cache purge have an error #3.1.4")
+	}
+	code = run([]string{"ipfilter", "add", "-admin", admin.URL, "-domain", domain, "-action", "deny", "-cidr", "192.0.2.0/24"}, stdout, stderr)
+	if rules := srv.GetIPRules(domain); code != exitOK || len(rules) != 1 || rules[0].Action != libra.IPDeny {
+		t.Error("run ipfilter add have an error #3.1.5", stderr.String())
+	}
+	code = run([]string{"ipfilter", "del", "-admin", admin.URL, "-domain", domain, "-action", "deny", "-cidr", "192.0.2.0/24"}, stdout, stderr)
+	if code != exitOK || srv.GetIPRules(domain) != nil {
+		t.Error("run ipfilter del have an error #3.1.6")
+	}
+	if code = run([]string{"ipfilter", "add", "-admin", admin.URL, "-domain", domain}, stdout, stderr); code != exitUsage {
+		t.Error("run ipfilter add have an error #3.1.7")
+	}
+	code = run([]string{"endpoint", "state", "-admin", admin.URL, "-domain", domain, "-addr", "192.168.1.100:80", "-state", "paused"}, stdout, stderr)
+	if code != exitError {
+		t.Error("run endpoint state have an error #3.2")
+	}
+
+	code = run([]string{"endpoint", "del", "-admin", admin.URL, "-domain", domain, "-addr", "192.168.1.100:80"}, stdout, stderr)
+	info, _ := srv.GetSiteInfo(domain)
+	if code != exitOK || len(info.Items) != 0 {
+		t.Error("run endpoint del have an error #4")
+	}
+
+	code = run([]string{"endpoint", "del", "-admin", "127.0.0.1:1", "-domain", domain, "-addr", "192.168.1.100:80"}, stdout, stderr)
+	if code != exitError {
+		t.Error("run endpoint del have an error #5")
+	}
+}
+
+func TestMergePersisted(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "libra")
+	defer os.RemoveAll(dir)
+	persister := libra.NewFilePersister(filepath.Join(dir, "registry.json"))
+	if err := mergePersisted(persister); err != nil {
+		t.Error("merge persisted have an error #1", err)
+	}
+
+	// the persist file holds a runtime change of the old site only
+	srv := libra.NewHttpProxySrv("127.0.0.1:5000", nil)
+	srv.RegistSite("www.persist-old.com", "roundrobin", "http").AddAddr("www.persist-old.com", "192.168.1.101:80", 1)
+	data, _ := srv.ExportRegistry()
+	persister.Save(data)
+	srv.FlushProxy("www.persist-old.com")
+
+	cfg := &Config{Sites: []SiteConfig{
+		{Domain: "www.persist-old.com", LoadType: "roundrobin", Scheme: "http", Endpoints: []balancer.EndpointItem{{OriginItem: balancer.OriginItem{Endpoint: "192.168.1.100:80", Weight: 1}}}},
+		{Domain: "www.persist-new.com", LoadType: "roundrobin", Scheme: "http", Endpoints: []balancer.EndpointItem{{OriginItem: balancer.OriginItem{Endpoint: "192.168.1.200:80", Weight: 1}}}},
+	}}
+	if err := cfg.Apply(srv); err != nil {
+		t.Error("merge persisted have an error #2", err)
+	}
+	if err := mergePersisted(persister); err != nil {
+		t.Error("merge persisted have an error #3", err)
+	}
+	if err := srv.SetPersister(persister); err != nil {
+		t.Error("merge persisted have an error #4", err)
+	}
+	if items, _ := balancer.GetEndpoints("www.persist-old.com"); len(items) != 1 || items[0].Endpoint != "192.168.1.101:80" {
+		t.Error("merge persisted have an error #5", items)
+	}
+	if items, _ := balancer.GetEndpoints("www.persist-new.com"); len(items) != 1 || items[0].Endpoint != "192.168.1.200:80" {
+		t.Error("merge persisted have an error #6", items)
+	}
+	srv.FlushProxy("www.persist-old.com")
+	srv.FlushProxy("www.persist-new.com")
+}
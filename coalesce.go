@@ -0,0 +1,252 @@
+package libra
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ErrCoalesceRuleInvalid coalesce rule is invalid
+var ErrCoalesceRuleInvalid = errors.New("the coalesce rule is invalid")
+
+// DefaultCoalesceMaxSize max bytes of a shared response if the rule does not set it
+var DefaultCoalesceMaxSize int64 = 1 << 20
+
+// coalesceCredentialHeaders requests with these headers are never shared
+var coalesceCredentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// CoalesceRule concurrent identical GET requests matching Path share one upstream call and its response,
+// requests are identical by method, host, path, query and Headers, requests with credentials are not shared
+type CoalesceRule struct {
+	Path       string   `json:"path,omitempty"`        // path prefix, empty matches all
+	Headers    []string `json:"headers,omitempty"`     // request headers selecting the response, like Accept-Encoding
+	MaxSize    int64    `json:"max_size,omitempty"`    // larger responses are not shared, waiting requests call the origin, default 1MB
+	MaxWaiters int      `json:"max_waiters,omitempty"` // more requests waiting for a call go to the origin, 0 is unlimited
+}
+
+// Validate check the rule
+func (r CoalesceRule) Validate() error {
+	if r.MaxSize < 0 || r.MaxWaiters < 0 {
+		return ErrCoalesceRuleInvalid
+	}
+	for _, name := range r.Headers {
+		if !validHeaderToken(name) {
+			return ErrCoalesceRuleInvalid
+		}
+	}
+	return nil
+}
+
+// key get the key of identical requests
+func (r CoalesceRule) key(req *http.Request) string {
+	var b bytes.Buffer
+	b.WriteString(req.Method + " " + req.Host + req.URL.RequestURI())
+	for _, name := range r.Headers {
+		b.WriteString("\n" + http.CanonicalHeaderKey(name) + ":" + strings.Join(req.Header[http.CanonicalHeaderKey(name)], ","))
+	}
+	return b.String()
+}
+
+// coalesceCall an upstream call shared by identical requests
+type coalesceCall struct {
+	done    chan struct{} // closed when the response is ready
+	waiters int
+	shared  bool // the response is captured and can be replayed
+	status  int
+	header  http.Header
+	body    []byte
+}
+
+// SetCoalesceRules set coalesce rules of a site, the first rule matching the path is used, nil removes them
+func (p *ProxySrv) SetCoalesceRules(domain string, rules []CoalesceRule) error {
+	for _, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+
+	p.coalesceLock.Lock()
+	defer p.coalesceLock.Unlock()
+	if p.coalesceRules == nil {
+		p.coalesceRules = map[string][]CoalesceRule{}
+	}
+	if len(rules) == 0 {
+		delete(p.coalesceRules, domain)
+	} else {
+		p.coalesceRules[domain] = append([]CoalesceRule{}, rules...)
+	}
+	return nil
+}
+
+// GetCoalesceRules get coalesce rules of a site
+func (p *ProxySrv) GetCoalesceRules(domain string) []CoalesceRule {
+	p.coalesceLock.RLock()
+	defer p.coalesceLock.RUnlock()
+	return p.coalesceRules[domain]
+}
+
+// matchCoalesceRule get the rule of a request, nil if the request can not be shared
+func (p *ProxySrv) matchCoalesceRule(r *http.Request) *CoalesceRule {
+	if r.Method != http.MethodGet || r.Header.Get("Range") != "" || r.Header.Get("Upgrade") != "" {
+		return nil
+	}
+	for _, name := range coalesceCredentialHeaders {
+		if r.Header.Get(name) != "" {
+			return nil
+		}
+	}
+	for _, rule := range p.GetCoalesceRules(r.Host) {
+		if strings.HasPrefix(r.URL.Path, rule.Path) {
+			rule := rule
+			return &rule
+		}
+	}
+	return nil
+}
+
+// coalesceMiddleware share upstream calls of identical requests of sites with coalesce rules
+func (p *ProxySrv) coalesceMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rule := p.matchCoalesceRule(r)
+		if rule == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		key := rule.key(r)
+
+		p.coalesceLock.Lock()
+		if p.coalesceCalls == nil {
+			p.coalesceCalls = map[string]*coalesceCall{}
+		}
+		call, ok := p.coalesceCalls[key]
+		if ok && (rule.MaxWaiters == 0 || call.waiters < rule.MaxWaiters) {
+			call.waiters++
+			p.coalesceLock.Unlock()
+			p.waitCoalesceCall(call, w, r, handler)
+			return
+		}
+		if ok {
+			p.coalesceLock.Unlock()
+			handler.ServeHTTP(w, r)
+			return
+		}
+		call = &coalesceCall{done: make(chan struct{})}
+		p.coalesceCalls[key] = call
+		p.coalesceLock.Unlock()
+
+		maxSize := rule.MaxSize
+		if maxSize == 0 {
+			maxSize = DefaultCoalesceMaxSize
+		}
+		cw := &coalesceWriter{ResponseWriter: w, maxSize: maxSize, outer: http.Header{}}
+		for key, values := range w.Header() {
+			cw.outer[key] = append([]string{}, values...)
+		}
+		defer func() {
+			// waiting requests call the origin themselves if the call panics
+			p.coalesceLock.Lock()
+			delete(p.coalesceCalls, key)
+			p.coalesceLock.Unlock()
+			close(call.done)
+		}()
+		handler.ServeHTTP(cw, r)
+		if cw.status == 0 {
+			cw.WriteHeader(http.StatusOK)
+		}
+
+		// responses setting cookies belong to the client who made the call, error pages of libra
+		// are rendered for the request, and a canceled call leaves waiting requests to call the origin
+		_, generated := cw.header[http.CanonicalHeaderKey(errorHeader)]
+		if !cw.tooLarge && cw.status < http.StatusInternalServerError && !generated && r.Context().Err() == nil &&
+			cw.header.Get("Set-Cookie") == "" {
+			call.status, call.header, call.body = cw.status, cw.header, cw.body.Bytes()
+			call.shared = true
+		}
+	})
+}
+
+// waitCoalesceCall write the response of a shared call, the request goes to the origin if it can not be shared,
+// headers set by middleware of the request are kept
+func (p *ProxySrv) waitCoalesceCall(call *coalesceCall, w http.ResponseWriter, r *http.Request, handler http.Handler) {
+	select {
+	case <-call.done:
+	case <-r.Context().Done():
+		return
+	}
+	if !call.shared {
+		handler.ServeHTTP(w, r)
+		return
+	}
+
+	header := w.Header()
+	for key, values := range call.header {
+		if _, ok := header[key]; !ok {
+			header[key] = append([]string{}, values...)
+		}
+	}
+	w.WriteHeader(call.status)
+	w.Write(call.body)
+}
+
+// coalesceWriter http.ResponseWriter copying the response of a shared call
+type coalesceWriter struct {
+	http.ResponseWriter
+	maxSize  int64
+	status   int
+	outer    http.Header // headers set by middleware before the call
+	header   http.Header // headers set by the call when the status is written
+	body     bytes.Buffer
+	tooLarge bool
+}
+
+// WriteHeader keep the status and headers
+func (w *coalesceWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	w.header = http.Header{}
+	for key, values := range w.ResponseWriter.Header() {
+		if outer := w.outer[key]; len(outer) > 0 {
+			if len(values) >= len(outer) && strings.Join(values[:len(outer)], "\n") == strings.Join(outer, "\n") {
+				values = values[len(outer):]
+			}
+		}
+		if len(values) > 0 {
+			w.header[key] = append([]string{}, values...)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write copy the body until it is larger than max size
+func (w *coalesceWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.tooLarge {
+		if int64(w.body.Len()+len(b)) > w.maxSize {
+			w.tooLarge = true
+			w.body.Reset()
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush flush the response if supported
+func (w *coalesceWriter) Flush() {
+	if w.status == 0 {
+		return
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap get the wrapped http.ResponseWriter
+func (w *coalesceWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,194 @@
+package libra
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalesceRule(t *testing.T) {
+	if (CoalesceRule{MaxSize: -1}).Validate() != ErrCoalesceRuleInvalid || (CoalesceRule{Headers: []string{"A B"}}).Validate() != ErrCoalesceRuleInvalid {
+		t.Error("coalesce rule have an error #1")
+	}
+	rule := CoalesceRule{Headers: []string{"accept"}}
+	req := httptest.NewRequest("GET", "http://www.a.com/a?b=1", nil)
+	req.Header.Set("Accept", "text/html")
+	if key := rule.key(req); key != "GET www.a.com/a?b=1\nAccept:text/html" {
+		t.Error("coalesce rule have an error #2", key)
+	}
+
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	proxy.SetCoalesceRules("www.a.com", []CoalesceRule{{Path: "/api/"}, {Path: "/", MaxWaiters: 1}})
+	if rule := proxy.matchCoalesceRule(httptest.NewRequest("GET", "http://www.a.com/api/a", nil)); rule == nil || rule.Path != "/api/" {
+		t.Error("coalesce rule have an error #3")
+	}
+	req = httptest.NewRequest("GET", "http://www.a.com/api/a", nil)
+	req.Header.Set("Cookie", "a=1")
+	if proxy.matchCoalesceRule(req) != nil || proxy.matchCoalesceRule(httptest.NewRequest("POST", "http://www.a.com/a", nil)) != nil {
+		t.Error("coalesce rule have an error #4")
+	}
+	if proxy.SetCoalesceRules("www.a.com", nil); proxy.GetCoalesceRules("www.a.com") != nil {
+		t.Error("coalesce rule have an error #5")
+	}
+}
+
+func TestCoalesceMiddleware(t *testing.T) {
+	domain := "www.coalesce.com"
+	var hits int32
+	release, releaseLarge := make(chan struct{}), make(chan struct{})
+	releaseFail, releaseCancel := make(chan struct{}), make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		if r.URL.Path == "/fail" {
+			<-releaseFail
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Path == "/cancel" {
+			<-releaseCancel
+		}
+		if r.URL.Path == "/large" {
+			<-releaseLarge
+			w.Write([]byte(strings.Repeat("a", 100)))
+			return
+		}
+		w.Write([]byte("body " + strconv.Itoa(int(n))))
+	}))
+	defer origin.Close()
+
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	proxy.RegistSite(domain, "roundrobin", "http").AddAddr(domain, origin.Listener.Addr().String(), 1)
+	proxy.SetCoalesceRules(domain, []CoalesceRule{{Path: "/slow"}, {Path: "/large", MaxSize: 10}, {Path: "/fail"}, {Path: "/cancel"}})
+	proxy.SetHeaderRules(domain, []HeaderRule{{Target: HeaderResponse, Action: HeaderSet, Name: "X-Rid", Value: "{#request_id#}"}})
+	proxy.SetErrorPage(http.StatusInternalServerError, "{#request_id#}")
+	handler := proxy.Handler()
+	getContext := func(ctx context.Context, path string, header map[string]string) (*httptest.ResponseRecorder, string) {
+		req := httptest.NewRequest("GET", "http://"+domain+path, nil).WithContext(ctx)
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		body, _ := ioutil.ReadAll(w.Body)
+		return w, string(body)
+	}
+	get := func(path string, header map[string]string) (*httptest.ResponseRecorder, string) {
+		return getContext(context.Background(), path, header)
+	}
+	waiters := func(n int) {
+		for i := 0; i < 200; i++ {
+			proxy.coalesceLock.Lock()
+			count := -1
+			for _, call := range proxy.coalesceCalls {
+				count = call.waiters
+			}
+			proxy.coalesceLock.Unlock()
+			if count >= n {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	var wg sync.WaitGroup
+	bodies := make([]string, 5)
+	ids := make([]string, 5)
+	rids := make([]string, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w, body := get("/slow", map[string]string{"X-Request-Id": "coalesce-" + strconv.Itoa(i)})
+			bodies[i], ids[i], rids[i] = body, w.Header().Get("X-Request-Id"), w.Header().Get("X-Rid")
+		}(i)
+	}
+	waiters(4)
+	close(release)
+	wg.Wait()
+	for i := 0; i < 5; i++ {
+		if bodies[i] != "body 1" || ids[i] != "coalesce-"+strconv.Itoa(i) || rids[i] != ids[i] {
+			t.Error("coalesce middleware have an error #1", i, bodies[i], ids[i], rids[i])
+		}
+	}
+	if atomic.LoadInt32(&hits) != 1 {
+		t.Error("coalesce middleware have an error #2", hits)
+	}
+
+	// requests with credentials are not shared
+	if _, body := get("/slow", map[string]string{"Authorization": "Basic eA=="}); body != "body 2" {
+		t.Error("coalesce middleware have an error #3", body)
+	}
+
+	// responses larger than max size are not shared
+	atomic.StoreInt32(&hits, 0)
+	wg.Add(2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			defer wg.Done()
+			if _, body := get("/large", nil); len(body) != 100 {
+				t.Error("coalesce middleware have an error #4", body)
+			}
+		}()
+	}
+	waiters(1)
+	close(releaseLarge)
+	wg.Wait()
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Error("coalesce middleware have an error #5", n)
+	}
+
+	// error pages are not shared, waiting requests call the origin and get their own
+	atomic.StoreInt32(&hits, 0)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := "fail-" + strconv.Itoa(i)
+			if w, body := get("/fail", map[string]string{"X-Request-Id": id}); w.Code != 500 || body != id {
+				t.Error("coalesce middleware have an error #6", w.Code, body)
+			}
+		}(i)
+	}
+	waiters(2)
+	close(releaseFail)
+	wg.Wait()
+	if n := atomic.LoadInt32(&hits); n != 3 {
+		t.Error("coalesce middleware have an error #7", n)
+	}
+
+	// a waiting request calls the origin itself if the client of the call is gone
+	atomic.StoreInt32(&hits, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		getContext(ctx, "/cancel", nil)
+	}()
+	waiters(0)
+	go func() {
+		defer wg.Done()
+		if w, body := get("/cancel", nil); w.Code != 200 || !strings.HasPrefix(body, "body") {
+			t.Error("coalesce middleware have an error #8", w.Code, body)
+		}
+	}()
+	waiters(1)
+	cancel()
+	for i := 0; i < 200 && atomic.LoadInt32(&hits) < 2; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(releaseCancel)
+	wg.Wait()
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Error("coalesce middleware have an error #9", n)
+	}
+}
@@ -0,0 +1,292 @@
+package libra
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrCompressInvalid response compression config is invalid
+var ErrCompressInvalid = errors.New("the response compression config is invalid")
+
+// DefaultCompressTypes content types compressed if the config does not set them
+var DefaultCompressTypes = []string{
+	"text/html", "text/css", "text/plain", "text/xml", "text/javascript",
+	"application/javascript", "application/json", "application/xml", "image/svg+xml",
+}
+
+// CompressConfig compression of responses of a site by Accept-Encoding of the client,
+// responses already encoded by the origin are not changed
+type CompressConfig struct {
+	Types   []string `json:"types,omitempty"`    // content types like text/html or text/*, default DefaultCompressTypes
+	MinSize int64    `json:"min_size,omitempty"` // smaller responses are not compressed
+	Level   int      `json:"level,omitempty"`    // 1 to 9, 0 is the default level
+}
+
+// Validate check the config
+func (c CompressConfig) Validate() error {
+	if c.MinSize < 0 || c.Level < 0 || c.Level > gzip.BestCompression {
+		return ErrCompressInvalid
+	}
+	for _, t := range c.Types {
+		if t == "" || !strings.Contains(t, "/") {
+			return ErrCompressInvalid
+		}
+	}
+	return nil
+}
+
+// withDefault fill zero fields by default value
+func (c CompressConfig) withDefault() CompressConfig {
+	if len(c.Types) == 0 {
+		c.Types = DefaultCompressTypes
+	}
+	if c.Level == 0 {
+		c.Level = gzip.DefaultCompression
+	}
+	return c
+}
+
+// compressible check the content type is in the types
+func (c CompressConfig) compressible(contentType string) bool {
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	if contentType == "" {
+		return false
+	}
+	for _, t := range c.Types {
+		t = strings.ToLower(t)
+		if t == contentType || strings.HasSuffix(t, "/*") && strings.HasPrefix(contentType, t[:len(t)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetCompress set response compression of a site, nil disables it
+func (p *ProxySrv) SetCompress(domain string, config *CompressConfig) error {
+	if config != nil {
+		if err := config.Validate(); err != nil {
+			return err
+		}
+	}
+
+	p.compressLock.Lock()
+	defer p.compressLock.Unlock()
+	if p.compressConfigs == nil {
+		p.compressConfigs = map[string]CompressConfig{}
+	}
+	if config == nil {
+		delete(p.compressConfigs, domain)
+	} else {
+		p.compressConfigs[domain] = *config
+	}
+	return nil
+}
+
+// GetCompress get response compression config of a site, nil if it is not enabled
+func (p *ProxySrv) GetCompress(domain string) *CompressConfig {
+	p.compressLock.RLock()
+	defer p.compressLock.RUnlock()
+	config, ok := p.compressConfigs[domain]
+	if !ok {
+		return nil
+	}
+	return &config
+}
+
+// acceptEncoding get the encoding accepted by the client, gzip is preferred, empty if none
+func acceptEncoding(header http.Header) string {
+	accepted := map[string]bool{}
+	for _, value := range header["Accept-Encoding"] {
+		for _, item := range strings.Split(value, ",") {
+			name, q := strings.TrimSpace(item), 1.0
+			if i := strings.Index(name, ";"); i >= 0 {
+				param := strings.TrimSpace(name[i+1:])
+				name = strings.TrimSpace(name[:i])
+				if strings.HasPrefix(param, "q=") {
+					var err error
+					if q, err = strconv.ParseFloat(param[2:], 64); err != nil {
+						q = 0
+					}
+				}
+			}
+			accepted[strings.ToLower(name)] = q > 0
+		}
+	}
+	for _, name := range []string{"gzip", "deflate"} {
+		if ok, found := accepted[name]; found {
+			if ok {
+				return name
+			}
+			continue
+		}
+		if accepted["*"] {
+			return name
+		}
+	}
+	return ""
+}
+
+// compressMiddleware compress responses of sites with compression enabled
+func (p *ProxySrv) compressMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := p.GetCompress(r.Host)
+		if config == nil || r.Header.Get("Upgrade") != "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		encoding := acceptEncoding(r.Header)
+		if r.Method == http.MethodHead {
+			// there is no body to compress, but the response varies like the GET one
+			encoding = ""
+		}
+		cw := &compressWriter{ResponseWriter: w, config: config.withDefault(), encoding: encoding}
+		defer cw.close()
+		handler.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter http.ResponseWriter compressing the body as it is written, the body is
+// held until it reaches min size if the origin does not tell Content-Length
+type compressWriter struct {
+	http.ResponseWriter
+	config   CompressConfig
+	encoding string // accepted by the client
+	status   int
+	pending  bool // the body is held until it reaches min size
+	buf      bytes.Buffer
+	writer   io.WriteCloser // nil if the body is not compressed
+}
+
+// WriteHeader decide whether the response is compressed
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	header := w.ResponseWriter.Header()
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified ||
+		header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" ||
+		strings.Contains(strings.ToLower(header.Get("Cache-Control")), "no-transform") ||
+		!w.config.compressible(header.Get("Content-Type")) {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	addVary(header, "Accept-Encoding")
+	if w.encoding == "" {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+		if length < w.config.MinSize {
+			w.ResponseWriter.WriteHeader(status)
+			return
+		}
+		w.start()
+		return
+	}
+	if w.config.MinSize > 0 {
+		w.pending = true
+		return
+	}
+	w.start()
+}
+
+// start write headers of the compressed response and the held body
+func (w *compressWriter) start() {
+	header := w.ResponseWriter.Header()
+	header.Del("Content-Length")
+	// ranges of the origin body do not apply to the compressed one
+	header.Del("Accept-Ranges")
+	header.Set("Content-Encoding", w.encoding)
+	// the compressed body is not byte for byte the same as the origin one
+	if etag := header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		header.Set("ETag", "W/"+etag)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	if w.encoding == "gzip" {
+		w.writer, _ = gzip.NewWriterLevel(w.ResponseWriter, w.config.Level)
+	} else {
+		w.writer, _ = zlib.NewWriterLevel(w.ResponseWriter, w.config.Level)
+	}
+	w.pending = false
+	if w.buf.Len() > 0 {
+		w.writer.Write(w.buf.Bytes())
+		w.buf.Reset()
+	}
+}
+
+// Write compress the body
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.pending {
+		w.buf.Write(b)
+		if int64(w.buf.Len()) >= w.config.MinSize {
+			w.start()
+		}
+		return len(b), nil
+	}
+	if w.writer != nil {
+		return w.writer.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush flush the compressed body if supported, a held body is compressed at once
+func (w *compressWriter) Flush() {
+	if w.status == 0 {
+		return
+	}
+	if w.pending {
+		w.start()
+	}
+	if flusher, ok := w.writer.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap get the wrapped http.ResponseWriter
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// close finish the compressed body, a held body smaller than min size is written as it is
+func (w *compressWriter) close() {
+	if w.pending {
+		w.ResponseWriter.Header().Set("Content-Length", strconv.Itoa(w.buf.Len()))
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.Write(w.buf.Bytes())
+		return
+	}
+	if w.writer != nil {
+		w.writer.Close()
+	}
+}
+
+// addVary add a header name to Vary if it is not there
+func addVary(header http.Header, name string) {
+	for _, value := range header["Vary"] {
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			if item == "*" || strings.EqualFold(item, name) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", name)
+}
@@ -0,0 +1,139 @@
+package libra
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompressConfig(t *testing.T) {
+	if (CompressConfig{Level: 10}).Validate() != ErrCompressInvalid || (CompressConfig{Types: []string{"html"}}).Validate() != ErrCompressInvalid ||
+		(CompressConfig{MinSize: -1}).Validate() != ErrCompressInvalid {
+		t.Error("compress config have an error #1")
+	}
+	config := CompressConfig{Types: []string{"text/*", "application/json"}}
+	if !config.compressible("text/html; charset=utf-8") || !config.compressible("Application/JSON") || config.compressible("image/png") || config.compressible("") {
+		t.Error("compress config have an error #2")
+	}
+
+	cases := map[string]string{
+		"gzip, deflate":         "gzip",
+		"deflate":               "deflate",
+		"gzip;q=0, deflate;q=1": "deflate",
+		"*":                     "gzip",
+		"gzip;q=0, *":           "deflate",
+		"br":                    "",
+		"":                      "",
+	}
+	for value, expect := range cases {
+		header := http.Header{}
+		header.Set("Accept-Encoding", value)
+		if encoding := acceptEncoding(header); encoding != expect {
+			t.Error("compress config have an error #3", value, encoding)
+		}
+	}
+}
+
+func TestCompressMiddleware(t *testing.T) {
+	domain := "www.compress.com"
+	body := strings.Repeat("hello libra ", 100)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/png":
+			w.Header().Set("Content-Type", "image/png")
+		case "/encoded":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Encoding", "br")
+		case "/small":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("small"))
+			return
+		case "/stream":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("abc"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(body))
+			return
+		default:
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Accept-Ranges", "bytes")
+		}
+		w.Write([]byte(body))
+	}))
+	defer origin.Close()
+
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	proxy.RegistSite(domain, "roundrobin", "http").AddAddr(domain, origin.Listener.Addr().String(), 1)
+	if err := proxy.SetCompress(domain, &CompressConfig{Level: -1}); err != ErrCompressInvalid {
+		t.Error("compress middleware have an error #1")
+	}
+	proxy.SetCompress(domain, &CompressConfig{MinSize: 100})
+	handler := proxy.Handler()
+	get := func(path, encoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://"+domain+path, nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/", "gzip")
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Content-Length") != "" ||
+		w.Header().Get("Vary") != "Accept-Encoding" || w.Header().Get("ETag") != `W/"v1"` || w.Header().Get("Accept-Ranges") != "" {
+		t.Error("compress middleware have an error #2", w.Header())
+	}
+	if reader, err := gzip.NewReader(w.Body); err != nil {
+		t.Error("compress middleware have an error #3", err)
+	} else if data, _ := ioutil.ReadAll(reader); string(data) != body {
+		t.Error("compress middleware have an error #4")
+	}
+
+	w = get("/", "deflate")
+	if reader, err := zlib.NewReader(w.Body); err != nil || w.Header().Get("Content-Encoding") != "deflate" {
+		t.Error("compress middleware have an error #5", err)
+	} else if data, _ := ioutil.ReadAll(reader); string(data) != body {
+		t.Error("compress middleware have an error #6")
+	}
+
+	if w = get("/", ""); w.Header().Get("Content-Encoding") != "" || w.Header().Get("Vary") != "Accept-Encoding" || w.Body.String() != body ||
+		w.Header().Get("Accept-Ranges") != "bytes" {
+		t.Error("compress middleware have an error #7")
+	}
+	if w = get("/png", "gzip"); w.Header().Get("Content-Encoding") != "" || w.Header().Get("Vary") != "" {
+		t.Error("compress middleware have an error #8")
+	}
+	if w = get("/encoded", "gzip"); w.Header().Get("Content-Encoding") != "br" || w.Body.String() != body {
+		t.Error("compress middleware have an error #9")
+	}
+	if w = get("/small", "gzip"); w.Header().Get("Content-Encoding") != "" || w.Body.String() != "small" {
+		t.Error("compress middleware have an error #10")
+	}
+
+	// a flushed body is compressed before it reaches min size
+	w = get("/stream", "gzip")
+	if reader, err := gzip.NewReader(w.Body); err != nil || !w.Flushed {
+		t.Error("compress middleware have an error #11", err)
+	} else if data, _ := ioutil.ReadAll(reader); string(data) != "abc"+body {
+		t.Error("compress middleware have an error #12")
+	}
+
+	// HEAD responses are not compressed but vary like GET ones
+	head := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("HEAD", "http://"+domain+path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	if w = head("/"); w.Header().Get("Content-Encoding") != "" || w.Header().Get("Vary") != "Accept-Encoding" || w.Body.Len() != 0 {
+		t.Error("compress middleware have an error #13", w.Header())
+	}
+	if w = head("/png"); w.Header().Get("Vary") != "" {
+		t.Error("compress middleware have an error #14")
+	}
+}
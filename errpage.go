@@ -3,6 +3,7 @@ package libra
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -31,15 +32,50 @@ var (
 <td>Date:</td>
 <td>{#time#}</td>
 </tr>
+<tr>
+<td>Request ID:</td>
+<td>{#request_id#}</td>
+</tr>
 </table>
-<hr/>Powered by <a href="https://github.com/zhuCheer/libra" target="_blank">libra/0.0.1</a></body>
+<hr/>{#powered#}</body>
 </html>
 `
 )
 
+// SetErrorPage set the error page template of a status code like 503, an empty template
+// resets to ErrDefaultPage, {#title#} {#msg#} {#url#} {#host#} {#time#} {#request_id#} {#powered#} are replaced
+func (p *ProxySrv) SetErrorPage(statusCode int, template string) {
+	p.pageLock.Lock()
+	defer p.pageLock.Unlock()
+	if p.errorPages == nil {
+		p.errorPages = map[int]string{}
+	}
+	if template == "" {
+		delete(p.errorPages, statusCode)
+		return
+	}
+	p.errorPages[statusCode] = template
+}
+
+// errorPage get the error page response of a status code
+func (p *ProxySrv) errorPage(statusCode int, msg string, req *http.Request) (resp *http.Response, err error) {
+	p.pageLock.RLock()
+	template, ok := p.errorPages[statusCode]
+	p.pageLock.RUnlock()
+	if !ok {
+		template = ErrDefaultPage
+	}
+	template = strings.Replace(template, "{#powered#}", p.poweredBy(), -1)
+	return renderErrorPage(template, statusCode, msg, req)
+}
+
 // getDefaultErrorPage proxy not found page
 func getDefaultErrorPage(statusCode int, msg string, req *http.Request) (resp *http.Response, err error) {
-	errPageTemplate := ErrDefaultPage
+	return renderErrorPage(strings.Replace(ErrDefaultPage, "{#powered#}", defaultPoweredBy, -1), statusCode, msg, req)
+}
+
+// renderErrorPage render an error page template
+func renderErrorPage(errPageTemplate string, statusCode int, msg string, req *http.Request) (resp *http.Response, err error) {
 
 	errPageTemplate = strings.Replace(errPageTemplate, "{#title#}",
 		fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)), -1)
@@ -49,6 +85,7 @@ func getDefaultErrorPage(statusCode int, msg string, req *http.Request) (resp *h
 	errPageTemplate = strings.Replace(errPageTemplate, "{#url#}", req.URL.Path, -1)
 	errPageTemplate = strings.Replace(errPageTemplate, "{#host#}", req.Host, -1)
 	errPageTemplate = strings.Replace(errPageTemplate, "{#time#}", time.Now().String(), -1)
+	errPageTemplate = strings.Replace(errPageTemplate, "{#request_id#}", requestID(req), -1)
 
 	resp = getResponsePage(statusCode, errPageTemplate, req)
 	return resp, err
@@ -75,3 +112,21 @@ func getResponsePage(status int, msg string, req *http.Request) *http.Response {
 	}
 	return resp
 }
+
+// writeResponse write an error page response to the client directly
+func writeResponse(w http.ResponseWriter, resp *http.Response) {
+	defer resp.Body.Close()
+	for key, values := range resp.Header {
+		if http.CanonicalHeaderKey(key) == http.CanonicalHeaderKey(errorHeader) {
+			continue
+		}
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
@@ -0,0 +1,269 @@
+package libra
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ErrForwardedInvalid forwarded header config is invalid
+var ErrForwardedInvalid = errors.New("the forwarded header config is invalid")
+
+// ForwardedMode how X-Forwarded-For of a request is sent to the origin
+type ForwardedMode string
+
+// X-Forwarded-For modes.
+const (
+	ForwardedAppend    ForwardedMode = "append"    // append the client addr to the incoming list
+	ForwardedOverwrite ForwardedMode = "overwrite" // replace the incoming list by the real client ip
+	ForwardedStrip     ForwardedMode = "strip"     // send no X-Forwarded-For
+)
+
+// ForwardedConfig forwarding headers sent to the origin of a site,
+// incoming X-Forwarded-Proto/Host/Port, X-Real-IP and Forwarded headers are kept only from trusted proxies
+type ForwardedConfig struct {
+	Mode       ForwardedMode `json:"mode,omitempty"`        // default append
+	XForwarded bool          `json:"x_forwarded,omitempty"` // set X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Port
+	RealIP     bool          `json:"real_ip,omitempty"`     // set X-Real-IP
+	Forwarded  bool          `json:"forwarded,omitempty"`   // set RFC 7239 Forwarded
+}
+
+// DefaultForwarded forwarding headers of a site without config
+var DefaultForwarded = ForwardedConfig{Mode: ForwardedAppend, XForwarded: true, RealIP: true}
+
+// Validate check the config
+func (c ForwardedConfig) Validate() error {
+	switch c.Mode {
+	case "", ForwardedAppend, ForwardedOverwrite, ForwardedStrip:
+		return nil
+	}
+	return ErrForwardedInvalid
+}
+
+// SetForwarded set forwarding headers of a site, nil resets it to DefaultForwarded
+func (p *ProxySrv) SetForwarded(domain string, config *ForwardedConfig) error {
+	if config != nil {
+		if err := config.Validate(); err != nil {
+			return err
+		}
+	}
+
+	p.forwardLock.Lock()
+	defer p.forwardLock.Unlock()
+	if p.forwardConfigs == nil {
+		p.forwardConfigs = map[string]ForwardedConfig{}
+	}
+	if config == nil {
+		delete(p.forwardConfigs, domain)
+	} else {
+		p.forwardConfigs[domain] = *config
+	}
+	return nil
+}
+
+// GetForwarded get forwarding headers config of a site
+func (p *ProxySrv) GetForwarded(domain string) ForwardedConfig {
+	p.forwardLock.RLock()
+	defer p.forwardLock.RUnlock()
+	config, ok := p.forwardConfigs[domain]
+	if !ok {
+		return DefaultForwarded
+	}
+	return config
+}
+
+// SetTrustedProxies set addrs of proxies in front of libra by CIDR like 10.0.0.0/8 or ip,
+// the client ip is taken from X-Forwarded-For of requests from them,
+// it is used by logging, rate limiting and the forwarding headers
+func (p *ProxySrv) SetTrustedProxies(cidrs []string) error {
+	nets := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		ipNet, err := parseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		nets = append(nets, ipNet)
+	}
+
+	p.forwardLock.Lock()
+	defer p.forwardLock.Unlock()
+	p.trustedProxies = nets
+	return nil
+}
+
+// parseCIDR parse a CIDR like 10.0.0.0/8 or 2001:db8::/32, an ip is a network of itself
+func parseCIDR(cidr string) (*net.IPNet, error) {
+	if !strings.Contains(cidr, "/") {
+		if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+			cidr += "/32"
+		} else {
+			cidr += "/128"
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(cidr)
+	return ipNet, err
+}
+
+// isTrusted check an ip is a trusted proxy
+func (p *ProxySrv) isTrusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	p.forwardLock.RLock()
+	defer p.forwardLock.RUnlock()
+	for _, ipNet := range p.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// realClientIP get the client ip of a request, X-Forwarded-For is read from right to left
+// while the hops are trusted proxies, the first untrusted one is the client
+func (p *ProxySrv) realClientIP(r *http.Request) (ip string, peerTrusted bool) {
+	peer := remoteIP(r)
+	if !p.isTrusted(peer) {
+		return peer, false
+	}
+
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !p.isTrusted(hops[i]) {
+			return hops[i], true
+		}
+	}
+	if len(hops) > 0 {
+		return hops[0], true
+	}
+	return peer, true
+}
+
+// setForwardedHeaders set forwarding headers of a request to the origin,
+// it is called in the transport as the header X-Forwarded-For is changed by the reverse proxy,
+// the host is the one asked by the client as req.Host may be changed by rewrite rules
+func (p *ProxySrv) setForwardedHeaders(req *http.Request, state *requestState) {
+	config := p.GetForwarded(state.domain)
+	peer := remoteIP(req)
+
+	switch config.Mode {
+	case ForwardedOverwrite:
+		req.Header.Set("X-Forwarded-For", state.clientIP)
+	case ForwardedStrip:
+		req.Header.Del("X-Forwarded-For")
+	default:
+		hops := state.forwardedFor
+		if peer != "" {
+			hops = append(append([]string{}, hops...), peer)
+		}
+		if len(hops) == 0 {
+			req.Header.Del("X-Forwarded-For")
+		} else {
+			req.Header.Set("X-Forwarded-For", strings.Join(hops, ", "))
+		}
+	}
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	if config.XForwarded {
+		// values set by a trusted proxy are kept
+		setForwardedValue(req.Header, "X-Forwarded-Proto", proto, state.peerTrusted)
+		setForwardedValue(req.Header, "X-Forwarded-Host", state.domain, state.peerTrusted)
+		setForwardedValue(req.Header, "X-Forwarded-Port", requestPort(state.domain, proto), state.peerTrusted)
+	} else if !state.peerTrusted {
+		req.Header.Del("X-Forwarded-Proto")
+		req.Header.Del("X-Forwarded-Host")
+		req.Header.Del("X-Forwarded-Port")
+	}
+
+	if config.RealIP {
+		req.Header.Set("X-Real-IP", state.clientIP)
+	} else if !state.peerTrusted {
+		req.Header.Del("X-Real-IP")
+	}
+
+	if config.Forwarded {
+		element := "for=" + forwardedNode(peer) + ";host=" + forwardedQuote(state.domain) + ";proto=" + proto
+		if prior := req.Header.Get("Forwarded"); prior != "" && state.peerTrusted {
+			element = prior + ", " + element
+		}
+		req.Header.Set("Forwarded", element)
+	} else if !state.peerTrusted {
+		req.Header.Del("Forwarded")
+	}
+}
+
+// setForwardedValue set a forwarding header, an existing value is kept if keep is true
+func setForwardedValue(header http.Header, key, value string, keep bool) {
+	if keep && header.Get(key) != "" {
+		return
+	}
+	header.Set(key, value)
+}
+
+// forwardedFor get hops of the X-Forwarded-For header
+func forwardedFor(header http.Header) []string {
+	hops := []string{}
+	for _, value := range header["X-Forwarded-For"] {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// clientIP get the real client ip of a request
+func clientIP(r *http.Request) string {
+	if state := getRequestState(r); state != nil && state.clientIP != "" {
+		return state.clientIP
+	}
+	return remoteIP(r)
+}
+
+// remoteIP get ip of the peer connected to libra
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// requestPort get the port the client connected to by the Host of the request
+func requestPort(host, proto string) string {
+	if _, port, err := net.SplitHostPort(host); err == nil {
+		return port
+	}
+	if proto == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+// forwardedNode format an ip as a node of the Forwarded header, ipv6 is bracketed and quoted
+func forwardedNode(ip string) string {
+	if ip == "" {
+		return "unknown"
+	}
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// forwardedQuote quote a value of the Forwarded header if it is not a token
+func forwardedQuote(value string) string {
+	for _, c := range value {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return `"` + strings.Replace(strings.Replace(value, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+		}
+	}
+	return value
+}
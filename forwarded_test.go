@@ -0,0 +1,105 @@
+package libra
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRealClientIP(t *testing.T) {
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	if err := proxy.SetTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "bad/ip"}); err == nil {
+		t.Error("real client ip have an error #1")
+	}
+	proxy.SetTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "::1"})
+
+	req := httptest.NewRequest("GET", "http://www.forwarded.com/", nil)
+	req.RemoteAddr = "172.16.0.1:5678"
+	req.Header.Set("X-Forwarded-For", "1.1.1.1")
+	if ip, trusted := proxy.realClientIP(req); ip != "172.16.0.1" || trusted {
+		t.Error("real client ip have an error #2", ip)
+	}
+
+	req.RemoteAddr = "10.0.0.2:5678"
+	req.Header.Set("X-Forwarded-For", "1.1.1.1, 2.2.2.2,192.168.1.1")
+	if ip, trusted := proxy.realClientIP(req); ip != "2.2.2.2" || !trusted {
+		t.Error("real client ip have an error #3", ip)
+	}
+	req.Header.Set("X-Forwarded-For", "10.0.0.5, 192.168.1.1")
+	if ip, _ := proxy.realClientIP(req); ip != "10.0.0.5" {
+		t.Error("real client ip have an error #4", ip)
+	}
+	req.Header.Del("X-Forwarded-For")
+	if ip, _ := proxy.realClientIP(req); ip != "10.0.0.2" {
+		t.Error("real client ip have an error #5", ip)
+	}
+	req.RemoteAddr = "[::1]:5678"
+	if ip, trusted := proxy.realClientIP(req); ip != "::1" || !trusted {
+		t.Error("real client ip have an error #6", ip)
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	domain := "www.forwarded.com"
+	var got http.Header
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+	}))
+	defer origin.Close()
+
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	proxy.RegistSite(domain, "roundrobin", "http").AddAddr(domain, origin.Listener.Addr().String(), 1)
+	proxy.SetTrustedProxies([]string{"10.0.0.0/8"})
+	handler := proxy.Handler()
+	get := func(remoteAddr string, header map[string]string) {
+		req := httptest.NewRequest("GET", "http://"+domain+"/", nil)
+		req.RemoteAddr = remoteAddr
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// default, incoming proto from an untrusted peer is replaced
+	get("172.16.0.1:5678", map[string]string{"X-Forwarded-For": "1.1.1.1", "X-Forwarded-Proto": "https"})
+	if got.Get("X-Forwarded-For") != "1.1.1.1, 172.16.0.1" || got.Get("X-Real-IP") != "172.16.0.1" ||
+		got.Get("X-Forwarded-Proto") != "http" || got.Get("X-Forwarded-Host") != domain || got.Get("X-Forwarded-Port") != "80" {
+		t.Error("forwarded headers have an error #1", got)
+	}
+	get("10.0.0.2:5678", map[string]string{"X-Forwarded-For": "1.1.1.1", "X-Forwarded-Proto": "https"})
+	if got.Get("X-Forwarded-For") != "1.1.1.1, 10.0.0.2" || got.Get("X-Real-IP") != "1.1.1.1" || got.Get("X-Forwarded-Proto") != "https" {
+		t.Error("forwarded headers have an error #2", got)
+	}
+
+	if err := proxy.SetForwarded(domain, &ForwardedConfig{Mode: "keep"}); err != ErrForwardedInvalid {
+		t.Error("forwarded headers have an error #3")
+	}
+	proxy.SetForwarded(domain, &ForwardedConfig{Mode: ForwardedOverwrite, Forwarded: true})
+	get("10.0.0.2:5678", map[string]string{"X-Forwarded-For": "1.1.1.1", "Forwarded": "for=1.1.1.1", "X-Real-IP": "3.3.3.3"})
+	if got.Get("X-Forwarded-For") != "1.1.1.1" || got.Get("Forwarded") != "for=1.1.1.1, for=10.0.0.2;host=www.forwarded.com;proto=http" ||
+		got.Get("X-Real-IP") != "3.3.3.3" || got.Get("X-Forwarded-Proto") != "" {
+		t.Error("forwarded headers have an error #4", got)
+	}
+	get("[2001:db8::1]:5678", map[string]string{"Forwarded": "for=1.1.1.1", "X-Real-IP": "3.3.3.3"})
+	if got.Get("X-Forwarded-For") != "2001:db8::1" || got.Get("Forwarded") != `for="[2001:db8::1]";host=www.forwarded.com;proto=http` ||
+		got.Get("X-Real-IP") != "" {
+		t.Error("forwarded headers have an error #5", got)
+	}
+
+	proxy.SetForwarded(domain, &ForwardedConfig{Mode: ForwardedStrip})
+	get("172.16.0.1:5678", map[string]string{"X-Forwarded-For": "1.1.1.1"})
+	if _, ok := got["X-Forwarded-For"]; ok {
+		t.Error("forwarded headers have an error #6", got)
+	}
+	proxy.SetForwarded(domain, nil)
+	if proxy.GetForwarded(domain) != DefaultForwarded {
+		t.Error("forwarded headers have an error #7")
+	}
+
+	data, _ := json.Marshal(ForwardedConfig{Mode: ForwardedStrip, RealIP: true})
+	if string(data) != `{"mode":"strip","real_ip":true}` {
+		t.Error("forwarded headers have an error #8", string(data))
+	}
+	proxy.FlushProxy(domain)
+}
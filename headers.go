@@ -0,0 +1,192 @@
+package libra
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ErrHeaderRuleInvalid header rule is invalid
+var ErrHeaderRuleInvalid = errors.New("the header rule is invalid")
+
+// HeaderAction what a header rule does
+type HeaderAction string
+
+// Header rule actions.
+const (
+	HeaderSet    HeaderAction = "set"    // replace values of the header
+	HeaderAdd    HeaderAction = "add"    // add a value to the header
+	HeaderRemove HeaderAction = "remove" // delete the header
+	HeaderRename HeaderAction = "rename" // move values of the header to To
+)
+
+// Header rule targets.
+const (
+	HeaderRequest  = "request"  // headers of the request to the origin
+	HeaderResponse = "response" // headers of the response to the client
+)
+
+// HeaderRule change a header of requests matching Path, Value can use variables
+// {#client_ip#}, {#request_id#}, {#endpoint#} and {#host#}, {#request_id#} is the id set by SetRequestID
+type HeaderRule struct {
+	Path   string       `json:"path,omitempty"` // path prefix, empty matches all
+	Target string       `json:"target"`         // request or response
+	Action HeaderAction `json:"action"`
+	Name   string       `json:"name"`
+	Value  string       `json:"value,omitempty"` // for set and add
+	To     string       `json:"to,omitempty"`    // for rename
+}
+
+// Validate check the rule
+func (r HeaderRule) Validate() error {
+	if r.Target != HeaderRequest && r.Target != HeaderResponse || r.Name == "" {
+		return ErrHeaderRuleInvalid
+	}
+	switch r.Action {
+	case HeaderSet, HeaderAdd, HeaderRemove:
+		return nil
+	case HeaderRename:
+		if r.To != "" {
+			return nil
+		}
+	}
+	return ErrHeaderRuleInvalid
+}
+
+// apply change the header by the rule
+func (r HeaderRule) apply(header http.Header, req *http.Request) {
+	switch r.Action {
+	case HeaderSet:
+		header.Set(r.Name, interpolateHeader(r.Value, req))
+	case HeaderAdd:
+		header.Add(r.Name, interpolateHeader(r.Value, req))
+	case HeaderRemove:
+		header.Del(r.Name)
+	case HeaderRename:
+		values := header[http.CanonicalHeaderKey(r.Name)]
+		if len(values) == 0 {
+			return
+		}
+		header.Del(r.Name)
+		for _, value := range values {
+			header.Add(r.To, value)
+		}
+	}
+}
+
+// interpolateHeader replace variables of a header value
+func interpolateHeader(value string, req *http.Request) string {
+	if !strings.Contains(value, "{#") {
+		return value
+	}
+
+	endpoint := ""
+	if state := getRequestState(req); state != nil {
+		endpoint = state.endpoint
+	}
+	value = strings.Replace(value, "{#client_ip#}", clientIP(req), -1)
+	value = strings.Replace(value, "{#request_id#}", requestID(req), -1)
+	value = strings.Replace(value, "{#endpoint#}", endpoint, -1)
+	value = strings.Replace(value, "{#host#}", req.Host, -1)
+	return value
+}
+
+// SetHeaderRules set header rules of a site, rules are applied in order, nil removes them
+func (p *ProxySrv) SetHeaderRules(domain string, rules []HeaderRule) error {
+	for _, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+
+	p.headerLock.Lock()
+	defer p.headerLock.Unlock()
+	if p.headerRules == nil {
+		p.headerRules = map[string][]HeaderRule{}
+	}
+	if len(rules) == 0 {
+		delete(p.headerRules, domain)
+	} else {
+		p.headerRules[domain] = append([]HeaderRule{}, rules...)
+	}
+	return nil
+}
+
+// GetHeaderRules get header rules of a site
+func (p *ProxySrv) GetHeaderRules(domain string) []HeaderRule {
+	p.headerLock.RLock()
+	defer p.headerLock.RUnlock()
+	return p.headerRules[domain]
+}
+
+// getCustomHeader get the custom response header of all sites, it must not be modified
+func (p *ProxySrv) getCustomHeader() map[string]string {
+	p.headerLock.RLock()
+	defer p.headerLock.RUnlock()
+	return p.customHeader
+}
+
+// applyHeaderRules change header by the rules of the site for the target,
+// paths of the rules match the client path, not the one sent to the endpoint
+func (p *ProxySrv) applyHeaderRules(target string, header http.Header, req *http.Request) {
+	state := getRequestState(req)
+	if state == nil {
+		return
+	}
+	for _, rule := range p.GetHeaderRules(state.domain) {
+		if rule.Target == target && strings.HasPrefix(state.path, rule.Path) {
+			rule.apply(header, req)
+		}
+	}
+}
+
+// responseHeaderMiddleware set identity, request id and response header rules when the response
+// is written to the client, so they are never kept by the cache or shared by coalesced requests
+func (p *ProxySrv) responseHeaderMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(&responseHeaderWriter{ResponseWriter: w, srv: p, req: r}, r)
+	})
+}
+
+// responseHeaderWriter http.ResponseWriter changing headers of the client before they are written
+type responseHeaderWriter struct {
+	http.ResponseWriter
+	srv         *ProxySrv
+	req         *http.Request
+	wroteHeader bool
+}
+
+// WriteHeader set headers of the client then write the status, informational ones are written as they are
+func (w *responseHeaderWriter) WriteHeader(status int) {
+	if !w.wroteHeader && (status >= http.StatusOK || status == http.StatusSwitchingProtocols) {
+		w.wroteHeader = true
+		header := w.ResponseWriter.Header()
+		w.srv.setIdentityHeader(header)
+		w.srv.setRequestIDHeader(header, w.req)
+		w.srv.applyHeaderRules(HeaderResponse, header, w.req)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write write the body, the status is 200 if it is not written
+func (w *responseHeaderWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush flush the response if supported
+func (w *responseHeaderWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap get the wrapped http.ResponseWriter
+func (w *responseHeaderWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,111 @@
+package libra
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestHeaderRule(t *testing.T) {
+	invalid := []HeaderRule{
+		{Target: "origin", Action: HeaderSet, Name: "X-A"},
+		{Target: HeaderRequest, Action: "append", Name: "X-A"},
+		{Target: HeaderRequest, Action: HeaderSet},
+		{Target: HeaderResponse, Action: HeaderRename, Name: "X-A"},
+	}
+	for k, rule := range invalid {
+		if rule.Validate() != ErrHeaderRuleInvalid {
+			t.Error("header rule have an error #1", k)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "http://www.headers.com/", nil)
+	req.RemoteAddr = "10.0.0.1:5678"
+	header := http.Header{"X-A": {"1", "2"}}
+	HeaderRule{Action: HeaderRename, Name: "x-a", To: "X-B"}.apply(header, req)
+	HeaderRule{Action: HeaderRename, Name: "X-C", To: "X-D"}.apply(header, req)
+	HeaderRule{Action: HeaderAdd, Name: "X-B", Value: "{#host#}"}.apply(header, req)
+	HeaderRule{Action: HeaderSet, Name: "X-C", Value: "{#client_ip#}|{#endpoint#}"}.apply(header, req)
+	if len(header) != 2 || len(header["X-B"]) != 3 || header["X-B"][2] != "www.headers.com" || header.Get("X-C") != "10.0.0.1|" {
+		t.Error("header rule have an error #2", header)
+	}
+	HeaderRule{Action: HeaderRemove, Name: "X-B"}.apply(header, req)
+	if len(header) != 1 {
+		t.Error("header rule have an error #3", header)
+	}
+}
+
+func TestProxyHeaderRules(t *testing.T) {
+	domain := "www.headers.com"
+	var got http.Header
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		w.Header().Set("X-Powered-By", "php")
+		w.Header().Set("X-Token", "abc")
+		fmt.Fprint(w, "ok")
+	}))
+	defer origin.Close()
+	addr := origin.Listener.Addr().String()
+
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	proxy.RegistSite(domain, "roundrobin", "http").AddAddr(domain, addr, 1)
+	err := proxy.SetHeaderRules(domain, []HeaderRule{
+		{Target: HeaderRequest, Action: HeaderSet, Name: "X-Upstream", Value: "{#endpoint#}"},
+		{Target: HeaderRequest, Action: HeaderRemove, Name: "Cookie"},
+		{Target: HeaderResponse, Action: HeaderRemove, Name: "X-Powered-By"},
+		{Path: "/api/", Target: HeaderResponse, Action: HeaderRename, Name: "X-Token", To: "X-Api-Token"},
+	})
+	if err != nil {
+		t.Error("proxy header rules have an error #1")
+	}
+	handler := proxy.Handler()
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://"+domain+path, nil)
+		req.Header.Set("Cookie", "a=1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/")
+	if got.Get("X-Upstream") != addr || got.Get("Cookie") != "" || w.Header().Get("X-Powered-By") != "" || w.Header().Get("X-Token") != "abc" {
+		t.Error("proxy header rules have an error #2", got, w.Header())
+	}
+	w = get("/api/users")
+	if w.Header().Get("X-Token") != "" || w.Header().Get("X-Api-Token") != "abc" {
+		t.Error("proxy header rules have an error #3", w.Header())
+	}
+	proxy.SetRewriteRules(domain, []RewriteRule{{Match: "^/api/(.*)$", Action: RewritePath, Replace: "/internal/$1"}})
+	w = get("/api/users")
+	if w.Header().Get("X-Token") != "" || w.Header().Get("X-Api-Token") != "abc" {
+		t.Error("proxy header rules have an error #3.1", w.Header())
+	}
+	proxy.SetRewriteRules(domain, nil)
+
+	// reconfiguration while serving
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			get("/")
+		}()
+		go func() {
+			defer wg.Done()
+			proxy.ResetCustomHeader(map[string]string{"X-LIBRA": "header"})
+			proxy.SetHeaderRules(domain, []HeaderRule{{Target: HeaderResponse, Action: HeaderSet, Name: "X-Site", Value: "{#host#}"}})
+		}()
+	}
+	wg.Wait()
+	if w = get("/"); w.Header().Get("X-Site") != domain || w.Header().Get("X-LIBRA") != "header" {
+		t.Error("proxy header rules have an error #4", w.Header())
+	}
+
+	proxy.SetHeaderRules(domain, nil)
+	if proxy.GetHeaderRules(domain) != nil {
+		t.Error("proxy header rules have an error #5")
+	}
+	proxy.FlushProxy(domain)
+}
@@ -0,0 +1,218 @@
+package libra
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrHTTPSInvalid https policy is invalid
+var ErrHTTPSInvalid = errors.New("the https policy is invalid")
+
+// hstsPreloadMinAge min max-age of HSTS preload lists
+const hstsPreloadMinAge = 365 * 24 * time.Hour
+
+// HTTPSConfig https policy of a site, a request is secure if libra terminated its TLS
+// or a trusted proxy tells X-Forwarded-Proto https
+type HTTPSConfig struct {
+	Redirect       bool        `json:"redirect,omitempty"`        // redirect plain http requests to https
+	RedirectStatus int         `json:"redirect_status,omitempty"` // 301, 302, 307 or 308, default 301, or 308 for methods other than GET and HEAD
+	Port           int         `json:"port,omitempty"`            // https port of the redirect location, default 443
+	HSTS           *HSTSConfig `json:"hsts,omitempty"`            // Strict-Transport-Security of secure responses, nil sends none
+	Exclude        []string    `json:"exclude,omitempty"`         // path prefixes neither redirected nor given HSTS, like /.well-known/acme-challenge/
+}
+
+// HSTSConfig Strict-Transport-Security header
+type HSTSConfig struct {
+	MaxAge            time.Duration // in whole seconds
+	IncludeSubDomains bool
+	Preload           bool // it needs max age of a year at least and include subdomains
+}
+
+// hstsConfigJSON json struct of HSTSConfig, max age is a string like 8760h
+type hstsConfigJSON struct {
+	MaxAge            string `json:"max_age"`
+	IncludeSubDomains bool   `json:"include_subdomains,omitempty"`
+	Preload           bool   `json:"preload,omitempty"`
+}
+
+// MarshalJSON encode max age as a string
+func (c HSTSConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hstsConfigJSON{MaxAge: c.MaxAge.String(), IncludeSubDomains: c.IncludeSubDomains, Preload: c.Preload})
+}
+
+// UnmarshalJSON decode max age from a string
+func (c *HSTSConfig) UnmarshalJSON(data []byte) error {
+	v := hstsConfigJSON{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	maxAge, err := time.ParseDuration(v.MaxAge)
+	if err != nil {
+		return err
+	}
+	*c = HSTSConfig{MaxAge: maxAge, IncludeSubDomains: v.IncludeSubDomains, Preload: v.Preload}
+	return nil
+}
+
+// value get the header value
+func (c HSTSConfig) value() string {
+	value := "max-age=" + strconv.FormatInt(int64(c.MaxAge/time.Second), 10)
+	if c.IncludeSubDomains {
+		value += "; includeSubDomains"
+	}
+	if c.Preload {
+		value += "; preload"
+	}
+	return value
+}
+
+// Validate check the policy
+func (c HTTPSConfig) Validate() error {
+	switch c.RedirectStatus {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return ErrHTTPSInvalid
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return ErrHTTPSInvalid
+	}
+	if c.HSTS != nil {
+		if c.HSTS.MaxAge < 0 || c.HSTS.Preload && (c.HSTS.MaxAge < hstsPreloadMinAge || !c.HSTS.IncludeSubDomains) {
+			return ErrHTTPSInvalid
+		}
+	}
+	for _, path := range c.Exclude {
+		if !strings.HasPrefix(path, "/") {
+			return ErrHTTPSInvalid
+		}
+	}
+	return nil
+}
+
+// excluded check the path is excluded from the policy
+func (c HTTPSConfig) excluded(path string) bool {
+	for _, prefix := range c.Exclude {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetHTTPS set the https policy of a site, nil disables it
+func (p *ProxySrv) SetHTTPS(domain string, config *HTTPSConfig) error {
+	if config != nil {
+		if err := config.Validate(); err != nil {
+			return err
+		}
+	}
+
+	p.httpsLock.Lock()
+	defer p.httpsLock.Unlock()
+	if p.httpsConfigs == nil {
+		p.httpsConfigs = map[string]HTTPSConfig{}
+	}
+	if config == nil {
+		delete(p.httpsConfigs, domain)
+	} else {
+		p.httpsConfigs[domain] = *config
+	}
+	return nil
+}
+
+// GetHTTPS get the https policy of a site, nil if it is not set
+func (p *ProxySrv) GetHTTPS(domain string) *HTTPSConfig {
+	p.httpsLock.RLock()
+	defer p.httpsLock.RUnlock()
+	config, ok := p.httpsConfigs[domain]
+	if !ok {
+		return nil
+	}
+	return &config
+}
+
+// RunTLS start https proxy server with the certificate and key files,
+// it returns the listen error, it is stopped by Shutdown as well
+func (p *ProxySrv) RunTLS(addr, certFile, keyFile string) error {
+	Logger.Info("start https proxy server bind " + addr)
+
+	tlsServer := &http.Server{
+		Addr:    addr,
+		Handler: p.Handler(),
+	}
+	p.srvLock.Lock()
+	p.tlsServer = tlsServer
+	p.srvLock.Unlock()
+
+	return tlsServer.ListenAndServeTLS(certFile, keyFile)
+}
+
+// secureRequest check the client connected by https
+func secureRequest(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	state := getRequestState(r)
+	return state != nil && state.peerTrusted && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// httpsMiddleware redirect plain http requests and set HSTS of sites with https policy
+func (p *ProxySrv) httpsMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := p.GetHTTPS(r.Host)
+		if config == nil || config.excluded(r.URL.Path) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		if !secureRequest(r) {
+			if config.Redirect {
+				p.setIdentityHeader(w.Header())
+				p.setRequestIDHeader(w.Header(), r)
+				http.Redirect(w, r, httpsLocation(r, config.Port), config.redirectStatus(r.Method))
+				return
+			}
+		} else if config.HSTS != nil {
+			w.Header().Set("Strict-Transport-Security", config.HSTS.value())
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// redirectStatus get the status of a redirect, methods other than GET and HEAD keep their body by 308
+func (c HTTPSConfig) redirectStatus(method string) int {
+	if c.RedirectStatus != 0 {
+		return c.RedirectStatus
+	}
+	if method == http.MethodGet || method == http.MethodHead {
+		return http.StatusMovedPermanently
+	}
+	return http.StatusPermanentRedirect
+}
+
+// httpsLocation get the https url of a request
+func httpsLocation(r *http.Request, port int) string {
+	host := hostWithoutPort(r.Host)
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != 0 && port != 443 {
+		host += ":" + strconv.Itoa(port)
+	}
+	return "https://" + host + r.URL.RequestURI()
+}
+
+// dropOriginHSTS delete Strict-Transport-Security of the origin if the site sets its own
+func (p *ProxySrv) dropOriginHSTS(header http.Header, req *http.Request) {
+	state := getRequestState(req)
+	if state == nil {
+		return
+	}
+	if config := p.GetHTTPS(state.domain); config != nil && config.HSTS != nil {
+		header.Del("Strict-Transport-Security")
+	}
+}
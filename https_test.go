@@ -0,0 +1,99 @@
+package libra
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPSConfig(t *testing.T) {
+	invalid := []HTTPSConfig{
+		{RedirectStatus: 303},
+		{Port: 70000},
+		{HSTS: &HSTSConfig{MaxAge: -time.Second}},
+		{HSTS: &HSTSConfig{MaxAge: time.Hour, IncludeSubDomains: true, Preload: true}},
+		{Exclude: []string{"health"}},
+	}
+	for k, config := range invalid {
+		if config.Validate() != ErrHTTPSInvalid {
+			t.Error("https config have an error #1", k)
+		}
+	}
+
+	hsts := HSTSConfig{MaxAge: hstsPreloadMinAge, IncludeSubDomains: true, Preload: true}
+	if value := hsts.value(); value != "max-age=31536000; includeSubDomains; preload" {
+		t.Error("https config have an error #2", value)
+	}
+	data, _ := json.Marshal(hsts)
+	decoded := HSTSConfig{}
+	if err := json.Unmarshal(data, &decoded); err != nil || decoded != hsts {
+		t.Error("https config have an error #3", string(data))
+	}
+
+	req := httptest.NewRequest("GET", "http://www.a.com:5000/a?b=1", nil)
+	if location := httpsLocation(req, 0); location != "https://www.a.com/a?b=1" {
+		t.Error("https config have an error #4", location)
+	}
+	if location := httpsLocation(req, 8443); location != "https://www.a.com:8443/a?b=1" {
+		t.Error("https config have an error #5", location)
+	}
+}
+
+func TestHTTPSMiddleware(t *testing.T) {
+	domain := "www.https.com"
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age=1")
+		w.Write([]byte(r.Header.Get("X-Forwarded-Proto")))
+	}))
+	defer origin.Close()
+
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	proxy.RegistSite(domain, "roundrobin", "http").AddAddr(domain, origin.Listener.Addr().String(), 1)
+	proxy.SetHTTPS(domain, &HTTPSConfig{
+		Redirect: true,
+		HSTS:     &HSTSConfig{MaxAge: time.Hour, IncludeSubDomains: true},
+		Exclude:  []string{"/.well-known/acme-challenge/"},
+	})
+	handler := proxy.Handler()
+	serve := func(method, url string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, nil)
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("GET", "http://"+domain+"/a?b=1", nil)
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "https://"+domain+"/a?b=1" || w.Header().Get("Strict-Transport-Security") != "" {
+		t.Error("https middleware have an error #1", w.Code, w.Header())
+	}
+	if w = serve("POST", "http://"+domain+"/a", nil); w.Code != http.StatusPermanentRedirect {
+		t.Error("https middleware have an error #2", w.Code)
+	}
+	if w = serve("GET", "http://"+domain+"/.well-known/acme-challenge/token", nil); w.Code != 200 {
+		t.Error("https middleware have an error #3", w.Code)
+	}
+
+	w = serve("GET", "https://"+domain+"/a", nil)
+	if w.Code != 200 || w.Header()["Strict-Transport-Security"][0] != "max-age=3600; includeSubDomains" || len(w.Header()["Strict-Transport-Security"]) != 1 ||
+		w.Body.String() != "https" {
+		t.Error("https middleware have an error #4", w.Code, w.Header(), w.Body.String())
+	}
+
+	// X-Forwarded-Proto is believed only from trusted proxies
+	if w = serve("GET", "http://"+domain+"/a", map[string]string{"X-Forwarded-Proto": "https"}); w.Code != http.StatusMovedPermanently {
+		t.Error("https middleware have an error #5", w.Code)
+	}
+	proxy.SetTrustedProxies([]string{"192.0.2.1"})
+	if w = serve("GET", "http://"+domain+"/a", map[string]string{"X-Forwarded-Proto": "https"}); w.Code != 200 {
+		t.Error("https middleware have an error #6", w.Code)
+	}
+
+	if err := proxy.RunTLS("127.0.0.1:0", "not-found.crt", "not-found.key"); err == nil {
+		t.Error("https middleware have an error #7")
+	}
+}
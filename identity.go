@@ -0,0 +1,99 @@
+package libra
+
+import (
+	"errors"
+	"html"
+	"net/http"
+)
+
+// ErrIdentityInvalid server identity is invalid
+var ErrIdentityInvalid = errors.New("the server identity is invalid")
+
+// IdentityMode how libra identifies itself in responses
+type IdentityMode string
+
+// Identity modes.
+const (
+	IdentityDefault IdentityMode = "default" // X-LIBRA-VERSION and X-LIBRA-CODE headers, libra version on error pages
+	IdentityHidden  IdentityMode = "hidden"  // nothing about libra is disclosed
+	IdentityCustom  IdentityMode = "custom"  // Server header and error pages show Server
+)
+
+// Identity server identity of proxied responses, error pages and admin api
+type Identity struct {
+	Mode   IdentityMode `json:"mode"`
+	Server string       `json:"server,omitempty"` // for custom mode
+}
+
+// defaultPoweredBy default footer of error pages
+var defaultPoweredBy = `Powered by <a href="` + githubUrl + `" target="_blank">libra/` + version[1:] + `</a>`
+
+// Validate check the identity
+func (i Identity) Validate() error {
+	switch i.Mode {
+	case "", IdentityDefault, IdentityHidden:
+		return nil
+	case IdentityCustom:
+		if i.Server != "" {
+			return nil
+		}
+	}
+	return ErrIdentityInvalid
+}
+
+// SetIdentity set how libra identifies itself, the default mode discloses the libra version
+func (p *ProxySrv) SetIdentity(identity Identity) error {
+	if err := identity.Validate(); err != nil {
+		return err
+	}
+	if identity.Mode == "" {
+		identity.Mode = IdentityDefault
+	}
+
+	p.identityLock.Lock()
+	defer p.identityLock.Unlock()
+	p.identity = identity
+	return nil
+}
+
+// GetIdentity get server identity
+func (p *ProxySrv) GetIdentity() Identity {
+	p.identityLock.RLock()
+	defer p.identityLock.RUnlock()
+	if p.identity.Mode == "" {
+		return Identity{Mode: IdentityDefault}
+	}
+	return p.identity
+}
+
+// setIdentityHeader set identity headers of a response
+func (p *ProxySrv) setIdentityHeader(header http.Header) {
+	identity := p.GetIdentity()
+	switch identity.Mode {
+	case IdentityDefault:
+		header.Set("X-LIBRA-VERSION", version)
+		header.Set("X-LIBRA-CODE", githubUrl)
+	case IdentityCustom:
+		header.Set("Server", identity.Server)
+	}
+}
+
+// poweredBy get the footer of error pages, {#powered#} of templates is replaced by it
+func (p *ProxySrv) poweredBy() string {
+	identity := p.GetIdentity()
+	switch identity.Mode {
+	case IdentityHidden:
+		return ""
+	case IdentityCustom:
+		return "Powered by " + html.EscapeString(identity.Server)
+	}
+	return defaultPoweredBy
+}
+
+// identityMiddleware set identity headers of admin api responses
+func (p *ProxySrv) identityMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.setIdentityHeader(w.Header())
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,108 @@
+package libra
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSetIdentity(t *testing.T) {
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	if proxy.GetIdentity().Mode != IdentityDefault {
+		t.Error("SetIdentity have an error #1")
+	}
+	if err := proxy.SetIdentity(Identity{Mode: IdentityCustom}); err != ErrIdentityInvalid {
+		t.Error("SetIdentity have an error #2")
+	}
+	if err := proxy.SetIdentity(Identity{Mode: "secret"}); err != ErrIdentityInvalid {
+		t.Error("SetIdentity have an error #3")
+	}
+	if err := proxy.SetIdentity(Identity{Mode: IdentityCustom, Server: "web"}); err != nil || proxy.GetIdentity().Server != "web" {
+		t.Error("SetIdentity have an error #4")
+	}
+	if err := proxy.SetIdentity(Identity{}); err != nil || proxy.GetIdentity().Mode != IdentityDefault {
+		t.Error("SetIdentity have an error #5")
+	}
+}
+
+func TestIdentityHeaders(t *testing.T) {
+	domain := "www.identity.com"
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "nginx")
+	}))
+	defer origin.Close()
+
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	proxy.RegistSite(domain, "roundrobin", "http").AddAddr(domain, origin.Listener.Addr().String(), 1)
+	handler := proxy.Handler()
+	admin := proxy.AdminHandler()
+	get := func(handler http.Handler, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+
+	w := get(handler, "http://"+domain+"/")
+	if len(w.Header()["X-Libra-Version"]) != 1 || w.Header().Get("X-LIBRA-CODE") != githubUrl || w.Header().Get("Server") != "nginx" {
+		t.Error("identity headers have an error #1", w.Header())
+	}
+	if w = get(admin, "/api/sites"); w.Header().Get("X-LIBRA-VERSION") != version {
+		t.Error("identity headers have an error #2")
+	}
+
+	proxy.SetIdentity(Identity{Mode: IdentityCustom, Server: "web"})
+	w = get(handler, "http://"+domain+"/")
+	if w.Header().Get("X-LIBRA-VERSION") != "" || len(w.Header()["Server"]) != 1 || w.Header().Get("Server") != "web" {
+		t.Error("identity headers have an error #3", w.Header())
+	}
+	if w = get(admin, "/api/sites"); w.Header().Get("Server") != "web" {
+		t.Error("identity headers have an error #4")
+	}
+
+	proxy.SetIdentity(Identity{Mode: IdentityHidden})
+	w = get(handler, "http://"+domain+"/")
+	if w.Header().Get("X-LIBRA-VERSION") != "" || w.Header().Get("X-LIBRA-CODE") != "" || w.Header().Get("Server") != "nginx" {
+		t.Error("identity headers have an error #5", w.Header())
+	}
+	if w = get(admin, "/api/sites"); w.Header().Get("X-LIBRA-VERSION") != "" || w.Header().Get("Server") != "" {
+		t.Error("identity headers have an error #6")
+	}
+}
+
+func TestIdentityErrorPage(t *testing.T) {
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	handler := proxy.Handler()
+	get := func() (http.Header, string) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "http://www.identity-none.com/", nil))
+		body, _ := ioutil.ReadAll(w.Body)
+		return w.Header(), string(body)
+	}
+
+	header, body := get()
+	if !strings.Contains(body, "libra/0.0.1") || header.Get("X-LIBRA-VERSION") != version {
+		t.Error("identity error page have an error #1", body)
+	}
+
+	proxy.SetIdentity(Identity{Mode: IdentityCustom, Server: "<web>"})
+	header, body = get()
+	if strings.Contains(body, "libra") || !strings.Contains(body, "Powered by &lt;web&gt;") || header.Get("Server") != "<web>" {
+		t.Error("identity error page have an error #2", body)
+	}
+
+	proxy.SetIdentity(Identity{Mode: IdentityHidden})
+	proxy.SetErrorPage(http.StatusInternalServerError, "<p>{#msg#}</p><i>{#powered#}</i>")
+	header, body = get()
+	if strings.Contains(body, "libra") || !strings.Contains(body, "<i></i>") || header.Get("X-LIBRA-VERSION") != "" {
+		t.Error("identity error page have an error #3", body)
+	}
+
+	if resp, _ := getDefaultErrorPage(http.StatusNotFound, "not found", httptest.NewRequest("GET", "/", nil)); resp != nil {
+		body, _ := ioutil.ReadAll(resp.Body)
+		if !strings.Contains(string(body), "libra/0.0.1") || strings.Contains(string(body), "{#powered#}") {
+			t.Error("identity error page have an error #4")
+		}
+	}
+}
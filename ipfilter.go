@@ -0,0 +1,187 @@
+package libra
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ErrIPRuleInvalid ip filter rule is invalid
+var ErrIPRuleInvalid = errors.New("the ip filter rule is invalid")
+
+// IPAction what an ip filter rule does with matched clients
+type IPAction string
+
+// Ip filter rule actions.
+const (
+	IPAllow IPAction = "allow"
+	IPDeny  IPAction = "deny"
+)
+
+// IPRule allow or deny clients of requests matching Path by the real client ip, see SetTrustedProxies,
+// rules of a path are checked in order and the first one containing the ip decides,
+// a client matching none is denied if any of the rules is an allow list
+type IPRule struct {
+	Path   string   `json:"path,omitempty"` // path prefix, empty matches all
+	Action IPAction `json:"action"`
+	CIDRs  []string `json:"cidrs"` // like 10.0.0.0/8, 2001:db8::/32 or an ip
+
+	nets []*net.IPNet
+}
+
+// Validate check the rule and parse its CIDRs
+func (r *IPRule) Validate() error {
+	if r.Action != IPAllow && r.Action != IPDeny || len(r.CIDRs) == 0 {
+		return ErrIPRuleInvalid
+	}
+	nets := make([]*net.IPNet, 0, len(r.CIDRs))
+	for _, cidr := range r.CIDRs {
+		ipNet, err := parseCIDR(cidr)
+		if err != nil {
+			return ErrIPRuleInvalid
+		}
+		nets = append(nets, ipNet)
+	}
+	r.nets = nets
+	return nil
+}
+
+// contains check the rule contains an ip
+func (r IPRule) contains(ip net.IP) bool {
+	for _, ipNet := range r.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetIPRules set ip filter rules of a site, nil removes them
+func (p *ProxySrv) SetIPRules(domain string, rules []IPRule) error {
+	parsed := make([]IPRule, len(rules))
+	for k, rule := range rules {
+		rule.CIDRs = append([]string{}, rule.CIDRs...)
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+		parsed[k] = rule
+	}
+
+	p.ipLock.Lock()
+	defer p.ipLock.Unlock()
+	p.setIPRules(domain, parsed)
+	return nil
+}
+
+// setIPRules replace rules of a site, it should be called with the ip lock
+func (p *ProxySrv) setIPRules(domain string, rules []IPRule) {
+	if p.ipRules == nil {
+		p.ipRules = map[string][]IPRule{}
+	}
+	if len(rules) == 0 {
+		delete(p.ipRules, domain)
+	} else {
+		p.ipRules[domain] = rules
+	}
+}
+
+// GetIPRules get ip filter rules of a site
+func (p *ProxySrv) GetIPRules(domain string) []IPRule {
+	p.ipLock.RLock()
+	defer p.ipLock.RUnlock()
+	return p.ipRules[domain]
+}
+
+// AddIPFilter add a CIDR to the rule of a site with the path and action,
+// the rule is appended if not existed
+func (p *ProxySrv) AddIPFilter(domain, path string, action IPAction, cidr string) error {
+	added := IPRule{Path: path, Action: action, CIDRs: []string{cidr}}
+	if err := added.Validate(); err != nil {
+		return err
+	}
+
+	p.ipLock.Lock()
+	defer p.ipLock.Unlock()
+	rules := append([]IPRule{}, p.ipRules[domain]...)
+	for k, rule := range rules {
+		if rule.Path != path || rule.Action != action {
+			continue
+		}
+		for _, existed := range rule.CIDRs {
+			if existed == cidr {
+				return nil
+			}
+		}
+		rule.CIDRs = append(append([]string{}, rule.CIDRs...), cidr)
+		rule.nets = append(append([]*net.IPNet{}, rule.nets...), added.nets...)
+		rules[k] = rule
+		p.setIPRules(domain, rules)
+		return nil
+	}
+	p.setIPRules(domain, append(rules, added))
+	return nil
+}
+
+// DelIPFilter delete a CIDR from the rule of a site with the path and action,
+// the rule is deleted if it has no CIDR left
+func (p *ProxySrv) DelIPFilter(domain, path string, action IPAction, cidr string) {
+	p.ipLock.Lock()
+	defer p.ipLock.Unlock()
+	rules := []IPRule{}
+	for _, rule := range p.ipRules[domain] {
+		if rule.Path == path && rule.Action == action {
+			kept := IPRule{Path: rule.Path, Action: rule.Action}
+			for k, existed := range rule.CIDRs {
+				if existed != cidr {
+					kept.CIDRs = append(kept.CIDRs, existed)
+					kept.nets = append(kept.nets, rule.nets[k])
+				}
+			}
+			if len(kept.CIDRs) == 0 {
+				continue
+			}
+			rule = kept
+		}
+		rules = append(rules, rule)
+	}
+	p.setIPRules(domain, rules)
+}
+
+// allowIP check a client ip can request the path of a site
+func (p *ProxySrv) allowIP(domain, path, clientIP string) bool {
+	rules := p.GetIPRules(domain)
+	if len(rules) == 0 {
+		return true
+	}
+	ip := net.ParseIP(clientIP)
+	allowList := false
+	for _, rule := range rules {
+		if !strings.HasPrefix(path, rule.Path) {
+			continue
+		}
+		if ip != nil && rule.contains(ip) {
+			return rule.Action == IPAllow
+		}
+		if rule.Action == IPAllow {
+			allowList = true
+		}
+	}
+	return !allowList
+}
+
+// ipFilterMiddleware respond 403 to clients denied by ip filter rules of the site
+func (p *ProxySrv) ipFilterMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.allowIP(r.Host, r.URL.Path, clientIP(r)) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		Logger.Info("deny %s to %s%s", clientIP(r), r.Host+r.URL.Path, requestIDField(r))
+		resp, _ := p.errorPage(http.StatusForbidden, "your ip is not allowed to access this site", r)
+		p.setIdentityHeader(resp.Header)
+		p.setRequestIDHeader(resp.Header, r)
+		writeResponse(w, resp)
+	})
+}
@@ -0,0 +1,99 @@
+package libra
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIPRule(t *testing.T) {
+	invalid := []IPRule{{Action: "block", CIDRs: []string{"10.0.0.0/8"}}, {Action: IPAllow}, {Action: IPDeny, CIDRs: []string{"10.0.0.0/33"}}}
+	for k, rule := range invalid {
+		if rule.Validate() != ErrIPRuleInvalid {
+			t.Error("ip rule have an error #1", k)
+		}
+	}
+
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	if !proxy.allowIP("www.a.com", "/", "192.0.2.1") {
+		t.Error("ip rule have an error #2")
+	}
+	err := proxy.SetIPRules("www.a.com", []IPRule{
+		{Path: "/admin/", Action: IPDeny, CIDRs: []string{"10.0.0.1"}},
+		{Path: "/admin/", Action: IPAllow, CIDRs: []string{"10.0.0.0/8", "2001:db8::/32"}},
+		{Action: IPDeny, CIDRs: []string{"192.0.2.0/24"}},
+	})
+	if err != nil {
+		t.Error("ip rule have an error #3", err)
+	}
+	cases := []struct {
+		path  string
+		ip    string
+		allow bool
+	}{
+		{"/", "198.51.100.1", true},
+		{"/", "192.0.2.9", false},
+		{"/admin/a", "10.1.2.3", true},
+		{"/admin/a", "2001:db8::1", true},
+		{"/admin/a", "10.0.0.1", false},
+		{"/admin/a", "198.51.100.1", false},
+		{"/admin/a", "2001:db9::1", false},
+	}
+	for k, c := range cases {
+		if proxy.allowIP("www.a.com", c.path, c.ip) != c.allow {
+			t.Error("ip rule have an error #4", k)
+		}
+	}
+
+	if proxy.AddIPFilter("www.a.com", "/admin/", IPAllow, "fd00::/8") != nil || proxy.AddIPFilter("www.a.com", "/admin/", IPAllow, "bad") != ErrIPRuleInvalid {
+		t.Error("ip rule have an error #5")
+	}
+	if !proxy.allowIP("www.a.com", "/admin/a", "fd00::1") || len(proxy.GetIPRules("www.a.com")) != 3 {
+		t.Error("ip rule have an error #6")
+	}
+	proxy.DelIPFilter("www.a.com", "", IPDeny, "192.0.2.0/24")
+	if !proxy.allowIP("www.a.com", "/", "192.0.2.9") || len(proxy.GetIPRules("www.a.com")) != 2 {
+		t.Error("ip rule have an error #7")
+	}
+	proxy.SetIPRules("www.a.com", nil)
+	if proxy.GetIPRules("www.a.com") != nil {
+		t.Error("ip rule have an error #8")
+	}
+}
+
+func TestIPFilterMiddleware(t *testing.T) {
+	domain := "www.ipfilter.com"
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	proxy.RegistSite(domain, "roundrobin", "http").AddAddr(domain, origin.Listener.Addr().String(), 1)
+	proxy.SetErrorPage(http.StatusForbidden, "<p>{#msg#}</p>")
+	proxy.AddIPFilter(domain, "", IPAllow, "203.0.113.0/24")
+	handler := proxy.Handler()
+	serve := func(forwardedFor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://"+domain+"/", nil)
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("")
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "<p>your ip is not allowed") {
+		t.Error("ip filter middleware have an error #1", w.Code, w.Body.String())
+	}
+	// X-Forwarded-For is believed only from trusted proxies
+	if w = serve("203.0.113.5"); w.Code != http.StatusForbidden {
+		t.Error("ip filter middleware have an error #2", w.Code)
+	}
+	proxy.SetTrustedProxies([]string{"192.0.2.0/24"})
+	if w = serve("203.0.113.5"); w.Code != 200 || w.Body.String() != "ok" {
+		t.Error("ip filter middleware have an error #3", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,108 @@
+package libra
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ErrHostPolicyInvalid origin host policy is invalid
+var ErrHostPolicyInvalid = errors.New("the origin host policy is invalid")
+
+// HostMode which Host header is sent to the origin
+type HostMode string
+
+// Origin Host header modes.
+const (
+	HostPreserve HostMode = "preserve" // the Host of the client
+	HostEndpoint HostMode = "endpoint" // the addr of the picked endpoint
+	HostCustom   HostMode = "custom"   // the Host of the policy, like a bucket name of a cloud storage
+)
+
+// HostPolicy Host header sent to the origin of a site, the TLS server name of https
+// endpoints is the host sent without port, so virtual hosted origins get the same name in both
+type HostPolicy struct {
+	Mode HostMode `json:"mode,omitempty"` // default preserve
+	Host string   `json:"host,omitempty"` // for custom, like bucket.storage.example.com
+}
+
+// Validate check the policy
+func (c HostPolicy) Validate() error {
+	switch c.Mode {
+	case "", HostPreserve, HostEndpoint:
+		if c.Host == "" {
+			return nil
+		}
+	case HostCustom:
+		if c.Host != "" && !strings.ContainsAny(c.Host, " /\\@?#\t\r\n") {
+			return nil
+		}
+	}
+	return ErrHostPolicyInvalid
+}
+
+// SetHostPolicy set the Host header sent to the origin of a site, nil resets it to preserve
+func (p *ProxySrv) SetHostPolicy(domain string, config *HostPolicy) error {
+	if config != nil {
+		if err := config.Validate(); err != nil {
+			return err
+		}
+	}
+
+	p.hostLock.Lock()
+	defer p.hostLock.Unlock()
+	if p.hostPolicies == nil {
+		p.hostPolicies = map[string]HostPolicy{}
+	}
+	if config == nil {
+		delete(p.hostPolicies, domain)
+	} else {
+		p.hostPolicies[domain] = *config
+	}
+	return nil
+}
+
+// GetHostPolicy get the origin host policy of a site
+func (p *ProxySrv) GetHostPolicy(domain string) HostPolicy {
+	p.hostLock.RLock()
+	defer p.hostLock.RUnlock()
+	config, ok := p.hostPolicies[domain]
+	if !ok {
+		return HostPolicy{Mode: HostPreserve}
+	}
+	return config
+}
+
+// originHost get the Host header sent to the endpoint of a site
+func (p *ProxySrv) originHost(domain, host, endpoint string) string {
+	config := p.GetHostPolicy(domain)
+	switch config.Mode {
+	case HostEndpoint:
+		return endpoint
+	case HostCustom:
+		return config.Host
+	}
+	return host
+}
+
+// serverName get the TLS server name of a request to an https endpoint by its Host, empty if it is the
+// endpoint host which http.Transport uses by default, names of ip addrs are not sent
+func serverName(req *http.Request) string {
+	if req.URL.Scheme != "https" || req.Host == "" {
+		return ""
+	}
+	name := hostWithoutPort(req.Host)
+	if name == hostWithoutPort(req.URL.Host) || net.ParseIP(name) != nil {
+		return ""
+	}
+	return name
+}
+
+// hostWithoutPort strip the port of a host
+func hostWithoutPort(host string) string {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		return name
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
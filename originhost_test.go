@@ -0,0 +1,118 @@
+package libra
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestHostPolicy(t *testing.T) {
+	invalid := []HostPolicy{{Mode: "origin"}, {Mode: HostCustom}, {Mode: HostCustom, Host: "a.com/b"}, {Mode: HostEndpoint, Host: "a.com"}}
+	for k, policy := range invalid {
+		if policy.Validate() != ErrHostPolicyInvalid {
+			t.Error("host policy have an error #1", k)
+		}
+	}
+
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	if proxy.GetHostPolicy("www.a.com").Mode != HostPreserve || proxy.originHost("www.a.com", "www.a.com", "10.0.0.1:80") != "www.a.com" {
+		t.Error("host policy have an error #2")
+	}
+	proxy.SetHostPolicy("www.a.com", &HostPolicy{Mode: HostEndpoint})
+	if proxy.originHost("www.a.com", "www.a.com", "10.0.0.1:80") != "10.0.0.1:80" {
+		t.Error("host policy have an error #3")
+	}
+	proxy.SetHostPolicy("www.a.com", &HostPolicy{Mode: HostCustom, Host: "bucket.storage.com"})
+	if proxy.originHost("www.a.com", "www.a.com", "10.0.0.1:80") != "bucket.storage.com" {
+		t.Error("host policy have an error #4")
+	}
+
+	req := httptest.NewRequest("GET", "https://10.0.0.1:443/a", nil)
+	req.Host = "bucket.storage.com:443"
+	if name := serverName(req); name != "bucket.storage.com" {
+		t.Error("host policy have an error #5", name)
+	}
+	req.Host = "10.0.0.1:443"
+	if name := serverName(req); name != "" {
+		t.Error("host policy have an error #6", name)
+	}
+	req.URL.Scheme = "http"
+	req.Host = "bucket.storage.com"
+	if name := serverName(req); name != "" {
+		t.Error("host policy have an error #7", name)
+	}
+}
+
+func TestOriginTransport(t *testing.T) {
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	tr := &transport{RoundTripper: newOriginTransport(""), srv: proxy}
+	get := func(name string) http.RoundTripper {
+		req := httptest.NewRequest("GET", "https://10.0.0.1:443/a", nil)
+		req.Host = name
+		return tr.originTransport(req)
+	}
+
+	if get("10.0.0.1:443") != tr.RoundTripper {
+		t.Error("origin transport have an error #1")
+	}
+	first := get("a0.com")
+	if get("a0.com") != first || first == tr.RoundTripper {
+		t.Error("origin transport have an error #2")
+	}
+	for i := 1; i <= maxTLSTransports; i++ {
+		get("a" + strconv.Itoa(i) + ".com")
+	}
+	if len(tr.tlsTransports) != maxTLSTransports || tr.tlsLRU.Len() != maxTLSTransports || get("a0.com") == first {
+		t.Error("origin transport have an error #3", len(tr.tlsTransports))
+	}
+}
+
+func TestHostPolicyProxy(t *testing.T) {
+	domain := "www.hostpolicy.com"
+	var lock sync.Mutex
+	names := []string{}
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	origin.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		lock.Lock()
+		names = append(names, hello.ServerName)
+		lock.Unlock()
+		return nil, nil
+	}}
+	origin.StartTLS()
+	defer origin.Close()
+	addr := origin.Listener.Addr().String()
+
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	proxy.RegistSite(domain, "roundrobin", "https").AddAddr(domain, addr, 1)
+	handler := proxy.Handler()
+	get := func() string {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "http://"+domain+"/", nil))
+		body, _ := ioutil.ReadAll(w.Body)
+		return string(body)
+	}
+
+	if host := get(); host != domain {
+		t.Error("host policy proxy have an error #1", host)
+	}
+	proxy.SetHostPolicy(domain, &HostPolicy{Mode: HostEndpoint})
+	if host := get(); host != addr {
+		t.Error("host policy proxy have an error #2", host)
+	}
+	proxy.SetHostPolicy(domain, &HostPolicy{Mode: HostCustom, Host: "bucket.storage.com"})
+	if host := get(); host != "bucket.storage.com" {
+		t.Error("host policy proxy have an error #3", host)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(names) != 3 || names[0] != domain || names[1] != "" || names[2] != "bucket.storage.com" {
+		t.Error("host policy proxy have an error #4", names)
+	}
+}
@@ -0,0 +1,96 @@
+package libra
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	var body map[string]interface{}
+	var header http.Header
+	status := http.StatusOK
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		data, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(data, &body)
+		w.WriteHeader(status)
+	}))
+	defer collector.Close()
+
+	exporter := NewOTLPExporter(collector.URL + "/v1/traces")
+	exporter.Headers = map[string]string{"Authorization": "Bearer token"}
+	exporter.ServiceName = "edge"
+	if err := exporter.Validate(); err != nil {
+		t.Error("OTLP exporter have an error #1")
+	}
+	if err := NewOTLPExporter("127.0.0.1:4318").Validate(); err == nil {
+		t.Error("OTLP exporter have an error #2")
+	}
+
+	start := time.Unix(1500000000, 0)
+	span := &Span{
+		TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7", Name: "upstream", Kind: SpanKindClient,
+		Start: start, End: start.Add(time.Millisecond), Error: "502 Bad Gateway",
+	}
+	span.SetAttribute("server.address", "127.0.0.1:80")
+	span.SetAttribute("http.response.status_code", 502)
+	span.SetAttribute("libra.sampled", true)
+	if err := exporter.ExportSpans([]*Span{span}); err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("Content-Type") != "application/json" || header.Get("Authorization") != "Bearer token" {
+		t.Error("OTLP exporter have an error #3")
+	}
+
+	resourceSpans := body["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	resource, _ := json.Marshal(resourceSpans["resource"])
+	if string(resource) != `{"attributes":[{"key":"service.name","value":{"stringValue":"edge"}}]}` {
+		t.Error("OTLP exporter have an error #4", string(resource))
+	}
+	got, _ := json.Marshal(resourceSpans["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})[0])
+	expect := `{"attributes":[{"key":"http.response.status_code","value":{"intValue":"502"}},` +
+		`{"key":"libra.sampled","value":{"boolValue":true}},{"key":"server.address","value":{"stringValue":"127.0.0.1:80"}}],` +
+		`"endTimeUnixNano":"1500000000001000000","kind":3,"name":"upstream","spanId":"00f067aa0ba902b7",` +
+		`"startTimeUnixNano":"1500000000000000000","status":{"code":2,"message":"502 Bad Gateway"},"traceId":"4bf92f3577b34da6a3ce929d0e0e4736"}`
+	if string(got) != expect {
+		t.Error("OTLP exporter have an error #5", string(got))
+	}
+
+	status = http.StatusBadRequest
+	if err := exporter.ExportSpans([]*Span{span}); err == nil {
+		t.Error("OTLP exporter have an error #6")
+	}
+}
+
+func TestOTLPTracing(t *testing.T) {
+	domain := "www.otlp.com"
+	received := make(chan int, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traces := otlpTraces{}
+		data, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(data, &traces)
+		received <- len(traces.ResourceSpans[0].ScopeSpans[0].Spans)
+	}))
+	defer collector.Close()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	proxy.RegistSite(domain, "roundrobin", "http").AddAddr(domain, origin.Listener.Addr().String(), 1)
+	proxy.SetTracing(&TracingConfig{BatchSize: 3}, NewOTLPExporter(collector.URL+"/v1/traces"))
+	defer proxy.SetTracing(nil, nil)
+
+	proxy.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://"+domain+"/", nil))
+	select {
+	case n := <-received:
+		if n != 3 {
+			t.Error("OTLP tracing have an error #1", n)
+		}
+	case <-time.After(time.Second):
+		t.Error("OTLP tracing have an error #2")
+	}
+}
@@ -2,16 +2,19 @@ package libra
 
 import (
 	"bytes"
+	"container/list"
 	"context"
 	"crypto/tls"
 	"github.com/zhuCheer/libra/balancer"
 	"github.com/zhuCheer/libra/logger"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -19,8 +22,82 @@ import (
 type ProxySrv struct {
 	ProxyAddr    string
 	customHeader map[string]string
+
+	headerLock  sync.RWMutex
+	headerRules map[string][]HeaderRule // by domain
+
+	identityLock sync.RWMutex
+	identity     Identity
+
+	requestIDLock sync.RWMutex
+	requestID     *RequestIDConfig // nil is DefaultRequestID
+
+	traceLock sync.RWMutex
+	tracer    *tracer // nil if tracing is not enabled
+
+	cacheLock       sync.RWMutex
+	cacheConfigs    map[string]CacheConfig // by domain
+	cacheStore      CacheStore
+	cacheRefreshing map[string]bool // keys refreshed in background
+
+	coalesceLock  sync.RWMutex
+	coalesceRules map[string][]CoalesceRule // by domain
+	coalesceCalls map[string]*coalesceCall  // calls in flight by key
+
+	compressLock    sync.RWMutex
+	compressConfigs map[string]CompressConfig // by domain
+
+	rewriteLock  sync.RWMutex
+	rewriteRules map[string][]RewriteRule // by domain
+
+	hostLock     sync.RWMutex
+	hostPolicies map[string]HostPolicy // by domain
+
+	httpsLock    sync.RWMutex
+	httpsConfigs map[string]HTTPSConfig // by domain
+
+	ipLock  sync.RWMutex
+	ipRules map[string][]IPRule // by domain
+
+	srvLock     sync.Mutex
+	server      *http.Server
+	tlsServer   *http.Server
+	adminServer *http.Server
+	closeOnce   sync.Once
+	closing     chan struct{}
+
+	persistLock   sync.Mutex
+	persister     Persister
+	persistHooked bool
+	persistTimer  *time.Timer // pending write of registry changes
+
+	breakerLock    sync.RWMutex
+	breakerConfigs map[string]BreakerConfig   // by domain
+	breakers       map[string]*circuitBreaker // by domain and endpoint
+	breakerHooked  bool
+
+	pageLock   sync.RWMutex
+	errorPages map[int]string // error page templates by status code
+
+	limitLock  sync.RWMutex
+	rateLimits map[string][]RateLimitRule // by domain
+	rateStore  RateLimitStore
+
+	queueLock    sync.Mutex
+	queueConfigs map[string]QueueConfig // by domain
+	queues       map[string]*siteQueue  // by domain
+
+	adaptiveLock sync.RWMutex
+	limiters     map[string]*adaptiveLimiter // by domain
+
+	forwardLock    sync.RWMutex
+	forwardConfigs map[string]ForwardedConfig // by domain
+	trustedProxies []*net.IPNet
 }
 
+// maxPickTimes max endpoints tried when circuit breakers refuse the picked one
+const maxPickTimes = 3
+
 // Common variable.
 var (
 	Logger      = logger.NoopLogger{}
@@ -38,6 +115,7 @@ func NewHttpProxySrv(addr string, header map[string]string) *ProxySrv {
 	return &ProxySrv{
 		ProxyAddr:    addr,
 		customHeader: header,
+		closing:      make(chan struct{}),
 	}
 }
 
@@ -48,17 +126,59 @@ func (p *ProxySrv) SetLoggerLevel(level string) {
 
 // Start http proxy server
 func (p *ProxySrv) Start() error {
+	err := p.Run()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	panic(err)
+}
 
-	proxyHttpMux := http.NewServeMux()
+// Run start http proxy server, unlike Start it returns the listen error
+// so the caller can decide how to exit
+func (p *ProxySrv) Run() error {
 	Logger.Info("start proxy server bind " + p.ProxyAddr)
-	proxyHttpMux.Handle("/", p.httpMiddleware(p.dynamicReverseProxy()))
 
 	proxyServer := &http.Server{
 		Addr:    p.ProxyAddr,
-		Handler: proxyHttpMux,
+		Handler: p.Handler(),
 	}
-	err := proxyServer.ListenAndServe()
-	panic(err)
+	p.srvLock.Lock()
+	p.server = proxyServer
+	p.srvLock.Unlock()
+
+	return proxyServer.ListenAndServe()
+}
+
+// Handler get the proxy http handler, it can be mounted on any http server
+func (p *ProxySrv) Handler() http.Handler {
+	proxyHttpMux := http.NewServeMux()
+	proxyHttpMux.Handle("/", p.httpMiddleware(p.ipFilterMiddleware(p.httpsMiddleware(p.rateLimitMiddleware(p.rewriteMiddleware(p.compressMiddleware(p.responseHeaderMiddleware(p.cacheMiddleware(p.coalesceMiddleware(p.dynamicReverseProxy()))))))))))
+
+	return proxyHttpMux
+}
+
+// Shutdown gracefully stop the proxy and admin servers,
+// in-flight requests are completed until ctx is done
+func (p *ProxySrv) Shutdown(ctx context.Context) error {
+	p.srvLock.Lock()
+	servers := []*http.Server{p.server, p.tlsServer, p.adminServer}
+	p.srvLock.Unlock()
+	p.closeOnce.Do(func() {
+		close(p.closing)
+	})
+
+	var err error
+	for _, server := range servers {
+		if server == nil {
+			continue
+		}
+		if e := server.Shutdown(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+	p.FlushTraces()
+	p.flushPersist()
+	return err
 }
 
 // RegistSite  register a site
@@ -91,6 +211,26 @@ func (p *ProxySrv) DelAddr(domain string, addr string) {
 	}
 }
 
+// SetAddrs replace all addrs of a site at once, requests never see a half updated list,
+// it returns the endpoints added, removed and changed
+func (p *ProxySrv) SetAddrs(domain string, items []balancer.EndpointItem) (*balancer.EndpointDiff, error) {
+	info, err := balancer.GetSiteInfo(domain)
+	if err != nil {
+		return nil, err
+	}
+	return info.Balancer.SetAddrs(items)
+}
+
+// SetWeight change the weight of an addr in place, no need to delete and add it again
+func (p *ProxySrv) SetWeight(domain, addr string, weight uint32) error {
+	return balancer.SetWeight(domain, addr, weight)
+}
+
+// RampWeight change the weight of an addr gradually during duration
+func (p *ProxySrv) RampWeight(domain, addr string, weight uint32, duration time.Duration) error {
+	return balancer.RampWeight(domain, addr, weight, duration)
+}
+
 // Flush Flush proxy by domain
 func (p *ProxySrv) FlushProxy(domain string) {
 	balancer.FlushProxy(domain)
@@ -103,18 +243,106 @@ func (p *ProxySrv) ChangeLoadType(domain, loadType string) {
 
 // ResetCustomHeader reset custom header
 func (p *ProxySrv) ResetCustomHeader(header map[string]string) {
-	p.customHeader = map[string]string{}
-	p.customHeader = header
+	customHeader := map[string]string{}
+	for key, value := range header {
+		customHeader[key] = value
+	}
+	p.headerLock.Lock()
+	p.customHeader = customHeader
+	p.headerLock.Unlock()
+	p.persist()
+}
+
+// SetSlowStart set slow start of a site, the weight of addrs added later grows
+// from a small value to their weight during the window, a zero window disables it
+func (p *ProxySrv) SetSlowStart(domain string, slowStart balancer.SlowStart) error {
+	return balancer.SetSlowStart(domain, slowStart)
+}
+
+// SetPriority set the priority level of an addr, 0 is primary,
+// addrs of a greater level are backups used only when lower levels fail
+func (p *ProxySrv) SetPriority(domain, addr string, priority int) error {
+	return balancer.SetPriority(domain, addr, priority)
+}
+
+// SetHealthy mark an addr healthy or not, unhealthy addrs get no new requests
+func (p *ProxySrv) SetHealthy(domain, addr string, healthy bool) error {
+	return balancer.SetHealthy(domain, addr, healthy)
+}
+
+// SetFailoverThreshold fail over to the next priority level when the ratio of
+// available addrs of a level is less than threshold, 0 means when none is available
+func (p *ProxySrv) SetFailoverThreshold(domain string, threshold float64) error {
+	return balancer.SetFailoverThreshold(domain, threshold)
+}
+
+// DrainAddr stop sending new requests to an addr, requests in flight are completed,
+// if remove is true the addr is deleted once drained or after timeout, timeout <= 0 means no timeout
+func (p *ProxySrv) DrainAddr(domain, addr string, remove bool, timeout time.Duration) error {
+	return balancer.DrainAddr(domain, addr, remove, timeout)
+}
+
+// SetAddrState set an addr active, draining or disabled
+func (p *ProxySrv) SetAddrState(domain, addr string, state balancer.EndpointState) error {
+	return balancer.SetState(domain, addr, state)
+}
+
+// InFlight get the count of requests in flight to an addr
+func (p *ProxySrv) InFlight(domain, addr string) int64 {
+	return balancer.InFlight(domain, addr)
+}
+
+// requestStateKey context key of requestState
+type requestStateKey struct{}
+
+// requestState proxy state of a request, it is shared by middleware, director and transport
+type requestState struct {
+	domain       string
+	path         string           // path of the client request, before rewrite rules
+	requestID    string           // empty if request id is disabled
+	clientIP     string           // real client ip, see SetTrustedProxies
+	peerTrusted  bool             // the peer is a trusted proxy
+	forwardedFor []string         // hops of the incoming X-Forwarded-For
+	endpoint     string           // the picked origin addr, empty if no one picked
+	breaker      *circuitBreaker  // breaker of the endpoint, nil if not enabled
+	probe        bool             // the request is a half-open probe
+	release      func()           // release the slot taken on the endpoint
+	limiter      *adaptiveLimiter // adaptive limiter holding a place, nil if not enabled
+	unavailable  error            // no endpoint can take the request, fail fast with 503
+	attempts     int              // endpoints picked by the balancer
+	trace        *requestTrace    // nil if the request is not traced
+	rewrite      *rewriteResult   // nil if no rewrite rule matches
+}
+
+// retries get the count of endpoints skipped before the picked one
+func (s *requestState) retries() int {
+	if s.attempts <= 1 {
+		return 0
+	}
+	return s.attempts - 1
+}
+
+// getRequestState get proxy state of a request, nil if not existed
+func getRequestState(req *http.Request) *requestState {
+	state, _ := req.Context().Value(requestStateKey{}).(*requestState)
+	return state
 }
 
 // httpMiddleware http middleware set some header
-func (p *ProxySrv) httpMiddleware(handler *httputil.ReverseProxy) http.Handler {
+func (p *ProxySrv) httpMiddleware(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		for key, value := range p.customHeader {
+		for key, value := range p.getCustomHeader() {
 			w.Header().Add(key, value)
 		}
-		w.Header().Set("X-LIBRA-VERSION", version)
-		w.Header().Set("X-LIBRA-CODE", githubUrl)
+
+		state := &requestState{domain: r.Host, path: r.URL.Path, forwardedFor: forwardedFor(r.Header)}
+		state.clientIP, state.peerTrusted = p.realClientIP(r)
+		state.requestID = p.assignRequestID(r)
+		r = r.WithContext(context.WithValue(r.Context(), requestStateKey{}, state))
+		if state.trace = p.startTrace(r); state.trace != nil {
+			p.traceHandler(state.trace, w, r, handler)
+			return
+		}
 		handler.ServeHTTP(w, r)
 	})
 }
@@ -123,6 +351,12 @@ func (p *ProxySrv) httpMiddleware(handler *httputil.ReverseProxy) http.Handler {
 // in this function proxy server knows where to forward to
 // if the target is a error node, proxy will forward to a default error page in local address.
 func (p *ProxySrv) dynamicDirector(req *http.Request) {
+	p.setRequestIDHeader(req.Header, req)
+	state := getRequestState(req)
+	var span *Span
+	if state != nil {
+		span = state.trace.child("balancer select", SpanKindInternal)
+	}
 	siteInfo, err := balancer.GetSiteInfo(req.Host)
 
 	var target *url.URL
@@ -133,7 +367,11 @@ func (p *ProxySrv) dynamicDirector(req *http.Request) {
 			req.Header.Set(errorHeader, err.Error())
 			break
 		}
-		proxyTarget, err = siteInfo.Balancer.GetOne()
+		if err = p.admitRequest(req, siteInfo.Domain); err != nil {
+			req.Header.Set(errorHeader, err.Error())
+			break
+		}
+		proxyTarget, err = p.waitTarget(req, siteInfo)
 
 		// if err not nil wirte an err in header
 		if err != nil {
@@ -147,8 +385,15 @@ func (p *ProxySrv) dynamicDirector(req *http.Request) {
 			break
 		}
 
+		req.Host = p.originHost(siteInfo.Domain, req.Host, target.Host)
+		// the path changed by rewrite rules is joined with the one of the endpoint as well
+		if state != nil && state.rewrite != nil {
+			req.URL.Path, req.URL.RawPath, req.URL.RawQuery = state.rewrite.path, "", state.rewrite.rawQuery
+			if state.rewrite.host != "" {
+				req.Host = state.rewrite.host
+			}
+		}
 		targetQuery := target.RawQuery
-		//req.Host = target.Host
 		req.URL.Host = target.Host
 		req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
 
@@ -168,13 +413,86 @@ func (p *ProxySrv) dynamicDirector(req *http.Request) {
 	if err == nil {
 		req.URL.Scheme = siteInfo.Scheme
 	}
+	if span != nil {
+		span.SetAttribute("libra.endpoint", state.endpoint)
+		span.SetAttribute("libra.retries", state.retries())
+		if err != nil {
+			span.Error = err.Error()
+		}
+		state.trace.end(span)
+	}
 
-	Logger.Info("proxy to " + req.URL.String())
+	Logger.Info("proxy %s to %s%s", clientIP(req), req.URL.String(), requestIDField(req))
+}
+
+// pickTarget get an endpoint by the site balancer, endpoints whose circuit breaker
+// refuses the request or at capacity are skipped, the picked endpoint is saved in the request state
+// with a slot taken on it, errAtCapacity is returned if all endpoints are at capacity
+func (p *ProxySrv) pickTarget(req *http.Request, siteInfo *balancer.RegistNode) (*balancer.ProxyTarget, error) {
+	state := getRequestState(req)
+	atCapacity := false
+	for i := 0; i < maxPickTimes; i++ {
+		proxyTarget, err := siteInfo.Balancer.GetOne()
+		if err == nil && state != nil {
+			state.attempts++
+		}
+		if err != nil {
+			if p.siteCircuitOpen(siteInfo.Domain) {
+				return nil, failFast(state, errCircuitOpen)
+			}
+			if balancer.AtCapacity(siteInfo.Domain) {
+				return nil, errAtCapacity
+			}
+			return nil, err
+		}
+
+		// the slot is taken before asking the breaker so a probe is never lost on a full endpoint
+		release, ok := balancer.TryAcquire(siteInfo.Domain, proxyTarget.Addr)
+		if !ok {
+			atCapacity = true
+			continue
+		}
+		breaker := p.getBreaker(siteInfo.Domain, proxyTarget.Addr)
+		probe := false
+		if breaker != nil {
+			if ok, probe = breaker.allow(time.Now()); !ok {
+				release()
+				continue
+			}
+		}
+		if state == nil {
+			release()
+		} else {
+			state.endpoint = proxyTarget.Addr
+			state.breaker = breaker
+			state.probe = probe
+			state.release = release
+		}
+		return proxyTarget, nil
+	}
+
+	if atCapacity {
+		return nil, errAtCapacity
+	}
+	return nil, failFast(state, errCircuitOpen)
 }
 
 // get ReverseProxy Http Handler
 func (p *ProxySrv) dynamicReverseProxy() *httputil.ReverseProxy {
-	roundTripper := &http.Transport{
+	transport := &transport{RoundTripper: newOriginTransport(""), srv: p}
+
+	httpProxy := &httputil.ReverseProxy{
+		Director:     p.dynamicDirector,
+		Transport:    transport,
+		ErrorHandler: p.proxyErrorHandler,
+	}
+	return httpProxy
+}
+
+// newOriginTransport get the http.Transport to endpoints, serverName is the TLS server name
+// of https endpoints, empty is the endpoint host
+func newOriginTransport(serverName string) *http.Transport {
+	return &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
 		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
 			return (&net.Dialer{
@@ -188,44 +506,182 @@ func (p *ProxySrv) dynamicReverseProxy() *httputil.ReverseProxy {
 		IdleConnTimeout:       10 * time.Second,
 		ResponseHeaderTimeout: 30 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
-		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true, ServerName: serverName},
 		ExpectContinueTimeout: 1 * time.Second,
 	}
-	transport := &transport{RoundTripper: roundTripper}
+}
 
-	httpProxy := &httputil.ReverseProxy{
-		Director:  p.dynamicDirector,
-		Transport: transport,
-	}
-	return httpProxy
+// proxyErrorHandler log the error of the origin with the request id and reply 502
+func (p *ProxySrv) proxyErrorHandler(w http.ResponseWriter, req *http.Request, err error) {
+	Logger.Error("proxy error %v%s", err, requestIDField(req))
+	p.setIdentityHeader(w.Header())
+	p.setRequestIDHeader(w.Header(), req)
+	w.WriteHeader(http.StatusBadGateway)
 }
 
 // Implementing RoundTripper interface
 type transport struct {
 	http.RoundTripper
+	srv *ProxySrv
+
+	tlsLock       sync.Mutex
+	tlsTransports map[string]*list.Element // by TLS server name, values are *tlsTransport
+	tlsLRU        *list.List               // recently used at front
+}
+
+// maxTLSTransports transports kept by TLS server name, the least recently used one is closed beyond it
+const maxTLSTransports = 64
+
+// tlsTransport transport of a TLS server name
+type tlsTransport struct {
+	name      string
+	transport *http.Transport
+}
+
+// originTransport get the RoundTripper of a request, connections to https endpoints
+// are kept by TLS server name so a connection is never shared by different names
+func (t *transport) originTransport(req *http.Request) http.RoundTripper {
+	name := serverName(req)
+	if name == "" {
+		return t.RoundTripper
+	}
+
+	t.tlsLock.Lock()
+	defer t.tlsLock.Unlock()
+	if t.tlsTransports == nil {
+		t.tlsTransports = map[string]*list.Element{}
+		t.tlsLRU = list.New()
+	}
+	if elem, ok := t.tlsTransports[name]; ok {
+		t.tlsLRU.MoveToFront(elem)
+		return elem.Value.(*tlsTransport).transport
+	}
+
+	item := &tlsTransport{name: name, transport: newOriginTransport(name)}
+	t.tlsTransports[name] = t.tlsLRU.PushFront(item)
+	for t.tlsLRU.Len() > maxTLSTransports {
+		oldest := t.tlsLRU.Remove(t.tlsLRU.Back()).(*tlsTransport)
+		delete(t.tlsTransports, oldest.name)
+		oldest.transport.CloseIdleConnections()
+	}
+	return item.transport
 }
 
 // RoundTrip http transport
-func (t *transport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.roundTrip(req)
+	if resp != nil {
+		// headers of the client are set by responseHeaderMiddleware, the response may be shared
+		t.srv.dropOriginHSTS(resp.Header, req)
+	}
+	return resp, err
+}
+
+// roundTrip send the request to the picked endpoint, or get the error page
+func (t *transport) roundTrip(req *http.Request) (resp *http.Response, err error) {
+	state := getRequestState(req)
 	proxyErrHeader := req.Header.Get(errorHeader)
+	var limiter *adaptiveLimiter
+	if state != nil {
+		limiter = state.limiter
+	}
+	if state != nil && state.unavailable != nil {
+		limiter.release()
+		return t.srv.errorPage(http.StatusServiceUnavailable, state.unavailable.Error(), req)
+	}
+
+	// the slot taken on the picked endpoint is kept until the response body is closed,
+	// so a draining endpoint knows when it is safe to be removed
+	release := func() {}
+	if state != nil && state.release != nil {
+		release = state.release
+	}
 	if proxyErrHeader != "" {
-		return getDefaultErrorPage(500, proxyErrHeader, req)
+		release()
+		limiter.release()
+		return t.srv.errorPage(500, proxyErrHeader, req)
 	}
 
-	resp, err = t.RoundTripper.RoundTrip(req)
+	if state != nil {
+		t.srv.setForwardedHeaders(req, state)
+		t.srv.applyHeaderRules(HeaderRequest, req.Header, req)
+	}
+	var span *Span
+	if state != nil && state.trace != nil {
+		span = state.trace.child("upstream "+state.endpoint, SpanKindClient)
+		span.SetAttribute("server.address", state.endpoint)
+		span.SetAttribute("url.full", req.URL.String())
+		span.SetAttribute("libra.retries", state.retries())
+		req.Header.Set("traceparent", state.trace.traceparent(span))
+	}
+	start := time.Now()
+	resp, err = t.originTransport(req).RoundTrip(req)
+	success := err == nil && resp.StatusCode < 500
+	if span != nil {
+		if err != nil {
+			span.Error = err.Error()
+		} else {
+			span.SetAttribute("http.response.status_code", resp.StatusCode)
+			if !success {
+				span.Error = resp.Status
+			}
+		}
+		state.trace.end(span)
+	}
+	limiter.sample(time.Since(start), !success)
+	if state != nil && state.breaker != nil {
+		state.breaker.record(state.probe, success, time.Now())
+	}
 	if err != nil {
-		return getDefaultErrorPage(502, err.Error(), req)
+		release()
+		return t.srv.errorPage(502, err.Error(), req)
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// upgraded connections like websocket are streamed, the body is the connection
+		resp.Body = wrapReleaseBody(resp.Body, release)
+		return resp, nil
 	}
 
 	if resp.StatusCode > 400 {
-		return getDefaultErrorPage(resp.StatusCode, "have an error", req)
+		resp.Body.Close()
+		release()
+		return t.srv.errorPage(resp.StatusCode, "have an error", req)
 	}
 	remoteBody, _ := ioutil.ReadAll(resp.Body)
-	resp.Body = ioutil.NopCloser(bytes.NewReader(remoteBody))
+	resp.Body.Close()
+	resp.Body = wrapReleaseBody(ioutil.NopCloser(bytes.NewReader(remoteBody)), release)
 
 	return resp, nil
 }
 
+// releaseBody call release when the body is closed
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// releaseConn releaseBody of an upgraded connection, it keeps the body writable
+type releaseConn struct {
+	releaseBody
+	io.Writer
+}
+
+// wrapReleaseBody wrap body to call release when it is closed,
+// a writable body of an upgraded connection is still writable
+func wrapReleaseBody(body io.ReadCloser, release func()) io.ReadCloser {
+	if rwc, ok := body.(io.ReadWriteCloser); ok {
+		return &releaseConn{releaseBody{rwc, release}, rwc}
+	}
+	return &releaseBody{body, release}
+}
+
 func singleJoiningSlash(a, b string) string {
 	aslash := strings.HasSuffix(a, "/")
 	bslash := strings.HasPrefix(b, "/")
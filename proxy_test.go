@@ -4,12 +4,26 @@ import (
 	"fmt"
 	"github.com/zhuCheer/libra/balancer"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 )
 
+// waitListen wait until the server started in goroutine accepts connections
+func waitListen(addr string) {
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func TestSetLoggerLevel(t *testing.T) {
 	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
 	proxy.SetLoggerLevel("info")
@@ -94,10 +108,11 @@ func TestReverseProxySrv(t *testing.T) {
 	proxy.ResetCustomHeader(map[string]string{"httptest": "01023"})
 	proxy.RegistSite(gateway, "random", "http")
 	go proxy.Start()
+	waitListen(gateway)
 
 	res, err := http.Get("http://" + gateway)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
 	if res.StatusCode != 500 {
@@ -115,7 +130,10 @@ func TestReverseProxySrv(t *testing.T) {
 	client := &http.Client{}
 	req, _ := http.NewRequest("GET", "http://"+gateway, nil)
 	req.Host = "www.google.cn"
-	res, _ = client.Do(req)
+	res, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer res.Body.Close()
 	if res.Header.Get(errorHeader) != "the proxy srv not found" {
 		t.Error("ReverseProxySrv have an error #2.1")
@@ -145,8 +163,8 @@ func TestReverseProxySrv(t *testing.T) {
 
 	proxy.DelAddr(gateway, targetHttpUrl.Host)
 	proxy.AddAddr(gateway, "", 1)
-	info, _ := proxy.GetSiteInfo(gateway)
-	fmt.Println(info, "=====")
+	// the empty endpoint would take part of the requests below
+	proxy.DelAddr(gateway, "")
 
 	// testing 404 not found
 	notfoundUrl, _ := url.Parse(notfoundHttpServer.URL)
@@ -191,6 +209,129 @@ func TestAddDelAddr(t *testing.T) {
 	}
 }
 
+func TestSetAddrs(t *testing.T) {
+	domain := "www.setaddrs.com"
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	if _, err := proxy.SetAddrs(domain, nil); err == nil {
+		t.Error("proxy SetAddrs have an error #1")
+	}
+
+	proxy.RegistSite(domain, "roundrobin", "http").
+		AddAddr(domain, "192.168.1.100:80", 1).
+		AddAddr(domain, "192.168.1.101:80", 1)
+	diff, err := proxy.SetAddrs(domain, []balancer.EndpointItem{
+		{OriginItem: balancer.OriginItem{Endpoint: "192.168.1.101:80", Weight: 1}},
+		{OriginItem: balancer.OriginItem{Endpoint: "192.168.1.102:80", Weight: 1}},
+	})
+	if err != nil || len(diff.Added) != 1 || len(diff.Removed) != 1 || len(diff.Changed) != 0 {
+		t.Error("proxy SetAddrs have an error #2")
+	}
+	siteInfo, _ := proxy.GetSiteInfo(domain)
+	if len(siteInfo.Items) != 2 || siteInfo.Items[1].Endpoint != "192.168.1.102:80" {
+		t.Error("proxy SetAddrs have an error #3")
+	}
+	proxy.FlushProxy(domain)
+}
+
+func TestSetWeight(t *testing.T) {
+	domain := "www.setweight.com"
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	proxy.RegistSite(domain, "wroundrobin", "http").
+		AddAddr(domain, "192.168.1.100:80", 1)
+
+	if err := proxy.SetWeight(domain, "192.168.1.100:80", 5); err != nil {
+		t.Error("proxy SetWeight have an error #1")
+	}
+	if err := proxy.RampWeight(domain, "192.168.1.100:80", 10, time.Minute); err != nil {
+		t.Error("proxy RampWeight have an error #2")
+	}
+	siteInfo, _ := proxy.GetSiteInfo(domain)
+	if len(siteInfo.Items) != 1 || siteInfo.Items[0].Weight != 10 {
+		t.Error("proxy SetWeight have an error #3")
+	}
+	if err := proxy.SetWeight(domain, "192.168.1.101:80", 5); err != balancer.ErrEndpointNotFound {
+		t.Error("proxy SetWeight have an error #4")
+	}
+	proxy.FlushProxy(domain)
+}
+
+func TestDrainAddr(t *testing.T) {
+	domain := "www.drainaddr.com"
+	block := make(chan struct{})
+	slowOrigin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+		fmt.Fprint(w, "slow")
+	}))
+	defer slowOrigin.Close()
+	fastOrigin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "fast")
+	}))
+	defer fastOrigin.Close()
+	slowAddr := slowOrigin.Listener.Addr().String()
+
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	proxy.RegistSite(domain, "roundrobin", "http").
+		AddAddr(domain, slowAddr, 1)
+	server := httptest.NewServer(proxy.Handler())
+	defer server.Close()
+
+	get := func() string {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		req.Host = domain
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err.Error()
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return string(body)
+	}
+
+	done := make(chan string)
+	go func() {
+		done <- get()
+	}()
+	for i := 0; i < 100 && proxy.InFlight(domain, slowAddr) == 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if proxy.InFlight(domain, slowAddr) != 1 {
+		t.Error("proxy DrainAddr have an error #1")
+	}
+
+	proxy.AddAddr(domain, fastOrigin.Listener.Addr().String(), 1)
+	if err := proxy.DrainAddr(domain, slowAddr, true, 0); err != nil {
+		t.Fatal(err)
+	}
+	if body := get(); body != "fast" {
+		t.Error("proxy DrainAddr have an error #2", body)
+	}
+
+	close(block)
+	if body := <-done; body != "slow" {
+		t.Error("proxy DrainAddr have an error #3", body)
+	}
+	siteItems := func() []balancer.EndpointItem {
+		for _, site := range balancer.Snapshot() {
+			if site.Domain == domain {
+				return site.Items
+			}
+		}
+		return nil
+	}
+	for i := 0; i < 100 && len(siteItems()) != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	items := siteItems()
+	if proxy.InFlight(domain, slowAddr) != 0 || len(items) != 1 || items[0].Endpoint == slowAddr {
+		t.Error("proxy DrainAddr have an error #4")
+	}
+
+	if err := proxy.SetAddrState(domain, slowAddr, balancer.StateDisabled); err != balancer.ErrEndpointNotFound {
+		t.Error("proxy SetAddrState have an error #5")
+	}
+	proxy.FlushProxy(domain)
+}
+
 func TestGetSiteInfo(t *testing.T) {
 	gateway := "127.0.0.1:5009"
 	domain := "www.google.cn"
@@ -0,0 +1,268 @@
+package libra
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/zhuCheer/libra/balancer"
+	"net/http"
+	"time"
+)
+
+// ErrQueueInvalid request queue config is invalid
+var ErrQueueInvalid = errors.New("the request queue config is invalid")
+
+// messages of the 503 responses when no endpoint has a free slot
+var (
+	errAtCapacity   = errors.New("all origin endpoints are at capacity")
+	errQueueFull    = errors.New("all origin endpoints are at capacity and the queue is full")
+	errQueueTimeout = errors.New("timeout waiting for a free origin endpoint")
+)
+
+// QueueConfig request queue of a site, when all endpoints are at capacity
+// requests wait for a free slot up to Timeout before failing with 503
+type QueueConfig struct {
+	Size    int           // max requests waiting
+	Timeout time.Duration // max wait time, default 10s
+}
+
+// queueConfigJSON json struct of QueueConfig, timeout is a string like 10s
+type queueConfigJSON struct {
+	Size    int    `json:"size"`
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// MarshalJSON encode timeout as a string
+func (c QueueConfig) MarshalJSON() ([]byte, error) {
+	v := queueConfigJSON{Size: c.Size}
+	if c.Timeout != 0 {
+		v.Timeout = c.Timeout.String()
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON decode timeout from a string
+func (c *QueueConfig) UnmarshalJSON(data []byte) error {
+	v := queueConfigJSON{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	config := QueueConfig{Size: v.Size}
+	if v.Timeout != "" {
+		var err error
+		if config.Timeout, err = time.ParseDuration(v.Timeout); err != nil {
+			return err
+		}
+	}
+	*c = config
+	return nil
+}
+
+// Validate check the config
+func (c QueueConfig) Validate() error {
+	if c.Size <= 0 || c.Timeout < 0 {
+		return ErrQueueInvalid
+	}
+	return nil
+}
+
+// withDefault fill zero fields by default value
+func (c QueueConfig) withDefault() QueueConfig {
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Second
+	}
+	return c
+}
+
+// SiteMetrics concurrency metrics of a site
+type SiteMetrics struct {
+	Domain    string            `json:"domain"`
+	Queue     *QueueConfig      `json:"queue,omitempty"`
+	Queued    int               `json:"queued"`    // requests waiting now
+	Dequeued  uint64            `json:"dequeued"`  // requests got a slot after waiting
+	Rejected  uint64            `json:"rejected"`  // requests failed at once as the queue is full or off
+	TimedOut  uint64            `json:"timed_out"` // requests failed after waiting
+	Adaptive  *AdaptiveMetrics  `json:"adaptive,omitempty"`
+	Endpoints []EndpointMetrics `json:"endpoints"`
+}
+
+// EndpointMetrics concurrency metrics of an endpoint
+type EndpointMetrics struct {
+	Endpoint string `json:"endpoint"`
+	InFlight int64  `json:"in_flight"`
+	MaxConns uint32 `json:"max_conns,omitempty"`
+}
+
+// siteQueue request queue state and counters of a site
+type siteQueue struct {
+	waiting  int
+	dequeued uint64
+	rejected uint64
+	timedOut uint64
+}
+
+// SetMaxConns set max requests in flight to an addr, 0 means unlimited
+func (p *ProxySrv) SetMaxConns(domain, addr string, maxConns uint32) error {
+	return balancer.SetMaxConns(domain, addr, maxConns)
+}
+
+// SetQueue set request queue of a site, nil disables it
+// so requests fail with 503 at once when all endpoints are at capacity
+func (p *ProxySrv) SetQueue(domain string, config *QueueConfig) error {
+	if config != nil {
+		if err := config.Validate(); err != nil {
+			return err
+		}
+	}
+
+	p.queueLock.Lock()
+	defer p.queueLock.Unlock()
+	if p.queueConfigs == nil {
+		p.queueConfigs = map[string]QueueConfig{}
+	}
+	if config == nil {
+		delete(p.queueConfigs, domain)
+	} else {
+		p.queueConfigs[domain] = *config
+	}
+	return nil
+}
+
+// GetQueue get request queue config of a site, nil if it is not enabled
+func (p *ProxySrv) GetQueue(domain string) *QueueConfig {
+	p.queueLock.Lock()
+	defer p.queueLock.Unlock()
+	config, ok := p.queueConfigs[domain]
+	if !ok {
+		return nil
+	}
+	return &config
+}
+
+// Metrics get concurrency metrics of all sites
+func (p *ProxySrv) Metrics() []SiteMetrics {
+	sites := []SiteMetrics{}
+	for _, node := range balancer.GetAllSites() {
+		metrics := SiteMetrics{
+			Domain:    node.Domain,
+			Queue:     p.GetQueue(node.Domain),
+			Endpoints: []EndpointMetrics{},
+		}
+		p.queueLock.Lock()
+		if queue, ok := p.queues[node.Domain]; ok {
+			metrics.Queued = queue.waiting
+			metrics.Dequeued = queue.dequeued
+			metrics.Rejected = queue.rejected
+			metrics.TimedOut = queue.timedOut
+		}
+		p.queueLock.Unlock()
+		if limiter := p.getLimiter(node.Domain); limiter != nil {
+			metrics.Adaptive = limiter.metrics()
+		}
+
+		items, _ := balancer.GetEndpoints(node.Domain)
+		for _, item := range items {
+			metrics.Endpoints = append(metrics.Endpoints, EndpointMetrics{
+				Endpoint: item.Endpoint,
+				InFlight: p.InFlight(node.Domain, item.Endpoint),
+				MaxConns: item.MaxConns,
+			})
+		}
+		sites = append(sites, metrics)
+	}
+	return sites
+}
+
+// getQueue get queue state of a site, it should be called with queueLock
+func (p *ProxySrv) getQueue(domain string) *siteQueue {
+	if p.queues == nil {
+		p.queues = map[string]*siteQueue{}
+	}
+	queue, ok := p.queues[domain]
+	if !ok {
+		queue = &siteQueue{}
+		p.queues[domain] = queue
+	}
+	return queue
+}
+
+// enterQueue take a place in the queue of a site,
+// it returns the reason to fail at once if the queue is full or not enabled
+func (p *ProxySrv) enterQueue(domain string) (QueueConfig, error) {
+	p.queueLock.Lock()
+	defer p.queueLock.Unlock()
+
+	queue := p.getQueue(domain)
+	config, ok := p.queueConfigs[domain]
+	if !ok {
+		queue.rejected++
+		return config, errAtCapacity
+	}
+	if queue.waiting >= config.Size {
+		queue.rejected++
+		return config, errQueueFull
+	}
+	queue.waiting++
+	return config.withDefault(), nil
+}
+
+// leaveQueue give up the place in the queue of a site
+func (p *ProxySrv) leaveQueue(domain string, picked, timedOut bool) {
+	p.queueLock.Lock()
+	defer p.queueLock.Unlock()
+
+	queue := p.getQueue(domain)
+	queue.waiting--
+	if picked {
+		queue.dequeued++
+	}
+	if timedOut {
+		queue.timedOut++
+	}
+}
+
+// waitTarget pick an endpoint, when all endpoints are at capacity
+// the request waits in the queue of the site until a slot is freed
+func (p *ProxySrv) waitTarget(req *http.Request, siteInfo *balancer.RegistNode) (*balancer.ProxyTarget, error) {
+	state := getRequestState(req)
+	domain := siteInfo.Domain
+	var timeout <-chan time.Time
+	queued := false
+	for {
+		freed := balancer.SlotFreed(domain)
+		proxyTarget, err := p.pickTarget(req, siteInfo)
+		if err != errAtCapacity {
+			if queued {
+				p.leaveQueue(domain, err == nil, false)
+			}
+			return proxyTarget, err
+		}
+
+		if !queued {
+			config, err := p.enterQueue(domain)
+			if err != nil {
+				return nil, failFast(state, err)
+			}
+			queued = true
+			timer := time.NewTimer(config.Timeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-freed:
+		case <-timeout:
+			p.leaveQueue(domain, false, true)
+			return nil, failFast(state, errQueueTimeout)
+		case <-req.Context().Done():
+			p.leaveQueue(domain, false, false)
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// failFast let the request fail with 503 and the reason
+func failFast(state *requestState, reason error) error {
+	if state != nil {
+		state.unavailable = reason
+	}
+	return reason
+}
@@ -0,0 +1,153 @@
+package libra
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/zhuCheer/libra/balancer"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueueConfig(t *testing.T) {
+	if (QueueConfig{}).Validate() != ErrQueueInvalid || (QueueConfig{Size: 1, Timeout: -1}).Validate() != ErrQueueInvalid {
+		t.Error("queue config have an error #1")
+	}
+	if (QueueConfig{Size: 1}).withDefault().Timeout != 10*time.Second {
+		t.Error("queue config have an error #2")
+	}
+
+	config := QueueConfig{}
+	err := json.Unmarshal([]byte(`{"size":10,"timeout":"5s"}`), &config)
+	if err != nil || config.Size != 10 || config.Timeout != 5*time.Second {
+		t.Error("queue config have an error #3")
+	}
+	data, _ := json.Marshal(QueueConfig{Size: 3})
+	if string(data) != `{"size":3}` {
+		t.Error("queue config have an error #4", string(data))
+	}
+}
+
+func TestProxyQueue(t *testing.T) {
+	domain := "www.queue.com"
+	hold := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hold" {
+			<-hold
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer origin.Close()
+	addr := origin.Listener.Addr().String()
+
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	proxy.RegistSite(domain, "roundrobin", "http").AddAddr(domain, addr, 1)
+	proxy.SetMaxConns(domain, addr, 1)
+	server := httptest.NewServer(proxy.Handler())
+	defer server.Close()
+
+	get := func(path string) (int, string) {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		req.Host = domain
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err.Error()
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+	siteMetrics := func() SiteMetrics {
+		for _, metrics := range proxy.Metrics() {
+			if metrics.Domain == domain {
+				return metrics
+			}
+		}
+		return SiteMetrics{}
+	}
+	waitInFlight := func(n int64) {
+		for i := 0; i < 100 && proxy.InFlight(domain, addr) != n; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		get("/hold")
+	}()
+	waitInFlight(1)
+
+	// no queue, fail at once
+	if code, body := get("/"); code != 503 || !strings.Contains(body, "at capacity") {
+		t.Error("proxy queue have an error #1", code)
+	}
+
+	// the queued request waits for the slot
+	if err := proxy.SetQueue(domain, &QueueConfig{}); err != ErrQueueInvalid {
+		t.Error("proxy queue have an error #2")
+	}
+	proxy.SetQueue(domain, &QueueConfig{Size: 1, Timeout: 5 * time.Second})
+	result := make(chan int)
+	go func() {
+		code, _ := get("/")
+		result <- code
+	}()
+	for i := 0; i < 100 && siteMetrics().Queued != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if code, body := get("/"); code != 503 || !strings.Contains(body, "queue is full") {
+		t.Error("proxy queue have an error #3", code)
+	}
+	close(hold)
+	if code := <-result; code != 200 {
+		t.Error("proxy queue have an error #4", code)
+	}
+	wg.Wait()
+
+	metrics := siteMetrics()
+	if metrics.Queued != 0 || metrics.Dequeued != 1 || metrics.Rejected != 2 {
+		t.Error("proxy queue have an error #5", metrics)
+	}
+
+	// timeout in the queue
+	proxy.SetQueue(domain, &QueueConfig{Size: 1, Timeout: 50 * time.Millisecond})
+	release, _ := balancer.TryAcquire(domain, addr)
+	if code, body := get("/"); code != 503 || !strings.Contains(body, "timeout") {
+		t.Error("proxy queue have an error #6", code)
+	}
+	release()
+	if metrics = siteMetrics(); metrics.TimedOut != 1 || metrics.Endpoints[0].MaxConns != 1 {
+		t.Error("proxy queue have an error #7")
+	}
+	proxy.FlushProxy(domain)
+}
+
+func TestMetricsSetAddrs(t *testing.T) {
+	domain := "www.metricsaddrs.com"
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	proxy.RegistSite(domain, "roundrobin", "http").AddAddr(domain, "192.168.1.100:80", 1)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			proxy.SetAddrs(domain, []balancer.EndpointItem{{OriginItem: balancer.OriginItem{Endpoint: fmt.Sprintf("192.168.1.%d:80", i), Weight: 1}}})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		for _, metrics := range proxy.Metrics() {
+			if metrics.Domain == domain && len(metrics.Endpoints) != 1 {
+				t.Error("metrics set addrs have an error #1", len(metrics.Endpoints))
+			}
+		}
+	}
+	wg.Wait()
+	proxy.FlushProxy(domain)
+}
@@ -0,0 +1,281 @@
+package libra
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRateLimitInvalid rate limit rule is invalid
+var ErrRateLimitInvalid = errors.New("the rate limit rule is invalid")
+
+// RateLimitRule a token bucket limit, requests matching Path share buckets by Key,
+// Key is empty for one bucket of the whole route, "ip" for a bucket of every client ip,
+// "header:X-Api-Key" for a bucket of every header value, clients without the header use their ip
+type RateLimitRule struct {
+	Name  string  `json:"name,omitempty"`
+	Path  string  `json:"path,omitempty"` // path prefix, empty matches all
+	Key   string  `json:"key,omitempty"`
+	Rate  float64 `json:"rate"`            // tokens added per second
+	Burst int     `json:"burst,omitempty"` // bucket size, default is rate rounded up
+}
+
+// Validate check the rule
+func (r RateLimitRule) Validate() error {
+	if !(r.Rate > 0) || math.IsInf(r.Rate, 0) || r.Burst < 0 {
+		return ErrRateLimitInvalid
+	}
+	if r.Key != "" && r.Key != "ip" && !(strings.HasPrefix(r.Key, "header:") && len(r.Key) > len("header:")) {
+		return ErrRateLimitInvalid
+	}
+	return nil
+}
+
+// burst get bucket size
+func (r RateLimitRule) burst() int {
+	if r.Burst > 0 {
+		return r.Burst
+	}
+	return int(math.Ceil(r.Rate))
+}
+
+// RateLimitResult result of taking a token
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int           // tokens left in the bucket
+	RetryAfter time.Duration // wait time until a token is available, when not allowed
+	Reset      time.Duration // wait time until the bucket is full
+}
+
+// RateLimitStore token bucket store, it can be replaced by a shared store
+// so proxies behind a load balancer share limits,
+// Refund give back a token taken by Take when another rule denies the request
+type RateLimitStore interface {
+	Take(key string, rate float64, burst int, now time.Time) (RateLimitResult, error)
+	Refund(key string, rate float64, burst int) error
+}
+
+// tokenBucket bucket of MemoryRateStore
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time // when the bucket is full again
+}
+
+// MemoryRateStore in-memory token bucket store
+type MemoryRateStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// sweepInterval how often full buckets are removed from MemoryRateStore
+var sweepInterval = time.Minute
+
+// NewMemoryRateStore get a MemoryRateStore point
+func NewMemoryRateStore() *MemoryRateStore {
+	return &MemoryRateStore{buckets: map[string]*tokenBucket{}}
+}
+
+// Take take a token from the bucket of key
+func (m *MemoryRateStore) Take(key string, rate float64, burst int, now time.Time) (RateLimitResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now.Sub(m.lastSweep) >= sweepInterval {
+		m.sweep(now)
+		m.lastSweep = now
+	}
+
+	bucket, ok := m.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(burst), last: now}
+		m.buckets[key] = bucket
+	}
+	if elapsed := now.Sub(bucket.last); elapsed > 0 {
+		bucket.tokens = math.Min(float64(burst), bucket.tokens+elapsed.Seconds()*rate)
+		bucket.last = now
+	}
+
+	result := RateLimitResult{}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+	}
+	result.Remaining = int(bucket.tokens)
+	result.Reset = time.Duration((float64(burst) - bucket.tokens) / rate * float64(time.Second))
+	bucket.full = now.Add(result.Reset)
+	return result, nil
+}
+
+// Refund give back a token to the bucket of key
+func (m *MemoryRateStore) Refund(key string, rate float64, burst int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	bucket, ok := m.buckets[key]
+	if !ok {
+		return nil
+	}
+	bucket.tokens = math.Min(float64(burst), bucket.tokens+1)
+	bucket.full = bucket.last.Add(time.Duration((float64(burst) - bucket.tokens) / rate * float64(time.Second)))
+	return nil
+}
+
+// sweep remove buckets idle long enough to be full again, it should be called with m.mu
+func (m *MemoryRateStore) sweep(now time.Time) {
+	for key, bucket := range m.buckets {
+		if !now.Before(bucket.full) {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// SetRateLimit set rate limit rules of a site, every rule matching a request should allow it,
+// a denied request takes no token, nil rules disable rate limit of the site
+func (p *ProxySrv) SetRateLimit(domain string, rules []RateLimitRule) error {
+	for _, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+
+	p.limitLock.Lock()
+	defer p.limitLock.Unlock()
+	if p.rateLimits == nil {
+		p.rateLimits = map[string][]RateLimitRule{}
+	}
+	if len(rules) == 0 {
+		delete(p.rateLimits, domain)
+	} else {
+		p.rateLimits[domain] = append([]RateLimitRule{}, rules...)
+	}
+	return nil
+}
+
+// GetRateLimit get rate limit rules of a site
+func (p *ProxySrv) GetRateLimit(domain string) []RateLimitRule {
+	p.limitLock.RLock()
+	defer p.limitLock.RUnlock()
+	return p.rateLimits[domain]
+}
+
+// SetRateLimitStore replace the in-memory token bucket store
+func (p *ProxySrv) SetRateLimitStore(store RateLimitStore) {
+	p.limitLock.Lock()
+	defer p.limitLock.Unlock()
+	p.rateStore = store
+}
+
+// getRateStore get the token bucket store, a MemoryRateStore is created at first
+func (p *ProxySrv) getRateStore() RateLimitStore {
+	p.limitLock.RLock()
+	store := p.rateStore
+	p.limitLock.RUnlock()
+	if store != nil {
+		return store
+	}
+
+	p.limitLock.Lock()
+	defer p.limitLock.Unlock()
+	if p.rateStore == nil {
+		p.rateStore = NewMemoryRateStore()
+	}
+	return p.rateStore
+}
+
+// rateLimitMiddleware respond 429 when a rate limit rule of the site is exceeded
+func (p *ProxySrv) rateLimitMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rules := p.GetRateLimit(r.Host)
+		if len(rules) == 0 {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		store := p.getRateStore()
+		now := time.Now()
+		var limited *RateLimitResult
+		var headerRule RateLimitRule
+		var headerResult *RateLimitResult
+		taken := []int{}
+		for k, rule := range rules {
+			if !strings.HasPrefix(r.URL.Path, rule.Path) {
+				continue
+			}
+			result, err := store.Take(rateLimitKey(r, k, rule), rule.Rate, rule.burst(), now)
+			if err != nil {
+				// a broken store should not stop the traffic
+				Logger.Error("rate limit store have an error %v%s", err, requestIDField(r))
+				continue
+			}
+			if !result.Allowed {
+				limited = &result
+				headerRule = rule
+				headerResult = &result
+				break
+			}
+			taken = append(taken, k)
+			// the headers show the tightest rule
+			if headerResult == nil || result.Remaining < headerResult.Remaining {
+				headerRule = rule
+				headerResult = &result
+			}
+		}
+		if limited != nil {
+			// buckets of the other rules keep their tokens, later rules are not taken at all
+			for _, k := range taken {
+				if err := store.Refund(rateLimitKey(r, k, rules[k]), rules[k].Rate, rules[k].burst()); err != nil {
+					Logger.Error("rate limit store have an error %v%s", err, requestIDField(r))
+				}
+			}
+		}
+
+		if headerResult != nil {
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(headerRule.burst()))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(headerResult.Remaining))
+			w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(headerResult.Reset)))
+		}
+		if limited == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(limited.RetryAfter)))
+		resp, _ := p.errorPage(http.StatusTooManyRequests, "too many requests, please retry later", r)
+		p.setIdentityHeader(resp.Header)
+		p.setRequestIDHeader(resp.Header, r)
+		writeResponse(w, resp)
+	})
+}
+
+// rateLimitKey bucket key of a request for the rule at index k
+func rateLimitKey(r *http.Request, k int, rule RateLimitRule) string {
+	name := rule.Name
+	if name == "" {
+		name = strconv.Itoa(k)
+	}
+	key := r.Host + "|" + name + "|"
+
+	switch {
+	case rule.Key == "ip":
+		return key + "ip:" + clientIP(r)
+	case strings.HasPrefix(rule.Key, "header:"):
+		if value := r.Header.Get(rule.Key[len("header:"):]); value != "" {
+			return key + "header:" + value
+		}
+		return key + "ip:" + clientIP(r)
+	}
+	return key
+}
+
+// ceilSeconds round a duration up to seconds
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
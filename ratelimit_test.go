@@ -0,0 +1,152 @@
+package libra
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryRateStore(t *testing.T) {
+	now := time.Now()
+	store := NewMemoryRateStore()
+
+	for i := 0; i < 3; i++ {
+		result, _ := store.Take("a", 1, 3, now)
+		if !result.Allowed || result.Remaining != 2-i {
+			t.Error("memory rate store have an error #1", i)
+		}
+	}
+	result, _ := store.Take("a", 1, 3, now)
+	if result.Allowed || result.RetryAfter != time.Second || result.Reset != 3*time.Second {
+		t.Error("memory rate store have an error #2", result)
+	}
+	if result, _ = store.Take("b", 1, 3, now); !result.Allowed {
+		t.Error("memory rate store have an error #3")
+	}
+
+	// tokens are added by rate
+	now = now.Add(1500 * time.Millisecond)
+	result, _ = store.Take("a", 1, 3, now)
+	if !result.Allowed || result.Remaining != 0 {
+		t.Error("memory rate store have an error #4", result)
+	}
+
+	// a refunded token can be taken again, the bucket is never over burst
+	store.Refund("a", 1, 3)
+	if result, _ = store.Take("a", 1, 3, now); !result.Allowed || result.Remaining != 0 {
+		t.Error("memory rate store have an error #4.1", result)
+	}
+	store.Refund("b", 1, 3)
+	store.Refund("b", 1, 3)
+	if store.buckets["b"].tokens != 3 || store.Refund("d", 1, 3) != nil {
+		t.Error("memory rate store have an error #4.2")
+	}
+
+	// full buckets are swept
+	now = now.Add(sweepInterval)
+	store.Take("c", 1, 3, now)
+	if len(store.buckets) != 1 {
+		t.Error("memory rate store have an error #5")
+	}
+}
+
+func TestRateLimitRule(t *testing.T) {
+	invalid := []RateLimitRule{{}, {Rate: -1}, {Rate: 1, Burst: -1}, {Rate: 1, Key: "cookie"}, {Rate: 1, Key: "header:"}}
+	for k, rule := range invalid {
+		if rule.Validate() != ErrRateLimitInvalid {
+			t.Error("rate limit rule have an error #1", k)
+		}
+	}
+	if (RateLimitRule{Rate: 1, Key: "header:X-Api-Key"}).Validate() != nil || (RateLimitRule{Rate: 2.5}).burst() != 3 {
+		t.Error("rate limit rule have an error #2")
+	}
+
+	req, _ := http.NewRequest("GET", "http://www.ratelimit.com/", nil)
+	req.RemoteAddr = "10.0.0.1:5678"
+	if rateLimitKey(req, 1, RateLimitRule{Key: "ip"}) != "www.ratelimit.com|1|ip:10.0.0.1" {
+		t.Error("rate limit rule have an error #3")
+	}
+	rule := RateLimitRule{Name: "api", Key: "header:X-Api-Key"}
+	if rateLimitKey(req, 1, rule) != "www.ratelimit.com|api|ip:10.0.0.1" {
+		t.Error("rate limit rule have an error #4")
+	}
+	req.Header.Set("X-Api-Key", "secret")
+	if rateLimitKey(req, 1, rule) != "www.ratelimit.com|api|header:secret" {
+		t.Error("rate limit rule have an error #5")
+	}
+}
+
+func TestProxyRateLimit(t *testing.T) {
+	domain := "www.ratelimit.com"
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer origin.Close()
+
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	proxy.RegistSite(domain, "roundrobin", "http").AddAddr(domain, origin.Listener.Addr().String(), 1)
+	if err := proxy.SetRateLimit(domain, []RateLimitRule{{Rate: 0}}); err != ErrRateLimitInvalid {
+		t.Error("proxy rate limit have an error #1")
+	}
+	proxy.SetRateLimit(domain, []RateLimitRule{
+		{Key: "ip", Rate: 0.001, Burst: 2},
+		{Path: "/api/", Key: "header:X-Api-Key", Rate: 0.001, Burst: 1},
+	})
+	handler := proxy.Handler()
+
+	get := func(path, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://"+domain+path, nil)
+		req.RemoteAddr = "10.0.0.1:5678"
+		if apiKey != "" {
+			req.Header.Set("X-Api-Key", apiKey)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/", "")
+	if w.Code != 200 || w.Header().Get("X-RateLimit-Limit") != "2" || w.Header().Get("X-RateLimit-Remaining") != "1" {
+		t.Error("proxy rate limit have an error #2", w.Code, w.Header())
+	}
+	w = get("/api/users", "a")
+	if w.Code != 200 || w.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Error("proxy rate limit have an error #3", w.Code)
+	}
+	w = get("/api/users", "b")
+	if w.Code != 429 || w.Header().Get("Retry-After") != "1000" || !strings.Contains(w.Body.String(), "429 Too Many Requests") {
+		t.Error("proxy rate limit have an error #4", w.Code, w.Header())
+	}
+	if w.Header().Get(errorHeader) != "" || w.Header().Get("X-LIBRA-VERSION") != version {
+		t.Error("proxy rate limit have an error #5")
+	}
+
+	// a request denied by a rule takes no token of other rules
+	proxy.SetRateLimit(domain, []RateLimitRule{
+		{Name: "key", Path: "/api/", Key: "header:X-Api-Key", Rate: 0.001, Burst: 1},
+		{Name: "ip", Key: "ip", Rate: 0.001, Burst: 1},
+	})
+	if w = get("/api/users", "c"); w.Code != 200 {
+		t.Error("proxy rate limit have an error #6", w.Code)
+	}
+	if w = get("/api/users", "d"); w.Code != 429 {
+		t.Error("proxy rate limit have an error #7", w.Code)
+	}
+	req := httptest.NewRequest("GET", "http://"+domain+"/api/users", nil)
+	req.RemoteAddr = "10.0.0.2:5678"
+	req.Header.Set("X-Api-Key", "d")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != 200 || w.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Error("proxy rate limit have an error #8", w.Code)
+	}
+
+	proxy.SetRateLimit(domain, nil)
+	if w = get("/", ""); w.Code != 200 || w.Header().Get("X-RateLimit-Limit") != "" {
+		t.Error("proxy rate limit have an error #9")
+	}
+	proxy.FlushProxy(domain)
+}
@@ -0,0 +1,199 @@
+package libra
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/zhuCheer/libra/balancer"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RegistryVersion current version of the registry document
+const RegistryVersion = 1
+
+// ErrRegistryVersion the registry document version is not supported
+var ErrRegistryVersion = errors.New("the registry version is not supported")
+
+// persistDelay changes within it are saved by one write
+var persistDelay = time.Second
+
+// persistEvents registry changes saved by the persister, health is runtime state and is not saved,
+// dropped events may hide config changes so they are saved too
+var persistEvents = map[balancer.EventType]bool{
+	balancer.SiteAdded:       true,
+	balancer.SiteRemoved:     true,
+	balancer.SiteChanged:     true,
+	balancer.LoadTypeChanged: true,
+	balancer.EndpointAdded:   true,
+	balancer.EndpointRemoved: true,
+	balancer.WeightChanged:   true,
+	balancer.StateChanged:    true,
+	balancer.PriorityChanged: true,
+	balancer.MaxConnsChanged: true,
+	balancer.EventsDropped:   true,
+}
+
+// RegistrySnapshot registry document struct,
+// it contains all sites and the custom response header
+type RegistrySnapshot struct {
+	Version int                     `json:"version"`
+	Headers map[string]string       `json:"headers"`
+	Sites   []balancer.SiteSnapshot `json:"sites"`
+}
+
+// Persister registry persistence backend
+type Persister interface {
+	Load() ([]byte, error) // return nil data if nothing has been saved
+	Save(data []byte) error
+}
+
+// FilePersister save registry document into a local file
+type FilePersister struct {
+	Path string
+}
+
+// NewFilePersister get a FilePersister point
+func NewFilePersister(path string) *FilePersister {
+	return &FilePersister{Path: path}
+}
+
+// Load read registry document, the file not existed is not an error
+func (f *FilePersister) Load() ([]byte, error) {
+	data, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Save write registry document, write a temp file then rename it
+// so the file is never half written
+func (f *FilePersister) Save(data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(f.Path), filepath.Base(f.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), f.Path)
+}
+
+// ExportRegistry export all sites and custom header as a json document
+func (p *ProxySrv) ExportRegistry() ([]byte, error) {
+	snapshot := RegistrySnapshot{
+		Version: RegistryVersion,
+		Headers: p.getCustomHeader(),
+		Sites:   balancer.Snapshot(),
+	}
+	return json.MarshalIndent(snapshot, "", "  ")
+}
+
+// ImportRegistry replace all sites and custom header by a json document
+func (p *ProxySrv) ImportRegistry(data []byte) error {
+	snapshot := RegistrySnapshot{}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	if snapshot.Version != RegistryVersion {
+		return ErrRegistryVersion
+	}
+
+	if err := balancer.Restore(snapshot.Sites); err != nil {
+		return err
+	}
+	if snapshot.Headers == nil {
+		snapshot.Headers = map[string]string{}
+	}
+	p.ResetCustomHeader(snapshot.Headers)
+	return nil
+}
+
+// SetPersister restore registry from the persister and save registry after changes of sites and endpoints,
+// runtime changes by AddAddr, DelAddr etc. will survive restarts, changes close together are saved
+// by one write in background, a pending write is done by Shutdown
+func (p *ProxySrv) SetPersister(persister Persister) error {
+	data, err := persister.Load()
+	if err != nil {
+		return err
+	}
+
+	p.persistLock.Lock()
+	p.persister = nil
+	p.persistLock.Unlock()
+	if len(data) > 0 {
+		if err = p.ImportRegistry(data); err != nil {
+			return err
+		}
+	}
+
+	p.persistLock.Lock()
+	p.persister = persister
+	if !p.persistHooked {
+		p.persistHooked = true
+		balancer.Subscribe(func(e balancer.Event) {
+			if persistEvents[e.Type] {
+				p.schedulePersist()
+			}
+		})
+	}
+	p.persistLock.Unlock()
+
+	return p.persist()
+}
+
+// schedulePersist save registry after persist delay unless a write is pending
+func (p *ProxySrv) schedulePersist() {
+	p.persistLock.Lock()
+	defer p.persistLock.Unlock()
+	if p.persister == nil || p.persistTimer != nil {
+		return
+	}
+	p.persistTimer = time.AfterFunc(persistDelay, func() {
+		p.persistLock.Lock()
+		p.persistTimer = nil
+		p.persistLock.Unlock()
+		p.persist()
+	})
+}
+
+// flushPersist do the pending write at once
+func (p *ProxySrv) flushPersist() {
+	p.persistLock.Lock()
+	timer := p.persistTimer
+	if timer == nil || !timer.Stop() {
+		p.persistLock.Unlock()
+		return
+	}
+	p.persistTimer = nil
+	p.persistLock.Unlock()
+	p.persist()
+}
+
+// persist save registry by the persister, the error is logged
+func (p *ProxySrv) persist() error {
+	p.persistLock.Lock()
+	defer p.persistLock.Unlock()
+	if p.persister == nil {
+		return nil
+	}
+
+	data, err := p.ExportRegistry()
+	if err != nil {
+		Logger.Error("persist registry have an error %v", err)
+		return err
+	}
+	err = p.persister.Save(data)
+	if err != nil {
+		Logger.Error("persist registry have an error %v", err)
+	}
+	return err
+}
@@ -0,0 +1,167 @@
+package libra
+
+import (
+	"context"
+	"github.com/zhuCheer/libra/balancer"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExportImportRegistry(t *testing.T) {
+	proxy := NewHttpProxySrv("127.0.0.1:5000", map[string]string{"X-LIBRA": "export"})
+	proxy.RegistSite("www.export.com", "wroundrobin", "https").
+		AddAddr("www.export.com", "192.168.1.100:80", 2)
+
+	data, err := proxy.ExportRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"version": 1`) || !strings.Contains(string(data), `"load_type": "wroundrobin"`) {
+		t.Error("ExportRegistry have an error #1")
+	}
+
+	proxy.FlushProxy("www.export.com")
+	proxy2 := NewHttpProxySrv("127.0.0.1:5000", nil)
+	if err = proxy2.ImportRegistry(data); err != nil {
+		t.Fatal(err)
+	}
+	info, err := proxy2.GetSiteInfo("www.export.com")
+	if err != nil || info.Scheme != "https" || len(info.Items) != 1 || info.Items[0].Weight != 2 {
+		t.Error("ImportRegistry have an error #2")
+	}
+	if _, ok := info.Balancer.(*balancer.WRoundRobinLoad); !ok {
+		t.Error("ImportRegistry have an error #3")
+	}
+	if proxy2.customHeader["X-LIBRA"] != "export" {
+		t.Error("ImportRegistry have an error #4")
+	}
+
+	if err = proxy2.ImportRegistry([]byte(`{"version":2}`)); err != ErrRegistryVersion {
+		t.Error("ImportRegistry have an error #5")
+	}
+	if err = proxy2.ImportRegistry([]byte(`{"version":`)); err == nil {
+		t.Error("ImportRegistry have an error #6")
+	}
+}
+
+func TestFilePersister(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "libra")
+	defer os.RemoveAll(dir)
+	persister := NewFilePersister(filepath.Join(dir, "registry.json"))
+
+	data, err := persister.Load()
+	if data != nil || err != nil {
+		t.Error("FilePersister Load have an error #1")
+	}
+	persister.Save([]byte("registry"))
+	data, err = persister.Load()
+	if string(data) != "registry" || err != nil {
+		t.Error("FilePersister Load have an error #2")
+	}
+}
+
+func TestSetPersister(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "libra")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "registry.json")
+
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	proxy.RegistSite("www.persist.com", "roundrobin", "http")
+	if err := proxy.SetPersister(NewFilePersister(path)); err != nil {
+		t.Fatal(err)
+	}
+	proxy.AddAddr("www.persist.com", "192.168.1.100:80", 1)
+	proxy.ResetCustomHeader(map[string]string{"X-LIBRA": "persist"})
+
+	data, _ := ioutil.ReadFile(path)
+	if !strings.Contains(string(data), "192.168.1.100:80") || !strings.Contains(string(data), `"X-LIBRA": "persist"`) {
+		t.Error("SetPersister have an error #1")
+	}
+
+	// restart, runtime changes are restored
+	proxy.persister = nil
+	proxy.FlushProxy("www.persist.com")
+	proxy2 := NewHttpProxySrv("127.0.0.1:5000", nil)
+	if err := proxy2.SetPersister(NewFilePersister(path)); err != nil {
+		t.Fatal(err)
+	}
+	info, err := proxy2.GetSiteInfo("www.persist.com")
+	if err != nil || len(info.Items) != 1 || proxy2.customHeader["X-LIBRA"] != "persist" {
+		t.Error("SetPersister have an error #2")
+	}
+	proxy2.persister = nil
+
+	ioutil.WriteFile(path, []byte("{"), 0644)
+	if err = proxy2.SetPersister(NewFilePersister(path)); err == nil {
+		t.Error("SetPersister have an error #3")
+	}
+}
+
+// countPersister count saves of the registry
+type countPersister struct {
+	saves int32
+}
+
+func (c *countPersister) Load() ([]byte, error) {
+	return nil, nil
+}
+
+func (c *countPersister) Save(data []byte) error {
+	atomic.AddInt32(&c.saves, 1)
+	return nil
+}
+
+func TestPersistDelay(t *testing.T) {
+	defer func(delay time.Duration) { persistDelay = delay }(persistDelay)
+	persistDelay = 50 * time.Millisecond
+	domain := "www.persistdelay.com"
+	persister := &countPersister{}
+
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	proxy.RegistSite(domain, "roundrobin", "http").AddAddr(domain, "192.168.1.100:80", 1)
+	proxy.SetPersister(persister)
+	if n := atomic.LoadInt32(&persister.saves); n != 1 {
+		t.Error("persist delay have an error #1", n)
+	}
+
+	// changes close together are saved once
+	proxy.AddAddr(domain, "192.168.1.101:80", 1)
+	proxy.SetWeight(domain, "192.168.1.101:80", 3)
+	for i := 0; i < 100 && atomic.LoadInt32(&persister.saves) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&persister.saves); n != 2 {
+		t.Error("persist delay have an error #2", n)
+	}
+
+	// health is runtime state
+	balancer.SetHealthy(domain, "192.168.1.101:80", false)
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&persister.saves); n != 2 {
+		t.Error("persist delay have an error #3", n)
+	}
+
+	// a pending write is done by Shutdown
+	proxy.DelAddr(domain, "192.168.1.100:80")
+	for i := 0; i < 100; i++ {
+		proxy.persistLock.Lock()
+		pending := proxy.persistTimer != nil
+		proxy.persistLock.Unlock()
+		if pending {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	proxy.Shutdown(context.Background())
+	if n := atomic.LoadInt32(&persister.saves); n != 3 {
+		t.Error("persist delay have an error #4", n)
+	}
+	proxy.persister = nil
+	proxy.FlushProxy(domain)
+}
@@ -0,0 +1,201 @@
+package libra
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrRequestIDInvalid request id config is invalid
+var ErrRequestIDInvalid = errors.New("the request id config is invalid")
+
+// RequestIDFormat format of generated request ids
+type RequestIDFormat string
+
+// Request id formats.
+const (
+	RequestIDUUID RequestIDFormat = "uuid" // random UUID v4
+	RequestIDULID RequestIDFormat = "ulid" // lexicographically sortable by time
+)
+
+// maxRequestIDLen an incoming request id longer than it is replaced
+const maxRequestIDLen = 128
+
+// crockford base32 alphabet of ulid
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// RequestIDConfig request id of requests, an incoming id in Header is kept,
+// otherwise one is generated, the id is sent to the origin, echoed in the response,
+// shown on error pages and written in logs
+type RequestIDConfig struct {
+	Header   string          `json:"header,omitempty"` // default X-Request-Id
+	Format   RequestIDFormat `json:"format,omitempty"` // default uuid
+	Disabled bool            `json:"disabled,omitempty"`
+}
+
+// DefaultRequestID request id config of a proxy server without config
+var DefaultRequestID = RequestIDConfig{Header: "X-Request-Id", Format: RequestIDUUID}
+
+// Validate check the config
+func (c RequestIDConfig) Validate() error {
+	switch c.Format {
+	case "", RequestIDUUID, RequestIDULID:
+	default:
+		return ErrRequestIDInvalid
+	}
+	if !validHeaderToken(c.Header) {
+		return ErrRequestIDInvalid
+	}
+	return nil
+}
+
+// withDefault fill zero fields by default value
+func (c RequestIDConfig) withDefault() RequestIDConfig {
+	if c.Header == "" {
+		c.Header = DefaultRequestID.Header
+	}
+	if c.Format == "" {
+		c.Format = DefaultRequestID.Format
+	}
+	c.Header = http.CanonicalHeaderKey(c.Header)
+	return c
+}
+
+// SetRequestID set request id config, nil resets it to DefaultRequestID
+func (p *ProxySrv) SetRequestID(config *RequestIDConfig) error {
+	if config != nil {
+		if err := config.Validate(); err != nil {
+			return err
+		}
+	}
+
+	p.requestIDLock.Lock()
+	defer p.requestIDLock.Unlock()
+	if config == nil {
+		p.requestID = nil
+	} else {
+		c := config.withDefault()
+		p.requestID = &c
+	}
+	return nil
+}
+
+// GetRequestID get request id config
+func (p *ProxySrv) GetRequestID() RequestIDConfig {
+	p.requestIDLock.RLock()
+	defer p.requestIDLock.RUnlock()
+	if p.requestID == nil {
+		return DefaultRequestID
+	}
+	return *p.requestID
+}
+
+// assignRequestID keep the incoming request id or generate one, empty if disabled
+func (p *ProxySrv) assignRequestID(r *http.Request) string {
+	config := p.GetRequestID()
+	if config.Disabled {
+		return ""
+	}
+	if id := r.Header.Get(config.Header); validRequestID(id) {
+		return id
+	}
+	if config.Format == RequestIDULID {
+		return newULID(time.Now())
+	}
+	return newUUID()
+}
+
+// setRequestIDHeader set the request id header of a request or response
+func (p *ProxySrv) setRequestIDHeader(header http.Header, req *http.Request) {
+	id := requestID(req)
+	if id == "" {
+		return
+	}
+	config := p.GetRequestID()
+	if !config.Disabled {
+		header.Set(config.Header, id)
+	}
+}
+
+// requestID get the request id of a request, empty if not assigned
+func requestID(req *http.Request) string {
+	if state := getRequestState(req); state != nil {
+		return state.requestID
+	}
+	return ""
+}
+
+// requestIDField get the request id field of a log line, empty if no request id
+func requestIDField(req *http.Request) string {
+	if id := requestID(req); id != "" {
+		return " request_id=" + id
+	}
+	return ""
+}
+
+// validRequestID check an incoming request id, it should be short printable ascii safe in html
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] >= 0x7f || strings.IndexByte(`"&'<>`, id[i]) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// validHeaderToken check a header name, empty is allowed
+func validHeaderToken(name string) bool {
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// newUUID get a random UUID v4
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	buf := make([]byte, 36)
+	hex.Encode(buf, b[:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:], b[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:], b[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:], b[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], b[10:])
+	return string(buf)
+}
+
+// newULID get a ULID, 48 bits of unix milliseconds and 80 random bits in crockford base32
+func newULID(now time.Time) string {
+	b := make([]byte, 16)
+	ms := uint64(now.UnixNano() / int64(time.Millisecond))
+	binary.BigEndian.PutUint64(b[:8], ms<<16)
+	rand.Read(b[6:])
+
+	// 128 bits are 26 chars of 5 bits, the first char takes 3 bits
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	id := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		id[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(id)
+}
@@ -0,0 +1,126 @@
+package libra
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewRequestID(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	if id := newUUID(); !uuid.MatchString(id) || id == newUUID() {
+		t.Error("new request id have an error #1", id)
+	}
+
+	ulid := regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`)
+	now := time.Unix(1500000000, 0)
+	id := newULID(now)
+	if !ulid.MatchString(id) || id == newULID(now) {
+		t.Error("new request id have an error #2", id)
+	}
+	// the first 10 chars are the time, ulids sort by time
+	if id[:10] != "01BMZFF600" || newULID(now.Add(time.Millisecond)) <= id {
+		t.Error("new request id have an error #3", id)
+	}
+}
+
+func TestSetRequestID(t *testing.T) {
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	if proxy.GetRequestID() != DefaultRequestID {
+		t.Error("SetRequestID have an error #1")
+	}
+	if err := proxy.SetRequestID(&RequestIDConfig{Format: "snowflake"}); err != ErrRequestIDInvalid {
+		t.Error("SetRequestID have an error #2")
+	}
+	if err := proxy.SetRequestID(&RequestIDConfig{Header: "X Id"}); err != ErrRequestIDInvalid {
+		t.Error("SetRequestID have an error #3")
+	}
+	proxy.SetRequestID(&RequestIDConfig{Format: RequestIDULID})
+	if config := proxy.GetRequestID(); config.Header != "X-Request-Id" || config.Format != RequestIDULID {
+		t.Error("SetRequestID have an error #4")
+	}
+	proxy.SetRequestID(nil)
+	if proxy.GetRequestID() != DefaultRequestID {
+		t.Error("SetRequestID have an error #5")
+	}
+}
+
+func TestRequestIDPropagation(t *testing.T) {
+	domain := "www.requestid.com"
+	var got string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("X-Request-Id")
+		if id := r.Header.Get("X-Trace-Id"); id != "" {
+			got = id
+		}
+		w.Header().Set("X-Origin-Id", r.Header.Get("X-Id"))
+	}))
+	defer origin.Close()
+
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	proxy.RegistSite(domain, "roundrobin", "http").AddAddr(domain, origin.Listener.Addr().String(), 1)
+	proxy.SetHeaderRules(domain, []HeaderRule{{Target: HeaderRequest, Action: HeaderSet, Name: "X-Id", Value: "{#request_id#}"}})
+	handler := proxy.Handler()
+	get := func(host, id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://"+host+"/", nil)
+		if id != "" {
+			req.Header.Set("X-Request-Id", id)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get(domain, "abc-123")
+	if got != "abc-123" || w.Header().Get("X-Request-Id") != "abc-123" || w.Header().Get("X-Origin-Id") != "abc-123" {
+		t.Error("request id propagation have an error #1", got)
+	}
+	w = get(domain, "<script>")
+	if len(got) != 36 || got == "<script>" || w.Header().Get("X-Request-Id") != got {
+		t.Error("request id propagation have an error #2", got)
+	}
+	w = get(domain, "")
+	if len(got) != 36 || len(w.Header()["X-Request-Id"]) != 1 || w.Header().Get("X-Request-Id") != got {
+		t.Error("request id propagation have an error #3", got)
+	}
+
+	proxy.SetRequestID(&RequestIDConfig{Header: "X-Trace-Id", Format: RequestIDULID})
+	w = get(domain, "abc-123")
+	if len(got) != 26 || w.Header().Get("X-Trace-Id") != got || w.Header().Get("X-Request-Id") != "" {
+		t.Error("request id propagation have an error #4", got)
+	}
+
+	proxy.SetRequestID(&RequestIDConfig{Disabled: true})
+	w = get(domain, "abc-123")
+	if got != "abc-123" || w.Header().Get("X-Request-Id") != "" || w.Header().Get("X-Origin-Id") != "" {
+		t.Error("request id propagation have an error #5", got)
+	}
+
+	proxy.SetRequestID(nil)
+	w = get("www.requestid-none.com", "abc-123")
+	body, _ := ioutil.ReadAll(w.Body)
+	if w.Header().Get("X-Request-Id") != "abc-123" || !strings.Contains(string(body), "<td>abc-123</td>") {
+		t.Error("request id propagation have an error #6", string(body))
+	}
+}
+
+func TestRequestIDBadGateway(t *testing.T) {
+	domain := "www.requestid-bad.com"
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	addr := origin.Listener.Addr().String()
+	origin.Close()
+
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	proxy.RegistSite(domain, "roundrobin", "http").AddAddr(domain, addr, 1)
+	req := httptest.NewRequest("GET", "http://"+domain+"/", nil)
+	req.Header.Set("X-Request-Id", "abc-502")
+	w := httptest.NewRecorder()
+	proxy.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusBadGateway || w.Header().Get("X-Request-Id") != "abc-502" || w.Header().Get("X-LIBRA-VERSION") != version {
+		t.Error("request id bad gateway have an error #1", w.Code)
+	}
+}
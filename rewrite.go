@@ -0,0 +1,181 @@
+package libra
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// ErrRewriteRuleInvalid rewrite rule is invalid
+var ErrRewriteRuleInvalid = errors.New("the rewrite rule is invalid")
+
+// RewriteAction what a rewrite rule does
+type RewriteAction string
+
+// Rewrite rule actions.
+const (
+	RewritePath     RewriteAction = "rewrite"  // change the path, query or host sent to the origin
+	RewriteRedirect RewriteAction = "redirect" // answer a redirect without calling an origin
+)
+
+// RewriteRule change requests whose path matches Match, Replace can use capture groups like $1 or ${name},
+// the query of the request is appended to the one of Replace unless DropQuery
+type RewriteRule struct {
+	Match     string        `json:"match"` // regexp of the path like ^/v1/(.*)$
+	Action    RewriteAction `json:"action"`
+	Replace   string        `json:"replace,omitempty"`    // path like /api/$1?v=1, or an url for redirect, empty keeps the path
+	Host      string        `json:"host,omitempty"`       // Host header sent to the origin, for rewrite, captures are not expanded
+	Status    int           `json:"status,omitempty"`     // 301, 302, 307 or 308 for redirect, default 302
+	DropQuery bool          `json:"drop_query,omitempty"` // the query of the request is not kept
+	Last      bool          `json:"last,omitempty"`       // rules after it are skipped if it matches
+
+	re *regexp.Regexp
+}
+
+// Validate check the rule and compile its regexp
+func (r *RewriteRule) Validate() error {
+	re, err := regexp.Compile(r.Match)
+	if err != nil || r.Match == "" {
+		return ErrRewriteRuleInvalid
+	}
+	switch r.Action {
+	case RewritePath:
+		if r.Replace == "" && r.Host == "" || r.Replace != "" && !strings.HasPrefix(r.Replace, "/") || r.Status != 0 ||
+			strings.ContainsAny(r.Host, "$ /\\@?#\t\r\n") {
+			return ErrRewriteRuleInvalid
+		}
+	case RewriteRedirect:
+		if r.Replace == "" || r.Host != "" {
+			return ErrRewriteRuleInvalid
+		}
+		switch r.Status {
+		case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return ErrRewriteRuleInvalid
+		}
+	default:
+		return ErrRewriteRuleInvalid
+	}
+	r.re = re
+	return nil
+}
+
+// rewriteResult how a request is sent to the origin by rewrite rules
+type rewriteResult struct {
+	path     string
+	rawQuery string
+	host     string // empty keeps the Host
+}
+
+// SetRewriteRules set rewrite rules of a site, rules are applied in order to the path
+// changed by the rules before, the first matched redirect answers the request, nil removes them
+func (p *ProxySrv) SetRewriteRules(domain string, rules []RewriteRule) error {
+	compiled := make([]RewriteRule, len(rules))
+	for k, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+		compiled[k] = rule
+	}
+
+	p.rewriteLock.Lock()
+	defer p.rewriteLock.Unlock()
+	if p.rewriteRules == nil {
+		p.rewriteRules = map[string][]RewriteRule{}
+	}
+	if len(rules) == 0 {
+		delete(p.rewriteRules, domain)
+	} else {
+		p.rewriteRules[domain] = compiled
+	}
+	return nil
+}
+
+// GetRewriteRules get rewrite rules of a site
+func (p *ProxySrv) GetRewriteRules(domain string) []RewriteRule {
+	p.rewriteLock.RLock()
+	defer p.rewriteLock.RUnlock()
+	return p.rewriteRules[domain]
+}
+
+// rewriteRequest apply rewrite rules to a request, it returns the location and status if it is redirected,
+// or how it is sent to the origin, nil if no rule matches
+func (p *ProxySrv) rewriteRequest(r *http.Request) (location string, status int, result *rewriteResult) {
+	rules := p.GetRewriteRules(r.Host)
+	if len(rules) == 0 {
+		return "", 0, nil
+	}
+
+	path, rawQuery := r.URL.Path, r.URL.RawQuery
+	for _, rule := range rules {
+		match := rule.re.FindStringSubmatchIndex(path)
+		if match == nil {
+			continue
+		}
+		if result == nil {
+			result = &rewriteResult{path: r.URL.Path, rawQuery: r.URL.RawQuery}
+		}
+
+		replaced, query := path, rawQuery
+		if rule.Replace != "" {
+			replaced = string(rule.re.ExpandString(nil, rule.Replace, path, match))
+			if i := strings.Index(replaced, "?"); i >= 0 {
+				replaced, query = replaced[:i], joinQuery(replaced[i+1:], rawQuery, rule.DropQuery)
+			} else if rule.DropQuery {
+				query = ""
+			}
+		} else if rule.DropQuery {
+			query = ""
+		}
+
+		if rule.Action == RewriteRedirect {
+			status = rule.Status
+			if status == 0 {
+				status = http.StatusFound
+			}
+			if query != "" {
+				replaced += "?" + query
+			}
+			return replaced, status, nil
+		}
+		if rule.Host != "" {
+			result.host = rule.Host
+		}
+		path, rawQuery = replaced, query
+		result.path, result.rawQuery = path, rawQuery
+		if rule.Last {
+			break
+		}
+	}
+	return "", 0, result
+}
+
+// joinQuery join the query of the replacement and the one of the request
+func joinQuery(replaced, original string, drop bool) string {
+	if drop || original == "" {
+		return replaced
+	}
+	if replaced == "" {
+		return original
+	}
+	return replaced + "&" + original
+}
+
+// rewriteMiddleware answer redirects and save how the request is sent to the origin,
+// the path is joined with the one of the endpoint in dynamicDirector
+func (p *ProxySrv) rewriteMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		location, status, result := p.rewriteRequest(r)
+		if status != 0 {
+			p.setIdentityHeader(w.Header())
+			p.setRequestIDHeader(w.Header(), r)
+			http.Redirect(w, r, location, status)
+			return
+		}
+		if state := getRequestState(r); state != nil && result != nil {
+			state.rewrite = result
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,83 @@
+package libra
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRewriteRule(t *testing.T) {
+	invalid := []RewriteRule{
+		{Match: "(", Action: RewritePath, Replace: "/"},
+		{Match: "", Action: RewritePath, Replace: "/"},
+		{Match: "^/a", Action: RewritePath},
+		{Match: "^/a", Action: RewritePath, Replace: "a"},
+		{Match: "^/a", Action: RewriteRedirect},
+		{Match: "^/a", Action: RewriteRedirect, Replace: "/b", Status: 303},
+		{Match: "^/a", Action: "proxy", Replace: "/b"},
+		{Match: "^/(.*)/", Action: RewritePath, Host: "$1.a.com"},
+		{Match: "^/a", Action: RewritePath, Host: "a.com/b"},
+	}
+	for k, rule := range invalid {
+		if rule.Validate() != ErrRewriteRuleInvalid {
+			t.Error("rewrite rule have an error #1", k)
+		}
+	}
+
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	if err := proxy.SetRewriteRules("www.a.com", invalid[:1]); err != ErrRewriteRuleInvalid {
+		t.Error("rewrite rule have an error #2")
+	}
+	proxy.SetRewriteRules("www.a.com", []RewriteRule{
+		{Match: "^/old/(.*)$", Action: RewriteRedirect, Replace: "https://www.b.com/new/$1", Status: 301},
+		{Match: "^/v1/(?P<rest>.*)$", Action: RewritePath, Replace: "/v2/${rest}?from=v1"},
+		{Match: "^/v2/(.*)$", Action: RewritePath, Replace: "/api/$1", Host: "api.a.com", Last: true},
+		{Match: "^/api/", Action: RewritePath, Replace: "/never"},
+		{Match: "^/bare", Action: RewritePath, Replace: "/plain", DropQuery: true},
+	})
+
+	location, status, _ := proxy.rewriteRequest(httptest.NewRequest("GET", "http://www.a.com/old/a?b=1", nil))
+	if location != "https://www.b.com/new/a?b=1" || status != 301 {
+		t.Error("rewrite rule have an error #3", location, status)
+	}
+	_, status, result := proxy.rewriteRequest(httptest.NewRequest("GET", "http://www.a.com/v1/users?id=1", nil))
+	if status != 0 || result == nil || result.path != "/api/users" || result.rawQuery != "from=v1&id=1" || result.host != "api.a.com" {
+		t.Error("rewrite rule have an error #4", result)
+	}
+	if _, _, result = proxy.rewriteRequest(httptest.NewRequest("GET", "http://www.a.com/bare?id=1", nil)); result == nil || result.path != "/plain" || result.rawQuery != "" {
+		t.Error("rewrite rule have an error #5", result)
+	}
+	if _, _, result = proxy.rewriteRequest(httptest.NewRequest("GET", "http://www.a.com/other", nil)); result != nil {
+		t.Error("rewrite rule have an error #6")
+	}
+}
+
+func TestRewriteMiddleware(t *testing.T) {
+	domain := "www.rewrite.com"
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + " " + r.URL.RequestURI() + " " + r.Header.Get("X-Forwarded-Host")))
+	}))
+	defer origin.Close()
+
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	proxy.RegistSite(domain, "roundrobin", "http").AddAddr(domain, origin.Listener.Addr().String(), 1)
+	proxy.SetForwarded(domain, &ForwardedConfig{XForwarded: true})
+	proxy.SetRewriteRules(domain, []RewriteRule{
+		{Match: "^/v1/(.*)$", Action: RewritePath, Replace: "/api/$1", Host: "api.internal"},
+		{Match: "^/login$", Action: RewriteRedirect, Replace: "/signin", Status: http.StatusPermanentRedirect},
+	})
+	handler := proxy.Handler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://"+domain+"/v1/users?id=1", nil))
+	if body, _ := ioutil.ReadAll(w.Body); string(body) != "api.internal /api/users?id=1 "+domain {
+		t.Error("rewrite middleware have an error #1", string(body))
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "http://"+domain+"/login?next=/a", nil))
+	if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != "/signin?next=/a" || w.Header().Get("X-Request-Id") == "" {
+		t.Error("rewrite middleware have an error #2", w.Code, w.Header())
+	}
+}
@@ -0,0 +1,448 @@
+package libra
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrTracingInvalid tracing config is invalid
+var ErrTracingInvalid = errors.New("the tracing config is invalid")
+
+// SpanKind kind of a span, the values are the same as OTLP
+type SpanKind int
+
+// Span kinds.
+const (
+	SpanKindInternal SpanKind = 1 // work inside libra like balancer selection
+	SpanKindServer   SpanKind = 2 // the request proxied by libra
+	SpanKindClient   SpanKind = 3 // the round trip to the origin
+)
+
+// Span a timed operation of a trace
+type Span struct {
+	TraceID      string // 32 hex chars
+	SpanID       string // 16 hex chars
+	ParentSpanID string // empty for a root span
+	TraceState   string // tracestate of the incoming request
+	Name         string
+	Kind         SpanKind
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]interface{} // values are string, int, int64, float64 or bool
+	Error        string                 // status message, empty if the span succeeded
+}
+
+// SetAttribute set an attribute of the span, it does nothing on a nil span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	if s.Attributes == nil {
+		s.Attributes = map[string]interface{}{}
+	}
+	s.Attributes[key] = value
+}
+
+// SpanExporter send finished spans to a tracing backend
+type SpanExporter interface {
+	ExportSpans(spans []*Span) error
+}
+
+// TracingConfig tracing of requests, traces from an incoming traceparent
+// are recorded if the parent is sampled, new traces are sampled by SampleRate
+type TracingConfig struct {
+	SampleRate    float64       // ratio of new traces recorded in 0~1, 0 means 1
+	BatchSize     int           // spans exported at once, default 512
+	FlushInterval time.Duration // max time a span waits to be exported, default 5s
+}
+
+// tracingConfigJSON json struct of TracingConfig, flush interval is a string like 5s
+type tracingConfigJSON struct {
+	SampleRate    float64 `json:"sample_rate,omitempty"`
+	BatchSize     int     `json:"batch_size,omitempty"`
+	FlushInterval string  `json:"flush_interval,omitempty"`
+}
+
+// MarshalJSON encode flush interval as a string
+func (c TracingConfig) MarshalJSON() ([]byte, error) {
+	v := tracingConfigJSON{SampleRate: c.SampleRate, BatchSize: c.BatchSize}
+	if c.FlushInterval != 0 {
+		v.FlushInterval = c.FlushInterval.String()
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON decode flush interval from a string
+func (c *TracingConfig) UnmarshalJSON(data []byte) error {
+	v := tracingConfigJSON{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	config := TracingConfig{SampleRate: v.SampleRate, BatchSize: v.BatchSize}
+	if v.FlushInterval != "" {
+		var err error
+		if config.FlushInterval, err = time.ParseDuration(v.FlushInterval); err != nil {
+			return err
+		}
+	}
+	*c = config
+	return nil
+}
+
+// Validate check the config
+func (c TracingConfig) Validate() error {
+	if !(c.SampleRate >= 0 && c.SampleRate <= 1) || c.BatchSize < 0 || c.FlushInterval < 0 {
+		return ErrTracingInvalid
+	}
+	return nil
+}
+
+// withDefault fill zero fields by default value
+func (c TracingConfig) withDefault() TracingConfig {
+	if c.SampleRate == 0 {
+		c.SampleRate = 1
+	}
+	if c.BatchSize == 0 {
+		c.BatchSize = 512
+	}
+	if c.FlushInterval == 0 {
+		c.FlushInterval = 5 * time.Second
+	}
+	return c
+}
+
+// tracer batch finished spans and export them in background
+type tracer struct {
+	config   TracingConfig
+	exporter SpanExporter
+
+	mu        sync.Mutex
+	spans     []*Span
+	exporting bool // a batch is being exported
+	dropped   uint64
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+// newTracer get a tracer point, spans are flushed every flush interval until it is closed
+func newTracer(config TracingConfig, exporter SpanExporter) *tracer {
+	t := &tracer{config: config.withDefault(), exporter: exporter, stop: make(chan struct{})}
+	go t.loop()
+	return t
+}
+
+// loop flush spans by the interval
+func (t *tracer) loop() {
+	ticker := time.NewTicker(t.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.flush()
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// record add a finished span, a full batch is exported at once,
+// spans are dropped if the exporter can not keep up
+func (t *tracer) record(span *Span) {
+	t.mu.Lock()
+	if len(t.spans) >= t.config.BatchSize*4 {
+		t.dropped++
+		t.mu.Unlock()
+		return
+	}
+	t.spans = append(t.spans, span)
+	full := len(t.spans) >= t.config.BatchSize && !t.exporting
+	t.mu.Unlock()
+
+	if full {
+		go t.flush()
+	}
+}
+
+// flush export all recorded spans
+func (t *tracer) flush() {
+	t.mu.Lock()
+	if t.exporting {
+		t.mu.Unlock()
+		return
+	}
+	t.exporting = true
+	t.mu.Unlock()
+
+	for {
+		t.mu.Lock()
+		if len(t.spans) == 0 {
+			t.exporting = false
+			t.mu.Unlock()
+			return
+		}
+		batch := t.spans
+		if len(batch) > t.config.BatchSize {
+			batch = batch[:t.config.BatchSize]
+		}
+		t.spans = t.spans[len(batch):]
+		t.mu.Unlock()
+
+		if err := t.exporter.ExportSpans(batch); err != nil {
+			Logger.Error("export %d spans have an error %v", len(batch), err)
+		}
+	}
+}
+
+// close stop the background flush and export the spans left
+func (t *tracer) close() {
+	t.stopOnce.Do(func() {
+		close(t.stop)
+	})
+	t.flush()
+}
+
+// SetTracing enable tracing of requests, spans are exported by the exporter,
+// a nil config or exporter disables it, spans of the tracer replaced are flushed
+func (p *ProxySrv) SetTracing(config *TracingConfig, exporter SpanExporter) error {
+	if config != nil {
+		if err := config.Validate(); err != nil {
+			return err
+		}
+	}
+
+	var t *tracer
+	if config != nil && exporter != nil {
+		t = newTracer(*config, exporter)
+	}
+	p.traceLock.Lock()
+	old := p.tracer
+	p.tracer = t
+	p.traceLock.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+	return nil
+}
+
+// GetTracing get tracing config, nil if it is not enabled
+func (p *ProxySrv) GetTracing() *TracingConfig {
+	t := p.getTracer()
+	if t == nil {
+		return nil
+	}
+	config := t.config
+	return &config
+}
+
+// FlushTraces export the spans not exported yet
+func (p *ProxySrv) FlushTraces() {
+	if t := p.getTracer(); t != nil {
+		t.flush()
+	}
+}
+
+// getTracer get the tracer, nil if tracing is not enabled
+func (p *ProxySrv) getTracer() *tracer {
+	p.traceLock.RLock()
+	defer p.traceLock.RUnlock()
+	return p.tracer
+}
+
+// requestTrace spans of a request, methods of a nil requestTrace do nothing
+type requestTrace struct {
+	tracer  *tracer
+	sampled bool
+	span    *Span // the proxy span
+}
+
+// startTrace start the proxy span of a request from its traceparent, nil if tracing is not enabled
+func (p *ProxySrv) startTrace(r *http.Request) *requestTrace {
+	t := p.getTracer()
+	if t == nil {
+		return nil
+	}
+
+	span := &Span{SpanID: newSpanID(), Name: "proxy " + r.Host, Kind: SpanKindServer, Start: time.Now()}
+	trace := &requestTrace{tracer: t, span: span}
+	if traceID, parentID, flags, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		span.TraceID = traceID
+		span.ParentSpanID = parentID
+		span.TraceState = r.Header.Get("tracestate")
+		trace.sampled = flags&1 == 1
+	} else {
+		// tracestate is meaningless without a valid traceparent
+		r.Header.Del("tracestate")
+		span.TraceID = newTraceID()
+		trace.sampled = sampleTrace(t.config.SampleRate)
+	}
+
+	span.SetAttribute("http.request.method", r.Method)
+	span.SetAttribute("url.path", r.URL.Path)
+	span.SetAttribute("server.address", r.Host)
+	span.SetAttribute("client.address", clientIP(r))
+	if id := requestID(r); id != "" {
+		span.SetAttribute("libra.request_id", id)
+	}
+	return trace
+}
+
+// child start a child span of the proxy span
+func (t *requestTrace) child(name string, kind SpanKind) *Span {
+	if t == nil {
+		return nil
+	}
+	return &Span{
+		TraceID:      t.span.TraceID,
+		SpanID:       newSpanID(),
+		ParentSpanID: t.span.SpanID,
+		TraceState:   t.span.TraceState,
+		Name:         name,
+		Kind:         kind,
+		Start:        time.Now(),
+	}
+}
+
+// end finish a span of the request, it is exported if the trace is sampled
+func (t *requestTrace) end(span *Span) {
+	if t == nil || span == nil {
+		return
+	}
+	span.End = time.Now()
+	if t.sampled {
+		t.tracer.record(span)
+	}
+}
+
+// traceparent get the traceparent header of a request sent by the span
+func (t *requestTrace) traceparent(span *Span) string {
+	flags := "00"
+	if t.sampled {
+		flags = "01"
+	}
+	return "00-" + span.TraceID + "-" + span.SpanID + "-" + flags
+}
+
+// parseTraceparent parse a W3C traceparent header like
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func parseTraceparent(value string) (traceID, parentID string, flags byte, ok bool) {
+	if len(value) < 55 || value[2] != '-' || value[35] != '-' || value[52] != '-' {
+		return
+	}
+	version := value[:2]
+	if !isLowerHex(version) || version == "ff" || version == "00" && len(value) != 55 || len(value) > 55 && value[55] != '-' {
+		return
+	}
+	traceID, parentID = value[3:35], value[36:52]
+	if !isLowerHex(traceID) || !isLowerHex(parentID) || !isLowerHex(value[53:55]) {
+		return
+	}
+	if traceID == strings.Repeat("0", 32) || parentID == strings.Repeat("0", 16) {
+		return
+	}
+	b, _ := hex.DecodeString(value[53:55])
+	return traceID, parentID, b[0], true
+}
+
+// isLowerHex check a string is lowercase hex
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !(s[i] >= '0' && s[i] <= '9' || s[i] >= 'a' && s[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// newTraceID get a random trace id
+func newTraceID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newSpanID get a random span id
+func newSpanID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// sampleTrace decide whether a new trace is recorded
+func sampleTrace(rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return float64(binary.BigEndian.Uint64(b)>>11)/(1<<53) < rate
+}
+
+// traceWriter http.ResponseWriter keeping the status code for the proxy span
+type traceWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader keep the status code
+func (w *traceWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write keep 200 if no status code written
+func (w *traceWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush flush the response if supported
+func (w *traceWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack take over the connection for upgraded protocols
+func (w *traceWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer does not support hijack")
+	}
+	return hijacker.Hijack()
+}
+
+// Unwrap get the wrapped http.ResponseWriter
+func (w *traceWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// traceHandler serve a request in the proxy span
+func (p *ProxySrv) traceHandler(trace *requestTrace, w http.ResponseWriter, r *http.Request, handler http.Handler) {
+	tw := &traceWriter{ResponseWriter: w}
+	handler.ServeHTTP(tw, r)
+
+	status := tw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	trace.span.SetAttribute("http.response.status_code", status)
+	if status >= 500 {
+		trace.span.Error = strconv.Itoa(status) + " " + http.StatusText(status)
+	}
+	trace.end(trace.span)
+}
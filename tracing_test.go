@@ -0,0 +1,168 @@
+package libra
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryExporter keep exported spans in memory
+type memoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (e *memoryExporter) ExportSpans(spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *memoryExporter) take() map[string]*Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	spans := map[string]*Span{}
+	for _, span := range e.spans {
+		spans[strings.Fields(span.Name)[0]] = span
+	}
+	e.spans = nil
+	return spans
+}
+
+func TestParseTraceparent(t *testing.T) {
+	traceID, parentID, flags, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok || traceID != "4bf92f3577b34da6a3ce929d0e0e4736" || parentID != "00f067aa0ba902b7" || flags != 1 {
+		t.Error("parse traceparent have an error #1")
+	}
+	if _, _, _, ok = parseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-future"); !ok {
+		t.Error("parse traceparent have an error #2")
+	}
+	for k, value := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00_4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		if _, _, _, ok = parseTraceparent(value); ok {
+			t.Error("parse traceparent have an error #3", k)
+		}
+	}
+}
+
+func TestSetTracing(t *testing.T) {
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	if err := proxy.SetTracing(&TracingConfig{SampleRate: 2}, &memoryExporter{}); err != ErrTracingInvalid {
+		t.Error("SetTracing have an error #1")
+	}
+	if err := proxy.SetTracing(&TracingConfig{}, &memoryExporter{}); err != nil || proxy.GetTracing().SampleRate != 1 {
+		t.Error("SetTracing have an error #2")
+	}
+	if err := proxy.SetTracing(&TracingConfig{}, nil); err != nil || proxy.GetTracing() != nil {
+		t.Error("SetTracing have an error #3")
+	}
+}
+
+func TestTracerBatch(t *testing.T) {
+	exporter := &memoryExporter{}
+	tracer := newTracer(TracingConfig{BatchSize: 2, FlushInterval: time.Hour}, exporter)
+	defer tracer.close()
+
+	tracer.record(&Span{Name: "a"})
+	if len(exporter.take()) != 0 {
+		t.Error("tracer batch have an error #1")
+	}
+	tracer.record(&Span{Name: "b"})
+	time.Sleep(50 * time.Millisecond)
+	if len(exporter.take()) != 2 {
+		t.Error("tracer batch have an error #2")
+	}
+	tracer.record(&Span{Name: "c"})
+	tracer.close()
+	if len(exporter.take()) != 1 {
+		t.Error("tracer batch have an error #3")
+	}
+}
+
+func TestTracingSpans(t *testing.T) {
+	domain := "www.tracing.com"
+	var got http.Header
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer origin.Close()
+	addr := origin.Listener.Addr().String()
+
+	proxy := NewHttpProxySrv("127.0.0.1:5000", nil)
+	proxy.RegistSite(domain, "roundrobin", "http").AddAddr(domain, addr, 1)
+	handler := proxy.Handler()
+	get := func(host string, header map[string]string) {
+		req := httptest.NewRequest("GET", "http://"+host+"/trace", nil)
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	parent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	// without tracing the headers pass through
+	get(domain, map[string]string{"traceparent": parent, "tracestate": "a=1"})
+	if got.Get("traceparent") != parent || got.Get("tracestate") != "a=1" {
+		t.Error("tracing spans have an error #1")
+	}
+
+	exporter := &memoryExporter{}
+	proxy.SetTracing(&TracingConfig{FlushInterval: time.Hour}, exporter)
+	defer proxy.SetTracing(nil, nil)
+	get(domain, map[string]string{"traceparent": parent, "tracestate": "a=1", "X-Request-Id": "trace-1"})
+	proxy.FlushTraces()
+	spans := exporter.take()
+	root, selected, upstream := spans["proxy"], spans["balancer"], spans["upstream"]
+	if len(spans) != 3 || root == nil || selected == nil || upstream == nil {
+		t.Fatal("tracing spans have an error #2", spans)
+	}
+	if root.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || root.ParentSpanID != "00f067aa0ba902b7" || root.Kind != SpanKindServer ||
+		root.TraceState != "a=1" || root.Attributes["http.response.status_code"] != 201 || root.Attributes["libra.request_id"] != "trace-1" {
+		t.Error("tracing spans have an error #3", root)
+	}
+	if selected.ParentSpanID != root.SpanID || selected.Attributes["libra.endpoint"] != addr || selected.Attributes["libra.retries"] != 0 {
+		t.Error("tracing spans have an error #4", selected)
+	}
+	if upstream.ParentSpanID != root.SpanID || upstream.Kind != SpanKindClient || upstream.Attributes["server.address"] != addr ||
+		upstream.Attributes["http.response.status_code"] != 201 || upstream.End.Before(upstream.Start) {
+		t.Error("tracing spans have an error #5", upstream)
+	}
+	if got.Get("traceparent") != "00-"+root.TraceID+"-"+upstream.SpanID+"-01" || got.Get("tracestate") != "a=1" {
+		t.Error("tracing spans have an error #6", got.Get("traceparent"))
+	}
+
+	// a not sampled parent is propagated without spans
+	get(domain, map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"})
+	proxy.FlushTraces()
+	if len(exporter.take()) != 0 || !strings.HasSuffix(got.Get("traceparent"), "-00") || !strings.HasPrefix(got.Get("traceparent"), "00-4bf92f3577b34da6a3ce929d0e0e4736-") {
+		t.Error("tracing spans have an error #7", got.Get("traceparent"))
+	}
+
+	// a new trace is started for an invalid traceparent
+	get(domain, map[string]string{"traceparent": "garbage", "tracestate": "a=1"})
+	proxy.FlushTraces()
+	spans = exporter.take()
+	if root = spans["proxy"]; root == nil || root.ParentSpanID != "" || len(root.TraceID) != 32 || got.Get("tracestate") != "" {
+		t.Error("tracing spans have an error #8")
+	}
+
+	// a failed request is traced without an upstream span
+	get("www.tracing-none.com", nil)
+	proxy.FlushTraces()
+	spans = exporter.take()
+	if len(spans) != 2 || spans["proxy"].Error == "" || spans["balancer"].Error == "" {
+		t.Error("tracing spans have an error #9", spans)
+	}
+}